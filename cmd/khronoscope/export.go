@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	flag "github.com/spf13/pflag"
+
+	"github.com/hoyle1974/khronoscope/internal/dao"
+)
+
+// runExport writes the changes in a recording out as events for other tools
+//
+//	khronoscope export session.khron --format jsonl | jq 'select(.type == "delete")'
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	output := flags.StringP("output", "o", "", "File to write the events to, defaults to stdout")
+	format := flags.String("format", "jsonl", "Export format, jsonl (also called ndjson)")
+	patches := flags.Bool("patches", false, "Write updates as JSON merge patches against the previous object")
+	sliceOptions := addSliceFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: khronoscope export FILE [--format jsonl] [-o OUTPUT] [--patches] [--from TIME] [--to TIME] [--kind KIND,...] [--namespace NAMESPACE,...] [--redact]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("export needs a recording")
+	}
+	switch *format {
+	case "jsonl", "ndjson":
+	default:
+		return fmt.Errorf("unknown export format %q", *format)
+	}
+
+	store, err := loadRecording(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = store.Close()
+	}()
+
+	opts := dao.ExportOptions{Patches: *patches}
+	if opts.SliceOptions, err = sliceOptions(store); err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	var f *os.File
+	if *output != "" {
+		if f, err = os.Create(*output); err != nil {
+			return err
+		}
+		w = f
+	}
+	if err := store.Export(w, opts); err != nil {
+		if f != nil {
+			_ = f.Close()
+		}
+		return fmt.Errorf("export failed: %w", err)
+	}
+	// Closing is where a full disk shows up, so its error is the command's
+	if f != nil {
+		return f.Close()
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+
+	"github.com/hoyle1974/khronoscope/internal/config"
+	"github.com/hoyle1974/khronoscope/internal/dao"
+	"github.com/hoyle1974/khronoscope/internal/importer"
+	"github.com/hoyle1974/khronoscope/internal/redact"
+)
+
+// importers build a recording from something other than a live cluster, named by the first argument
+var importers = map[string]func(args []string) error{
+	"audit":     runImportAudit,
+	"snapshots": runImportSnapshots,
+}
+
+// runImport builds a recording from another source
+//
+//	khronoscope import audit /var/log/kubernetes/audit.log* -o incident.khron
+//	khronoscope import snapshots support-bundle/ -o incident.khron
+func runImport(args []string) error {
+	if len(args) > 0 {
+		if run, ok := importers[args[0]]; ok {
+			return run(args[1:])
+		}
+	}
+	fmt.Fprintln(os.Stderr, "Usage: khronoscope import audit FILE... -o OUTPUT")
+	fmt.Fprintln(os.Stderr, "       khronoscope import snapshots DIRECTORY... -o OUTPUT")
+	return errors.New("import needs a source")
+}
+
+// addImportFlags adds the flags for writing out an imported recording, returning a function that saves it
+func addImportFlags(flags *flag.FlagSet) func(store dao.KhronoStore) error {
+	output := flags.StringP("output", "o", "", "File to write the recording to")
+	encrypt := flags.Bool("encrypt", false, "Encrypt the recording with a passphrase")
+	compression := flags.String("compression", "none", "Compression for the recording ("+strings.Join(dao.CodecNames(), ", ")+"), a .gz extension always uses gzip")
+
+	return func(store dao.KhronoStore) error {
+		if *output == "" {
+			return errors.New("import needs an output file")
+		}
+		codec, err := dao.CodecByName(*compression)
+		if err != nil {
+			return err
+		}
+		dao.DefaultCodec = codec.ID
+
+		var saveOpts []dao.FileOption
+		if *encrypt {
+			passphrase, err := newPassphrase()
+			if err != nil {
+				return err
+			}
+			saveOpts = append(saveOpts, dao.WithPassphrase(passphrase))
+		}
+		return store.Save(*output, saveOpts...)
+	}
+}
+
+// openInput opens a file to import, - is stdin and files ending in .gz are decompressed
+func openInput(filename string) (io.ReadCloser, error) {
+	if filename == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(filename, ".gz") {
+		return f, nil
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{gz, f}, nil
+}
+
+func runImportAudit(args []string) error {
+	flags := flag.NewFlagSet("import audit", flag.ExitOnError)
+	save := addImportFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: khronoscope import audit FILE... -o OUTPUT")
+		fmt.Fprintln(os.Stderr, "Audit logs can be in any order and gzipped, - reads stdin")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("import needs at least one audit log")
+	}
+
+	rules := redact.FromConfig(config.Get().Redaction)
+	audit := importer.NewAudit(rules)
+	for _, filename := range flags.Args() {
+		r, err := openInput(filename)
+		if err != nil {
+			return err
+		}
+		err = audit.Read(r)
+		_ = r.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+
+	store := dao.New()
+	stats := audit.Import(store)
+	if stats.Imported == 0 {
+		return fmt.Errorf("none of the %d audit events changed a resource, the audit policy needs the RequestResponse level", stats.Read)
+	}
+	store.SetMetadata(dao.Metadata{
+		ClusterContext: "audit log",
+		ToolVersion:    dao.ToolVersion(),
+		Redaction:      &rules,
+	})
+	if err := save(store); err != nil {
+		return err
+	}
+	start, end := store.GetTimeRange()
+	fmt.Printf("Imported %d changes (%d partial) from %d audit events covering %s to %s\n", stats.Imported, stats.Partial, stats.Read, start, end)
+	return store.Close()
+}
+
+func runImportSnapshots(args []string) error {
+	flags := flag.NewFlagSet("import snapshots", flag.ExitOnError)
+	save := addImportFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: khronoscope import snapshots DIRECTORY... -o OUTPUT")
+		fmt.Fprintln(os.Stderr, "Each file or directory in DIRECTORY is a snapshot, like kubectl get -A -o yaml output or a must-gather,")
+		fmt.Fprintln(os.Stderr, "timed by a timestamp in its name or when it was modified")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("import needs at least one directory of snapshots")
+	}
+
+	rules := redact.FromConfig(config.Get().Redaction)
+	snapshots := importer.NewSnapshots(rules)
+	for _, dir := range flags.Args() {
+		if err := snapshots.ReadDir(os.DirFS(dir)); err != nil {
+			return fmt.Errorf("%s: %w", dir, err)
+		}
+	}
+
+	store := dao.New()
+	stats, err := snapshots.Import(store)
+	if err != nil {
+		return err
+	}
+	if stats.Imported == 0 {
+		return fmt.Errorf("none of the %d objects found could be imported", stats.Read)
+	}
+	store.SetMetadata(dao.Metadata{
+		ClusterContext: "snapshots",
+		ToolVersion:    dao.ToolVersion(),
+		Redaction:      &rules,
+	})
+	if err := save(store); err != nil {
+		return err
+	}
+	start, end := store.GetTimeRange()
+	fmt.Printf("Imported %d changes from %d objects covering %s to %s\n", stats.Imported, stats.Read, start, end)
+	return store.Close()
+}
@@ -2,9 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
 	"runtime/pprof"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -13,6 +17,7 @@ import (
 	flag "github.com/spf13/pflag"
 
 	tea "github.com/charmbracelet/bubbletea"
+	"github.com/hoyle1974/khronoscope/internal/api"
 	"github.com/hoyle1974/khronoscope/internal/config"
 	"github.com/hoyle1974/khronoscope/internal/conn"
 	"github.com/hoyle1974/khronoscope/internal/dao"
@@ -23,7 +28,38 @@ import (
 	"github.com/hoyle1974/khronoscope/internal/ui"
 )
 
+// commands are run instead of the viewer when named as the first argument
+var commands = map[string]func(args []string) error{
+	"merge":     runMerge,
+	"slice":     runSlice,
+	"export":    runExport,
+	"import":    runImport,
+	"manifests": runManifests,
+}
+
+func runCommand(command func(args []string) error, args []string) error {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr}).Level(zerolog.InfoLevel)
+
+	cfg, err := config.InitConfig()
+	if err != nil {
+		return fmt.Errorf("problem initializing config: %w", err)
+	}
+	if err := dao.ApplyConfig(cfg); err != nil {
+		return fmt.Errorf("bad storage config: %w", err)
+	}
+	return command(args)
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := runCommand(command, os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
 
 	// Init logging
 	ringBuffer := misc.NewRingBuffer(100) // Store last 100 log messages
@@ -41,11 +77,31 @@ func main() {
 
 	// Get flags
 	filename := flag.StringP("file", "f", "", "Filename to load")
+	server := flag.String("server", "", "Browse the recording of a khronoscope server, like http://host:8080, instead of recording locally")
+	token := flag.String("token", "", "Bearer token for --server, defaults to the kubeconfig's token for https servers and none for http")
 	namespace := flag.StringP("namespace", "n", "", "Namespace to filter on")
 	showKeybindings := flag.BoolP("keybindings", "k", false, "Show keybindings")
 	kubeConfigFlag := flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
+	storeDir := flag.String("store-dir", "", "Keep the recording in segment files in this directory instead of in memory")
+	recordTo := flag.String("record-to", "", "Journal the recording to this directory so it survives a crash, recovering any previous recording found there")
+	checkpointInterval := flag.Duration("checkpoint-interval", dao.DefaultCheckpointInterval, "How often to checkpoint a journaled recording")
+	metricsAddr := flag.String("metrics-addr", "", "Serve Prometheus metrics on this address, like :9090")
+	compression := flag.String("compression", "none", "Compression for saved recordings ("+strings.Join(dao.CodecNames(), ", ")+"), a .gz extension always uses gzip")
 	flag.Parse()
 
+	// The journal checkpoints the whole recording to a file, it can't keep it in segment files too
+	if len(*recordTo) > 0 && len(*storeDir) > 0 {
+		log.Panic().Msg("--record-to and --store-dir can't be used together")
+	}
+	if codec, err := dao.CodecByName(*compression); err != nil {
+		log.Panic().Err(err).Msg("bad --compression")
+	} else {
+		dao.DefaultCodec = codec.ID
+	}
+	if err := dao.ApplyConfig(cfg); err != nil {
+		log.Panic().Err(err).Msg("bad storage config")
+	}
+
 	// Show keybindings and then exit
 	if *showKeybindings {
 		config.Get().KeyBindings.Print()
@@ -94,20 +150,56 @@ func main() {
 		log.Panic().Err(err).Msg("could not create khronos connection")
 	}
 
-	// Create a new data and if we need to replace it from one from a file
-	d := dao.New()
-	if filename != nil && len(*filename) > 0 {
-		d = dao.NewFromFile(*filename)
+	// Create a new data and if we need to replace it from one from a file or a server
+	var d dao.Recording
+	var store dao.KhronoStore // The recording when it is held here rather than by a server
+	var remote *api.RemoteStore
+	if len(*server) > 0 {
+		bearer := serverToken(*server, *token, client)
+		if remote, err = api.NewRemoteStore(*server, api.WithToken(bearer), api.WithBackgroundFetch()); errors.Is(err, api.ErrUnauthorized) && bearer == "" {
+			log.Panic().Err(err).Msg("the server needs a token, pass one with --token")
+		} else if err != nil {
+			log.Panic().Err(err).Msg("could not connect to server")
+		}
+		d = remote
+	} else if filename != nil && len(*filename) > 0 {
+		if store, err = loadRecording(*filename); err != nil {
+			log.Panic().Err(err).Msg("could not load recording")
+		}
+	} else if len(*recordTo) > 0 {
+		if store, err = dao.OpenJournal(*recordTo, *checkpointInterval); err != nil {
+			log.Panic().Err(err).Msg("could not open journal")
+		}
+	} else if len(*storeDir) > 0 {
+		if store, err = dao.OpenDir(*storeDir); err != nil {
+			log.Panic().Err(err).Msg("could not open segment store")
+		}
+	} else {
+		store = dao.New()
+	}
+	if store != nil {
+		d = store
+	}
+	defer func() {
+		if err := d.Close(); err != nil {
+			log.Error().Err(err).Msg("error closing store")
+		}
+	}()
+
+	// Remember where this recording came from
+	if store != nil && (filename == nil || len(*filename) == 0) {
+		store.SetMetadata(dao.ClusterMetadata(client))
 	}
 
 	// Start the k8s resource watcher
-	var watcher = resources.GetK8sWatcher(d)
+	var watcher = resources.GetK8sWatcher(store)
 
 	// This tool helps us collect logs
 	var logCollector = resources.GetLogCollector(client)
 
-	// Stop the watcher and log collector if we are just playing back from a file
-	if filename != nil && len(*filename) > 0 {
+	// Stop the watcher and log collector if we are just playing back from a file, or the server is
+	// doing the recording
+	if remote != nil || (filename != nil && len(*filename) > 0) {
 		watcher = nil
 		logCollector = nil
 	}
@@ -117,11 +209,31 @@ func main() {
 	defer cancel()
 
 	// Start watching everything
-	err = watcher.StartWatching(ctx, client, d, logCollector, *namespace)
+	err = watcher.StartWatching(ctx, client, store, logCollector, *namespace)
 	if err != nil {
 		log.Panic().Err(err).Msg("watch failed")
 	}
 
+	// Keep the recording from growing forever
+	if cfg.Retention.Enabled && watcher != nil {
+		go dao.RunRetention(ctx, store, cfg.Retention)
+	}
+
+	// Serve metrics for Prometheus to scrape
+	if len(*metricsAddr) > 0 {
+		// The server measures its own recording
+		if store != nil {
+			go dao.RunMetrics(ctx, store, dao.DefaultMetricsInterval)
+		}
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metrics.Handler())
+			if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+				log.Error().Err(err).Str("Address", *metricsAddr).Msg("metrics server failed")
+			}
+		}()
+	}
+
 	// Start the program
 	appModel := khronoscope.NewProgram(watcher, d, logCollector, client, ringBuffer)
 	p := tea.NewProgram(appModel)
@@ -142,6 +254,11 @@ func main() {
 	watcher.OnChange(func() {
 		p.Send(1)
 	})
+	if remote != nil {
+		remote.OnChange(func() {
+			p.Send(1)
+		})
+	}
 
 	// Run the program
 	if _, err := p.Run(); err != nil {
@@ -151,3 +268,24 @@ func main() {
 	// Try to cleanup, but this doesn't always work
 	ui.ResetTerminal()
 }
+
+// serverToken is the token to authenticate to a server with, the one the kubeconfig uses if none is
+// given.  The kubeconfig's token is a credential for the cluster so it is only sent over https, an
+// http server gets no token unless one is given and the server says if it needs one.
+func serverToken(server, token string, client conn.KhronosConn) string {
+	if token != "" {
+		return token
+	}
+	if u, err := url.Parse(server); err != nil || u.Scheme != "https" || client.Config == nil {
+		return ""
+	}
+	if client.Config.BearerToken != "" {
+		return client.Config.BearerToken
+	}
+	if client.Config.BearerTokenFile != "" {
+		if b, err := os.ReadFile(client.Config.BearerTokenFile); err == nil {
+			return strings.TrimSpace(string(b))
+		}
+	}
+	return ""
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	flag "github.com/spf13/pflag"
+
+	"github.com/hoyle1974/khronoscope/internal/manifest"
+	"github.com/hoyle1974/khronoscope/internal/resources"
+)
+
+// runManifests writes the resources at a moment in a recording out as manifests, to roll back to
+//
+//	khronoscope manifests session.khron --at 2024-05-01T12:00:00Z -n payments -o last-good/
+//	kubectl apply -R -f last-good/
+func runManifests(args []string) error {
+	flags := flag.NewFlagSet("manifests", flag.ExitOnError)
+	output := flags.StringP("output", "o", "", "Directory to write the manifests to")
+	at := flags.String("at", "", "When to take the resources from, an RFC3339 time or +DURATION from the start of the recording, defaults to the end")
+	kinds := flags.StringSliceP("kind", "k", nil, "Only write resources of these kinds")
+	namespaces := flags.StringSliceP("namespace", "n", nil, "Only write resources in these namespaces")
+	includeOwned := flags.Bool("include-owned", false, "Also write resources a controller recreates, like the pods of a replica set")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: khronoscope manifests FILE -o DIRECTORY [--at TIME] [--kind KIND,...] [--namespace NAMESPACE,...]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *output == "" || flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("manifests needs a recording and an output directory")
+	}
+
+	store, err := loadRecording(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = store.Close()
+	}()
+
+	start, end := store.GetTimeRange()
+	timestamp, err := parseSliceTime(*at, start)
+	if err != nil {
+		return fmt.Errorf("bad --at: %w", err)
+	}
+	if timestamp.IsZero() {
+		timestamp = end
+	}
+
+	rs := slices.DeleteFunc(store.GetResourcesAt(timestamp, "", ""), func(r resources.Resource) bool {
+		return (len(*kinds) > 0 && !slices.Contains(*kinds, r.Kind)) ||
+			(len(*namespaces) > 0 && !slices.Contains(*namespaces, r.Namespace))
+	})
+	stats, err := manifest.Write(*output, rs, manifest.Options{IncludeOwned: *includeOwned})
+	if err != nil {
+		return err
+	}
+	for _, filename := range stats.Scrubbed {
+		fmt.Fprintf(os.Stderr, "%s has redacted values, fill them in before applying it\n", filename)
+	}
+	fmt.Printf("Wrote %d manifests to %s as of %s, skipped %d resources that shouldn't be applied\n", stats.Written, *output, timestamp, stats.Skipped)
+	return nil
+}
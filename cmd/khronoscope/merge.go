@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+
+	"github.com/hoyle1974/khronoscope/internal/dao"
+)
+
+// runMerge combines recordings into a single timeline
+//
+//	khronoscope merge a.khron b.khron -o out.khron
+func runMerge(args []string) error {
+	flags := flag.NewFlagSet("merge", flag.ExitOnError)
+	output := flags.StringP("output", "o", "", "File to write the merged recording to")
+	encrypt := flags.Bool("encrypt", false, "Encrypt the merged recording with a passphrase")
+	compression := flags.String("compression", "none", "Compression for the merged recording ("+strings.Join(dao.CodecNames(), ", ")+"), a .gz extension always uses gzip")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: khronoscope merge FILE FILE... -o OUTPUT")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *output == "" || flags.NArg() < 2 {
+		flags.Usage()
+		return errors.New("merge needs at least two recordings and an output file")
+	}
+	codec, err := dao.CodecByName(*compression)
+	if err != nil {
+		return err
+	}
+	dao.DefaultCodec = codec.ID
+
+	merged, err := loadRecording(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	for _, filename := range flags.Args()[1:] {
+		other, err := loadRecording(filename)
+		if err != nil {
+			return err
+		}
+		conflicts, err := merged.Merge(other)
+		if err != nil {
+			return fmt.Errorf("unable to merge %s: %w", filename, err)
+		}
+		for _, c := range conflicts {
+			fmt.Fprintf(os.Stderr, "%s: conflict at %s, keeping the earlier file's value\n", filename, c)
+		}
+		if err := other.Close(); err != nil {
+			return err
+		}
+	}
+
+	var saveOpts []dao.FileOption
+	if *encrypt {
+		passphrase, err := newPassphrase()
+		if err != nil {
+			return err
+		}
+		saveOpts = append(saveOpts, dao.WithPassphrase(passphrase))
+	}
+	if err := merged.Save(*output, saveOpts...); err != nil {
+		return err
+	}
+	start, end := merged.GetTimeRange()
+	fmt.Printf("Merged %d recordings into %s covering %s to %s\n", flags.NArg(), *output, start, end)
+	return merged.Close()
+}
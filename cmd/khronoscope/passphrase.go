@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/term"
+
+	"github.com/hoyle1974/khronoscope/internal/dao"
+)
+
+// passphraseEnv can hold the passphrase for scripts, it is used instead of prompting
+const passphraseEnv = "KHRONOSCOPE_PASSPHRASE"
+
+// loadRecording loads a recording, asking for the passphrase if it is encrypted
+func loadRecording(filename string) (dao.KhronoStore, error) {
+	d, err := dao.NewFromFile(filename)
+	if !errors.Is(err, dao.ErrPassphraseRequired) {
+		return d, err
+	}
+	if passphrase := os.Getenv(passphraseEnv); passphrase != "" {
+		return dao.NewFromFile(filename, dao.WithPassphrase(passphrase))
+	}
+
+	for range 3 {
+		passphrase, err := readPassphrase(fmt.Sprintf("Passphrase for %s: ", filename))
+		if err != nil {
+			return nil, err
+		}
+		d, err = dao.NewFromFile(filename, dao.WithPassphrase(passphrase))
+		if !errors.Is(err, dao.ErrWrongPassphrase) {
+			return d, err
+		}
+		fmt.Fprintln(os.Stderr, "Wrong passphrase")
+	}
+	return nil, dao.ErrWrongPassphrase
+}
+
+// newPassphrase asks for a passphrase to encrypt with, twice to catch typos
+func newPassphrase() (string, error) {
+	if passphrase := os.Getenv(passphraseEnv); passphrase != "" {
+		return passphrase, nil
+	}
+	passphrase, err := readPassphrase("Passphrase to encrypt with: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase == "" {
+		return "", errors.New("empty passphrase")
+	}
+	again, err := readPassphrase("Repeat the passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if again != passphrase {
+		return "", errors.New("passphrases don't match")
+	}
+	return passphrase, nil
+}
+
+func readPassphrase(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	b, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("unable to read passphrase: %w", err)
+	}
+	return string(b), nil
+}
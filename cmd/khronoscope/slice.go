@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	flag "github.com/spf13/pflag"
+
+	"github.com/hoyle1974/khronoscope/internal/config"
+	"github.com/hoyle1974/khronoscope/internal/dao"
+	"github.com/hoyle1974/khronoscope/internal/redact"
+)
+
+// runSlice writes part of a recording to a new file
+//
+//	khronoscope slice in.khron -o out.khron --from +1h10m --to +1h30m -n default,payments
+func runSlice(args []string) error {
+	flags := flag.NewFlagSet("slice", flag.ExitOnError)
+	output := flags.StringP("output", "o", "", "File to write the slice to")
+	sliceOptions := addSliceFlags(flags)
+	encrypt := flags.Bool("encrypt", false, "Encrypt the slice with a passphrase")
+	compression := flags.String("compression", "none", "Compression for the slice ("+strings.Join(dao.CodecNames(), ", ")+"), a .gz extension always uses gzip")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: khronoscope slice FILE -o OUTPUT [--from TIME] [--to TIME] [--kind KIND,...] [--namespace NAMESPACE,...] [--redact]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *output == "" || flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("slice needs a recording and an output file")
+	}
+	codec, err := dao.CodecByName(*compression)
+	if err != nil {
+		return err
+	}
+	dao.DefaultCodec = codec.ID
+
+	store, err := loadRecording(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = store.Close()
+	}()
+
+	opts, err := sliceOptions(store)
+	if err != nil {
+		return err
+	}
+	slice, err := store.Slice(opts)
+	if err != nil {
+		return err
+	}
+	var saveOpts []dao.FileOption
+	if *encrypt {
+		passphrase, err := newPassphrase()
+		if err != nil {
+			return err
+		}
+		saveOpts = append(saveOpts, dao.WithPassphrase(passphrase))
+	}
+	if err := slice.Save(*output, saveOpts...); err != nil {
+		return err
+	}
+	first, last := slice.GetTimeRange()
+	fmt.Printf("Wrote %s covering %s to %s\n", *output, first, last)
+	return slice.Close()
+}
+
+// addSliceFlags adds the flags that select part of a recording, the returned function turns them
+// into SliceOptions once the recording is loaded
+func addSliceFlags(flags *flag.FlagSet) func(store dao.KhronoStore) (dao.SliceOptions, error) {
+	from := flags.String("from", "", "Start of the selection, an RFC3339 time or +DURATION from the start of the recording")
+	to := flags.String("to", "", "End of the selection, an RFC3339 time or +DURATION from the start of the recording")
+	kinds := flags.StringSliceP("kind", "k", nil, "Only keep resources of these kinds")
+	namespaces := flags.StringSliceP("namespace", "n", nil, "Only keep resources in these namespaces")
+	redactConfigured := flags.Bool("redact", false, "Scrub resources with the redaction rules from the config")
+	redactEnv := flags.Bool("redact-env", false, "Replace env var values with a hash")
+	redactAnnotations := flags.StringSlice("redact-annotation", nil, "Mask annotations whose key matches these patterns")
+
+	return func(store dao.KhronoStore) (dao.SliceOptions, error) {
+		var err error
+		start, _ := store.GetTimeRange()
+		opts := dao.SliceOptions{Kinds: *kinds, Namespaces: *namespaces}
+		if opts.From, err = parseSliceTime(*from, start); err != nil {
+			return opts, fmt.Errorf("bad --from: %w", err)
+		}
+		if opts.To, err = parseSliceTime(*to, start); err != nil {
+			return opts, fmt.Errorf("bad --to: %w", err)
+		}
+
+		if *redactConfigured || *redactEnv || len(*redactAnnotations) > 0 {
+			rules := redact.Rules{HashEnv: *redactEnv, Annotations: *redactAnnotations}
+			if *redactConfigured {
+				rules = rules.Union(redact.FromConfig(config.Get().Redaction))
+			}
+			opts.Redact = &rules
+		}
+		return opts, nil
+	}
+}
+
+// parseSliceTime accepts an RFC3339 time or a +DURATION offset from start, empty is the zero time
+func parseSliceTime(value string, start time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if offset, ok := strings.CutPrefix(value, "+"); ok {
+		d, err := time.ParseDuration(offset)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return start.Add(d), nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
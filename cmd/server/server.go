@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"runtime/pprof"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -14,6 +15,8 @@ import (
 
 	flag "github.com/spf13/pflag"
 
+	"github.com/hoyle1974/khronoscope/internal/api"
+	"github.com/hoyle1974/khronoscope/internal/auth"
 	"github.com/hoyle1974/khronoscope/internal/config"
 	"github.com/hoyle1974/khronoscope/internal/conn"
 	"github.com/hoyle1974/khronoscope/internal/dao"
@@ -36,8 +39,27 @@ func main() {
 	// Get flags
 	namespace := flag.StringP("namespace", "n", "", "Namespace to filter on")
 	kubeConfigFlag := flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
+	storeDir := flag.String("store-dir", "", "Keep the recording in segment files in this directory instead of in memory")
+	recordTo := flag.String("record-to", "", "Journal the recording to this directory so it survives a crash, recovering any previous recording found there")
+	checkpointInterval := flag.Duration("checkpoint-interval", dao.DefaultCheckpointInterval, "How often to checkpoint a journaled recording")
+	compression := flag.String("compression", "none", "Compression for saved recordings ("+strings.Join(dao.CodecNames(), ", ")+"), a .gz extension always uses gzip")
+	authMode := flag.String("auth", "kubernetes", "How requests are authenticated: kubernetes reviews bearer tokens and access with the cluster, static accepts the tokens in --token-file and lets them see everything")
+	tokenFile := flag.String("token-file", "", "CSV of token,user,uid,\"groups\" for --auth static")
 	flag.Parse()
 
+	// The journal checkpoints the whole recording to a file, it can't keep it in segment files too
+	if len(*recordTo) > 0 && len(*storeDir) > 0 {
+		log.Panic().Msg("--record-to and --store-dir can't be used together")
+	}
+	if codec, err := dao.CodecByName(*compression); err != nil {
+		log.Panic().Err(err).Msg("bad --compression")
+	} else {
+		dao.DefaultCodec = codec.ID
+	}
+	if err := dao.ApplyConfig(cfg); err != nil {
+		log.Panic().Err(err).Msg("bad storage config")
+	}
+
 	// Are we collecting metrics?
 	if cfg.Metrics {
 		done := make(chan bool)
@@ -80,8 +102,26 @@ func main() {
 		log.Panic().Err(err).Msg("could not create khronos connection")
 	}
 
-	// Create a new data and if we need to replace it from one from a file
-	d = dao.New()
+	// Create a new data store, on disk if requested
+	if len(*recordTo) > 0 {
+		if d, err = dao.OpenJournal(*recordTo, *checkpointInterval); err != nil {
+			log.Panic().Err(err).Msg("could not open journal")
+		}
+	} else if len(*storeDir) > 0 {
+		if d, err = dao.OpenDir(*storeDir); err != nil {
+			log.Panic().Err(err).Msg("could not open segment store")
+		}
+	} else {
+		d = dao.New()
+	}
+	defer func() {
+		if err := d.Close(); err != nil {
+			log.Error().Err(err).Msg("error closing store")
+		}
+	}()
+
+	// Remember where this recording came from
+	d.SetMetadata(dao.ClusterMetadata(client))
 
 	// Start the k8s resource watcher
 	var watcher = resources.GetK8sWatcher(d)
@@ -99,10 +139,38 @@ func main() {
 		log.Panic().Err(err).Msg("watch failed")
 	}
 
+	// Keep the recording from growing forever
+	if cfg.Retention.Enabled && watcher != nil {
+		go dao.RunRetention(ctx, d, cfg.Retention)
+	}
+
+	// Keep the store metrics current
+	go dao.RunMetrics(ctx, d, dao.DefaultMetricsInterval)
+
+	// Work out who is asking and what they can see
+	var authn auth.Authenticator
+	var authz auth.Authorizer
+	switch *authMode {
+	case "kubernetes":
+		authn = auth.NewTokenReviewer(client.Client)
+		authz = auth.NewSubjectAccessReviewer(client.Client)
+	case "static":
+		tokens, err := auth.ReadTokenFile(*tokenFile)
+		if err != nil {
+			log.Panic().Err(err).Msg("bad --token-file")
+		}
+		log.Warn().Msg("static tokens can see everything, only use them for testing")
+		authn, authz = tokens, auth.AllowAll{}
+	default:
+		log.Panic().Str("Auth", *authMode).Msg("bad --auth, it must be kubernetes or static")
+	}
+
 	// Register the request handler.
+	http.Handle("/metrics", metrics.Handler())
+	http.Handle("/api/", auth.Authenticate(authn, api.NewHandler(d, api.WithLive(watcher), api.WithUploads(), api.WithAuthorizer(authz))))
 	http.HandleFunc("/health", handleHealth)
-	http.HandleFunc("/resources", handleResources)
-	http.HandleFunc("/query/range", handleQueryRange)
+	http.Handle("/resources", auth.Authenticate(authn, auth.RequireAll(authz, http.HandlerFunc(handleResources))))
+	http.Handle("/query/range", auth.Authenticate(authn, http.HandlerFunc(handleQueryRange)))
 	http.HandleFunc("/", handleRoot)
 
 	// Start the HTTP server.
@@ -0,0 +1,490 @@
+// Package api serves an HTTP API over a recording, for tools that want to query the past state of
+// a cluster without the TUI.
+//
+//	GET /api/v1/resources?at=&kind=&namespace=&name=&labelSelector=&limit=&continue=
+//	GET /api/v1/resources/{uid}?at=
+//	GET /api/v1/resources/{uid}/history?from=&to=&limit=&continue=
+//	GET /api/v1/labels?from=&to=
+//	GET /api/v1/metadata
+//	GET /api/v1/watch?kind=&namespace=&since=
+//	GET /api/v1/recording?from=&to=&namespace=&compression=
+//
+// The recording is downloaded as a .khron file.  With WithUploads .khron files can be uploaded and
+// then browsed through the same endpoints under /api/v1/uploads/{id}/.
+//
+//	GET|POST /api/v1/uploads
+//	GET|DELETE /api/v1/uploads/{id}
+//
+// With WithAuthorizer a user only sees the resources the authorizer lets them get, the user being
+// whoever auth.Authenticate put in the request's context.  Downloading the recording needs get on
+// every resource in the namespaces downloaded, and uploads are only seen by whoever uploaded them
+// and by users who can get every resource.
+//
+// Times are RFC3339, or "now".  Lists are paged, a response with a continue token has more items
+// which are fetched by passing the token back.  Errors are returned as an Error.
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/hoyle1974/khronoscope/internal/auth"
+	"github.com/hoyle1974/khronoscope/internal/dao"
+	"github.com/hoyle1974/khronoscope/internal/resources"
+)
+
+const (
+	// DefaultLimit is how many items a page has when the limit isn't given
+	DefaultLimit = 500
+	// MaxLimit is the most items a page can have
+	MaxLimit = 5000
+)
+
+// MaxNameReviews is how many resources a list asks the authorizer about by name, the page ends
+// early once it is reached and the rest are asked about when the next page is fetched
+var MaxNameReviews = 100
+
+// Resource is a resource as it was at a moment
+type Resource struct {
+	UID       string          `json:"uid"`
+	Kind      string          `json:"kind"`
+	Namespace string          `json:"namespace,omitempty"`
+	Name      string          `json:"name"`
+	Timestamp time.Time       `json:"timestamp"` // When it last changed
+	Object    json.RawMessage `json:"object,omitempty"`
+}
+
+// ResourceList is a page of the resources that existed at a moment
+type ResourceList struct {
+	At       time.Time  `json:"at"`
+	Items    []Resource `json:"items"`
+	Continue string     `json:"continue,omitempty"`
+}
+
+// Revision is a change to a resource
+type Revision struct {
+	Timestamp time.Time `json:"timestamp"`
+	Type      string    `json:"type"` // One of dao.EventAdd, dao.EventUpdate or dao.EventDelete
+	Resource  *Resource `json:"resource,omitempty"`
+}
+
+// History is a page of the changes to a resource
+type History struct {
+	UID      string     `json:"uid"`
+	Items    []Revision `json:"items"`
+	Continue string     `json:"continue,omitempty"`
+}
+
+// LabelList is the labels in a recording
+type LabelList struct {
+	Items []dao.Label `json:"items"`
+}
+
+// Error is returned for every failed request
+type Error struct {
+	Error ErrorDetails `json:"error"`
+}
+
+// ErrorDetails describes what went wrong
+type ErrorDetails struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// statusError is an error with the HTTP status to report it as
+type statusError struct {
+	code int
+	err  error
+}
+
+func (e statusError) Error() string { return e.err.Error() }
+
+func badRequest(format string, args ...any) error {
+	return statusError{http.StatusBadRequest, fmt.Errorf(format, args...)}
+}
+
+func notFound(format string, args ...any) error {
+	return statusError{http.StatusNotFound, fmt.Errorf(format, args...)}
+}
+
+func forbidden(format string, args ...any) error {
+	return statusError{http.StatusForbidden, fmt.Errorf(format, args...)}
+}
+
+type handler struct {
+	store   dao.KhronoStore
+	live    Source
+	uploads *uploads
+	authz   auth.Authorizer
+}
+
+// Source is where live changes come from, a resources.K8sWatcher
+type Source interface {
+	Subscribe(fn func(resources.Change)) func()
+}
+
+// Option configures the handler
+type Option func(*handler)
+
+// WithLive streams the changes from source to watchers, without it they only get what is
+// already in the store
+func WithLive(source Source) Option {
+	return func(h *handler) {
+		h.live = source
+	}
+}
+
+// WithAuthorizer hides the resources a user can't get
+func WithAuthorizer(authz auth.Authorizer) Option {
+	return func(h *handler) {
+		h.authz = authz
+	}
+}
+
+// canGet is whether the user making a request can see a resource
+func (h handler) canGet(r *http.Request, resource resources.Resource) bool {
+	if h.authz == nil {
+		return true
+	}
+	user, _ := auth.UserFrom(r.Context())
+	return h.authz.CanGet(r.Context(), user, resource)
+}
+
+// canGetKind is whether the user making a request can see every resource of a resource's kind in
+// its namespace
+func (h handler) canGetKind(r *http.Request, resource resources.Resource) bool {
+	if h.authz == nil {
+		return true
+	}
+	user, _ := auth.UserFrom(r.Context())
+	return h.authz.CanGetKind(r.Context(), user, resource)
+}
+
+// canGetAll is whether the user making a request can see every resource in namespace
+func (h handler) canGetAll(r *http.Request, namespace string) bool {
+	if h.authz == nil {
+		return true
+	}
+	user, _ := auth.UserFrom(r.Context())
+	return h.authz.CanGetAll(r.Context(), user, namespace)
+}
+
+// NewHandler returns a handler serving the API for store under /api/v1
+func NewHandler(store dao.KhronoStore, opts ...Option) http.Handler {
+	h := handler{store: store}
+	for _, opt := range opts {
+		opt(&h)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/watch", h.watch)
+	mux.Handle("/api/v1/resources", get(h.listResources))
+	mux.Handle("/api/v1/resources/{uid}", get(h.getResource))
+	mux.Handle("/api/v1/resources/{uid}/history", get(h.getHistory))
+	mux.Handle("/api/v1/labels", get(h.listLabels))
+	mux.Handle("/api/v1/metadata", get(h.getMetadata))
+	mux.HandleFunc("/api/v1/recording", h.download)
+	if h.uploads != nil {
+		mux.HandleFunc("/api/v1/uploads", h.listUploads)
+		mux.HandleFunc("/api/v1/uploads/{id}", h.uploadItem)
+		mux.HandleFunc("/api/v1/uploads/{id}/", h.uploadAPI)
+	}
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, notFound("no such endpoint %s", r.URL.Path))
+	})
+	return mux
+}
+
+// get adapts a function returning a response to a handler for GET requests
+func get(fn func(r *http.Request) (any, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeError(w, r, methodNotAllowed(w, r, "GET, HEAD"))
+			return
+		}
+		response, err := fn(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, response)
+	})
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request, allow string) error {
+	w.Header().Set("Allow", allow)
+	return statusError{http.StatusMethodNotAllowed, fmt.Errorf("method %s isn't allowed", r.Method)}
+}
+
+// writeError writes err as an Error, errors without a status are internal errors
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	code := http.StatusInternalServerError
+	var se statusError
+	if errors.As(err, &se) {
+		code = se.code
+	} else {
+		log.Error().Err(err).Str("Path", r.URL.Path).Msg("api request failed")
+	}
+	writeJSON(w, code, Error{ErrorDetails{Code: code, Message: err.Error()}})
+}
+
+func writeJSON(w http.ResponseWriter, code int, response any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Warn().Err(err).Msg("unable to write api response")
+	}
+}
+
+// parseTime parses a time parameter, an empty value is fallback
+func parseTime(r *http.Request, name string, fallback time.Time) (time.Time, error) {
+	value := r.URL.Query().Get(name)
+	switch value {
+	case "":
+		return fallback, nil
+	case "now":
+		return time.Now(), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return t, badRequest("bad %s: %v", name, err)
+	}
+	return t, nil
+}
+
+func parseLimit(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("limit")
+	if value == "" {
+		return DefaultLimit, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 || limit > MaxLimit {
+		return 0, badRequest("bad limit %q, it must be between 1 and %d", value, MaxLimit)
+	}
+	return limit, nil
+}
+
+// cursor is where a page ends, encoded as the continue token
+type cursor struct {
+	At     time.Time `json:"at,omitempty"`    // The moment a resource list is of
+	After  string    `json:"after,omitempty"` // Sort key of the last resource returned
+	Offset int       `json:"offset,omitempty"`
+}
+
+func (c cursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func parseContinue(r *http.Request) (cursor, bool, error) {
+	var c cursor
+	token := r.URL.Query().Get("continue")
+	if token == "" {
+		return c, false, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || json.Unmarshal(b, &c) != nil {
+		return c, false, badRequest("bad continue token")
+	}
+	return c, true, nil
+}
+
+func toResource(r resources.Resource) Resource {
+	resource := Resource{
+		UID:       r.Uid,
+		Kind:      r.Kind,
+		Namespace: r.Namespace,
+		Name:      r.Name,
+		Timestamp: r.Timestamp.Time,
+	}
+	if json.Valid([]byte(r.RawJSON)) {
+		resource.Object = json.RawMessage(r.RawJSON)
+	}
+	return resource
+}
+
+// sortKey orders resources by namespace, kind, name and then uid
+func sortKey(r resources.Resource) string {
+	return strings.Join([]string{r.Namespace, r.Kind, r.Name, r.Uid}, "\x00")
+}
+
+// resourceLabels returns the labels of a resource from its object
+func resourceLabels(r resources.Resource) labels.Set {
+	var obj struct {
+		Metadata struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+	}
+	_ = json.Unmarshal([]byte(r.RawJSON), &obj)
+	return obj.Metadata.Labels
+}
+
+func (h handler) listResources(r *http.Request) (any, error) {
+	query := r.URL.Query()
+	limit, err := parseLimit(r)
+	if err != nil {
+		return nil, err
+	}
+	page, more, err := parseContinue(r)
+	if err != nil {
+		return nil, err
+	}
+	at := page.At
+	if !more {
+		if at, err = parseTime(r, "at", time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	selector := labels.Everything()
+	if value := query.Get("labelSelector"); value != "" {
+		if selector, err = labels.Parse(value); err != nil {
+			return nil, badRequest("bad labelSelector: %v", err)
+		}
+	}
+	name := query.Get("name")
+
+	found := h.store.GetResourcesAt(at, query.Get("kind"), query.Get("namespace"))
+	found = slices.DeleteFunc(found, func(resource resources.Resource) bool {
+		return (name != "" && resource.Name != name) ||
+			(!selector.Empty() && !selector.Matches(resourceLabels(resource))) ||
+			(more && sortKey(resource) <= page.After)
+	})
+	slices.SortFunc(found, func(a, b resources.Resource) int {
+		return strings.Compare(sortKey(a), sortKey(b))
+	})
+
+	// Whole kinds in a namespace are decided once, only the resources that would make it onto the
+	// page are asked about by name
+	list := ResourceList{At: at, Items: []Resource{}}
+	visible := make([]resources.Resource, 0, min(len(found), limit+1))
+	reviews := 0
+	for idx, resource := range found {
+		if len(visible) > limit {
+			break
+		}
+		if !h.canGetKind(r, resource) {
+			if reviews >= MaxNameReviews && idx > 0 {
+				list.Continue = cursor{At: at, After: sortKey(found[idx-1])}.encode()
+				break
+			}
+			reviews++
+			if !h.canGet(r, resource) {
+				continue
+			}
+		}
+		visible = append(visible, resource)
+	}
+	if len(visible) > limit {
+		visible = visible[:limit]
+		list.Continue = cursor{At: at, After: sortKey(visible[limit-1])}.encode()
+	}
+	for _, r := range visible {
+		list.Items = append(list.Items, toResource(r))
+	}
+	return list, nil
+}
+
+func (h handler) getResource(r *http.Request) (any, error) {
+	uid := r.PathValue("uid")
+	at, err := parseTime(r, "at", time.Now())
+	if err != nil {
+		return nil, err
+	}
+	resource, err := h.store.GetResourceAt(at, uid)
+	if err != nil || resource.Uid == "" || !h.canGet(r, resource) {
+		return nil, notFound("resource %s doesn't exist at %s", uid, at.Format(time.RFC3339Nano))
+	}
+	return toResource(resource), nil
+}
+
+func (h handler) getHistory(r *http.Request) (any, error) {
+	uid := r.PathValue("uid")
+	from, err := parseTime(r, "from", time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	to, err := parseTime(r, "to", time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	limit, err := parseLimit(r)
+	if err != nil {
+		return nil, err
+	}
+	page, _, err := parseContinue(r)
+	if err != nil {
+		return nil, err
+	}
+
+	revisions, err := h.store.GetHistory(uid, from, to)
+	if err != nil {
+		return nil, err
+	}
+	// Whoever can't get the resource isn't told it was ever recorded
+	recorded := revisions
+	if !slices.ContainsFunc(recorded, func(revision dao.Revision) bool { return !revision.Deleted }) {
+		if recorded, err = h.store.GetHistory(uid, time.Time{}, time.Time{}); err != nil {
+			return nil, err
+		}
+	}
+	i := slices.IndexFunc(recorded, func(revision dao.Revision) bool { return !revision.Deleted })
+	if i < 0 || !h.canGet(r, recorded[i].Resource) {
+		return nil, notFound("resource %s was never recorded", uid)
+	}
+
+	// Whether a change is an add or an update depends on whether the resource existed before it
+	existed := false
+	if !from.IsZero() && len(revisions) > 0 {
+		before, err := h.store.GetResourceAt(revisions[0].Timestamp.Add(-time.Nanosecond), uid)
+		existed = err == nil && before.Uid != ""
+	}
+	history := History{UID: uid, Items: []Revision{}}
+	for i, revision := range revisions {
+		if i >= page.Offset+limit {
+			history.Continue = cursor{Offset: i}.encode()
+			break
+		}
+		if i >= page.Offset {
+			history.Items = append(history.Items, toRevision(revision, existed))
+		}
+		existed = !revision.Deleted
+	}
+	return history, nil
+}
+
+func toRevision(revision dao.Revision, existed bool) Revision {
+	switch {
+	case revision.Deleted:
+		return Revision{Timestamp: revision.Timestamp, Type: dao.EventDelete}
+	case existed:
+		resource := toResource(revision.Resource)
+		return Revision{Timestamp: revision.Timestamp, Type: dao.EventUpdate, Resource: &resource}
+	}
+	resource := toResource(revision.Resource)
+	return Revision{Timestamp: revision.Timestamp, Type: dao.EventAdd, Resource: &resource}
+}
+
+func (h handler) listLabels(r *http.Request) (any, error) {
+	from, err := parseTime(r, "from", time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	to, err := parseTime(r, "to", time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return LabelList{Items: h.store.GetLabels(from, to)}, nil
+}
+
+func (h handler) getMetadata(r *http.Request) (any, error) {
+	return h.store.GetMetadata(), nil
+}
@@ -0,0 +1,395 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/hoyle1974/khronoscope/internal/auth"
+	"github.com/hoyle1974/khronoscope/internal/dao"
+	"github.com/hoyle1974/khronoscope/internal/resources"
+)
+
+var start = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func at(seconds int) time.Time {
+	return start.Add(time.Duration(seconds) * time.Second)
+}
+
+func resource(seconds int, uid, kind, namespace, name, json string) resources.Resource {
+	r := resources.NewResource(uid, at(seconds), kind, namespace, name)
+	r.RawJSON = json
+	return r
+}
+
+func testStore() dao.KhronoStore {
+	store := dao.New()
+	store.AddResource(resource(0, "uid-node", "Node", "", "node-1", `{"kind":"Node"}`))
+	store.AddResource(resource(1, "uid-web-1", "Pod", "default", "web-1", `{"kind":"Pod","metadata":{"labels":{"app":"web","tier":"front"}}}`))
+	store.AddResource(resource(2, "uid-web-2", "Pod", "default", "web-2", `{"kind":"Pod","metadata":{"labels":{"app":"web"}}}`))
+	store.AddResource(resource(3, "uid-db", "Pod", "data", "db", `{"kind":"Pod","metadata":{"labels":{"app":"db"}}}`))
+	store.AddResource(resource(4, "uid-deploy", "Deployment", "default", "web", `{"kind":"Deployment"}`))
+	store.UpdateResource(resource(5, "uid-web-1", "Pod", "default", "web-1", `{"kind":"Pod","metadata":{"labels":{"app":"web"}},"status":{"phase":"Running"}}`))
+	store.DeleteResource(resource(6, "uid-web-1", "Pod", "default", "web-1", ""))
+	store.AddResource(resource(20, "uid-late", "Pod", "default", "a-late", `{"kind":"Pod"}`))
+	store.SetLabel(at(1), "deploy")
+	store.SetLabel(at(6), "incident")
+	return store
+}
+
+// request makes a GET request and decodes the response into v, returning the status
+func request(t *testing.T, h http.Handler, path string, query url.Values, v any) int {
+	t.Helper()
+	if query != nil {
+		path += "?" + query.Encode()
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("%s: expected json, got %q", path, ct)
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("%s: bad response %q: %v", path, rec.Body.String(), err)
+	}
+	return rec.Code
+}
+
+func names(list ResourceList) []string {
+	n := []string{}
+	for _, r := range list.Items {
+		n = append(n, r.Namespace+"/"+r.Name)
+	}
+	return n
+}
+
+func TestListResources(t *testing.T) {
+	h := NewHandler(testStore())
+
+	tests := []struct {
+		query    url.Values
+		expected []string
+	}{
+		{url.Values{"at": {at(4).Format(time.RFC3339)}}, []string{"/node-1", "data/db", "default/web", "default/web-1", "default/web-2"}},
+		{url.Values{"at": {at(10).Format(time.RFC3339)}}, []string{"/node-1", "data/db", "default/web", "default/web-2"}},
+		{url.Values{"at": {at(4).Format(time.RFC3339)}, "kind": {"Pod"}}, []string{"data/db", "default/web-1", "default/web-2"}},
+		{url.Values{"at": {at(4).Format(time.RFC3339)}, "namespace": {"default"}, "kind": {"Pod"}}, []string{"default/web-1", "default/web-2"}},
+		{url.Values{"at": {at(4).Format(time.RFC3339)}, "name": {"web"}}, []string{"default/web"}},
+		{url.Values{"at": {at(4).Format(time.RFC3339)}, "labelSelector": {"app=web,tier"}}, []string{"default/web-1"}},
+		{url.Values{"at": {at(4).Format(time.RFC3339)}, "labelSelector": {"app in (web, db)"}}, []string{"data/db", "default/web-1", "default/web-2"}},
+		{url.Values{"at": {"now"}, "kind": {"Pod"}}, []string{"data/db", "default/a-late", "default/web-2"}},
+	}
+	for _, test := range tests {
+		var list ResourceList
+		if code := request(t, h, "/api/v1/resources", test.query, &list); code != http.StatusOK {
+			t.Errorf("%v: expected 200, got %d", test.query, code)
+			continue
+		}
+		if got := names(list); len(got) != len(test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.query, test.expected, got)
+		} else {
+			for i := range got {
+				if got[i] != test.expected[i] {
+					t.Errorf("%v: expected %v, got %v", test.query, test.expected, got)
+					break
+				}
+			}
+		}
+	}
+
+	var list ResourceList
+	request(t, h, "/api/v1/resources", url.Values{"at": {at(4).Format(time.RFC3339)}, "name": {"db"}}, &list)
+	if len(list.Items) != 1 || list.Items[0].UID != "uid-db" || string(list.Items[0].Object) != `{"kind":"Pod","metadata":{"labels":{"app":"db"}}}` ||
+		!list.Items[0].Timestamp.Equal(at(3)) || !list.At.Equal(at(4)) {
+		t.Errorf("Unexpected resource %+v", list)
+	}
+}
+
+func TestListResourcesPaged(t *testing.T) {
+	store := testStore()
+	h := NewHandler(store)
+
+	got := []string{}
+	query := url.Values{"at": {at(10).Format(time.RFC3339)}, "limit": {"3"}}
+	for pages := 0; ; pages++ {
+		var list ResourceList
+		if code := request(t, h, "/api/v1/resources", query, &list); code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", code)
+		}
+		got = append(got, names(list)...)
+		if list.Continue == "" {
+			if pages != 1 {
+				t.Errorf("Expected 2 pages, got %d", pages+1)
+			}
+			break
+		}
+		// Pages stay at the time of the first, even when asked for another
+		query = url.Values{"continue": {list.Continue}, "limit": {"3"}, "at": {"now"}}
+	}
+	expected := []string{"/node-1", "data/db", "default/web", "default/web-2"}
+	if len(got) != len(expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
+
+func TestGetResource(t *testing.T) {
+	h := NewHandler(testStore())
+
+	var r Resource
+	if code := request(t, h, "/api/v1/resources/uid-web-1", url.Values{"at": {at(5).Format(time.RFC3339)}}, &r); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+	if r.Name != "web-1" || string(r.Object) != `{"kind":"Pod","metadata":{"labels":{"app":"web"}},"status":{"phase":"Running"}}` {
+		t.Errorf("Unexpected resource %+v", r)
+	}
+
+	for _, query := range []url.Values{{"at": {at(0).Format(time.RFC3339)}}, {"at": {at(7).Format(time.RFC3339)}}} {
+		var e Error
+		if code := request(t, h, "/api/v1/resources/uid-web-1", query, &e); code != http.StatusNotFound || e.Error.Code != http.StatusNotFound {
+			t.Errorf("%v: expected 404, got %d %+v", query, code, e)
+		}
+	}
+}
+
+func TestGetHistory(t *testing.T) {
+	h := NewHandler(testStore())
+
+	var history History
+	if code := request(t, h, "/api/v1/resources/uid-web-1/history", nil, &history); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+	expected := []string{dao.EventAdd, dao.EventUpdate, dao.EventDelete}
+	if len(history.Items) != len(expected) {
+		t.Fatalf("Expected %v, got %+v", expected, history)
+	}
+	for i, revision := range history.Items {
+		if revision.Type != expected[i] || (revision.Resource == nil) != (revision.Type == dao.EventDelete) {
+			t.Errorf("Expected %s, got %+v", expected[i], revision)
+		}
+	}
+
+	// Starting part way through, one change at a time
+	got := []string{}
+	query := url.Values{"from": {at(5).Format(time.RFC3339)}, "limit": {"1"}}
+	for {
+		history = History{}
+		request(t, h, "/api/v1/resources/uid-web-1/history", query, &history)
+		for _, revision := range history.Items {
+			got = append(got, revision.Type)
+		}
+		if history.Continue == "" {
+			break
+		}
+		query.Set("continue", history.Continue)
+	}
+	if len(got) != 2 || got[0] != dao.EventUpdate || got[1] != dao.EventDelete {
+		t.Errorf("Expected an update and a delete, got %v", got)
+	}
+
+	var e Error
+	if code := request(t, h, "/api/v1/resources/uid-nothing/history", nil, &e); code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", code)
+	}
+}
+
+func TestListLabels(t *testing.T) {
+	h := NewHandler(testStore())
+
+	var list LabelList
+	request(t, h, "/api/v1/labels", nil, &list)
+	if len(list.Items) != 2 || list.Items[0].Label != "deploy" || !list.Items[1].Timestamp.Equal(at(6)) {
+		t.Errorf("Unexpected labels %+v", list)
+	}
+	request(t, h, "/api/v1/labels", url.Values{"from": {at(2).Format(time.RFC3339)}}, &list)
+	if len(list.Items) != 1 || list.Items[0].Label != "incident" {
+		t.Errorf("Unexpected labels %+v", list)
+	}
+}
+
+func TestGetMetadata(t *testing.T) {
+	store := testStore()
+	store.SetMetadata(dao.Metadata{ClusterContext: "prod"})
+	h := NewHandler(store)
+
+	var meta dao.Metadata
+	request(t, h, "/api/v1/metadata", nil, &meta)
+	if meta.ClusterContext != "prod" || !meta.StartTime.Equal(at(0)) || !meta.EndTime.Equal(at(20)) {
+		t.Errorf("Unexpected metadata %+v", meta)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	h := NewHandler(testStore())
+
+	tests := []struct {
+		path  string
+		query url.Values
+		code  int
+	}{
+		{"/api/v1/resources", url.Values{"at": {"yesterday"}}, http.StatusBadRequest},
+		{"/api/v1/resources", url.Values{"limit": {"0"}}, http.StatusBadRequest},
+		{"/api/v1/resources", url.Values{"limit": {"100000"}}, http.StatusBadRequest},
+		{"/api/v1/resources", url.Values{"continue": {"!!"}}, http.StatusBadRequest},
+		{"/api/v1/resources", url.Values{"labelSelector": {"app in"}}, http.StatusBadRequest},
+		{"/api/v1/resources/uid-db/history", url.Values{"to": {"soon"}}, http.StatusBadRequest},
+		{"/api/v1/nothing", nil, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		var e Error
+		if code := request(t, h, test.path, test.query, &e); code != test.code || e.Error.Code != test.code || e.Error.Message == "" {
+			t.Errorf("%s %v: expected %d, got %d %+v", test.path, test.query, test.code, code, e)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/labels", nil))
+	var e Error
+	if err := json.Unmarshal(rec.Body.Bytes(), &e); err != nil || rec.Code != http.StatusMethodNotAllowed || e.Error.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+// namespaceAuthorizer lets users see only the namespaces they are named with
+type namespaceAuthorizer map[string][]string
+
+func (a namespaceAuthorizer) CanGet(ctx context.Context, user auth.User, r resources.Resource) bool {
+	return slices.Contains(a[user.Name], r.Namespace)
+}
+
+func (a namespaceAuthorizer) CanGetKind(ctx context.Context, user auth.User, r resources.Resource) bool {
+	return a.CanGet(ctx, user, r)
+}
+
+func (a namespaceAuthorizer) CanGetAll(ctx context.Context, user auth.User, namespace string) bool {
+	return slices.Contains(a[user.Name], namespace)
+}
+
+// nameAuthorizer only lets users see the resources it names, and counts how often it is asked
+type nameAuthorizer struct {
+	names map[string]bool
+	asked int
+}
+
+func (a *nameAuthorizer) CanGet(ctx context.Context, user auth.User, r resources.Resource) bool {
+	a.asked++
+	return a.names[r.Name]
+}
+
+func (a *nameAuthorizer) CanGetKind(ctx context.Context, user auth.User, r resources.Resource) bool {
+	return false
+}
+
+func (a *nameAuthorizer) CanGetAll(ctx context.Context, user auth.User, namespace string) bool {
+	return false
+}
+
+func TestNameReviews(t *testing.T) {
+	store := dao.New()
+	authz := &nameAuthorizer{names: map[string]bool{}}
+	for i := range 50 {
+		name := fmt.Sprintf("pod-%02d", i)
+		store.AddResource(resource(i, "uid-"+name, "Pod", "default", name, `{"kind":"Pod"}`))
+		if i%2 == 0 {
+			authz.names[name] = true
+		}
+	}
+	h := NewHandler(store, WithAuthorizer(authz))
+
+	// Only the resources up to the end of the page are asked about
+	var list ResourceList
+	request(t, h, "/api/v1/resources", url.Values{"limit": {"5"}}, &list)
+	if got := names(list); !slices.Equal(got, []string{"default/pod-00", "default/pod-02", "default/pod-04", "default/pod-06", "default/pod-08"}) || list.Continue == "" {
+		t.Errorf("Unexpected page %v", got)
+	}
+	if authz.asked > 11 {
+		t.Errorf("Expected at most 11 resources to be asked about, got %d", authz.asked)
+	}
+
+	// Running out of reviews ends the page early
+	defer func(n int) { MaxNameReviews = n }(MaxNameReviews)
+	MaxNameReviews = 4
+	authz.asked = 0
+	request(t, h, "/api/v1/resources", url.Values{"limit": {"5"}}, &list)
+	if got := names(list); !slices.Equal(got, []string{"default/pod-00", "default/pod-02"}) || list.Continue == "" || authz.asked != 4 {
+		t.Errorf("Unexpected page %v after %d reviews", got, authz.asked)
+	}
+	request(t, h, "/api/v1/resources", url.Values{"limit": {"5"}, "continue": {list.Continue}}, &list)
+	if got := names(list); !slices.Equal(got, []string{"default/pod-04", "default/pod-06"}) {
+		t.Errorf("Unexpected next page %v", got)
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	tokens := auth.StaticTokens{"alice-token": {Name: "alice"}}
+	authz := namespaceAuthorizer{"alice": {"default"}}
+	server := httptest.NewServer(auth.Authenticate(tokens, NewHandler(testStore(), WithAuthorizer(authz))))
+	defer server.Close()
+
+	get := func(path string, query url.Values, token string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, server.URL+path+"?"+query.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	if resp := get("/api/v1/resources", nil, ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected a 401 without a token, got %s", resp.Status)
+	}
+
+	var list ResourceList
+	resp := get("/api/v1/resources", url.Values{"at": {at(5).Format(time.RFC3339)}}, "alice-token")
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(list); !slices.Equal(got, []string{"default/web", "default/web-1", "default/web-2"}) {
+		t.Errorf("Expected only default, got %v", got)
+	}
+
+	// What alice can't see doesn't exist
+	tests := []struct {
+		path  string
+		query url.Values
+		code  int
+	}{
+		{"/api/v1/resources/uid-web-1", url.Values{"at": {at(5).Format(time.RFC3339)}}, http.StatusOK},
+		{"/api/v1/resources/uid-db", url.Values{"at": {at(5).Format(time.RFC3339)}}, http.StatusNotFound},
+		{"/api/v1/resources/uid-web-1/history", nil, http.StatusOK},
+		{"/api/v1/resources/uid-db/history", nil, http.StatusNotFound},
+		{"/api/v1/recording", url.Values{"namespace": {"default"}}, http.StatusOK},
+		{"/api/v1/recording", url.Values{"namespace": {"default", "data"}}, http.StatusForbidden},
+		{"/api/v1/recording", nil, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		if resp := get(test.path, test.query, "alice-token"); resp.StatusCode != test.code {
+			t.Errorf("%s %v: expected %d, got %s", test.path, test.query, test.code, resp.Status)
+		}
+	}
+
+	// The TUI authenticates with a token too
+	if _, err := NewRemoteStore(server.URL); err == nil {
+		t.Error("Expected connecting without a token to fail")
+	}
+	remote, err := NewRemoteStore(server.URL, WithToken("alice-token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	if got := resourceNames(remote.GetResourcesAt(at(5), "Pod", "")); !slices.Equal(got, []string{"default/web-1", "default/web-2"}) {
+		t.Errorf("Expected only default, got %v", got)
+	}
+}
@@ -0,0 +1,406 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/hoyle1974/khronoscope/internal/auth"
+	"github.com/hoyle1974/khronoscope/internal/dao"
+	"github.com/hoyle1974/khronoscope/internal/temporal"
+)
+
+// PassphraseHeader carries the passphrase to encrypt a download with, or to decrypt an upload with
+const PassphraseHeader = "X-Khronoscope-Passphrase"
+
+var (
+	// MaxUploadSize is the largest recording that can be uploaded
+	MaxUploadSize int64 = 1 << 30
+	// MaxUploadDecompressedSize is the most an uploaded recording can decompress to
+	MaxUploadDecompressedSize int64 = 4 << 30
+	// MaxUploads is how many uploaded recordings are kept at once
+	MaxUploads = 10
+	// MaxUploadsPerUser is how many of them one user can have
+	MaxUploadsPerUser = 2
+)
+
+// Upload is a recording uploaded to be browsed through the API.  Uploads are only seen by whoever
+// uploaded them, and by users who can get every resource.
+type Upload struct {
+	ID       string       `json:"id"`
+	Owner    string       `json:"owner,omitempty"`
+	Uploaded time.Time    `json:"uploaded"`
+	Size     int64        `json:"size"` // Of the file as it was uploaded
+	Metadata dao.Metadata `json:"metadata"`
+}
+
+// UploadList is the uploaded recordings
+type UploadList struct {
+	Items []Upload `json:"items"`
+}
+
+type upload struct {
+	Upload
+	store   dao.KhronoStore
+	dir     string // Where the resources are kept
+	handler http.Handler
+	active  sync.WaitGroup     // Requests using the upload, counted while it is in uploads
+	ctx     context.Context    // Done once the upload is closed, ending requests like watches
+	cancel  context.CancelFunc // Ends ctx
+}
+
+// close ends the requests using the upload and waits for them, then releases the recording and
+// removes it from disk.  It must have been taken out of uploads first so nothing else starts using it.
+func (u *upload) close() {
+	u.cancel()
+	u.active.Wait()
+	if err := u.store.Close(); err != nil {
+		log.Warn().Err(err).Str("ID", u.ID).Msg("unable to close an uploaded recording")
+	}
+	if err := os.RemoveAll(u.dir); err != nil {
+		log.Warn().Err(err).Str("ID", u.ID).Msg("unable to remove an uploaded recording")
+	}
+}
+
+// uploads are the recordings uploaded to a handler, shared by its copies
+type uploads struct {
+	lock  sync.Mutex
+	items map[string]*upload
+}
+
+// WithUploads lets recordings be uploaded and then browsed under /api/v1/uploads/{id}/.  Uploaded
+// resources are kept on disk, in the temporary directory.
+func WithUploads() Option {
+	return func(h *handler) {
+		h.uploads = &uploads{items: map[string]*upload{}}
+	}
+}
+
+// owner is who uploads made by the user making a request belong to
+func owner(r *http.Request) string {
+	user, _ := auth.UserFrom(r.Context())
+	return user.Name
+}
+
+// canSeeUpload is whether the user making a request can see an upload
+func (h handler) canSeeUpload(r *http.Request, u *upload) bool {
+	return u.Owner == owner(r) || h.canGetAll(r, "")
+}
+
+// getUpload returns the upload with the id in the request's path, if the user can see it.  It is
+// in use until done is called, which holds off closing it.
+func (h handler) getUpload(r *http.Request) (u *upload, done func(), err error) {
+	id := r.PathValue("id")
+	h.uploads.lock.Lock()
+	u, ok := h.uploads.items[id]
+	if ok {
+		u.active.Add(1)
+	}
+	h.uploads.lock.Unlock()
+	if !ok {
+		return nil, nil, notFound("no upload %s", id)
+	}
+	if !h.canSeeUpload(r, u) {
+		u.active.Done()
+		return nil, nil, notFound("no upload %s", id)
+	}
+	return u, u.active.Done, nil
+}
+
+// full is why another upload by owner can't be kept, if it can't
+func (u *uploads) full(owner string) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.fullLocked(owner)
+}
+
+// add keeps an upload if there is still room for it
+func (u *uploads) add(item *upload) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if err := u.fullLocked(item.Owner); err != nil {
+		return err
+	}
+	u.items[item.ID] = item
+	return nil
+}
+
+func (u *uploads) fullLocked(owner string) error {
+	if len(u.items) >= MaxUploads {
+		return statusError{http.StatusConflict, fmt.Errorf("there are already %d uploads, delete one first", MaxUploads)}
+	}
+	owned := 0
+	for _, item := range u.items {
+		if item.Owner == owner {
+			owned++
+		}
+	}
+	if owned >= MaxUploadsPerUser {
+		return statusError{http.StatusConflict, fmt.Errorf("you already have %d uploads, delete one first", owned)}
+	}
+	return nil
+}
+
+func fileOptions(r *http.Request) []dao.FileOption {
+	if passphrase := r.Header.Get(PassphraseHeader); passphrase != "" {
+		return []dao.FileOption{dao.WithPassphrase(passphrase)}
+	}
+	return nil
+}
+
+// download sends the recording as a .khron file, sliced by from, to and namespace if they are given
+func (h handler) download(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, r, methodNotAllowed(w, r, "GET, HEAD"))
+		return
+	}
+	if err := h.writeRecording(w, r); err != nil {
+		writeError(w, r, err)
+	}
+}
+
+func (h handler) writeRecording(w http.ResponseWriter, r *http.Request) error {
+	var opts dao.SliceOptions
+	var err error
+	if opts.From, err = parseTime(r, "from", time.Time{}); err != nil {
+		return err
+	}
+	if opts.To, err = parseTime(r, "to", time.Time{}); err != nil {
+		return err
+	}
+	if !opts.To.IsZero() && opts.To.Before(opts.From) {
+		return badRequest("to is before from")
+	}
+	opts.Namespaces = r.URL.Query()["namespace"]
+	if len(opts.Namespaces) == 0 && !h.canGetAll(r, "") {
+		return forbidden("downloading the recording needs get on every resource")
+	}
+	for _, namespace := range opts.Namespaces {
+		if !h.canGetAll(r, namespace) {
+			return forbidden("downloading namespace %q needs get on every resource in it", namespace)
+		}
+	}
+	compression := r.URL.Query().Get("compression")
+	if compression == "" {
+		compression = "none"
+	}
+	codec, err := dao.CodecByName(compression)
+	if err != nil {
+		return badRequest("%v", err)
+	}
+
+	store := h.store
+	if !opts.From.IsZero() || !opts.To.IsZero() || len(opts.Namespaces) > 0 {
+		slice, err := h.store.Slice(opts)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = slice.Close()
+		}()
+		store = slice
+	}
+
+	name := "khronoscope-" + time.Now().UTC().Format("20060102T150405Z") + ".khron"
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	if r.Method == http.MethodHead {
+		return nil
+	}
+
+	// The recording is encoded straight onto the response, nothing is kept but what's buffered
+	sent := &countingWriter{w: w}
+	if err := store.Write(sent, codec, fileOptions(r)...); err != nil {
+		if sent.n == 0 {
+			return err
+		}
+		// Too late for an error response, cutting the connection short tells the client instead
+		log.Warn().Err(err).Int64("Sent", sent.n).Msg("download failed")
+		panic(http.ErrAbortHandler)
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// listUploads lists the uploaded recordings, or uploads a new one
+func (h handler) listUploads(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		h.uploads.lock.Lock()
+		items := slices.Collect(maps.Values(h.uploads.items))
+		h.uploads.lock.Unlock()
+		list := UploadList{Items: []Upload{}}
+		for _, u := range items {
+			if h.canSeeUpload(r, u) {
+				list.Items = append(list.Items, u.Upload)
+			}
+		}
+		slices.SortFunc(list.Items, func(a, b Upload) int {
+			return a.Uploaded.Compare(b.Uploaded)
+		})
+		writeJSON(w, http.StatusOK, list)
+	case http.MethodPost:
+		u, err := h.upload(w, r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Location", "/api/v1/uploads/"+u.ID)
+		writeJSON(w, http.StatusCreated, u)
+	default:
+		writeError(w, r, methodNotAllowed(w, r, "GET, HEAD, POST"))
+	}
+}
+
+// countingReader counts the bytes read through it and remembers why reading stopped, which
+// dao.Read doesn't always pass on
+type countingReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if err != nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// upload reads an uploaded recording, its resources go to a segment map on disk rather than memory
+func (h handler) upload(w http.ResponseWriter, r *http.Request) (Upload, error) {
+	if err := h.uploads.full(owner(r)); err != nil {
+		return Upload{}, err
+	}
+
+	dir, err := os.MkdirTemp("", "khronoscope-upload-*")
+	if err != nil {
+		return Upload{}, err
+	}
+	m, err := temporal.NewSegmentMap(dir, temporal.SegmentOptions{OnError: func(err error) {
+		log.Error().Err(err).Str("Dir", dir).Msg("uploaded recording storage failed")
+	}})
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return Upload{}, err
+	}
+	body := &countingReader{r: http.MaxBytesReader(w, r.Body, MaxUploadSize)}
+	opts := append(fileOptions(r), dao.LoadInto(m), dao.WithMaxSize(MaxUploadDecompressedSize))
+	store, err := dao.Read(body, opts...)
+	if err != nil {
+		if c, ok := m.(io.Closer); ok {
+			_ = c.Close()
+		}
+		_ = os.RemoveAll(dir)
+		var tooLarge *http.MaxBytesError
+		if errors.As(body.err, &tooLarge) {
+			return Upload{}, statusError{http.StatusRequestEntityTooLarge, fmt.Errorf("recordings can be at most %d bytes", MaxUploadSize)}
+		}
+		if errors.Is(err, dao.ErrTooLarge) {
+			return Upload{}, statusError{http.StatusRequestEntityTooLarge, fmt.Errorf("recordings can decompress to at most %d bytes", MaxUploadDecompressedSize)}
+		}
+		return Upload{}, badRequest("unable to read the recording: %v", err)
+	}
+
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	u := &upload{
+		Upload: Upload{
+			ID:       hex.EncodeToString(id),
+			Owner:    owner(r),
+			Uploaded: time.Now(),
+			Size:     body.n,
+			Metadata: store.GetMetadata(),
+		},
+		store:   store,
+		dir:     dir,
+		handler: NewHandler(store, WithAuthorizer(h.authz)),
+	}
+	u.ctx, u.cancel = context.WithCancel(context.Background())
+
+	// Checked again since others may have finished uploading while this one was read
+	if err := h.uploads.add(u); err != nil {
+		u.close()
+		return Upload{}, err
+	}
+	log.Info().Str("ID", u.ID).Str("Owner", u.Owner).Int64("Size", u.Size).Msg("recording uploaded")
+	return u.Upload, nil
+}
+
+// uploadItem describes an uploaded recording, or deletes it
+func (h handler) uploadItem(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		u, done, err := h.getUpload(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		done()
+		writeJSON(w, http.StatusOK, u.Upload)
+	case http.MethodDelete:
+		u, done, err := h.getUpload(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		done()
+		h.uploads.lock.Lock()
+		_, ok := h.uploads.items[u.ID]
+		delete(h.uploads.items, u.ID)
+		h.uploads.lock.Unlock()
+		if !ok {
+			writeError(w, r, notFound("no upload %s", u.ID))
+			return
+		}
+		u.close()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, r, methodNotAllowed(w, r, "GET, HEAD, DELETE"))
+	}
+}
+
+// uploadAPI serves the API for an uploaded recording, /api/v1/uploads/{id}/resources is
+// /api/v1/resources of the upload
+func (h handler) uploadAPI(w http.ResponseWriter, r *http.Request) {
+	u, done, err := h.getUpload(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer done()
+
+	// Requests that don't end on their own, like watches, end when the upload is deleted
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	defer context.AfterFunc(u.ctx, cancel)()
+	sub := r.Clone(ctx)
+	sub.URL.Path = "/api/v1/" + strings.TrimPrefix(r.URL.Path, "/api/v1/uploads/"+u.ID+"/")
+	sub.URL.RawPath = ""
+	u.handler.ServeHTTP(w, sub)
+}
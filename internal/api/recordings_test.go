@@ -0,0 +1,348 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hoyle1974/khronoscope/internal/auth"
+	"github.com/hoyle1974/khronoscope/internal/dao"
+)
+
+func getRecording(t *testing.T, server *httptest.Server, query url.Values) (dao.KhronoStore, *http.Response) {
+	t.Helper()
+	resp, err := http.Get(server.URL + "/api/v1/recording?" + query.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp
+	}
+	store, err := dao.Read(resp.Body)
+	if err != nil {
+		t.Fatalf("Bad download: %v", err)
+	}
+	return store, resp
+}
+
+func TestDownload(t *testing.T) {
+	server := httptest.NewServer(NewHandler(testStore()))
+	defer server.Close()
+
+	store, resp := getRecording(t, server, nil)
+	if store == nil {
+		t.Fatalf("Expected a recording, got %s", resp.Status)
+	}
+	if cd := resp.Header.Get("Content-Disposition"); !strings.HasPrefix(cd, "attachment;") || !strings.Contains(cd, ".khron") {
+		t.Errorf("Unexpected Content-Disposition %q", cd)
+	}
+	for _, seconds := range []int{0, 2, 5, 6, 20} {
+		expected := resourceNames(testStore().GetResourcesAt(at(seconds), "", ""))
+		if got := resourceNames(store.GetResourcesAt(at(seconds), "", "")); !slices.Equal(got, expected) {
+			t.Errorf("At %d expected %v, got %v", seconds, expected, got)
+		}
+	}
+	if labels := store.GetLabels(time.Time{}, time.Time{}); len(labels) != 2 {
+		t.Errorf("Expected the labels, got %+v", labels)
+	}
+
+	head, err := http.Head(server.URL + "/api/v1/recording")
+	if err != nil {
+		t.Fatal(err)
+	}
+	head.Body.Close()
+	if head.StatusCode != http.StatusOK || head.Header.Get("Content-Disposition") == "" {
+		t.Errorf("Unexpected HEAD response %s %v", head.Status, head.Header)
+	}
+
+	// Sliced and compressed
+	query := url.Values{"from": {at(2).Format(time.RFC3339)}, "namespace": {"default"}, "compression": {"gzip"}}
+	if store, resp = getRecording(t, server, query); store == nil {
+		t.Fatalf("Expected a recording, got %s", resp.Status)
+	}
+	if from, _ := store.GetTimeRange(); !from.Equal(at(2)) {
+		t.Errorf("Expected the slice to start at %v, got %v", at(2), from)
+	}
+	if got := resourceNames(store.GetResourcesAt(at(20), "", "")); !slices.Equal(got, []string{"default/a-late", "default/web", "default/web-2"}) {
+		t.Errorf("Unexpected sliced resources %v", got)
+	}
+
+	for _, query := range []url.Values{
+		{"from": {"yesterday"}},
+		{"from": {at(5).Format(time.RFC3339)}, "to": {at(1).Format(time.RFC3339)}},
+		{"compression": {"zip"}},
+	} {
+		if _, resp := getRecording(t, server, query); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%v: expected a 400, got %s", query, resp.Status)
+		}
+	}
+}
+
+func postUpload(t *testing.T, server *httptest.Server, body []byte, passphrase string) (Upload, *http.Response) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/api/v1/uploads", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if passphrase != "" {
+		req.Header.Set(PassphraseHeader, passphrase)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var u Upload
+	if resp.StatusCode == http.StatusCreated {
+		if err := json.NewDecoder(resp.Body).Decode(&u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return u, resp
+}
+
+func getJSON(t *testing.T, u string, v any) int {
+	t.Helper()
+	resp, err := http.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("%s: bad response: %v", u, err)
+	}
+	return resp.StatusCode
+}
+
+func TestUpload(t *testing.T) {
+	server := httptest.NewServer(NewHandler(dao.New(), WithUploads()))
+	defer server.Close()
+
+	var file bytes.Buffer
+	codec, _ := dao.CodecByName("none")
+	if err := testStore().Write(&file, codec); err != nil {
+		t.Fatal(err)
+	}
+	u, resp := postUpload(t, server, file.Bytes(), "")
+	if resp.StatusCode != http.StatusCreated || u.ID == "" || u.Size != int64(file.Len()) || !u.Metadata.StartTime.Equal(at(0)) {
+		t.Fatalf("Unexpected upload %s %+v", resp.Status, u)
+	}
+	if location := resp.Header.Get("Location"); location != "/api/v1/uploads/"+u.ID {
+		t.Errorf("Unexpected location %q", location)
+	}
+
+	// Browsed through the same API
+	var list ResourceList
+	query := url.Values{"at": {at(5).Format(time.RFC3339)}, "kind": {"Pod"}}
+	if code := getJSON(t, server.URL+"/api/v1/uploads/"+u.ID+"/resources?"+query.Encode(), &list); code != http.StatusOK || len(list.Items) != 3 {
+		t.Errorf("Unexpected resources %d %+v", code, list)
+	}
+	var history History
+	if code := getJSON(t, server.URL+"/api/v1/uploads/"+u.ID+"/resources/uid-web-1/history", &history); code != http.StatusOK || len(history.Items) != 3 {
+		t.Errorf("Unexpected history %d %+v", code, history)
+	}
+	// The server's own recording is untouched
+	if code := getJSON(t, server.URL+"/api/v1/resources?"+query.Encode(), &list); code != http.StatusOK || len(list.Items) != 0 {
+		t.Errorf("Unexpected resources %d %+v", code, list)
+	}
+
+	var uploads UploadList
+	if getJSON(t, server.URL+"/api/v1/uploads", &uploads); len(uploads.Items) != 1 || uploads.Items[0].ID != u.ID {
+		t.Errorf("Unexpected uploads %+v", uploads)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, server.URL+"/api/v1/uploads/"+u.ID, nil)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Unexpected delete %v %v", resp, err)
+	}
+	var e Error
+	if code := getJSON(t, server.URL+"/api/v1/uploads/"+u.ID+"/resources", &e); code != http.StatusNotFound {
+		t.Errorf("Expected a deleted upload to be gone, got %d", code)
+	}
+}
+
+func TestUploadErrors(t *testing.T) {
+	server := httptest.NewServer(NewHandler(dao.New(), WithUploads()))
+	defer server.Close()
+
+	if _, resp := postUpload(t, server, []byte("not a recording"), ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a 400, got %s", resp.Status)
+	}
+
+	var encrypted bytes.Buffer
+	codec, _ := dao.CodecByName("gzip")
+	if err := testStore().Write(&encrypted, codec, dao.WithPassphrase("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if _, resp := postUpload(t, server, encrypted.Bytes(), ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a 400 without the passphrase, got %s", resp.Status)
+	}
+	if _, resp := postUpload(t, server, encrypted.Bytes(), "secret"); resp.StatusCode != http.StatusCreated {
+		t.Errorf("Expected the upload to be decrypted, got %s", resp.Status)
+	}
+
+	// A header asking for terabytes of scrypt work is turned away before any key is derived
+	hostile := bytes.Clone(encrypted.Bytes()[:60])
+	copy(hostile[8+2+1+1+16:], []byte{30, 255, 255})
+	if _, resp := postUpload(t, server, hostile, "secret"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a 400 for hostile scrypt parameters, got %s", resp.Status)
+	}
+
+	defer func(size int64) { MaxUploadSize = size }(MaxUploadSize)
+	MaxUploadSize = 100
+	if _, resp := postUpload(t, server, encrypted.Bytes(), "secret"); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected a 413, got %s", resp.Status)
+	}
+
+	// Uploads aren't on unless asked for
+	plain := httptest.NewServer(NewHandler(dao.New()))
+	defer plain.Close()
+	if _, resp := postUpload(t, plain, encrypted.Bytes(), "secret"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected a 404, got %s", resp.Status)
+	}
+}
+
+func TestUploadOwners(t *testing.T) {
+	tokens := auth.StaticTokens{"alice-token": {Name: "alice"}, "bob-token": {Name: "bob"}, "admin-token": {Name: "admin"}}
+	authz := namespaceAuthorizer{"alice": {"default"}, "bob": {"default"}, "admin": {""}}
+	server := httptest.NewServer(auth.Authenticate(tokens, NewHandler(dao.New(), WithUploads(), WithAuthorizer(authz))))
+	defer server.Close()
+
+	do := func(method, path, token string, body []byte, v any) int {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if v != nil {
+			_ = json.NewDecoder(resp.Body).Decode(v)
+		}
+		return resp.StatusCode
+	}
+
+	var file bytes.Buffer
+	codec, _ := dao.CodecByName("gzip")
+	if err := testStore().Write(&file, codec); err != nil {
+		t.Fatal(err)
+	}
+	var u Upload
+	if code := do(http.MethodPost, "/api/v1/uploads", "alice-token", file.Bytes(), &u); code != http.StatusCreated || u.Owner != "alice" {
+		t.Fatalf("Unexpected upload %d %+v", code, u)
+	}
+
+	// Only alice, and those who can see everything, know it is there
+	for token, count := range map[string]int{"alice-token": 1, "bob-token": 0, "admin-token": 1} {
+		var uploads UploadList
+		if do(http.MethodGet, "/api/v1/uploads", token, nil, &uploads); len(uploads.Items) != count {
+			t.Errorf("%s: expected %d uploads, got %+v", token, count, uploads)
+		}
+	}
+	for _, path := range []string{"/api/v1/uploads/" + u.ID, "/api/v1/uploads/" + u.ID + "/resources"} {
+		if code := do(http.MethodGet, path, "bob-token", nil, nil); code != http.StatusNotFound {
+			t.Errorf("%s: expected bob to get a 404, got %d", path, code)
+		}
+		if code := do(http.MethodGet, path, "alice-token", nil, nil); code != http.StatusOK {
+			t.Errorf("%s: expected alice to get a 200, got %d", path, code)
+		}
+	}
+	if code := do(http.MethodDelete, "/api/v1/uploads/"+u.ID, "bob-token", nil, nil); code != http.StatusNotFound {
+		t.Errorf("Expected bob to not be able to delete it, got %d", code)
+	}
+
+	// Each user only gets so many
+	if code := do(http.MethodPost, "/api/v1/uploads", "alice-token", file.Bytes(), nil); code != http.StatusCreated {
+		t.Errorf("Expected a second upload, got %d", code)
+	}
+	if code := do(http.MethodPost, "/api/v1/uploads", "alice-token", file.Bytes(), nil); code != http.StatusConflict {
+		t.Errorf("Expected a third upload to be refused, got %d", code)
+	}
+	if code := do(http.MethodPost, "/api/v1/uploads", "bob-token", file.Bytes(), nil); code != http.StatusCreated {
+		t.Errorf("Expected bob to be able to upload, got %d", code)
+	}
+	if code := do(http.MethodDelete, "/api/v1/uploads/"+u.ID, "alice-token", nil, nil); code != http.StatusNoContent {
+		t.Errorf("Expected alice to be able to delete it, got %d", code)
+	}
+
+	// What a recording decompresses to is limited too
+	defer func(size int64) { MaxUploadDecompressedSize = size }(MaxUploadDecompressedSize)
+	MaxUploadDecompressedSize = int64(file.Len())
+	if code := do(http.MethodPost, "/api/v1/uploads", "admin-token", file.Bytes(), nil); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected a 413, got %d", code)
+	}
+}
+
+func TestUploadDeleteWaits(t *testing.T) {
+	h := handler{store: dao.New()}
+	WithUploads()(&h)
+	server := httptest.NewServer(NewHandler(h.store, func(o *handler) { *o = h }))
+	defer server.Close()
+
+	var file bytes.Buffer
+	codec, _ := dao.CodecByName("none")
+	if err := testStore().Write(&file, codec); err != nil {
+		t.Fatal(err)
+	}
+	u, resp := postUpload(t, server, file.Bytes(), "")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Unexpected upload %s", resp.Status)
+	}
+
+	// A request is using the upload when it is deleted
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/uploads/"+u.ID+"/resources", nil)
+	r.SetPathValue("id", u.ID)
+	item, done, err := h.getUpload(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted := make(chan int)
+	go func() {
+		req, _ := http.NewRequest(http.MethodDelete, server.URL+"/api/v1/uploads/"+u.ID, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			deleted <- 0
+			return
+		}
+		resp.Body.Close()
+		deleted <- resp.StatusCode
+	}()
+
+	select {
+	case <-item.ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected requests using the upload to be told it is going")
+	}
+	select {
+	case <-deleted:
+		t.Fatalf("Expected the delete to wait for the request using the upload")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := os.Stat(item.dir); err != nil {
+		t.Fatalf("Expected the upload to stay on disk while in use: %v", err)
+	}
+	// Nothing new can start using it
+	if _, _, err := h.getUpload(r); err == nil {
+		t.Errorf("Expected the upload to be gone")
+	}
+
+	done()
+	if code := <-deleted; code != http.StatusNoContent {
+		t.Fatalf("Expected a 204, got %d", code)
+	}
+	if _, err := os.Stat(item.dir); !os.IsNotExist(err) {
+		t.Fatalf("Expected the upload to be removed: %v", err)
+	}
+}
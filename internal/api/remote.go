@@ -0,0 +1,634 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/hoyle1974/khronoscope/internal/dao"
+	"github.com/hoyle1974/khronoscope/internal/resources"
+)
+
+var (
+	// RequestTimeout bounds every request a RemoteStore makes other than its watch
+	RequestTimeout = 30 * time.Second
+	// MaxReconnectBackoff is the longest a RemoteStore waits before reconnecting a lost watch
+	MaxReconnectBackoff = 30 * time.Second
+	// pageSize is how many items a RemoteStore asks for at a time
+	pageSize = MaxLimit
+)
+
+// ErrUnauthorized is returned when the server wants a token, or a different one
+var ErrUnauthorized = errors.New("the server needs a valid token")
+
+// RemoteStore is a dao.Recording backed by the API of a khronoscope server, so a team can share
+// one long running recorder.  The resources as they are now are kept up to date by watching the
+// server, any other moment is asked for.  The server does the recording, so a RemoteStore can't be
+// changed, labelled or saved.  Download copies the recording here for that.
+type RemoteStore struct {
+	base   *url.URL
+	client *http.Client
+	token  string
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	lock     sync.Mutex
+	metadata dao.Metadata
+	labels   []dao.Label                   // In time order
+	live     map[string]resources.Resource // The resources as they are now
+	synced   bool                          // Whether live is up to date with the server
+	latest   time.Time                     // Everything up to here is in live
+	cached   cachedQuery
+	onChange func()
+
+	background bool         // Whether GetResourcesAt fetches in the background
+	fetching   bool         // Whether a background fetch is running
+	wanted     *cachedQuery // The moment to fetch next in the background, without its resources
+}
+
+// cachedQuery remembers the last moment asked for, it doesn't change while playback is paused
+type cachedQuery struct {
+	at        time.Time
+	kind      string
+	namespace string
+	resources []resources.Resource
+	lasting   bool // Whether the moment is in the past, so the resources can't change
+}
+
+func (q cachedQuery) matches(at time.Time, kind, namespace string) bool {
+	return q.resources != nil && q.at.Equal(at) && q.kind == kind && q.namespace == namespace
+}
+
+// RemoteOption configures a RemoteStore
+type RemoteOption func(*RemoteStore)
+
+// WithHTTPClient makes requests with client instead of http.DefaultClient
+func WithHTTPClient(client *http.Client) RemoteOption {
+	return func(r *RemoteStore) {
+		r.client = client
+	}
+}
+
+// WithToken authenticates to the server with a bearer token
+func WithToken(token string) RemoteOption {
+	return func(r *RemoteStore) {
+		r.token = token
+	}
+}
+
+// WithBackgroundFetch makes GetResourcesAt return straight away rather than wait on the server, for
+// a UI that draws from it.  Until a moment has been fetched the last moment fetched stands in for
+// it, and OnChange is called when it arrives.
+func WithBackgroundFetch() RemoteOption {
+	return func(r *RemoteStore) {
+		r.background = true
+	}
+}
+
+// NewRemoteStore connects to the khronoscope server at server, like http://host:8080, and starts
+// watching it
+func NewRemoteStore(server string, opts ...RemoteOption) (*RemoteStore, error) {
+	base, err := url.Parse(server)
+	if err != nil {
+		return nil, fmt.Errorf("bad server %q: %w", server, err)
+	}
+	if (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("bad server %q, it must be an http or https URL", server)
+	}
+
+	r := &RemoteStore{
+		base:   base,
+		client: http.DefaultClient,
+		done:   make(chan struct{}),
+		live:   map[string]resources.Resource{},
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+
+	// Fail now rather than show an empty recording if the server can't be reached
+	if err := r.refresh(); err != nil {
+		r.cancel()
+		return nil, fmt.Errorf("unable to reach %s: %w", server, err)
+	}
+	go r.run()
+	return r, nil
+}
+
+// OnChange calls fn whenever the server records a change
+func (r *RemoteStore) OnChange(fn func()) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.onChange = fn
+}
+
+func (r *RemoteStore) changed() {
+	r.lock.Lock()
+	fn := r.onChange
+	r.lock.Unlock()
+	if fn != nil {
+		fn()
+	}
+}
+
+// run keeps live up to date until the store is closed
+func (r *RemoteStore) run() {
+	defer close(r.done)
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := r.follow()
+
+		r.lock.Lock()
+		r.synced = false
+		r.lock.Unlock()
+		if r.ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > MaxReconnectBackoff {
+			backoff = time.Second
+		}
+		log.Warn().Err(err).Str("Server", r.base.String()).Dur("Backoff", backoff).Msg("lost the watch on the server, reconnecting")
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, MaxReconnectBackoff)
+	}
+}
+
+// follow lists the resources as they are now and then applies the changes to them as they are
+// recorded, until the watch ends
+func (r *RemoteStore) follow() error {
+	if err := r.refresh(); err != nil {
+		return err
+	}
+	at, current, err := r.list(url.Values{"at": {"now"}})
+	if err != nil {
+		return err
+	}
+	live := make(map[string]resources.Resource, len(current))
+	for _, resource := range current {
+		live[resource.Uid] = resource
+	}
+	r.lock.Lock()
+	r.live = live
+	r.latest = at
+	r.lock.Unlock()
+
+	// Changes from the moment listed on are replayed, so nothing made since is missed
+	return r.watch(r.ctx, at, func(e dao.Event) bool {
+		r.lock.Lock()
+		switch e.Type {
+		case dao.EventAdd, dao.EventUpdate:
+			r.live[e.UID] = eventResource(e)
+		case dao.EventDelete:
+			delete(r.live, e.UID)
+		case EventReplayed:
+			r.synced = true
+		}
+		if e.Timestamp.After(r.latest) {
+			r.latest = e.Timestamp
+		}
+		r.lock.Unlock()
+		r.changed()
+		return true
+	})
+}
+
+// refresh fetches the metadata and labels of the recording
+func (r *RemoteStore) refresh() error {
+	var metadata dao.Metadata
+	if err := r.get("metadata", nil, &metadata); err != nil {
+		return err
+	}
+	var labels LabelList
+	if err := r.get("labels", nil, &labels); err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.metadata = metadata
+	r.labels = labels.Items
+	return nil
+}
+
+// get fetches an API endpoint into v
+func (r *RemoteStore) get(path string, query url.Values, v any) error {
+	ctx, cancel := context.WithTimeout(r.ctx, RequestTimeout)
+	defer cancel()
+
+	resp, err := r.do(ctx, path, query)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("bad response from %s: %w", path, err)
+	}
+	return nil
+}
+
+// do makes a request to an API endpoint, a response that isn't OK is returned as an error
+func (r *RemoteStore) do(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	u := r.base.JoinPath("api", "v1", path)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		var e Error
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error.Message == "" {
+			e.Error.Message = resp.Status
+		}
+		if resp.StatusCode == http.StatusUnauthorized {
+			return nil, fmt.Errorf("%s: %s: %w", path, e.Error.Message, ErrUnauthorized)
+		}
+		return nil, fmt.Errorf("%s: %s", path, e.Error.Message)
+	}
+	return resp, nil
+}
+
+// list fetches every page of resources matching query, with the moment they were listed at
+func (r *RemoteStore) list(query url.Values) (time.Time, []resources.Resource, error) {
+	query.Set("limit", strconv.Itoa(pageSize))
+	found := []resources.Resource{}
+	for {
+		var page ResourceList
+		if err := r.get("resources", query, &page); err != nil {
+			return time.Time{}, nil, err
+		}
+		for _, resource := range page.Items {
+			found = append(found, fromResource(resource))
+		}
+		if page.Continue == "" {
+			return page.At, found, nil
+		}
+		// The filters aren't in the cursor, they are sent with every page
+		query.Set("continue", page.Continue)
+	}
+}
+
+// watch streams the changes recorded from since on to fn, the end of the replay is marked by an
+// EventReplayed event.  It returns when fn returns false, the context is done or the watch fails.
+func (r *RemoteStore) watch(ctx context.Context, since time.Time, fn func(dao.Event) bool) error {
+	resp, err := r.do(ctx, "watch", url.Values{"since": {since.Format(time.RFC3339Nano)}})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	reader := bufio.NewReader(resp.Body)
+	eventType, data := "", []byte{}
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		switch {
+		case len(line) == 0:
+			// A blank line ends an event
+			if eventType == "" {
+				continue
+			}
+			if eventType == EventError {
+				var e Error
+				_ = json.Unmarshal(data, &e)
+				return fmt.Errorf("watch: %s", e.Error.Message)
+			}
+			var e dao.Event
+			if err := json.Unmarshal(data, &e); err != nil {
+				return fmt.Errorf("bad watch event: %w", err)
+			}
+			e.Type = eventType
+			if !fn(e) {
+				return nil
+			}
+			eventType, data = "", data[:0]
+		case bytes.HasPrefix(line, []byte("event: ")):
+			eventType = string(line[len("event: "):])
+		case bytes.HasPrefix(line, []byte("data: ")):
+			data = append(data, line[len("data: "):]...)
+		}
+	}
+}
+
+// fromResource is the resource as it was recorded
+func fromResource(resource Resource) resources.Resource {
+	r := resources.NewResource(resource.UID, resource.Timestamp, resource.Kind, resource.Namespace, resource.Name)
+	r.RawJSON = string(resource.Object)
+	return resources.WithExtra(r)
+}
+
+func eventResource(e dao.Event) resources.Resource {
+	r := resources.NewResource(e.UID, e.Timestamp, e.Kind, e.Namespace, e.Name)
+	r.RawJSON = string(e.Object)
+	return resources.WithExtra(r)
+}
+
+func matchesResource(r resources.Resource, kind, namespace string) bool {
+	return (kind == "" || r.Kind == kind) && (namespace == "" || r.Namespace == namespace)
+}
+
+// GetResourcesAt returns the resources at timestamp, from live if it is up to date by then
+func (r *RemoteStore) GetResourcesAt(timestamp time.Time, kind string, namespace string) []resources.Resource {
+	r.lock.Lock()
+	if r.synced && !timestamp.Before(r.latest) {
+		found := []resources.Resource{}
+		for _, resource := range r.live {
+			if matchesResource(resource, kind, namespace) {
+				found = append(found, resource)
+			}
+		}
+		r.lock.Unlock()
+		return found
+	}
+	cached := r.cached
+	if cached.lasting && cached.matches(timestamp, kind, namespace) {
+		r.lock.Unlock()
+		return slices.Clone(cached.resources)
+	}
+	if r.background {
+		defer r.lock.Unlock()
+		r.wanted = &cachedQuery{at: timestamp, kind: kind, namespace: namespace}
+		if !r.fetching {
+			r.fetching = true
+			go r.fetchInBackground()
+		}
+		if cached.kind == kind && cached.namespace == namespace {
+			return slices.Clone(cached.resources)
+		}
+		return nil
+	}
+	r.lock.Unlock()
+
+	found, _, err := r.fetch(timestamp, kind, namespace)
+	if err != nil {
+		log.Error().Err(err).Time("At", timestamp).Msg("unable to get resources from the server")
+		return nil
+	}
+	return slices.Clone(found)
+}
+
+// fetch lists the resources at a moment and caches them, returning whether they differ from the
+// ones cached before
+func (r *RemoteStore) fetch(timestamp time.Time, kind string, namespace string) ([]resources.Resource, bool, error) {
+	query := url.Values{"at": {timestamp.Format(time.RFC3339Nano)}, "kind": {kind}, "namespace": {namespace}}
+	_, found, err := r.list(query)
+	if err != nil {
+		return nil, false, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	changed := !slices.EqualFunc(found, r.cached.resources, func(a, b resources.Resource) bool {
+		return a.Uid == b.Uid && a.Timestamp.Time.Equal(b.Timestamp.Time)
+	})
+	// The past doesn't change, but the moments after the latest change seen might
+	r.cached = cachedQuery{at: timestamp, kind: kind, namespace: namespace, resources: found, lasting: !timestamp.After(r.latest)}
+	return found, changed, nil
+}
+
+// fetchInBackground fetches the moments GetResourcesAt asks for until it has caught up with them,
+// while playback moves only the latest is fetched
+func (r *RemoteStore) fetchInBackground() {
+	for {
+		r.lock.Lock()
+		wanted := r.wanted
+		r.wanted = nil
+		if wanted == nil || r.ctx.Err() != nil {
+			r.fetching = false
+			r.lock.Unlock()
+			return
+		}
+		r.lock.Unlock()
+
+		_, changed, err := r.fetch(wanted.at, wanted.kind, wanted.namespace)
+		if err != nil {
+			log.Error().Err(err).Time("At", wanted.at).Msg("unable to get resources from the server")
+			continue
+		}
+		// Moments that aren't over yet are fetched again whenever they're drawn, so only a change
+		// is worth drawing again for
+		if changed {
+			r.changed()
+		}
+	}
+}
+
+func (r *RemoteStore) GetResourceAt(timestamp time.Time, uid string) (resources.Resource, error) {
+	var resource Resource
+	if err := r.get("resources/"+url.PathEscape(uid), url.Values{"at": {timestamp.Format(time.RFC3339Nano)}}, &resource); err != nil {
+		return resources.Resource{}, err
+	}
+	return fromResource(resource), nil
+}
+
+func (r *RemoteStore) GetResourceByName(timestamp time.Time, kind, namespace, name string) (resources.Resource, error) {
+	query := url.Values{"at": {timestamp.Format(time.RFC3339Nano)}, "kind": {kind}, "namespace": {namespace}, "name": {name}}
+	_, found, err := r.list(query)
+	if err != nil {
+		return resources.Resource{}, err
+	}
+	if len(found) == 0 {
+		return resources.Resource{}, fmt.Errorf("no %s %s/%s at %v", kind, namespace, name, timestamp)
+	}
+	return found[0], nil
+}
+
+// GetHistory fetches every change to a resource between from and to, a zero from or to leaves that
+// end open
+func (r *RemoteStore) GetHistory(uid string, from, to time.Time) ([]dao.Revision, error) {
+	query := url.Values{"limit": {strconv.Itoa(pageSize)}}
+	if !from.IsZero() {
+		query.Set("from", from.Format(time.RFC3339Nano))
+	}
+	if !to.IsZero() {
+		query.Set("to", to.Format(time.RFC3339Nano))
+	}
+	revisions := []dao.Revision{}
+	for {
+		var page History
+		if err := r.get("resources/"+url.PathEscape(uid)+"/history", query, &page); err != nil {
+			return nil, err
+		}
+		for _, revision := range page.Items {
+			found := dao.Revision{Timestamp: revision.Timestamp, Deleted: revision.Type == dao.EventDelete}
+			if revision.Resource != nil {
+				found.Resource = fromResource(*revision.Resource)
+			}
+			revisions = append(revisions, found)
+		}
+		if page.Continue == "" {
+			return revisions, nil
+		}
+		query.Set("continue", page.Continue)
+	}
+}
+
+// GetTimeRange is the time range of the recording on the server, including what has been watched
+// since it was last asked for
+func (r *RemoteStore) GetTimeRange() (time.Time, time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.timeRangeLocked()
+}
+
+func (r *RemoteStore) timeRangeLocked() (time.Time, time.Time) {
+	from, to := r.metadata.StartTime, r.metadata.EndTime
+	if from.IsZero() {
+		from = r.latest
+	}
+	if r.latest.After(to) {
+		to = r.latest
+	}
+	return from, to
+}
+
+func (r *RemoteStore) GetLabel(timestamp time.Time) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	label := ""
+	for _, l := range r.labels {
+		if l.Timestamp.After(timestamp) {
+			break
+		}
+		label = l.Label
+	}
+	return label
+}
+
+func (r *RemoteStore) GetNextLabelTime(timestamp time.Time) time.Time {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, l := range r.labels {
+		if l.Timestamp.After(timestamp) {
+			return l.Timestamp
+		}
+	}
+	_, next := r.timeRangeLocked()
+	return next
+}
+
+func (r *RemoteStore) GetPrevLabelTime(timestamp time.Time) time.Time {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, l := range slices.Backward(r.labels) {
+		if l.Timestamp.Before(timestamp) {
+			return l.Timestamp
+		}
+	}
+	prev, _ := r.timeRangeLocked()
+	return prev
+}
+
+// GetLabels returns the labels between from and to, both inclusive, a zero from or to leaves that
+// end open
+func (r *RemoteStore) GetLabels(from, to time.Time) []dao.Label {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	labels := []dao.Label{}
+	for _, l := range r.labels {
+		if (from.IsZero() || !l.Timestamp.Before(from)) && (to.IsZero() || !l.Timestamp.After(to)) {
+			labels = append(labels, l)
+		}
+	}
+	return labels
+}
+
+// GetMetadata describes the recording on the server
+func (r *RemoteStore) GetMetadata() dao.Metadata {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	metadata := r.metadata
+	metadata.StartTime, metadata.EndTime = r.timeRangeLocked()
+	return metadata
+}
+
+// Close stops watching the server
+func (r *RemoteStore) Close() error {
+	r.cancel()
+	<-r.done
+	return nil
+}
+
+// Events yields the changes recorded between from and to, both inclusive, in time order.  A zero
+// from or to leaves that end open, the end being when the server was asked.
+func (r *RemoteStore) Events(from, to time.Time) iter.Seq2[dao.Event, error] {
+	return func(yield func(dao.Event, error) bool) {
+		if from.IsZero() {
+			// The server only replays history for a watch with a since
+			from = time.Unix(0, 0)
+		}
+		stopped := false
+		err := r.watch(r.ctx, from, func(e dao.Event) bool {
+			if e.Type == EventReplayed || (!to.IsZero() && e.Timestamp.After(to)) {
+				return false
+			}
+			stopped = !yield(e, nil)
+			return !stopped
+		})
+		if err != nil && !stopped {
+			yield(dao.Event{}, err)
+		}
+	}
+}
+
+// Download copies the recording on the server into memory, the whole of it is transferred so it
+// shouldn't be called while drawing
+func (r *RemoteStore) Download() (dao.KhronoStore, error) {
+	resp, err := r.do(r.ctx, "recording", nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to download the recording: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	local, err := dao.Read(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to download the recording: %w", err)
+	}
+	return local, nil
+}
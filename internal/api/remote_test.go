@@ -0,0 +1,250 @@
+package api
+
+import (
+	"errors"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/hoyle1974/khronoscope/internal/auth"
+	"github.com/hoyle1974/khronoscope/internal/dao"
+	"github.com/hoyle1974/khronoscope/internal/resources"
+)
+
+func resourceNames(rs []resources.Resource) []string {
+	n := []string{}
+	for _, r := range rs {
+		n = append(n, r.Namespace+"/"+r.Name)
+	}
+	slices.Sort(n)
+	return n
+}
+
+// eventually waits for condition to become true
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRemoteStore(t *testing.T) {
+	server := httptest.NewServer(NewHandler(testStore()))
+	defer server.Close()
+	var remote dao.Recording
+	remote, err := NewRemoteStore(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+
+	if from, to := remote.GetTimeRange(); !from.Equal(at(0)) || to.Before(at(20)) {
+		t.Errorf("Unexpected time range %v to %v", from, to)
+	}
+	if got := resourceNames(remote.GetResourcesAt(at(5), "Pod", "")); !slices.Equal(got, []string{"data/db", "default/web-1", "default/web-2"}) {
+		t.Errorf("Unexpected pods %v", got)
+	}
+	// Asked for twice, the second from the cache
+	if got := resourceNames(remote.GetResourcesAt(at(6), "", "default")); !slices.Equal(got, []string{"default/web", "default/web-2"}) {
+		t.Errorf("Unexpected resources %v", got)
+	}
+	if got := resourceNames(remote.GetResourcesAt(at(6), "", "default")); !slices.Equal(got, []string{"default/web", "default/web-2"}) {
+		t.Errorf("Unexpected cached resources %v", got)
+	}
+
+	r, err := remote.GetResourceAt(at(5), "uid-web-1")
+	if err != nil || r.Name != "web-1" || r.RawJSON == "" {
+		t.Errorf("Unexpected resource %+v %v", r, err)
+	}
+	if _, ok := r.Extra.(resources.PodExtra); !ok {
+		t.Errorf("Expected pods to have their extra filled in, got %T", r.Extra)
+	}
+	if _, err := remote.GetResourceAt(at(7), "uid-web-1"); err == nil {
+		t.Error("Expected a deleted resource to not be found")
+	}
+	if r, err := remote.GetResourceByName(at(7), "Pod", "data", "db"); err != nil || r.Uid != "uid-db" {
+		t.Errorf("Unexpected resource %+v %v", r, err)
+	}
+
+	history, err := remote.GetHistory("uid-web-1", time.Time{}, time.Time{})
+	if err != nil || len(history) != 3 || !history[2].Deleted || history[1].Resource.Name != "web-1" {
+		t.Errorf("Unexpected history %+v %v", history, err)
+	}
+
+	if label := remote.GetLabel(at(3)); label != "deploy" {
+		t.Errorf("Expected deploy, got %q", label)
+	}
+	if next := remote.GetNextLabelTime(at(1)); !next.Equal(at(6)) {
+		t.Errorf("Expected the next label at %v, got %v", at(6), next)
+	}
+	if prev := remote.GetPrevLabelTime(at(6)); !prev.Equal(at(1)) {
+		t.Errorf("Expected the previous label at %v, got %v", at(1), prev)
+	}
+	if labels := remote.GetLabels(at(2), at(10)); len(labels) != 1 || !labels[0].Timestamp.Equal(at(6)) {
+		t.Errorf("Unexpected labels %+v", labels)
+	}
+}
+
+func TestRemoteStorePaged(t *testing.T) {
+	defer func(size int) { pageSize = size }(pageSize)
+	pageSize = 1
+
+	server := httptest.NewServer(NewHandler(testStore()))
+	defer server.Close()
+	remote, err := NewRemoteStore(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+
+	// Every page is filtered, not just the first
+	if got := resourceNames(remote.GetResourcesAt(at(5), "Pod", "")); !slices.Equal(got, []string{"data/db", "default/web-1", "default/web-2"}) {
+		t.Errorf("Unexpected pods %v", got)
+	}
+	if got := resourceNames(remote.GetResourcesAt(at(6), "", "default")); !slices.Equal(got, []string{"default/web", "default/web-2"}) {
+		t.Errorf("Unexpected resources %v", got)
+	}
+	if history, err := remote.GetHistory("uid-web-1", time.Time{}, time.Time{}); err != nil || len(history) != 3 {
+		t.Errorf("Unexpected history %+v %v", history, err)
+	}
+}
+
+func TestRemoteStoreLive(t *testing.T) {
+	store := testStore()
+	source := newFakeSource(store)
+	server := httptest.NewServer(NewHandler(store, WithLive(source)))
+	defer server.Close()
+	remote, err := NewRemoteStore(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	changes := make(chan struct{}, 100)
+	remote.OnChange(func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	})
+
+	synced := func() bool {
+		remote.lock.Lock()
+		defer remote.lock.Unlock()
+		return remote.synced
+	}
+	eventually(t, "the watch to sync", synced)
+	if got := resourceNames(remote.GetResourcesAt(time.Now(), "Pod", "")); !slices.Equal(got, []string{"data/db", "default/a-late", "default/web-2"}) {
+		t.Errorf("Unexpected pods %v", got)
+	}
+
+	added := resources.NewResource("uid-new", time.Now(), "Pod", "default", "new")
+	added.RawJSON = `{"kind":"Pod"}`
+	source.record(watch.Added, added)
+	source.record(watch.Deleted, resources.NewResource("uid-db", time.Now(), "Pod", "data", "db"))
+	eventually(t, "the changes", func() bool {
+		got := resourceNames(remote.GetResourcesAt(time.Now(), "Pod", ""))
+		return slices.Equal(got, []string{"default/a-late", "default/new", "default/web-2"})
+	})
+	select {
+	case <-changes:
+	default:
+		t.Error("Expected to be told about the changes")
+	}
+	if _, to := remote.GetTimeRange(); to.Before(added.Timestamp.Time) {
+		t.Errorf("Expected the time range to end after %v, got %v", added.Timestamp.Time, to)
+	}
+}
+
+func TestRemoteStoreBackgroundFetch(t *testing.T) {
+	server := httptest.NewServer(NewHandler(testStore()))
+	defer server.Close()
+	remote, err := NewRemoteStore(server.URL, WithBackgroundFetch())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	changes := make(chan struct{}, 100)
+	remote.OnChange(func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	})
+
+	if got := remote.GetResourcesAt(at(5), "Pod", ""); len(got) != 0 {
+		t.Errorf("Expected nothing until the pods are fetched, got %v", resourceNames(got))
+	}
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected to be told when the pods were fetched")
+	}
+	if got := resourceNames(remote.GetResourcesAt(at(5), "Pod", "")); !slices.Equal(got, []string{"data/db", "default/web-1", "default/web-2"}) {
+		t.Errorf("Unexpected pods %v", got)
+	}
+
+	// The last moment fetched stands in for the next one until it arrives
+	if got := resourceNames(remote.GetResourcesAt(at(7), "Pod", "")); !slices.Equal(got, []string{"data/db", "default/web-1", "default/web-2"}) {
+		t.Errorf("Expected the pods at 5 to stand in, got %v", got)
+	}
+	eventually(t, "the pods at 7", func() bool {
+		return slices.Equal(resourceNames(remote.GetResourcesAt(at(7), "Pod", "")), []string{"data/db", "default/web-2"})
+	})
+}
+
+func TestRemoteStoreDownload(t *testing.T) {
+	server := httptest.NewServer(NewHandler(testStore()))
+	defer server.Close()
+	remote, err := NewRemoteStore(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+
+	saved, err := remote.Download()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer saved.Close()
+	for _, seconds := range []int{0, 2, 5, 6, 20} {
+		expected := resourceNames(testStore().GetResourcesAt(at(seconds), "", ""))
+		if got := resourceNames(saved.GetResourcesAt(at(seconds), "", "")); !slices.Equal(got, expected) {
+			t.Errorf("At %d expected %v, got %v", seconds, expected, got)
+		}
+	}
+	if labels := saved.GetLabels(time.Time{}, time.Time{}); len(labels) != 2 {
+		t.Errorf("Expected the labels to be saved, got %+v", labels)
+	}
+}
+
+func TestRemoteStoreBadServer(t *testing.T) {
+	for _, server := range []string{"host:8080", "ftp://host", "http://127.0.0.1:1"} {
+		if _, err := NewRemoteStore(server); err == nil {
+			t.Errorf("Expected %s to fail", server)
+		}
+	}
+}
+
+func TestRemoteStoreUnauthorized(t *testing.T) {
+	tokens := auth.StaticTokens{"alice-token": {Name: "alice"}}
+	server := httptest.NewServer(auth.Authenticate(tokens, NewHandler(testStore())))
+	defer server.Close()
+
+	for _, token := range []string{"", "wrong-token"} {
+		if _, err := NewRemoteStore(server.URL, WithToken(token)); !errors.Is(err, ErrUnauthorized) {
+			t.Errorf("Expected ErrUnauthorized with %q, got %v", token, err)
+		}
+	}
+	remote, err := NewRemoteStore(server.URL, WithToken("alice-token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+}
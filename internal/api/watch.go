@@ -0,0 +1,246 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/hoyle1974/khronoscope/internal/dao"
+	"github.com/hoyle1974/khronoscope/internal/resources"
+)
+
+const (
+	// EventReplayed is sent once the history asked for with since has been sent, what follows is live
+	EventReplayed = "replayed"
+	// EventError is sent as an Error before the server ends a watch
+	EventError = "error"
+)
+
+var (
+	// HeartbeatInterval is how often an idle watch is pinged to keep proxies from closing it
+	HeartbeatInterval = 15 * time.Second
+	// WatchBuffer is how many live events a watch can fall behind by before it is dropped
+	WatchBuffer = 1024
+)
+
+var upgrader = websocket.Upgrader{}
+
+// stream sends events to a watcher, as Server-Sent Events or over a WebSocket
+type stream interface {
+	send(eventType string, id time.Time, v any) error
+	heartbeat() error
+	close()
+}
+
+type sseStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (s sseStream) send(eventType string, id time.Time, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	// The id lets a client that reconnects pick up where it left off with Last-Event-ID
+	if _, err := fmt.Fprintf(s.w, "id: %s\nevent: %s\ndata: %s\n\n", id.Format(time.RFC3339Nano), eventType, b); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+func (s sseStream) heartbeat() error {
+	if _, err := fmt.Fprint(s.w, ": heartbeat\n\n"); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+func (s sseStream) close() {}
+
+type webSocketStream struct {
+	conn *websocket.Conn
+}
+
+func (s webSocketStream) send(eventType string, id time.Time, v any) error {
+	return s.conn.WriteJSON(v)
+}
+
+func (s webSocketStream) heartbeat() error {
+	return s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(HeartbeatInterval))
+}
+
+func (s webSocketStream) close() {
+	_ = s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	_ = s.conn.Close()
+}
+
+// liveEventTypes maps the watcher's changes to event types
+var liveEventTypes = map[watch.EventType]string{
+	watch.Added:    dao.EventAdd,
+	watch.Modified: dao.EventUpdate,
+	watch.Deleted:  dao.EventDelete,
+}
+
+// watch streams changes to resources as they are recorded.  With since the changes already
+// recorded from then on are sent first.
+func (h handler) watch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, methodNotAllowed(w, r, "GET"))
+		return
+	}
+	query := r.URL.Query()
+	kind, namespace := query.Get("kind"), query.Get("namespace")
+	since, err := parseTime(r, "since", time.Time{})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		// A reconnecting EventSource, everything up to the last event it saw has been sent
+		if last, err := time.Parse(time.RFC3339Nano, lastEventID); err == nil {
+			since = last.Add(time.Nanosecond)
+		}
+	}
+	matches := func(e dao.Event) bool {
+		return (kind == "" || e.Kind == kind) && (namespace == "" || e.Namespace == namespace)
+	}
+
+	var s stream
+	ctx := r.Context()
+	if websocket.IsWebSocketUpgrade(r) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return // The upgrader has already replied
+		}
+		// Reading is what notices the client going away, and handles pongs and close messages
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+		s = webSocketStream{conn: conn}
+		var cancel func()
+		ctx, cancel = contextDone(ctx, done)
+		defer cancel()
+	} else {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, r, fmt.Errorf("streaming isn't supported"))
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		s = sseStream{w: w, flusher: flusher}
+	}
+	defer s.close()
+
+	// Subscribe before replaying so nothing recorded in between is missed
+	events := make(chan dao.Event, WatchBuffer)
+	overflow := make(chan struct{})
+	var overflowOnce sync.Once
+	subscribed := time.Now()
+	if h.live != nil {
+		unsubscribe := h.live.Subscribe(func(c resources.Change) {
+			e := dao.NewEvent(liveEventTypes[c.Type], c.Resource.Timestamp.Time, c.Resource)
+			if !matches(e) {
+				return
+			}
+			select {
+			case events <- e:
+			default:
+				overflowOnce.Do(func() { close(overflow) })
+			}
+		})
+		defer unsubscribe()
+	}
+
+	// Recent replayed events may show up live too
+	replayedTo := time.Now()
+	replayed := map[string]bool{}
+	eventKey := func(e dao.Event) string {
+		return e.UID + "@" + e.Timestamp.Format(time.RFC3339Nano)
+	}
+	if !since.IsZero() {
+		for e, err := range h.store.Events(since, replayedTo) {
+			if err != nil {
+				log.Error().Err(err).Msg("unable to replay history")
+				_ = s.send(EventError, time.Now(), Error{ErrorDetails{Code: http.StatusInternalServerError, Message: err.Error()}})
+				return
+			}
+			if !matches(e) || !h.canGetEvent(r, e) {
+				continue
+			}
+			if e.Timestamp.After(subscribed.Add(-time.Minute)) {
+				replayed[eventKey(e)] = true
+			}
+			if err := s.send(e.Type, e.Timestamp, e); err != nil {
+				return
+			}
+		}
+		if err := s.send(EventReplayed, replayedTo, dao.Event{Timestamp: replayedTo, Type: EventReplayed}); err != nil {
+			return
+		}
+	}
+
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-overflow:
+			_ = s.send(EventError, time.Now(), Error{ErrorDetails{Code: http.StatusServiceUnavailable, Message: "fell too far behind"}})
+			return
+		case e := <-events:
+			if (!e.Timestamp.After(replayedTo) && replayed[eventKey(e)]) || !h.canGetEvent(r, e) {
+				continue
+			}
+			if err := s.send(e.Type, e.Timestamp, e); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := s.heartbeat(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// canGetEvent is whether the user making a request can see the resource an event is about
+func (h handler) canGetEvent(r *http.Request, e dao.Event) bool {
+	if h.authz == nil {
+		return true
+	}
+	resource := resources.NewResource(e.UID, e.Timestamp, e.Kind, e.Namespace, e.Name)
+	resource.RawJSON = string(e.Object)
+	return h.canGet(r, resource)
+}
+
+// contextDone returns a context that is also done when done is closed
+func contextDone(ctx context.Context, done <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
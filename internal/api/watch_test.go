@@ -0,0 +1,174 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"k8s.io/apimachinery/pkg/watch"
+
+	"github.com/hoyle1974/khronoscope/internal/dao"
+	"github.com/hoyle1974/khronoscope/internal/resources"
+)
+
+// fakeSource stands in for the watcher, recording changes to a store and passing them on
+type fakeSource struct {
+	lock        sync.Mutex
+	store       dao.KhronoStore
+	subscribers []func(resources.Change)
+	subscribed  chan struct{}
+}
+
+func newFakeSource(store dao.KhronoStore) *fakeSource {
+	return &fakeSource{store: store, subscribed: make(chan struct{}, 10)}
+}
+
+func (f *fakeSource) Subscribe(fn func(resources.Change)) func() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.subscribers = append(f.subscribers, fn)
+	f.subscribed <- struct{}{}
+	return func() {}
+}
+
+func (f *fakeSource) record(eventType watch.EventType, r resources.Resource) {
+	switch eventType {
+	case watch.Added:
+		f.store.AddResource(r)
+	case watch.Modified:
+		f.store.UpdateResource(r)
+	case watch.Deleted:
+		f.store.DeleteResource(r)
+	}
+	f.publish(eventType, r)
+}
+
+func (f *fakeSource) publish(eventType watch.EventType, r resources.Resource) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, fn := range f.subscribers {
+		fn(resources.Change{Type: eventType, Resource: r})
+	}
+}
+
+type sseEvent struct {
+	id, event string
+	data      dao.Event
+}
+
+func readSSE(t *testing.T, scanner *bufio.Scanner) sseEvent {
+	t.Helper()
+	var e sseEvent
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "" && e.event != "":
+			return e
+		case strings.HasPrefix(line, "id: "):
+			e.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			e.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e.data); err != nil {
+				t.Fatalf("Bad data %q: %v", line, err)
+			}
+		}
+	}
+	t.Fatalf("Stream ended: %v", scanner.Err())
+	return e
+}
+
+func TestWatchSSE(t *testing.T) {
+	store := dao.New()
+	source := newFakeSource(store)
+	server := httptest.NewServer(NewHandler(store, WithLive(source)))
+	defer server.Close()
+
+	now := time.Now()
+	pod := func(offset time.Duration, name, phase string) resources.Resource {
+		r := resources.NewResource("uid-"+name, now.Add(offset), "Pod", "default", name)
+		r.RawJSON = `{"kind":"Pod","status":{"phase":"` + phase + `"}}`
+		return r
+	}
+	source.record(watch.Added, pod(-3*time.Second, "old", "Pending"))
+	source.record(watch.Modified, pod(-2*time.Second, "old", "Running"))
+	node := resources.NewResource("uid-node", now.Add(-2*time.Second), "Node", "", "node-1")
+	source.record(watch.Added, node)
+
+	query := url.Values{"kind": {"Pod"}, "since": {now.Add(-2500 * time.Millisecond).Format(time.RFC3339Nano)}}
+	resp, err := http.Get(server.URL + "/api/v1/watch?" + query.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %q", ct)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+
+	// History first, the pod already existed when the watch starts so it's an update
+	e := readSSE(t, scanner)
+	if e.event != dao.EventUpdate || e.data.Name != "old" || !strings.Contains(string(e.data.Object), "Running") || e.id != now.Add(-2*time.Second).Format(time.RFC3339Nano) {
+		t.Errorf("Expected the update to be replayed, got %+v", e)
+	}
+	if e = readSSE(t, scanner); e.event != EventReplayed {
+		t.Errorf("Expected the end of the replay, got %+v", e)
+	}
+
+	// Then live, without the node which is filtered out
+	source.record(watch.Added, resources.NewResource("uid-node-2", time.Now(), "Node", "", "node-2"))
+	source.record(watch.Added, pod(time.Second, "new", "Pending"))
+	source.record(watch.Deleted, pod(2*time.Second, "old", ""))
+	for _, expected := range []struct{ event, name string }{{dao.EventAdd, "new"}, {dao.EventDelete, "old"}} {
+		if e = readSSE(t, scanner); e.event != expected.event || e.data.Name != expected.name {
+			t.Errorf("Expected %s of %s, got %+v", expected.event, expected.name, e)
+		}
+	}
+}
+
+func TestWatchWebSocket(t *testing.T) {
+	store := dao.New()
+	source := newFakeSource(store)
+	server := httptest.NewServer(NewHandler(store, WithLive(source)))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/v1/watch?namespace=default", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case <-source.subscribed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The watch never subscribed")
+	}
+
+	source.record(watch.Added, resources.NewResource("uid-other", time.Now(), "Pod", "other", "skipped"))
+	r := resources.NewResource("uid-web", time.Now(), "Pod", "default", "web")
+	r.RawJSON = `{"kind":"Pod"}`
+	source.record(watch.Added, r)
+
+	var e dao.Event
+	if err := conn.ReadJSON(&e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != dao.EventAdd || e.UID != "uid-web" || string(e.Object) != `{"kind":"Pod"}` {
+		t.Errorf("Unexpected event %+v", e)
+	}
+}
+
+func TestWatchBadRequest(t *testing.T) {
+	h := NewHandler(dao.New())
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/watch?since=yesterday", nil))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `"code":400`) {
+		t.Errorf("Expected a 400, got %d %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,98 @@
+// Package auth works out who is making a request to the server and what they are allowed to see.
+// Requests carry a bearer token, which the cluster is asked about with a TokenReview, and users see
+// the resources the cluster would let them get, which it is asked about with SubjectAccessReviews.
+// StaticTokens and AllowAll stand in for the cluster when testing locally.
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/hoyle1974/khronoscope/internal/resources"
+)
+
+// ErrUnauthenticated is returned for a token that doesn't belong to anyone
+var ErrUnauthenticated = errors.New("invalid bearer token")
+
+// User is who made a request
+type User struct {
+	Name   string
+	UID    string
+	Groups []string
+	Extra  map[string][]string
+}
+
+// Authenticator works out who a bearer token belongs to
+type Authenticator interface {
+	Authenticate(ctx context.Context, token string) (User, error)
+}
+
+// Authorizer decides which resources a user can see.  Failing to decide is a no.
+type Authorizer interface {
+	// CanGet is whether user can get r
+	CanGet(ctx context.Context, user User, r resources.Resource) bool
+	// CanGetKind is whether user can get every resource of r's kind in r's namespace, without
+	// asking about r by name
+	CanGetKind(ctx context.Context, user User, r resources.Resource) bool
+	// CanGetAll is whether user can get every resource in namespace, or in every namespace if it
+	// is ""
+	CanGetAll(ctx context.Context, user User, namespace string) bool
+}
+
+type userKey struct{}
+
+// WithUser returns a context carrying user
+func WithUser(ctx context.Context, user User) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// UserFrom returns the user a context carries
+func UserFrom(ctx context.Context) (User, bool) {
+	user, ok := ctx.Value(userKey{}).(User)
+	return user, ok
+}
+
+// Authenticate only passes on requests with a bearer token that authn accepts, with the user it
+// belongs to in their context
+func Authenticate(authn Authenticator, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || strings.TrimSpace(token) == "" {
+			unauthorized(w, "a bearer token is required")
+			return
+		}
+		user, err := authn.Authenticate(r.Context(), strings.TrimSpace(token))
+		if errors.Is(err, ErrUnauthenticated) {
+			unauthorized(w, err.Error())
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Str("Path", r.URL.Path).Msg("unable to authenticate request")
+			http.Error(w, "unable to authenticate", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithUser(r.Context(), user)))
+	})
+}
+
+func unauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="khronoscope"`)
+	http.Error(w, message, http.StatusUnauthorized)
+}
+
+// RequireAll only passes on requests from users who can get every resource, for endpoints that
+// can't hide what a user isn't allowed to see
+func RequireAll(authz Authorizer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := UserFrom(r.Context())
+		if !authz.CanGetAll(r.Context(), user, "") {
+			http.Error(w, "get on every resource is required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/hoyle1974/khronoscope/internal/resources"
+)
+
+// namespaceAuthorizer lets users see only the namespaces they are named with
+type namespaceAuthorizer map[string][]string
+
+func (a namespaceAuthorizer) CanGet(ctx context.Context, user User, r resources.Resource) bool {
+	return slices.Contains(a[user.Name], r.Namespace)
+}
+
+func (a namespaceAuthorizer) CanGetKind(ctx context.Context, user User, r resources.Resource) bool {
+	return a.CanGet(ctx, user, r)
+}
+
+func (a namespaceAuthorizer) CanGetAll(ctx context.Context, user User, namespace string) bool {
+	return slices.Contains(a[user.Name], "*")
+}
+
+func TestAuthenticate(t *testing.T) {
+	tokens := StaticTokens{"secret": {Name: "alice"}}
+	h := Authenticate(tokens, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := UserFrom(r.Context())
+		_, _ = w.Write([]byte(user.Name))
+	}))
+
+	tests := []struct {
+		authorization string
+		code          int
+		body          string
+	}{
+		{"", http.StatusUnauthorized, ""},
+		{"Basic c2VjcmV0", http.StatusUnauthorized, ""},
+		{"Bearer wrong", http.StatusUnauthorized, ""},
+		{"Bearer secret", http.StatusOK, "alice"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/resources", nil)
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != test.code || (test.body != "" && rec.Body.String() != test.body) {
+			t.Errorf("%q: expected %d %q, got %d %q", test.authorization, test.code, test.body, rec.Code, rec.Body.String())
+		}
+		if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%q: expected a challenge", test.authorization)
+		}
+	}
+}
+
+func TestRequireAll(t *testing.T) {
+	authz := namespaceAuthorizer{"admin": {"*"}, "alice": {"default"}}
+	h := RequireAll(authz, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for user, code := range map[string]int{"admin": http.StatusOK, "alice": http.StatusForbidden} {
+		req := httptest.NewRequest(http.MethodGet, "/resources", nil)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req.WithContext(WithUser(req.Context(), User{Name: user})))
+		if rec.Code != code {
+			t.Errorf("%s: expected %d, got %d", user, code, rec.Code)
+		}
+	}
+}
+
+func TestReadTokenFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "tokens.csv")
+	content := "# Local testing\nsecret,alice,1,\"dev,ops\"\nother,bob,2\n"
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := ReadTokenFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, err := tokens.Authenticate(context.Background(), "secret"); err != nil || user.Name != "alice" || !slices.Equal(user.Groups, []string{"dev", "ops"}) {
+		t.Errorf("Unexpected user %+v %v", user, err)
+	}
+	if user, err := tokens.Authenticate(context.Background(), "other"); err != nil || user.Name != "bob" || user.UID != "2" {
+		t.Errorf("Unexpected user %+v %v", user, err)
+	}
+
+	if err := os.WriteFile(filename, []byte("secret,alice\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadTokenFile(filename); err == nil {
+		t.Error("Expected a line without a uid to fail")
+	}
+}
@@ -0,0 +1,265 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/hoyle1974/khronoscope/internal/resources"
+)
+
+var (
+	// CacheTTL is how long a review by the cluster is trusted for
+	CacheTTL = time.Minute
+	// maxCached is how many reviews are remembered, the expired ones are dropped first
+	maxCached = 10000
+)
+
+// ttlCache remembers values for CacheTTL
+type ttlCache[V any] struct {
+	lock  sync.Mutex
+	items map[string]cached[V]
+}
+
+type cached[V any] struct {
+	value   V
+	expires time.Time
+}
+
+func newTTLCache[V any]() *ttlCache[V] {
+	return &ttlCache[V]{items: map[string]cached[V]{}}
+}
+
+func (c *ttlCache[V]) get(key string) (V, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	item, ok := c.items[key]
+	if !ok || time.Now().After(item.expires) {
+		var zero V
+		return zero, false
+	}
+	return item.value, true
+}
+
+func (c *ttlCache[V]) add(key string, value V) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	if len(c.items) >= maxCached {
+		for k, item := range c.items {
+			if now.After(item.expires) {
+				delete(c.items, k)
+			}
+		}
+		// Nothing had expired, forget a quarter of them so there is room for a while
+		for k := range c.items {
+			if len(c.items) < maxCached*3/4 {
+				break
+			}
+			delete(c.items, k)
+		}
+	}
+	c.items[key] = cached[V]{value: value, expires: now.Add(CacheTTL)}
+}
+
+// TokenReviewer authenticates tokens by asking the cluster with a TokenReview, the server's service
+// account needs to be able to create tokenreviews
+type TokenReviewer struct {
+	client    kubernetes.Interface
+	audiences []string
+	cache     *ttlCache[*User]
+}
+
+// NewTokenReviewer returns a TokenReviewer that accepts tokens for any of audiences, or for the API
+// server if none are given
+func NewTokenReviewer(client kubernetes.Interface, audiences ...string) *TokenReviewer {
+	return &TokenReviewer{client: client, audiences: audiences, cache: newTTLCache[*User]()}
+}
+
+func (t *TokenReviewer) Authenticate(ctx context.Context, token string) (User, error) {
+	// The token itself isn't kept around
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+	if user, ok := t.cache.get(key); ok {
+		if user == nil {
+			return User{}, ErrUnauthenticated
+		}
+		return *user, nil
+	}
+
+	review, err := t.client.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token, Audiences: t.audiences},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return User{}, fmt.Errorf("token review failed: %w", err)
+	}
+	if !review.Status.Authenticated {
+		t.cache.add(key, nil)
+		return User{}, ErrUnauthenticated
+	}
+
+	info := review.Status.User
+	user := User{Name: info.Username, UID: info.UID, Groups: info.Groups}
+	if len(info.Extra) > 0 {
+		user.Extra = map[string][]string{}
+		for k, v := range info.Extra {
+			user.Extra[k] = v
+		}
+	}
+	t.cache.add(key, &user)
+	return user, nil
+}
+
+// SubjectAccessReviewer authorizes users by asking the cluster whether they could get a resource
+// with a SubjectAccessReview, the server's service account needs to be able to create
+// subjectaccessreviews.  Being able to get every resource of a kind in a namespace is asked first,
+// so most users cost a review per kind and namespace rather than one per resource.
+type SubjectAccessReviewer struct {
+	client    kubernetes.Interface
+	decisions *ttlCache[bool]
+
+	lock       sync.Mutex
+	kinds      map[string]schema.GroupResource // By kind, and by group and kind
+	discovered time.Time
+}
+
+// NewSubjectAccessReviewer returns a SubjectAccessReviewer asking the cluster client connects to
+func NewSubjectAccessReviewer(client kubernetes.Interface) *SubjectAccessReviewer {
+	return &SubjectAccessReviewer{client: client, decisions: newTTLCache[bool]()}
+}
+
+func (s *SubjectAccessReviewer) CanGet(ctx context.Context, user User, r resources.Resource) bool {
+	if s.CanGetKind(ctx, user, r) {
+		return true
+	}
+	attributes := s.attributesFor(r)
+	attributes.Name = r.Name
+	return s.allowed(ctx, user, attributes)
+}
+
+func (s *SubjectAccessReviewer) CanGetKind(ctx context.Context, user User, r resources.Resource) bool {
+	return s.allowed(ctx, user, s.attributesFor(r))
+}
+
+// attributesFor is getting every resource of r's kind in r's namespace
+func (s *SubjectAccessReviewer) attributesFor(r resources.Resource) authorizationv1.ResourceAttributes {
+	resource := s.resourceFor(r)
+	return authorizationv1.ResourceAttributes{
+		Verb:      "get",
+		Group:     resource.Group,
+		Resource:  resource.Resource,
+		Namespace: r.Namespace,
+	}
+}
+
+func (s *SubjectAccessReviewer) CanGetAll(ctx context.Context, user User, namespace string) bool {
+	return s.allowed(ctx, user, authorizationv1.ResourceAttributes{
+		Verb:      "get",
+		Group:     "*",
+		Resource:  "*",
+		Namespace: namespace,
+	})
+}
+
+func (s *SubjectAccessReviewer) allowed(ctx context.Context, user User, attributes authorizationv1.ResourceAttributes) bool {
+	key := strings.Join([]string{user.Name, user.UID, strings.Join(user.Groups, ","), attributes.Verb, attributes.Group, attributes.Resource, attributes.Namespace, attributes.Name}, "\x00")
+	if allowed, ok := s.decisions.get(key); ok {
+		return allowed
+	}
+
+	review := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:               user.Name,
+			UID:                user.UID,
+			Groups:             user.Groups,
+			ResourceAttributes: &attributes,
+		},
+	}
+	if len(user.Extra) > 0 {
+		review.Spec.Extra = map[string]authorizationv1.ExtraValue{}
+		for k, v := range user.Extra {
+			review.Spec.Extra[k] = v
+		}
+	}
+	result, err := s.client.AuthorizationV1().SubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+	if err != nil {
+		log.Warn().Err(err).Str("User", user.Name).Msg("subject access review failed")
+		return false
+	}
+	s.decisions.add(key, result.Status.Allowed)
+	return result.Status.Allowed
+}
+
+// resourceFor works out which API resource a recorded resource is, from its kind and the group in
+// its apiVersion
+func (s *SubjectAccessReviewer) resourceFor(r resources.Resource) schema.GroupResource {
+	var obj struct {
+		APIVersion string `json:"apiVersion"`
+	}
+	_ = json.Unmarshal([]byte(r.RawJSON), &obj)
+	gv, _ := schema.ParseGroupVersion(obj.APIVersion)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	lookup := func() (schema.GroupResource, bool) {
+		if obj.APIVersion != "" {
+			resource, ok := s.kinds[gv.Group+"/"+r.Kind]
+			return resource, ok
+		}
+		resource, ok := s.kinds[r.Kind]
+		return resource, ok
+	}
+	resource, ok := lookup()
+	if !ok && time.Since(s.discovered) > CacheTTL {
+		s.discoverLocked()
+		resource, ok = lookup()
+	}
+	if !ok {
+		// Not served by the cluster any more, it is likely named the usual way
+		guessed, _ := meta.UnsafeGuessKindToResource(gv.WithKind(r.Kind))
+		return guessed.GroupResource()
+	}
+	return resource
+}
+
+func (s *SubjectAccessReviewer) discoverLocked() {
+	s.discovered = time.Now()
+	_, lists, err := s.client.Discovery().ServerGroupsAndResources()
+	if err != nil {
+		log.Warn().Err(err).Msg("Warning: Some API groups may not be accessible")
+	}
+	kinds := map[string]schema.GroupResource{}
+	for _, list := range lists {
+		gv, err := schema.ParseGroupVersion(list.GroupVersion)
+		if err != nil {
+			continue
+		}
+		for _, resource := range list.APIResources {
+			if strings.Contains(resource.Name, "/") {
+				continue // A subresource
+			}
+			gr := schema.GroupResource{Group: gv.Group, Resource: resource.Name}
+			kinds[gv.Group+"/"+resource.Kind] = gr
+			// Without a group the core one wins, Event is both v1 and events.k8s.io
+			if existing, ok := kinds[resource.Kind]; !ok || (existing.Group != "" && gv.Group == "") {
+				kinds[resource.Kind] = gr
+			}
+		}
+	}
+	if len(kinds) > 0 {
+		s.kinds = kinds
+	}
+}
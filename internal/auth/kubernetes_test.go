@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/hoyle1974/khronoscope/internal/resources"
+)
+
+func TestTokenReviewer(t *testing.T) {
+	client := fake.NewClientset()
+	reviews := 0
+	client.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		reviews++
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		if review.Spec.Token == "good" {
+			review.Status.Authenticated = true
+			review.Status.User = authenticationv1.UserInfo{Username: "alice", Groups: []string{"dev"}}
+		}
+		return true, review, nil
+	})
+	reviewer := NewTokenReviewer(client)
+
+	for range 2 {
+		user, err := reviewer.Authenticate(context.Background(), "good")
+		if err != nil || user.Name != "alice" || len(user.Groups) != 1 {
+			t.Errorf("Unexpected user %+v %v", user, err)
+		}
+		if _, err := reviewer.Authenticate(context.Background(), "bad"); err != ErrUnauthenticated {
+			t.Errorf("Expected a bad token to be rejected, got %v", err)
+		}
+	}
+	if reviews != 2 {
+		t.Errorf("Expected the reviews to be cached, got %d", reviews)
+	}
+}
+
+func TestSubjectAccessReviewer(t *testing.T) {
+	client := fake.NewClientset()
+	client.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{
+		{GroupVersion: "events.k8s.io/v1", APIResources: []metav1.APIResource{{Name: "events", Kind: "Event"}}},
+		{GroupVersion: "v1", APIResources: []metav1.APIResource{
+			{Name: "pods", Kind: "Pod"},
+			{Name: "pods/log", Kind: "Pod"},
+			{Name: "secrets", Kind: "Secret"},
+			{Name: "events", Kind: "Event"},
+		}},
+		{GroupVersion: "apps/v1", APIResources: []metav1.APIResource{{Name: "deployments", Kind: "Deployment"}}},
+	}
+	// alice can get pods and deployments in default, and the secret named config
+	reviews := []authorizationv1.ResourceAttributes{}
+	client.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		a := *review.Spec.ResourceAttributes
+		reviews = append(reviews, a)
+		review.Status.Allowed = review.Spec.User == "alice" && a.Verb == "get" && a.Namespace == "default" &&
+			((a.Group == "" && a.Resource == "pods") || (a.Group == "apps" && a.Resource == "deployments") ||
+				(a.Group == "" && a.Resource == "events") || (a.Resource == "secrets" && a.Name == "config"))
+		return true, review, nil
+	})
+	reviewer := NewSubjectAccessReviewer(client)
+	alice := User{Name: "alice"}
+
+	resource := func(kind, namespace, name, json string) resources.Resource {
+		r := resources.NewResource("uid-"+name, time.Now(), kind, namespace, name)
+		r.RawJSON = json
+		return r
+	}
+	tests := []struct {
+		user     User
+		resource resources.Resource
+		allowed  bool
+	}{
+		{alice, resource("Pod", "default", "web", `{"apiVersion":"v1","kind":"Pod"}`), true},
+		{alice, resource("Pod", "default", "db", `{"apiVersion":"v1","kind":"Pod"}`), true},
+		{alice, resource("Pod", "other", "web", `{"apiVersion":"v1","kind":"Pod"}`), false},
+		{alice, resource("Deployment", "default", "web", `{"apiVersion":"apps/v1","kind":"Deployment"}`), true},
+		{alice, resource("Secret", "default", "config", `{"apiVersion":"v1","kind":"Secret"}`), true},
+		{alice, resource("Secret", "default", "token", `{"apiVersion":"v1","kind":"Secret"}`), false},
+		{alice, resource("Event", "default", "e1", ``), true}, // The core group without an apiVersion
+		{alice, resource("Event", "default", "e2", `{"apiVersion":"events.k8s.io/v1","kind":"Event"}`), false},
+		{User{Name: "bob"}, resource("Pod", "default", "web", `{"apiVersion":"v1","kind":"Pod"}`), false},
+	}
+	for _, test := range tests {
+		if allowed := reviewer.CanGet(context.Background(), test.user, test.resource); allowed != test.allowed {
+			t.Errorf("%s %s %s/%s: expected %v", test.user.Name, test.resource.Kind, test.resource.Namespace, test.resource.Name, test.allowed)
+		}
+	}
+	// Pods in default were allowed as a whole, so only asked about once
+	pods := 0
+	for _, a := range reviews {
+		if a.Resource == "pods" && a.Namespace == "default" && a.Name == "" {
+			pods++
+		}
+	}
+	if pods != 2 {
+		t.Errorf("Expected pods in default to be reviewed once for each user, got %d", pods)
+	}
+
+	if reviewer.CanGetAll(context.Background(), alice, "") {
+		t.Error("Expected alice to not be able to get everything")
+	}
+}
+
+func TestTTLCacheBound(t *testing.T) {
+	defer func(n int) { maxCached = n }(maxCached)
+	maxCached = 8
+
+	c := newTTLCache[bool]()
+	for i := range 100 {
+		c.add(fmt.Sprint(i), true)
+		if len(c.items) > maxCached {
+			t.Fatalf("Expected at most %d cached reviews, got %d", maxCached, len(c.items))
+		}
+	}
+	if _, ok := c.get("99"); !ok {
+		t.Error("Expected the latest review to be cached")
+	}
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/hoyle1974/khronoscope/internal/resources"
+)
+
+// StaticTokens authenticates a fixed set of tokens, for testing without a cluster to review them
+type StaticTokens map[string]User
+
+func (s StaticTokens) Authenticate(ctx context.Context, token string) (User, error) {
+	if user, ok := s[token]; ok {
+		return user, nil
+	}
+	return User{}, ErrUnauthenticated
+}
+
+// ReadTokenFile reads tokens in the format of the API server's --token-auth-file, lines of
+//
+//	token,user,uid,"group1,group2"
+//
+// where the groups are optional
+func ReadTokenFile(filename string) (StaticTokens, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s: %w", filename, err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	tokens := StaticTokens{}
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s: %w", filename, err)
+		}
+		line, _ := reader.FieldPos(0)
+		if len(record) < 3 || record[0] == "" || record[1] == "" {
+			return nil, fmt.Errorf("%s:%d: expected token,user,uid and optionally groups", filename, line)
+		}
+		user := User{Name: record[1], UID: record[2]}
+		if len(record) > 3 && record[3] != "" {
+			user.Groups = strings.Split(record[3], ",")
+		}
+		tokens[record[0]] = user
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%s has no tokens", filename)
+	}
+	return tokens, nil
+}
+
+// AllowAll lets everyone see everything, for testing without a cluster to ask
+type AllowAll struct{}
+
+func (AllowAll) CanGet(ctx context.Context, user User, r resources.Resource) bool { return true }
+
+func (AllowAll) CanGetKind(ctx context.Context, user User, r resources.Resource) bool { return true }
+
+func (AllowAll) CanGetAll(ctx context.Context, user User, namespace string) bool { return true }
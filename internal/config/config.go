@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"reflect"
+	"time"
 
 	"github.com/gookit/config/v2"
 	"github.com/gookit/config/v2/yaml"
@@ -35,6 +36,7 @@ type Keys struct {
 	Debug            string `default:"ctrl+d" doc:"Debug log window"`
 	NextLabel        string `default:"shift+right" doc:"In VCR mode, jump to the next marked label"`
 	PrevLabel        string `default:"shift+left" doc:"In VCR mode, jump to the previous marked label"`
+	Manifests        string `default:"w" doc:"Write the resources shown at this timestamp out as manifests kubectl can apply"`
 }
 
 func (k Keys) Print() {
@@ -58,11 +60,41 @@ type Filter struct {
 	Collapse Collapse
 }
 
+// Retention controls how much history a recording keeps.  Data newer than FullFidelity is kept
+// as is, older data is downsampled to one value per resource per Resolution, and anything older
+// than MaxAge (if set) is dropped.
+type Retention struct {
+	Enabled      bool
+	Interval     time.Duration // How often to apply retention, defaults to a minute
+	FullFidelity time.Duration // Defaults to 6h
+	Resolution   time.Duration // Defaults to a minute
+	MaxAge       time.Duration // 0 keeps everything
+}
+
+// Keyframe tunes how often a kind of resource is stored whole instead of as a diff against its
+// previous value, see temporal.KeyframePolicy.  Kinds not configured get a keyframe every 16 values,
+// {MaxDiffs: 64, MaxDiffRatio: 1} is the adaptive policy.
+type Keyframe struct {
+	MaxDiffs     int     // Most diffs between keyframes
+	MaxDiffRatio float64 // Start a keyframe once the diffs outweigh the keyframe by this much, 0 disables
+}
+
+// Redaction controls what is scrubbed from resources before they are recorded, see redact.Rules
+type Redaction struct {
+	SecretData  bool     // Drop the data and stringData of Secrets, on unless turned off
+	HashEnv     bool     // Replace env var values with a hash of the value
+	Annotations []string // Mask annotations whose key matches one of these patterns, like "vault.hashicorp.com/*"
+}
+
 type Config struct {
 	Metrics     bool
 	Profiling   bool
 	KeyBindings Keys
 	Filter      Filter
+	Retention   Retention
+	Differ      string              // How resource history is diffed, "bsdiff" (the default) or "resource" (JSON patches)
+	Keyframes   map[string]Keyframe // Keyed by kind, "default" applies to kinds that aren't listed
+	Redaction   Redaction
 }
 
 var cfg = Config{}
@@ -72,13 +104,14 @@ func Get() Config {
 }
 
 func InitConfig() (Config, error) {
-	config.WithOptions(config.ParseEnv, config.ParseDefault)
+	config.WithOptions(config.ParseEnv, config.ParseDefault, config.ParseTime)
 	config.AddDriver(yaml.Driver)
 
 	temp := map[string]any{
 		"metrics":     "false",
 		"profiling":   "false",
 		"keybindings": map[string]string{},
+		"redaction":   map[string]any{"secretData": true},
 	}
 	err := config.LoadData(temp)
 	if err != nil {
@@ -99,5 +132,6 @@ func InitConfig() (Config, error) {
 	if err != nil {
 		return cfg, fmt.Errorf("error decoding config data (keybindings): %w", err)
 	}
+
 	return cfg, nil
 }
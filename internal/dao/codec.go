@@ -0,0 +1,101 @@
+package dao
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// A Codec compresses everything in a .khron file after the header.  The codec ID is written to the
+// header so a file loads with whatever codec it was saved with, the extension or --compression flag
+// only matter when saving.  To add a codec give it an unused ID and register it in init, IDs are
+// stored in files so they can never be reused.
+type Codec struct {
+	ID         byte
+	Name       string
+	Extensions []string // Saving to a file with one of these extensions selects the codec
+	NewWriter  func(w io.Writer) (io.WriteCloser, error)
+	NewReader  func(r io.Reader) (io.ReadCloser, error)
+}
+
+const (
+	CodecNone byte = 0
+	CodecGzip byte = 1
+)
+
+var codecs = map[byte]Codec{}
+
+// DefaultCodec is used when saving to a file whose extension doesn't select a codec
+var DefaultCodec = CodecNone
+
+func init() {
+	RegisterCodec(Codec{
+		ID:   CodecNone,
+		Name: "none",
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(r), nil
+		},
+	})
+	RegisterCodec(Codec{
+		ID:         CodecGzip,
+		Name:       "gzip",
+		Extensions: []string{".gz", ".khronz"},
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	})
+}
+
+// RegisterCodec makes a codec available for saving and loading
+func RegisterCodec(codec Codec) {
+	if _, ok := codecs[codec.ID]; ok {
+		panic(fmt.Sprintf("codec %d is already registered", codec.ID))
+	}
+	codecs[codec.ID] = codec
+}
+
+// CodecByName finds a registered codec, used for the --compression flag
+func CodecByName(name string) (Codec, error) {
+	for _, codec := range codecs {
+		if codec.Name == name {
+			return codec, nil
+		}
+	}
+	return Codec{}, fmt.Errorf("unknown compression %q, expected one of %s", name, strings.Join(CodecNames(), ", "))
+}
+
+// CodecNames lists the registered codecs
+func CodecNames() []string {
+	names := []string{}
+	for _, codec := range codecs {
+		names = append(names, codec.Name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// codecForFile picks the codec to save filename with
+func codecForFile(filename string) Codec {
+	ext := strings.ToLower(filepath.Ext(filename))
+	for _, codec := range codecs {
+		if slices.Contains(codec.Extensions, ext) {
+			return codec
+		}
+	}
+	return codecs[DefaultCodec]
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,283 @@
+package dao
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Recordings can be encrypted with a passphrase.  The codec byte is followed by
+//
+//	scheme  byte      encryptionNone or encryptionScrypt, nothing else follows encryptionNone
+//	salt    [16]byte
+//	logN    byte      scrypt cost parameters
+//	r       byte
+//	p       byte
+//	check   [32]byte  derived along with the key, tells a wrong passphrase apart from a damaged file
+//
+// and everything after it, the compressed sections, is split into chunks sealed with AES-256-GCM.
+// Each chunk is a big endian uint32 length, with the top bit set on the final chunk, followed by the
+// sealed bytes.  The nonce is the chunk's number with the last byte set on the final chunk, so chunks
+// can't be reordered or dropped and the file can't be truncated without it being noticed.  The flag
+// picks the one nonce a chunk is opened with, changing it makes the chunk fail authentication.  The salt is new for every file so a key, and
+// therefore a nonce, is never reused.  The header is authenticated as additional data on every chunk.
+
+const (
+	encryptionNone   byte = 0
+	encryptionScrypt byte = 1
+
+	encryptionSaltSize  = 16
+	encryptionKeySize   = 32
+	encryptionCheckSize = 32
+	encryptionChunkSize = 64 * 1024
+	encryptionLastChunk = 1 << 31 // Set in the length of the final chunk
+
+	scryptLogN = 15
+	scryptR    = 8
+	scryptP    = 1
+
+	// The cost parameters come from the file, so they're capped well before scrypt would need more
+	// than a few hundred megabytes or minutes to derive the key
+	scryptMaxLogN = 20
+	scryptMaxR    = 16
+	scryptMaxP    = 4
+)
+
+var (
+	// ErrPassphraseRequired is returned when loading an encrypted recording without a passphrase
+	ErrPassphraseRequired = errors.New("recording is encrypted, a passphrase is required")
+	// ErrWrongPassphrase is returned when loading an encrypted recording with the wrong passphrase
+	ErrWrongPassphrase = errors.New("wrong passphrase")
+)
+
+// WithPassphrase encrypts a recording when saving and decrypts it when loading, a passphrase given
+// for a recording that isn't encrypted is ignored
+func WithPassphrase(passphrase string) FileOption {
+	return func(o *fileOptions) {
+		o.passphrase = passphrase
+	}
+}
+
+// encryptionHeader holds the parameters the key was derived with
+type encryptionHeader struct {
+	salt    [encryptionSaltSize]byte
+	logN    byte
+	r, p    byte
+	check   [encryptionCheckSize]byte
+	codecID byte // Not written as part of the header but authenticated along with it
+}
+
+func (h *encryptionHeader) bytes() []byte {
+	b := []byte{encryptionScrypt}
+	b = append(b, h.salt[:]...)
+	b = append(b, h.logN, h.r, h.p)
+	return append(b, h.check[:]...)
+}
+
+// validate checks the cost parameters are ones this build would derive a key with
+func (h *encryptionHeader) validate() error {
+	if h.logN == 0 || h.logN > scryptMaxLogN || h.r == 0 || h.r > scryptMaxR || h.p == 0 || h.p > scryptMaxP {
+		return fmt.Errorf("bad scrypt cost parameters N=2^%d r=%d p=%d", h.logN, h.r, h.p)
+	}
+	return nil
+}
+
+// deriveKey returns the AES key and the check value for the passphrase
+func (h *encryptionHeader) deriveKey(passphrase string) ([]byte, []byte, error) {
+	if err := h.validate(); err != nil {
+		return nil, nil, err
+	}
+	derived, err := scrypt.Key([]byte(passphrase), h.salt[:], 1<<h.logN, int(h.r), int(h.p), encryptionKeySize+encryptionCheckSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	return derived[:encryptionKeySize], derived[encryptionKeySize:], nil
+}
+
+func (h *encryptionHeader) aead(key []byte) (cipher.AEAD, []byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, append([]byte{h.codecID}, h.bytes()...), nil
+}
+
+// writeEncryptionHeader writes the encryption scheme and returns w wrapped so everything written to
+// it is encrypted, the returned writer must be closed to write the final chunk
+func writeEncryptionHeader(w io.Writer, codecID byte, passphrase string) (io.WriteCloser, error) {
+	if passphrase == "" {
+		_, err := w.Write([]byte{encryptionNone})
+		return nopWriteCloser{w}, err
+	}
+
+	h := &encryptionHeader{logN: scryptLogN, r: scryptR, p: scryptP, codecID: codecID}
+	if _, err := rand.Read(h.salt[:]); err != nil {
+		return nil, err
+	}
+	key, check, err := h.deriveKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	copy(h.check[:], check)
+
+	aead, aad, err := h.aead(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(h.bytes()); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, aad: aad}, nil
+}
+
+// readEncryptionHeader reads the encryption scheme and returns r wrapped so it reads decrypted data
+func readEncryptionHeader(r *bufio.Reader, codecID byte, passphrase string) (io.Reader, error) {
+	scheme, err := r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption scheme: %w", err)
+	}
+	switch scheme {
+	case encryptionNone:
+		return r, nil
+	case encryptionScrypt:
+	default:
+		return nil, fmt.Errorf("file is encrypted with unknown scheme %d", scheme)
+	}
+
+	h := &encryptionHeader{codecID: codecID}
+	params := make([]byte, encryptionSaltSize+3+encryptionCheckSize)
+	if _, err := io.ReadFull(r, params); err != nil {
+		return nil, fmt.Errorf("failed to read encryption header: %w", err)
+	}
+	copy(h.salt[:], params)
+	h.logN, h.r, h.p = params[encryptionSaltSize], params[encryptionSaltSize+1], params[encryptionSaltSize+2]
+	copy(h.check[:], params[encryptionSaltSize+3:])
+	if err := h.validate(); err != nil {
+		return nil, err
+	}
+
+	if passphrase == "" {
+		return nil, ErrPassphraseRequired
+	}
+	key, check, err := h.deriveKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(check, h.check[:]) != 1 {
+		return nil, ErrWrongPassphrase
+	}
+
+	aead, aad, err := h.aead(key)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{r: r, aead: aead, aad: aad}, nil
+}
+
+func chunkNonce(size int, count uint64, last bool) []byte {
+	nonce := make([]byte, size)
+	binary.BigEndian.PutUint64(nonce[size-9:size-1], count)
+	if last {
+		nonce[size-1] = 1
+	}
+	return nonce
+}
+
+type encryptWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	aad   []byte
+	buf   []byte
+	count uint64
+}
+
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	ew.buf = append(ew.buf, p...)
+	// Hold back a full chunk since it might turn out to be the last
+	for len(ew.buf) > encryptionChunkSize {
+		if err := ew.seal(ew.buf[:encryptionChunkSize], false); err != nil {
+			return 0, err
+		}
+		ew.buf = ew.buf[encryptionChunkSize:]
+	}
+	return len(p), nil
+}
+
+func (ew *encryptWriter) Close() error {
+	err := ew.seal(ew.buf, true)
+	ew.buf = nil
+	return err
+}
+
+func (ew *encryptWriter) seal(chunk []byte, last bool) error {
+	sealed := ew.aead.Seal(nil, chunkNonce(ew.aead.NonceSize(), ew.count, last), chunk, ew.aad)
+	ew.count++
+	length := uint32(len(sealed))
+	if last {
+		length |= encryptionLastChunk
+	}
+	if err := binary.Write(ew.w, binary.BigEndian, length); err != nil {
+		return err
+	}
+	_, err := ew.w.Write(sealed)
+	return err
+}
+
+type decryptReader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	aad   []byte
+	buf   []byte
+	count uint64
+	done  bool
+}
+
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	for len(dr.buf) == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+		if err := dr.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, dr.buf)
+	dr.buf = dr.buf[n:]
+	return n, nil
+}
+
+func (dr *decryptReader) next() error {
+	var size uint32
+	if err := binary.Read(dr.r, binary.BigEndian, &size); err != nil {
+		return fmt.Errorf("encrypted data is truncated: %w", io.ErrUnexpectedEOF)
+	}
+	last := size&encryptionLastChunk != 0
+	size &^= encryptionLastChunk
+	if int(size) > encryptionChunkSize+dr.aead.Overhead() {
+		return fmt.Errorf("encrypted chunk %d is too large", dr.count)
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(dr.r, sealed); err != nil {
+		return fmt.Errorf("encrypted data is truncated: %w", io.ErrUnexpectedEOF)
+	}
+
+	chunk, err := dr.aead.Open(nil, chunkNonce(dr.aead.NonceSize(), dr.count, last), sealed, dr.aad)
+	if err != nil {
+		return fmt.Errorf("encrypted chunk %d failed authentication, the file is damaged", dr.count)
+	}
+	dr.buf, dr.done = chunk, last
+	dr.count++
+	return nil
+}
@@ -0,0 +1,178 @@
+package dao
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"iter"
+	"time"
+
+	"github.com/hoyle1974/khronoscope/internal/jsonpatch"
+	"github.com/hoyle1974/khronoscope/internal/misc"
+	"github.com/hoyle1974/khronoscope/internal/resources"
+	"github.com/hoyle1974/khronoscope/internal/temporal"
+)
+
+const (
+	EventAdd    = "add"
+	EventUpdate = "update"
+	EventDelete = "delete"
+	EventLabel  = "label"
+)
+
+// Event is a single change to a recording as it is exported, one JSON object per line
+type Event struct {
+	Timestamp time.Time       `json:"timestamp"`
+	Type      string          `json:"type"`
+	Kind      string          `json:"kind,omitempty"`
+	Namespace string          `json:"namespace,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	UID       string          `json:"uid,omitempty"`
+	Object    json.RawMessage `json:"object,omitempty"` // The whole object after the change
+	Patch     json.RawMessage `json:"patch,omitempty"`  // A JSON merge patch from the previous object, instead of Object
+	Label     string          `json:"label,omitempty"`
+}
+
+// ExportOptions control Export
+type ExportOptions struct {
+	SliceOptions      // Only export part of the recording
+	Patches      bool // Updates carry a merge patch instead of the whole object, when one can express the change
+}
+
+func (opts ExportOptions) sliced() bool {
+	s := opts.SliceOptions
+	return !s.From.IsZero() || !s.To.IsZero() || len(s.Kinds) > 0 || len(s.Namespaces) > 0 || s.Redact != nil
+}
+
+// Export writes every change in the recording to w in time order as JSON Lines, labels are
+// interleaved as events of their own
+func (d *dataModelImpl) Export(w io.Writer, opts ExportOptions) error {
+	source := d
+	if opts.sliced() {
+		slice, err := d.Slice(opts.SliceOptions)
+		if err != nil {
+			return err
+		}
+		source = slice.(*dataModelImpl)
+	}
+
+	writer := bufio.NewWriter(w)
+	enc := json.NewEncoder(writer)
+
+	labels := []Event{}
+	from, to := source.meta.GetTimeRange()
+	for timestamp, label := range source.meta.History(META_LABEL_KEY, from, to) {
+		labels = append(labels, Event{Timestamp: timestamp, Type: EventLabel, Label: string(label)})
+	}
+	writeLabels := func(until time.Time) error {
+		for len(labels) > 0 && !labels[0].Timestamp.After(until) {
+			if err := enc.Encode(labels[0]); err != nil {
+				return err
+			}
+			labels = labels[1:]
+		}
+		return nil
+	}
+
+	previous := map[string]resources.Resource{}
+	from, to = source.resources.GetTimeRange()
+	for change := range source.resources.Changes(from, to) {
+		if err := writeLabels(change.Timestamp); err != nil {
+			return err
+		}
+		event, ok, err := exportEvent(change, previous, opts.Patches)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := enc.Encode(event); err != nil {
+			return err
+		}
+	}
+	// Whatever labels come after the last change
+	for _, label := range labels {
+		if err := enc.Encode(label); err != nil {
+			return err
+		}
+	}
+
+	return writer.Flush()
+}
+
+// NewEvent describes a change of type to r, deletes don't carry the object
+func NewEvent(eventType string, timestamp time.Time, r resources.Resource) Event {
+	event := Event{
+		Timestamp: timestamp,
+		Type:      eventType,
+		Kind:      r.Kind,
+		Namespace: r.Namespace,
+		Name:      r.Name,
+		UID:       r.Uid,
+	}
+	if eventType != EventDelete && json.Valid([]byte(r.RawJSON)) {
+		event.Object = json.RawMessage(r.RawJSON)
+	}
+	return event
+}
+
+// Events yields the changes to resources between from and to, both inclusive, in time order.  A
+// resource that already existed before from starts with an update rather than an add.
+func (d *dataModelImpl) Events(from, to time.Time) iter.Seq2[Event, error] {
+	return func(yield func(Event, error) bool) {
+		previous := map[string]resources.Resource{}
+		seen := map[string]bool{}
+		before := from.Add(-time.Nanosecond)
+		for change := range d.resources.Changes(from, to) {
+			if !seen[change.Key] {
+				seen[change.Key] = true
+				if v := d.resources.GetItem(before, change.Key); len(v) > 0 {
+					var r resources.Resource
+					if err := misc.DecodeFromBytes(v, &r); err == nil {
+						previous[change.Key] = r
+					}
+				}
+			}
+			event, ok, err := exportEvent(change, previous, false)
+			if err != nil {
+				yield(Event{}, err)
+				return
+			}
+			if ok && !yield(event, nil) {
+				return
+			}
+		}
+	}
+}
+
+// exportEvent describes a change to a resource, previous holds the last value of each resource
+func exportEvent(change temporal.Change, previous map[string]resources.Resource, patches bool) (Event, bool, error) {
+	prev, existed := previous[change.Key]
+
+	if change.Value == nil {
+		if !existed {
+			return Event{}, false, nil
+		}
+		delete(previous, change.Key)
+		return NewEvent(EventDelete, change.Timestamp, prev), true, nil
+	}
+
+	var r resources.Resource
+	if err := misc.DecodeFromBytes(change.Value, &r); err != nil {
+		return Event{}, false, fmt.Errorf("unable to decode %s at %v: %w", change.Key, change.Timestamp, err)
+	}
+	previous[change.Key] = r
+
+	event := NewEvent(EventAdd, change.Timestamp, r)
+	if existed {
+		event.Type = EventUpdate
+		if patches && event.Object != nil && json.Valid([]byte(prev.RawJSON)) {
+			if patch, err := jsonpatch.CreateMergePatch([]byte(prev.RawJSON), []byte(r.RawJSON)); err == nil {
+				event.Object, event.Patch = nil, patch
+			}
+		}
+	}
+	return event, true, nil
+}
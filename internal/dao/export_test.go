@@ -0,0 +1,135 @@
+package dao_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/hoyle1974/khronoscope/internal/dao"
+	"github.com/hoyle1974/khronoscope/internal/resources"
+)
+
+func exportEvents(t *testing.T, store dao.KhronoStore, opts dao.ExportOptions) []dao.Event {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := store.Export(&buf, opts); err != nil {
+		t.Fatal(err)
+	}
+	events := []dao.Event{}
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var e dao.Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("Line %q isn't JSON: %v", scanner.Text(), err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestExport(t *testing.T) {
+	start := time.Now()
+	at := func(seconds int) time.Time {
+		return start.Add(time.Duration(seconds) * time.Second)
+	}
+	pod := func(seconds int, json string) resources.Resource {
+		r := resources.NewResource("uid-pod", at(seconds), "Pod", "default", "web")
+		r.RawJSON = json
+		return r
+	}
+
+	store := dao.New()
+	store.SetLabel(at(0), "start")
+	store.AddResource(pod(1, `{"kind":"Pod","status":{"phase":"Pending"}}`))
+	store.AddResource(resources.NewResource("uid-node", at(2), "Node", "", "node-1"))
+	store.UpdateResource(pod(3, `{"kind":"Pod","status":{"phase":"Running"}}`))
+	store.SetLabel(at(4), "incident")
+	store.DeleteResource(pod(5, ""))
+	store.SetLabel(at(10), "end")
+
+	events := exportEvents(t, store, dao.ExportOptions{})
+	expected := []struct {
+		seconds int
+		kind    string
+		name    string
+	}{
+		{0, dao.EventLabel, "start"},
+		{1, dao.EventAdd, "web"},
+		{2, dao.EventAdd, "node-1"},
+		{3, dao.EventUpdate, "web"},
+		{4, dao.EventLabel, "incident"},
+		{5, dao.EventDelete, "web"},
+		{10, dao.EventLabel, "end"},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d events, got %+v", len(expected), events)
+	}
+	for i, e := range expected {
+		got := events[i]
+		name := got.Name
+		if got.Type == dao.EventLabel {
+			name = got.Label
+		}
+		if !got.Timestamp.Equal(at(e.seconds)) || got.Type != e.kind || name != e.name {
+			t.Fatalf("Event %d: expected %v, got %+v", i, e, got)
+		}
+	}
+	if string(events[3].Object) != `{"kind":"Pod","status":{"phase":"Running"}}` || events[3].Patch != nil {
+		t.Fatalf("Expected the whole object, got %+v", events[3])
+	}
+	if events[5].UID != "uid-pod" || events[5].Kind != "Pod" || events[5].Object != nil {
+		t.Fatalf("Expected the delete to describe the pod, got %+v", events[5])
+	}
+
+	// Patches instead of whole objects
+	events = exportEvents(t, store, dao.ExportOptions{Patches: true})
+	if string(events[3].Patch) != `{"status":{"phase":"Running"}}` || events[3].Object != nil {
+		t.Fatalf("Expected a patch, got %+v", events[3])
+	}
+	if events[1].Object == nil {
+		t.Fatalf("Expected adds to carry the whole object")
+	}
+
+	// Filtered through a slice, which ends with the last resource change
+	events = exportEvents(t, store, dao.ExportOptions{SliceOptions: dao.SliceOptions{From: at(2), Kinds: []string{"Pod"}}})
+	if len(events) != 5 || events[1].Type != dao.EventAdd || !events[1].Timestamp.Equal(at(2)) || events[1].Name != "web" {
+		t.Fatalf("Expected the slice to start with the pod as it was, got %+v", events)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	start := time.Now()
+	at := func(seconds int) time.Time {
+		return start.Add(time.Duration(seconds) * time.Second)
+	}
+	store := dao.New()
+	store.AddResource(resources.NewResource("uid-a", at(1), "Pod", "default", "a"))
+	store.UpdateResource(resources.NewResource("uid-a", at(3), "Pod", "default", "a"))
+	store.AddResource(resources.NewResource("uid-b", at(4), "Pod", "default", "b"))
+	store.DeleteResource(resources.NewResource("uid-a", at(5), "Pod", "default", "a"))
+
+	expected := []struct {
+		eventType string
+		uid       string
+	}{
+		{dao.EventUpdate, "uid-a"}, // It already existed at 2
+		{dao.EventAdd, "uid-b"},
+		{dao.EventDelete, "uid-a"},
+	}
+	i := 0
+	for e, err := range store.Events(at(2), at(10)) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i >= len(expected) || e.Type != expected[i].eventType || e.UID != expected[i].uid {
+			t.Fatalf("Unexpected event %d %+v", i, e)
+		}
+		i++
+	}
+	if i != len(expected) {
+		t.Errorf("Expected %d events, got %d", len(expected), i)
+	}
+}
@@ -0,0 +1,553 @@
+package dao
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"runtime/debug"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/hoyle1974/khronoscope/internal/config"
+	"github.com/hoyle1974/khronoscope/internal/conn"
+	"github.com/hoyle1974/khronoscope/internal/redact"
+	"github.com/hoyle1974/khronoscope/internal/temporal"
+)
+
+// A .khron file looks like this:
+//
+//	magic   [8]byte  "KHRONOS\x00"
+//	version uint16
+//	codec   byte
+//	encryption...    (see encryption.go)
+//	sections...      (compressed by the codec, then encrypted)
+//
+// Each section is a one byte type followed by the payload split into length prefixed chunks, a zero
+// length chunk marks the end of the payload and is followed by a CRC32 and SHA256 of the payload.
+// Chunking lets sections be written as a stream without knowing their size up front.  A section of
+// type sectionEnd terminates the file.  Unknown section types are skipped so newer files with extra
+// sections can still be read by older builds as long as the version matches.
+//
+// The resources and labels sections hold the temporal maps in the temporal stream format, so they
+// can be written and read one key at a time without a second copy of the store in memory.
+//
+// A checkpoint of a journaled store also has a journal section, the big endian uint64 sequence of
+// the last journal entry the checkpoint holds.
+//
+// Files written before the format existed (version 0) are just two length prefixed gob blobs, those
+// are still loaded by readLegacy.
+
+const (
+	FormatVersion = 1
+
+	sectionEnd       byte = 0
+	sectionMetadata  byte = 1
+	sectionResources byte = 2
+	sectionMeta      byte = 3
+	sectionJournal   byte = 4
+
+	sectionChunkSize = 64 * 1024
+)
+
+var fileMagic = []byte("KHRONOS\x00")
+
+// ErrTooLarge is returned when a recording holds more than WithMaxSize allows
+var ErrTooLarge = errors.New("recording is too large")
+
+// FileOption customizes how a recording is saved or loaded
+type FileOption func(*fileOptions)
+
+type fileOptions struct {
+	passphrase string
+	maxSize    int64
+	resources  temporal.Map
+	journalSeq uint64
+}
+
+func newFileOptions(opts []FileOption) fileOptions {
+	var o fileOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithMaxSize stops loading a recording with ErrTooLarge once more than size bytes of it have been
+// decompressed, so a small compressed file can't expand without bound
+func WithMaxSize(size int64) FileOption {
+	return func(o *fileOptions) {
+		o.maxSize = size
+	}
+}
+
+// LoadInto loads the resources of a recording into m, like a map created with
+// temporal.NewSegmentMap, rather than into memory
+func LoadInto(m temporal.Map) FileOption {
+	return func(o *fileOptions) {
+		o.resources = m
+	}
+}
+
+// withJournalSequence records that the file holds every journal entry up to seq
+func withJournalSequence(seq uint64) FileOption {
+	return func(o *fileOptions) {
+		o.journalSeq = seq
+	}
+}
+
+// Metadata describes a recording
+type Metadata struct {
+	ClusterContext string        `json:"clusterContext,omitempty"`
+	ServerVersion  string        `json:"serverVersion,omitempty"`
+	Kinds          []string      `json:"kinds,omitempty"`
+	StartTime      time.Time     `json:"startTime"`
+	EndTime        time.Time     `json:"endTime"`
+	ToolVersion    string        `json:"toolVersion,omitempty"`
+	FormatVersion  int           `json:"formatVersion"`       // The version of the file this was loaded from, 0 for legacy files
+	Redaction      *redact.Rules `json:"redaction,omitempty"` // What was scrubbed from the resources, nil if unknown
+}
+
+// ToolVersion returns the version of khronoscope that is running
+func ToolVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "unknown"
+}
+
+// ClusterMetadata describes the cluster a connection is recording
+func ClusterMetadata(client conn.KhronosConn) Metadata {
+	rules := redact.FromConfig(config.Get().Redaction)
+	meta := Metadata{
+		ClusterContext: client.CurrentUser,
+		ToolVersion:    ToolVersion(),
+		Redaction:      &rules,
+	}
+	if info, err := client.DiscoveryClient.ServerVersion(); err == nil {
+		meta.ServerVersion = info.GitVersion
+	} else {
+		log.Warn().Err(err).Msg("unable to get server version")
+	}
+	return meta
+}
+
+// loaders knows how to read each format version that has ever been written.  When the format
+// changes add a new loader and bump FormatVersion, older files keep loading through their loader.
+var loaders = map[uint16]func(r *bufio.Reader, d *dataModelImpl, o fileOptions) error{
+	0: readLegacy,
+	1: readSections,
+}
+
+// Write encodes the whole store to w in the current format, compressed with codec
+func (d *dataModelImpl) Write(w io.Writer, codec Codec, opts ...FileOption) error {
+	o := newFileOptions(opts)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	meta := d.metadataLocked()
+	meta.FormatVersion = FormatVersion
+
+	writer := bufio.NewWriter(w)
+	if _, err := writer.Write(fileMagic); err != nil {
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+	if err := binary.Write(writer, binary.BigEndian, uint16(FormatVersion)); err != nil {
+		return fmt.Errorf("failed to write version: %w", err)
+	}
+	if err := writer.WriteByte(codec.ID); err != nil {
+		return fmt.Errorf("failed to write codec: %w", err)
+	}
+	encrypted, err := writeEncryptionHeader(writer, codec.ID, o.passphrase)
+	if err != nil {
+		return fmt.Errorf("failed to start encryption: %w", err)
+	}
+
+	compressed, err := codec.NewWriter(encrypted)
+	if err != nil {
+		return fmt.Errorf("failed to start %s compression: %w", codec.Name, err)
+	}
+	body := bufio.NewWriter(compressed)
+
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+
+	type section struct {
+		kind   byte
+		name   string
+		encode func(io.Writer) error
+	}
+	sections := []section{
+		{sectionMetadata, "metadata", func(w io.Writer) error {
+			_, err := w.Write(metaBytes)
+			return err
+		}},
+		{sectionResources, "resources", d.resources.Encode},
+		{sectionMeta, "labels", d.meta.Encode},
+	}
+	if o.journalSeq > 0 {
+		sections = append(sections, section{sectionJournal, "journal", func(w io.Writer) error {
+			return binary.Write(w, binary.BigEndian, o.journalSeq)
+		}})
+	}
+	for _, s := range sections {
+		sw := newSectionWriter(body, s.kind)
+		if err := s.encode(sw); err != nil {
+			return fmt.Errorf("failed to write %s section: %w", s.name, err)
+		}
+		if err := sw.Close(); err != nil {
+			return fmt.Errorf("failed to write %s section: %w", s.name, err)
+		}
+	}
+
+	if err := body.WriteByte(sectionEnd); err != nil {
+		return fmt.Errorf("failed to write end of file: %w", err)
+	}
+	if err := body.Flush(); err != nil {
+		return err
+	}
+	if err := compressed.Close(); err != nil {
+		return fmt.Errorf("failed to finish %s compression: %w", codec.Name, err)
+	}
+	if err := encrypted.Close(); err != nil {
+		return fmt.Errorf("failed to finish encryption: %w", err)
+	}
+
+	return writer.Flush()
+}
+
+// Read decodes a store previously written with Write, or by an older build of khronoscope
+func Read(r io.Reader, opts ...FileOption) (KhronoStore, error) {
+	o := newFileOptions(opts)
+	d := New().(*dataModelImpl)
+
+	reader := bufio.NewReader(r)
+	version := uint16(0)
+
+	head, err := reader.Peek(len(fileMagic))
+	if err != nil {
+		return nil, fmt.Errorf("file is too short to be a recording: %w", err)
+	}
+	if bytes.Equal(head, fileMagic) {
+		if _, err := reader.Discard(len(fileMagic)); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(reader, binary.BigEndian, &version); err != nil {
+			return nil, fmt.Errorf("failed to read format version: %w", err)
+		}
+	}
+
+	loader, ok := loaders[version]
+	if !ok {
+		return nil, fmt.Errorf("unsupported file format version %d, this build supports up to %d", version, FormatVersion)
+	}
+
+	if version > 0 {
+		id, err := reader.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read codec: %w", err)
+		}
+		codec, ok := codecs[id]
+		if !ok {
+			return nil, fmt.Errorf("file is compressed with unknown codec %d", id)
+		}
+		source, err := readEncryptionHeader(reader, id, o.passphrase)
+		if err != nil {
+			return nil, err
+		}
+		decompressed, err := codec.NewReader(source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start %s decompression: %w", codec.Name, err)
+		}
+		defer func() {
+			_ = decompressed.Close()
+		}()
+		reader = bufio.NewReader(decompressed)
+	}
+	if o.maxSize > 0 {
+		reader = bufio.NewReader(&sizeLimiter{r: reader, remaining: o.maxSize})
+	}
+
+	if err := loader(reader, d, o); err != nil {
+		return nil, err
+	}
+	d.metadata.FormatVersion = int(version)
+	for _, k := range d.metadata.Kinds {
+		d.kinds[k] = true
+	}
+	d.index = buildIndex(d.resources)
+
+	return d, nil
+}
+
+// sizeLimiter fails with ErrTooLarge once more than remaining bytes have been read through it
+type sizeLimiter struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (s *sizeLimiter) Read(p []byte) (int, error) {
+	if s.remaining <= 0 {
+		return 0, ErrTooLarge
+	}
+	if int64(len(p)) > s.remaining {
+		p = p[:s.remaining]
+	}
+	n, err := s.r.Read(p)
+	s.remaining -= int64(n)
+	return n, err
+}
+
+// readSections reads the sections of a file, which follow the header
+func readSections(r *bufio.Reader, d *dataModelImpl, o fileOptions) error {
+	seen := map[byte]bool{}
+	for {
+		kind, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("file is truncated, missing end of file marker: %w", err)
+		}
+		if kind == sectionEnd {
+			break
+		}
+
+		sr := newSectionReader(r)
+		switch kind {
+		case sectionMetadata:
+			err = json.NewDecoder(sr).Decode(&d.metadata)
+		case sectionResources:
+			if o.resources == nil {
+				d.resources, err = temporal.DecodeStream(sr, resourceMapOptions()...)
+			} else {
+				d.resources, err = o.resources, temporal.DecodeStreamInto(sr, o.resources)
+			}
+		case sectionMeta:
+			d.meta, err = temporal.DecodeStream(sr)
+		case sectionJournal:
+			err = binary.Read(sr, binary.BigEndian, &d.journalSeq)
+		}
+		// Read whatever is left, including all of an unknown section, so the checksums get verified.
+		// A corrupt section usually fails to decode too, the checksum error is the more useful one.
+		if _, cerr := io.Copy(io.Discard, sr); cerr != nil {
+			return fmt.Errorf("%s: %w", sectionName(kind), cerr)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to decode %s: %w", sectionName(kind), err)
+		}
+		seen[kind] = true
+	}
+
+	if !seen[sectionResources] {
+		return errors.New("file has no resources section")
+	}
+	return nil
+}
+
+// copyInto writes every value in decoded to m and returns m, for legacy files that can't be streamed
+func copyInto(m temporal.Map, decoded temporal.Map) temporal.Map {
+	from, to := decoded.GetTimeRange()
+	for change := range decoded.Changes(from, to) {
+		if change.Value == nil {
+			m.Remove(change.Timestamp, change.Key)
+		} else {
+			m.Add(change.Timestamp, change.Key, change.Value)
+		}
+	}
+	return m
+}
+
+func sectionName(kind byte) string {
+	switch kind {
+	case sectionMetadata:
+		return "metadata"
+	case sectionResources:
+		return "resources"
+	case sectionMeta:
+		return "labels"
+	case sectionJournal:
+		return "journal"
+	}
+	return fmt.Sprintf("section %d", kind)
+}
+
+// readLegacy reads files written before the format had a header
+func readLegacy(r *bufio.Reader, d *dataModelImpl, o fileOptions) error {
+	readBlob := func(name string) ([]byte, error) {
+		var length uint32
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return nil, fmt.Errorf("failed to read %s length: %w", name, err)
+		}
+		if o.maxSize > 0 && int64(length) > o.maxSize {
+			return nil, fmt.Errorf("%s is %d bytes: %w", name, length, ErrTooLarge)
+		}
+		// The length can't be trusted, so the blob only grows as far as there's data to fill it
+		data, err := io.ReadAll(io.LimitReader(r, int64(length)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		if len(data) < int(length) {
+			return nil, fmt.Errorf("failed to read %s: %w", name, io.ErrUnexpectedEOF)
+		}
+		return data, nil
+	}
+
+	resourceData, err := readBlob("resources")
+	if err != nil {
+		return err
+	}
+	metaData, err := readBlob("labels")
+	if err != nil {
+		return err
+	}
+
+	if d.resources, err = temporal.Decode(resourceData, resourceMapOptions()...); err != nil {
+		return fmt.Errorf("failed to decode resources: %w", err)
+	}
+	if o.resources != nil {
+		d.resources = copyInto(o.resources, d.resources)
+	}
+	if d.meta, err = temporal.Decode(metaData); err != nil {
+		return fmt.Errorf("failed to decode labels: %w", err)
+	}
+
+	d.metadata.StartTime, d.metadata.EndTime = d.resources.GetTimeRange()
+	return nil
+}
+
+// sectionWriter chunks a section payload and appends its checksums when closed
+type sectionWriter struct {
+	w   io.Writer
+	buf []byte
+	crc hash.Hash32
+	sha hash.Hash
+	err error
+}
+
+func newSectionWriter(w *bufio.Writer, kind byte) *sectionWriter {
+	sw := &sectionWriter{w: w, crc: crc32.NewIEEE(), sha: sha256.New()}
+	sw.err = w.WriteByte(kind)
+	return sw
+}
+
+func (sw *sectionWriter) Write(p []byte) (int, error) {
+	if sw.err != nil {
+		return 0, sw.err
+	}
+	sw.crc.Write(p)
+	sw.sha.Write(p)
+
+	n := len(p)
+	for len(p) > 0 {
+		take := min(sectionChunkSize-len(sw.buf), len(p))
+		sw.buf = append(sw.buf, p[:take]...)
+		p = p[take:]
+		if len(sw.buf) == sectionChunkSize {
+			if sw.err = sw.flush(); sw.err != nil {
+				return 0, sw.err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (sw *sectionWriter) flush() error {
+	if len(sw.buf) == 0 {
+		return nil
+	}
+	if err := binary.Write(sw.w, binary.BigEndian, uint32(len(sw.buf))); err != nil {
+		return err
+	}
+	if _, err := sw.w.Write(sw.buf); err != nil {
+		return err
+	}
+	sw.buf = sw.buf[:0]
+	return nil
+}
+
+// Close writes any buffered data, the end of section marker and the checksums
+func (sw *sectionWriter) Close() error {
+	if sw.err != nil {
+		return sw.err
+	}
+	if err := sw.flush(); err != nil {
+		return err
+	}
+	if err := binary.Write(sw.w, binary.BigEndian, uint32(0)); err != nil {
+		return err
+	}
+	if err := binary.Write(sw.w, binary.BigEndian, sw.crc.Sum32()); err != nil {
+		return err
+	}
+	_, err := sw.w.Write(sw.sha.Sum(nil))
+	return err
+}
+
+// sectionReader reads a chunked section payload, verifying its checksums once the end is reached
+type sectionReader struct {
+	r         io.Reader
+	remaining uint32
+	crc       hash.Hash32
+	sha       hash.Hash
+	done      bool
+	err       error // io.EOF, or why the checksums didn't match
+}
+
+func newSectionReader(r io.Reader) *sectionReader {
+	return &sectionReader{r: r, crc: crc32.NewIEEE(), sha: sha256.New()}
+}
+
+func (sr *sectionReader) Read(p []byte) (int, error) {
+	if sr.done {
+		return 0, sr.err
+	}
+
+	if sr.remaining == 0 {
+		if err := binary.Read(sr.r, binary.BigEndian, &sr.remaining); err != nil {
+			return 0, fmt.Errorf("truncated section: %w", err)
+		}
+		if sr.remaining == 0 {
+			sr.done = true
+			sr.err = sr.verify()
+			return 0, sr.err
+		}
+	}
+
+	if uint32(len(p)) > sr.remaining {
+		p = p[:sr.remaining]
+	}
+	n, err := sr.r.Read(p)
+	sr.remaining -= uint32(n)
+	sr.crc.Write(p[:n])
+	sr.sha.Write(p[:n])
+	if errors.Is(err, io.EOF) {
+		err = fmt.Errorf("truncated section: %w", io.ErrUnexpectedEOF)
+	}
+	return n, err
+}
+
+func (sr *sectionReader) verify() error {
+	var crc uint32
+	if err := binary.Read(sr.r, binary.BigEndian, &crc); err != nil {
+		return fmt.Errorf("missing section checksum: %w", err)
+	}
+	sum := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(sr.r, sum); err != nil {
+		return fmt.Errorf("missing section checksum: %w", err)
+	}
+	if crc != sr.crc.Sum32() {
+		return fmt.Errorf("section CRC32 mismatch, file is corrupt")
+	}
+	if !bytes.Equal(sum, sr.sha.Sum(nil)) {
+		return fmt.Errorf("section SHA256 mismatch, file is corrupt")
+	}
+	return io.EOF
+}
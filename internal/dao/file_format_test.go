@@ -0,0 +1,333 @@
+package dao_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hoyle1974/khronoscope/internal/dao"
+	"github.com/hoyle1974/khronoscope/internal/misc"
+	"github.com/hoyle1974/khronoscope/internal/resources"
+	"github.com/hoyle1974/khronoscope/internal/temporal"
+)
+
+func newTestStore(t *testing.T) (dao.KhronoStore, []resources.Resource) {
+	gob.Register(resources.Resource{})
+	gob.Register(resources.PodExtra{})
+
+	store := dao.New()
+	r := rand.New(rand.NewPCG(0, 2))
+	data := []resources.Resource{}
+	for i := 0; i < 10; i++ {
+		resource := randomResource(r)
+		resource.Timestamp.Time = resource.Timestamp.Time.Add(time.Duration(i) * time.Second)
+		store.AddResource(resource)
+		data = append(data, resource)
+	}
+	store.SetLabel(data[3].GetTimestamp(), "label")
+	store.SetMetadata(dao.Metadata{ClusterContext: "kind-test", ServerVersion: "v1.32.0"})
+
+	return store, data
+}
+
+func TestFileRoundTrip(t *testing.T) {
+	store, data := newTestStore(t)
+	filename := filepath.Join(t.TempDir(), "session.khron")
+	if err := store.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := dao.NewFromFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta := loaded.GetMetadata()
+	if meta.ClusterContext != "kind-test" || meta.ServerVersion != "v1.32.0" || meta.FormatVersion != dao.FormatVersion {
+		t.Fatalf("Unexpected metadata: %+v", meta)
+	}
+	if len(meta.Kinds) != 1 || meta.Kinds[0] != "Pod" {
+		t.Fatalf("Unexpected kinds: %v", meta.Kinds)
+	}
+	if !meta.StartTime.Equal(data[0].GetTimestamp()) || !meta.EndTime.Equal(data[len(data)-1].GetTimestamp()) {
+		t.Fatalf("Unexpected time range: %v - %v", meta.StartTime, meta.EndTime)
+	}
+	if loaded.GetLabel(data[5].GetTimestamp()) != "label" {
+		t.Fatalf("Expected label to be loaded")
+	}
+	if r, err := loaded.GetResourceAt(data[4].GetTimestamp(), data[4].Uid); err != nil || r.Name != data[4].Name {
+		t.Fatalf("Expected resource to be loaded: %v", err)
+	}
+}
+
+func TestFileLegacy(t *testing.T) {
+	gob.Register(resources.Resource{})
+
+	resource := resources.NewResource("uid", time.Now(), "ConfigMap", "default", "config")
+	b, err := misc.EncodeToBytes(resource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resourceMap := temporal.New()
+	resourceMap.Add(resource.GetTimestamp(), resource.Key(), b)
+	metaMap := temporal.New()
+	metaMap.Add(resource.GetTimestamp(), dao.META_LABEL_KEY, []byte("legacy"))
+
+	// The format used before files had a header
+	var buf bytes.Buffer
+	for _, blob := range [][]byte{resourceMap.ToBytes(), metaMap.ToBytes()} {
+		if err := binary.Write(&buf, binary.BigEndian, uint32(len(blob))); err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(blob)
+	}
+
+	loaded, err := dao.Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.GetMetadata().FormatVersion != 0 {
+		t.Fatalf("Expected a legacy format version")
+	}
+	if loaded.GetLabel(resource.GetTimestamp()) != "legacy" {
+		t.Fatalf("Expected the legacy label")
+	}
+	if r, err := loaded.GetResourceAt(resource.GetTimestamp(), "uid"); err != nil || r.Name != "config" {
+		t.Fatalf("Expected the legacy resource: %v", err)
+	}
+
+	// A length claiming far more than the file holds doesn't allocate it up front
+	huge := binary.BigEndian.AppendUint32(nil, 0xfffffff0)
+	huge = append(huge, "not much here"...)
+	if _, err := dao.Read(bytes.NewReader(huge)); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Expected a truncated blob, got %v", err)
+	}
+	if _, err := dao.Read(bytes.NewReader(huge), dao.WithMaxSize(1024)); !errors.Is(err, dao.ErrTooLarge) {
+		t.Fatalf("Expected ErrTooLarge, got %v", err)
+	}
+}
+
+func TestFileCompressed(t *testing.T) {
+	store, data := newTestStore(t)
+	dir := t.TempDir()
+
+	plain := filepath.Join(dir, "session.khron")
+	if err := store.Save(plain); err != nil {
+		t.Fatal(err)
+	}
+	compressed := filepath.Join(dir, "session.khron.gz")
+	if err := store.Save(compressed); err != nil {
+		t.Fatal(err)
+	}
+
+	plainBytes, err := os.ReadFile(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressedBytes, err := os.ReadFile(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plainBytes[10] != dao.CodecNone || compressedBytes[10] != dao.CodecGzip {
+		t.Fatalf("Expected the codec to be recorded in the header")
+	}
+	if len(compressedBytes) >= len(plainBytes) {
+		t.Fatalf("Expected compression to shrink the file: %d >= %d", len(compressedBytes), len(plainBytes))
+	}
+
+	// The codec comes from the header, not the file name
+	renamed := filepath.Join(dir, "renamed.khron")
+	if err := os.Rename(compressed, renamed); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := dao.NewFromFile(renamed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, resource := range data {
+		if r, err := loaded.GetResourceAt(resource.GetTimestamp(), resource.Uid); err != nil || r.Name != resource.Name {
+			t.Fatalf("Expected resource to be loaded: %v", err)
+		}
+	}
+	if loaded.GetLabel(data[5].GetTimestamp()) != "label" {
+		t.Fatalf("Expected label to be loaded")
+	}
+
+	if _, err := dao.CodecByName("gzip"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dao.CodecByName("lzma"); err == nil {
+		t.Fatalf("Expected an error for an unknown codec")
+	}
+}
+
+func TestFileEncrypted(t *testing.T) {
+	store, data := newTestStore(t)
+	// Enough data for several encrypted chunks
+	for i := range 200 {
+		r := resources.NewResource("big", time.Now().Add(time.Duration(i)*time.Second), "ConfigMap", "default", "big")
+		r.RawJSON = strings.Repeat(string(rune('a'+i%26)), 4096)
+		store.UpdateResource(r)
+	}
+	dir := t.TempDir()
+
+	for _, name := range []string{"session.khron", "session.khron.gz"} {
+		filename := filepath.Join(dir, name)
+		if err := store.Save(filename, dao.WithPassphrase("correct horse")); err != nil {
+			t.Fatal(err)
+		}
+		raw, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(raw, []byte(data[0].Name)) || bytes.Contains(raw, []byte("kind-test")) {
+			t.Fatalf("Expected %s to be encrypted", name)
+		}
+
+		loaded, err := dao.NewFromFile(filename, dao.WithPassphrase("correct horse"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, resource := range data {
+			if r, err := loaded.GetResourceAt(resource.GetTimestamp(), resource.Uid); err != nil || r.Name != resource.Name {
+				t.Fatalf("Expected resource to be loaded: %v", err)
+			}
+		}
+		if loaded.GetMetadata().ClusterContext != "kind-test" || loaded.GetLabel(data[5].GetTimestamp()) != "label" {
+			t.Fatalf("Expected metadata and labels to be loaded")
+		}
+
+		if _, err := dao.NewFromFile(filename); !errors.Is(err, dao.ErrPassphraseRequired) {
+			t.Fatalf("Expected ErrPassphraseRequired, got %v", err)
+		}
+		if _, err := dao.NewFromFile(filename, dao.WithPassphrase("wrong horse")); !errors.Is(err, dao.ErrWrongPassphrase) {
+			t.Fatalf("Expected ErrWrongPassphrase, got %v", err)
+		}
+
+		// Damage is caught by authentication, before anything is decompressed
+		corrupt := bytes.Clone(raw)
+		corrupt[len(corrupt)/2] ^= 0xff
+		if _, err := dao.Read(bytes.NewReader(corrupt), dao.WithPassphrase("correct horse")); err == nil || !strings.Contains(err.Error(), "failed authentication") {
+			t.Fatalf("Expected an authentication error, got %v", err)
+		}
+		// Cutting the file at a chunk boundary is caught by the final chunk being missing
+		if _, err := dao.Read(bytes.NewReader(raw[:len(raw)-20]), dao.WithPassphrase("correct horse")); err == nil {
+			t.Fatalf("Expected an error for a truncated file")
+		}
+		// So is changing which chunk is marked as the final one
+		const firstChunk = 8 + 2 + 1 + 1 + 16 + 3 + 32 // magic, version, codec, scheme, salt, cost and check
+		cut := bytes.Clone(raw)
+		cut[firstChunk] ^= 0x80
+		if _, err := dao.Read(bytes.NewReader(cut), dao.WithPassphrase("correct horse")); err == nil || !strings.Contains(err.Error(), "failed authentication") {
+			t.Fatalf("Expected an authentication error, got %v", err)
+		}
+	}
+
+	// Cost parameters are checked before any work is done deriving a key
+	var encrypted bytes.Buffer
+	codec, _ := dao.CodecByName("none")
+	if err := store.Write(&encrypted, codec, dao.WithPassphrase("correct horse")); err != nil {
+		t.Fatal(err)
+	}
+	const logN = 8 + 2 + 1 + 1 + 16 // magic, version, codec, scheme and salt
+	for _, params := range [][3]byte{{30, 255, 1}, {20, 255, 1}, {20, 8, 255}, {0, 8, 1}, {15, 0, 1}} {
+		hostile := bytes.Clone(encrypted.Bytes())
+		copy(hostile[logN:], params[:])
+		if _, err := dao.Read(bytes.NewReader(hostile), dao.WithPassphrase("correct horse")); err == nil || !strings.Contains(err.Error(), "bad scrypt cost") {
+			t.Fatalf("Expected %v to be rejected, got %v", params, err)
+		}
+	}
+
+	// A passphrase for a file that isn't encrypted is ignored
+	plain := filepath.Join(dir, "plain.khron")
+	if err := store.Save(plain); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dao.NewFromFile(plain, dao.WithPassphrase("correct horse")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileErrors(t *testing.T) {
+	store, _ := newTestStore(t)
+	filename := filepath.Join(t.TempDir(), "session.khron")
+	if err := store.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+	good, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	corrupt := bytes.Clone(good)
+	corrupt[len(corrupt)/2] ^= 0xff
+
+	future := bytes.Clone(good)
+	future[9] = 99
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected string
+	}{
+		{"Empty", []byte{}, "too short"},
+		{"Truncated", good[:len(good)/2], "truncated"},
+		{"Corrupt", corrupt, "mismatch"},
+		{"Future", future, "unsupported file format version"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := dao.Read(bytes.NewReader(tt.data))
+			if err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Fatalf("Expected an error containing %q, got %v", tt.expected, err)
+			}
+		})
+	}
+
+	if _, err := dao.NewFromFile(filepath.Join(t.TempDir(), "missing.khron")); err == nil {
+		t.Fatalf("Expected an error for a missing file")
+	}
+}
+
+func TestFileLoadInto(t *testing.T) {
+	store, data := newTestStore(t)
+	var file bytes.Buffer
+	codec, _ := dao.CodecByName("gzip")
+	if err := store.Write(&file, codec); err != nil {
+		t.Fatal(err)
+	}
+
+	// The limit is on what the file decompresses to
+	if _, err := dao.Read(bytes.NewReader(file.Bytes()), dao.WithMaxSize(int64(file.Len()))); !errors.Is(err, dao.ErrTooLarge) {
+		t.Fatalf("Expected the recording to be too large, got %v", err)
+	}
+
+	m, err := temporal.NewSegmentMap(t.TempDir(), temporal.SegmentOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := dao.Read(bytes.NewReader(file.Bytes()), dao.LoadInto(m), dao.WithMaxSize(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = loaded.Close()
+	}()
+	for _, resource := range data {
+		if r, err := loaded.GetResourceAt(resource.GetTimestamp(), resource.Uid); err != nil || r.Name != resource.Name {
+			t.Fatalf("Expected resource to be loaded: %v", err)
+		}
+	}
+	if m.StoredBytes() == 0 {
+		t.Fatal("Expected the resources to be in the segment map")
+	}
+}
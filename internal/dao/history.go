@@ -0,0 +1,64 @@
+package dao
+
+import (
+	"math"
+	"time"
+
+	"github.com/hoyle1974/khronoscope/internal/misc"
+	"github.com/hoyle1974/khronoscope/internal/resources"
+)
+
+// Label marks a moment in a recording
+type Label struct {
+	Timestamp time.Time `json:"timestamp"`
+	Label     string    `json:"label"`
+}
+
+// Revision is a change to a resource, Resource is the zero value when it was deleted
+type Revision struct {
+	Timestamp time.Time
+	Deleted   bool
+	Resource  resources.Resource
+}
+
+// GetLabels returns the labels set between from and to, both inclusive, in time order.  A zero
+// from or to leaves that end open.
+func (d *dataModelImpl) GetLabels(from, to time.Time) []Label {
+	from, to = openRange(from, to)
+	labels := []Label{}
+	for timestamp, label := range d.meta.History(META_LABEL_KEY, from, to) {
+		if label != nil {
+			labels = append(labels, Label{Timestamp: timestamp, Label: string(label)})
+		}
+	}
+	return labels
+}
+
+// GetHistory returns every change to a resource between from and to, both inclusive, in time
+// order.  A zero from or to leaves that end open.
+func (d *dataModelImpl) GetHistory(uid string, from, to time.Time) ([]Revision, error) {
+	defer observeQuery("history", time.Now())
+	from, to = openRange(from, to)
+	revisions := []Revision{}
+	for timestamp, value := range d.resources.History(uid, from, to) {
+		revision := Revision{Timestamp: timestamp, Deleted: value == nil}
+		if value != nil {
+			if err := misc.DecodeFromBytes(value, &revision.Resource); err != nil {
+				return nil, err
+			}
+		}
+		revisions = append(revisions, revision)
+	}
+	return revisions, nil
+}
+
+// openRange replaces a zero from or to with the earliest or latest time there is
+func openRange(from, to time.Time) (time.Time, time.Time) {
+	if from.IsZero() {
+		from = time.Unix(0, 0)
+	}
+	if to.IsZero() {
+		to = time.Unix(0, math.MaxInt64)
+	}
+	return from, to
+}
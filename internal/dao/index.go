@@ -0,0 +1,198 @@
+package dao
+
+import (
+	"slices"
+	"time"
+
+	"github.com/hoyle1974/khronoscope/internal/misc"
+	"github.com/hoyle1974/khronoscope/internal/resources"
+	"github.com/hoyle1974/khronoscope/internal/temporal"
+)
+
+// resourceIndex finds the keys that could match a query without decoding every resource.  A uid
+// never changes kind, namespace or name so those are recorded once per key along with enough of
+// the key's lifetime to rule it out at times it didn't exist.  Names do get reused, byName keeps
+// every uid that has had a name so the one alive at a given time can be picked out.
+//
+// The index only ever narrows down candidates, the temporal.Map remains the source of truth.
+type resourceIndex struct {
+	keys        map[string]*keyInfo
+	byKind      map[string]map[string]bool
+	byNamespace map[string]map[string]bool
+	byName      map[resourceName][]string
+}
+
+type resourceName struct {
+	kind      string
+	namespace string
+	name      string
+}
+
+type keyInfo struct {
+	resourceName
+	first      time.Time // Earliest value
+	lastWrite  time.Time // Latest value
+	lastDelete time.Time // Latest removal, zero if never removed
+}
+
+func newResourceIndex() *resourceIndex {
+	return &resourceIndex{
+		keys:        map[string]*keyInfo{},
+		byKind:      map[string]map[string]bool{},
+		byNamespace: map[string]map[string]bool{},
+		byName:      map[resourceName][]string{},
+	}
+}
+
+// buildIndex indexes everything already in m, each resource is only decoded once
+func buildIndex(m temporal.Map) *resourceIndex {
+	idx := newResourceIndex()
+	from, to := m.GetTimeRange()
+	for change := range m.Changes(from, to) {
+		idx.apply(change)
+	}
+	return idx
+}
+
+// apply indexes a change read straight from the map, the value is only decoded for keys the index
+// hasn't seen yet
+func (idx *resourceIndex) apply(change temporal.Change) {
+	if change.Value == nil {
+		idx.remove(change.Key, change.Timestamp)
+		return
+	}
+	if info, ok := idx.keys[change.Key]; ok {
+		info.wrote(change.Timestamp)
+		return
+	}
+	var r resources.Resource
+	if err := misc.DecodeFromBytes(change.Value, &r); err != nil {
+		return
+	}
+	idx.write(change.Key, r)
+}
+
+func (idx *resourceIndex) write(key string, r resources.Resource) {
+	if info, ok := idx.keys[key]; ok {
+		info.wrote(r.Timestamp.Time)
+		return
+	}
+
+	info := &keyInfo{
+		resourceName: resourceName{kind: r.Kind, namespace: r.Namespace, name: r.Name},
+		first:        r.Timestamp.Time,
+		lastWrite:    r.Timestamp.Time,
+	}
+	idx.keys[key] = info
+	addToSet(idx.byKind, r.Kind, key)
+	addToSet(idx.byNamespace, r.Namespace, key)
+	idx.byName[info.resourceName] = append(idx.byName[info.resourceName], key)
+}
+
+func (idx *resourceIndex) remove(key string, timestamp time.Time) {
+	if info, ok := idx.keys[key]; ok && timestamp.After(info.lastDelete) {
+		info.lastDelete = timestamp
+	}
+}
+
+// trim forgets the keys that were removed before cutoff, retention has dropped all of their history
+func (idx *resourceIndex) trim(cutoff time.Time) {
+	for key, info := range idx.keys {
+		if !info.lastDelete.After(info.lastWrite) || !info.lastDelete.Before(cutoff) {
+			continue
+		}
+		delete(idx.keys, key)
+		removeFromSet(idx.byKind, info.kind, key)
+		removeFromSet(idx.byNamespace, info.namespace, key)
+		uids := slices.DeleteFunc(idx.byName[info.resourceName], func(uid string) bool { return uid == key })
+		if len(uids) == 0 {
+			delete(idx.byName, info.resourceName)
+		} else {
+			idx.byName[info.resourceName] = uids
+		}
+	}
+}
+
+func addToSet(sets map[string]map[string]bool, name, key string) {
+	set, ok := sets[name]
+	if !ok {
+		set = map[string]bool{}
+		sets[name] = set
+	}
+	set[key] = true
+}
+
+func removeFromSet(sets map[string]map[string]bool, name, key string) {
+	delete(sets[name], key)
+	if len(sets[name]) == 0 {
+		delete(sets, name)
+	}
+}
+
+func (info *keyInfo) wrote(timestamp time.Time) {
+	if timestamp.Before(info.first) {
+		info.first = timestamp
+	}
+	if timestamp.After(info.lastWrite) {
+		info.lastWrite = timestamp
+	}
+}
+
+// mayExistAt is false only when the key certainly had no value at timestamp
+func (info *keyInfo) mayExistAt(timestamp time.Time) bool {
+	if timestamp.Before(info.first) {
+		return false
+	}
+	// Removed after its last write, and we are past the removal
+	if info.lastDelete.After(info.lastWrite) && !timestamp.Before(info.lastDelete) {
+		return false
+	}
+	return true
+}
+
+// candidates returns the keys that may hold a resource of kind in namespace at timestamp, an empty
+// kind or namespace matches anything
+func (idx *resourceIndex) candidates(timestamp time.Time, kind, namespace string) []string {
+	set := idx.keys
+	var narrowed map[string]bool
+	switch {
+	case kind != "" && namespace != "":
+		narrowed = idx.byKind[kind]
+		if other := idx.byNamespace[namespace]; len(other) < len(narrowed) {
+			narrowed = other
+		}
+	case kind != "":
+		narrowed = idx.byKind[kind]
+	case namespace != "":
+		narrowed = idx.byNamespace[namespace]
+	}
+
+	keys := []string{}
+	match := func(key string, info *keyInfo) {
+		if (kind == "" || info.kind == kind) && (namespace == "" || info.namespace == namespace) && info.mayExistAt(timestamp) {
+			keys = append(keys, key)
+		}
+	}
+	if kind == "" && namespace == "" {
+		for key, info := range set {
+			match(key, info)
+		}
+	} else {
+		for key := range narrowed {
+			match(key, set[key])
+		}
+	}
+	return keys
+}
+
+// named returns the keys that have had this name and may exist at timestamp, newest first
+func (idx *resourceIndex) named(timestamp time.Time, kind, namespace, name string) []string {
+	uids := idx.byName[resourceName{kind: kind, namespace: namespace, name: name}]
+	keys := []string{}
+	for i := len(uids) - 1; i >= 0; i-- {
+		if idx.keys[uids[i]].mayExistAt(timestamp) {
+			keys = append(keys, uids[i])
+		}
+	}
+	return keys
+}
@@ -0,0 +1,178 @@
+package dao_test
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/hoyle1974/khronoscope/internal/dao"
+	"github.com/hoyle1974/khronoscope/internal/resources"
+)
+
+type indexEvent struct {
+	resource resources.Resource
+	deleted  bool
+}
+
+// indexHistory creates, updates and deletes resources of a few kinds across a few namespaces, names
+// are reused so some names belong to different uids over time
+func indexHistory(start time.Time) []indexEvent {
+	r := rand.New(rand.NewPCG(0, 4))
+	kinds := []string{"Pod", "ConfigMap", "Service"}
+	namespaces := []string{"default", "kube-system", ""}
+
+	events := []indexEvent{}
+	live := map[string]resources.Resource{}
+	for i := 0; i < 600; i++ {
+		ts := start.Add(time.Duration(i) * time.Second)
+		name := fmt.Sprintf("name-%d", r.IntN(20))
+		kind := kinds[r.IntN(len(kinds))]
+		namespace := namespaces[r.IntN(len(namespaces))]
+		key := kind + "/" + namespace + "/" + name
+
+		existing, ok := live[key]
+		switch {
+		case ok && r.IntN(3) == 0:
+			existing.Timestamp.Time = ts
+			events = append(events, indexEvent{resource: existing, deleted: true})
+			delete(live, key)
+		case ok:
+			existing.Timestamp.Time = ts
+			existing.RawJSON = fmt.Sprintf(`{"generation":%d}`, i)
+			events = append(events, indexEvent{resource: existing})
+			live[key] = existing
+		default:
+			created := resources.NewResource(fmt.Sprintf("uid-%d", i), ts, kind, namespace, name)
+			events = append(events, indexEvent{resource: created})
+			live[key] = created
+		}
+	}
+	return events
+}
+
+// expectedAt replays the events up to timestamp
+func expectedAt(events []indexEvent, timestamp time.Time) map[string]resources.Resource {
+	live := map[string]resources.Resource{}
+	for _, e := range events {
+		if e.resource.Timestamp.Time.After(timestamp) {
+			break
+		}
+		if e.deleted {
+			delete(live, e.resource.Uid)
+		} else {
+			live[e.resource.Uid] = e.resource
+		}
+	}
+	return live
+}
+
+func validateIndex(t *testing.T, store dao.KhronoStore, events []indexEvent, start time.Time) {
+	for _, offset := range []int{0, 100, 250, 399, 599} {
+		ts := start.Add(time.Duration(offset)*time.Second + time.Millisecond)
+		live := expectedAt(events, ts)
+
+		for _, query := range [][2]string{{"", ""}, {"Pod", ""}, {"", "default"}, {"ConfigMap", "kube-system"}, {"Service", ""}, {"Missing", ""}} {
+			expected := []string{}
+			for uid, r := range live {
+				if (query[0] == "" || r.Kind == query[0]) && (query[1] == "" || r.Namespace == query[1]) {
+					expected = append(expected, uid)
+				}
+			}
+			got := []string{}
+			for _, r := range store.GetResourcesAt(ts, query[0], query[1]) {
+				got = append(got, r.Uid)
+			}
+			slices.Sort(expected)
+			slices.Sort(got)
+			if !slices.Equal(expected, got) {
+				t.Fatalf("At %d, %v: expected %v, got %v", offset, query, expected, got)
+			}
+		}
+
+		for _, r := range live {
+			found, err := store.GetResourceByName(ts, r.Kind, r.Namespace, r.Name)
+			if err != nil || found.Uid != r.Uid || found.RawJSON != r.RawJSON {
+				t.Fatalf("At %d expected %s for %s/%s/%s, got %s (%v)", offset, r.Uid, r.Kind, r.Namespace, r.Name, found.Uid, err)
+			}
+		}
+	}
+
+	if _, err := store.GetResourceByName(start.Add(time.Hour), "Pod", "default", "never-existed"); err == nil {
+		t.Fatalf("Expected an error for a name that never existed")
+	}
+}
+
+func TestIndex(t *testing.T) {
+	start := time.Now()
+	events := indexHistory(start)
+
+	store := dao.New()
+	for _, e := range events {
+		if e.deleted {
+			store.DeleteResource(e.resource)
+		} else {
+			store.AddResource(e.resource)
+		}
+	}
+	validateIndex(t, store, events, start)
+
+	// The index is rebuilt when a recording is loaded
+	filename := filepath.Join(t.TempDir(), "index.khron")
+	if err := store.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := dao.NewFromFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validateIndex(t, loaded, events, start)
+}
+
+func TestIndexReusedName(t *testing.T) {
+	start := time.Now()
+	store := dao.New()
+
+	first := resources.NewResource("uid-1", start, "Pod", "default", "web")
+	store.AddResource(first)
+	first.Timestamp.Time = start.Add(time.Minute)
+	store.DeleteResource(first)
+	store.AddResource(resources.NewResource("uid-2", start.Add(2*time.Minute), "Pod", "default", "web"))
+
+	for _, tt := range []struct {
+		at  time.Duration
+		uid string
+	}{{30 * time.Second, "uid-1"}, {90 * time.Second, ""}, {3 * time.Minute, "uid-2"}} {
+		r, err := store.GetResourceByName(start.Add(tt.at), "Pod", "default", "web")
+		if tt.uid == "" {
+			if err == nil {
+				t.Fatalf("Expected nothing at %v, got %s", tt.at, r.Uid)
+			}
+			continue
+		}
+		if err != nil || r.Uid != tt.uid {
+			t.Fatalf("Expected %s at %v, got %s (%v)", tt.uid, tt.at, r.Uid, err)
+		}
+	}
+}
+
+func BenchmarkGetResourcesAt(b *testing.B) {
+	start := time.Now()
+	store := dao.New()
+	for i := 0; i < 5000; i++ {
+		kind := "ConfigMap"
+		if i%50 == 0 {
+			kind = "Node"
+		}
+		store.AddResource(resources.NewResource(fmt.Sprintf("uid-%d", i), start, kind, "default", fmt.Sprintf("name-%d", i)))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if len(store.GetResourcesAt(start, "Node", "")) != 100 {
+			b.Fatalf("Expected 100 nodes")
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package dao
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/hoyle1974/khronoscope/internal/metrics"
+	"github.com/hoyle1974/khronoscope/internal/misc"
+	"github.com/hoyle1974/khronoscope/internal/resources"
+	"github.com/hoyle1974/khronoscope/internal/temporal"
+)
+
+// A journaled store records every change to a write-ahead journal as it happens and periodically
+// checkpoints the whole store, so a crash loses at most the changes that never made it out of the
+// process.  On startup the last checkpoint is loaded and the journal replayed on top of it.
+//
+//	DIR/checkpoint.khron   the last checkpoint, written with Save
+//	DIR/journal.log        every change since that checkpoint
+//
+// Journal records are a big endian uint32 length and CRC32 followed by a gob encoded journalEntry.
+// Each entry is encoded on its own so the journal can be appended to across restarts.  Entries are
+// numbered and a checkpoint records the last one it holds, so a crash after a checkpoint is saved
+// but before the journal is emptied doesn't replay those entries twice.
+//
+// If writing to the journal fails journaling stops, with an error logged and counted in
+// khronoscope_journal_errors_total, until the next checkpoint saves everything it missed.
+
+const (
+	checkpointFileName = "checkpoint.khron"
+	journalFileName    = "journal.log"
+
+	DefaultCheckpointInterval = 5 * time.Minute
+	journalSyncInterval       = time.Second
+)
+
+const (
+	journalAdd byte = iota + 1
+	journalUpdate
+	journalDelete
+	journalLabel
+)
+
+type journalEntry struct {
+	Seq      uint64 // Numbered from 1, 0 for entries written before they were numbered
+	Op       byte
+	Resource resources.Resource
+	Time     time.Time
+	Label    string
+}
+
+type journaledStore struct {
+	*dataModelImpl
+
+	jlock   sync.Mutex
+	dir     string
+	journal *os.File
+	seq     uint64 // The last entry appended
+	failed  error  // Why journaling stopped, until the next checkpoint
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// OpenJournal opens a crash safe recording in dir, recovering anything a previous run left behind.
+// A checkpoint is written every checkpointInterval.
+func OpenJournal(dir string, checkpointInterval time.Duration) (KhronoStore, error) {
+	if checkpointInterval <= 0 {
+		checkpointInterval = DefaultCheckpointInterval
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("unable to create journal directory %s: %w", dir, err)
+	}
+
+	d := New().(*dataModelImpl)
+	checkpoint := filepath.Join(dir, checkpointFileName)
+	if _, err := os.Stat(checkpoint); err == nil {
+		loaded, err := NewFromFile(checkpoint)
+		if err != nil {
+			return nil, fmt.Errorf("unable to recover checkpoint: %w", err)
+		}
+		d = loaded.(*dataModelImpl)
+	}
+
+	journalName := filepath.Join(dir, journalFileName)
+	replayed, good, seq, err := replayJournal(journalName, d)
+	if err != nil {
+		return nil, err
+	}
+	if replayed > 0 {
+		log.Info().Int("Entries", replayed).Str("Dir", dir).Msg("Recovered journal")
+	}
+
+	journal, err := os.OpenFile(journalName, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open journal %s: %w", journalName, err)
+	}
+	// Drop any partially written entry left by a crash
+	if err := journal.Truncate(good); err != nil {
+		_ = journal.Close()
+		return nil, fmt.Errorf("unable to truncate journal %s: %w", journalName, err)
+	}
+	if _, err := journal.Seek(good, io.SeekStart); err != nil {
+		_ = journal.Close()
+		return nil, err
+	}
+
+	j := &journaledStore{
+		dataModelImpl: d,
+		dir:           dir,
+		journal:       journal,
+		seq:           max(seq, d.journalSeq),
+		done:          make(chan struct{}),
+	}
+
+	j.wg.Add(1)
+	go j.run(checkpointInterval)
+
+	return j, nil
+}
+
+// replayJournal applies every complete entry in the journal that d's checkpoint doesn't already
+// hold, returning how many were applied, the offset just past the last good entry and the sequence
+// of the last entry
+func replayJournal(filename string, d *dataModelImpl) (int, int64, uint64, error) {
+	f, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("unable to open journal %s: %w", filename, err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	reader := bufio.NewReader(f)
+	count := 0
+	offset := int64(0)
+	seq := uint64(0)
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			return count, offset, seq, nil
+		}
+		body := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return count, offset, seq, nil
+		}
+		if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:8]) {
+			log.Warn().Int64("Offset", offset).Msg("Journal entry is corrupt, ignoring the rest of the journal")
+			return count, offset, seq, nil
+		}
+
+		var entry journalEntry
+		if err := misc.DecodeFromBytes(body, &entry); err != nil {
+			return count, offset, seq, fmt.Errorf("unable to decode journal entry at %d: %w", offset, err)
+		}
+		offset += int64(len(header) + len(body))
+		seq = max(seq, entry.Seq)
+		// The checkpoint was saved but the journal wasn't emptied
+		if entry.Seq != 0 && entry.Seq <= d.journalSeq {
+			continue
+		}
+		d.apply(entry)
+		count++
+	}
+}
+
+// apply replays a single journal entry
+func (d *dataModelImpl) apply(entry journalEntry) {
+	switch entry.Op {
+	case journalAdd:
+		d.AddResource(entry.Resource)
+	case journalUpdate:
+		d.UpdateResource(entry.Resource)
+	case journalDelete:
+		d.DeleteResource(entry.Resource)
+	case journalLabel:
+		d.SetLabel(entry.Time, entry.Label)
+	}
+}
+
+func (j *journaledStore) run(checkpointInterval time.Duration) {
+	defer j.wg.Done()
+
+	syncTicker := time.NewTicker(journalSyncInterval)
+	defer syncTicker.Stop()
+	checkpointTicker := time.NewTicker(checkpointInterval)
+	defer checkpointTicker.Stop()
+
+	for {
+		select {
+		case <-j.done:
+			return
+		case <-syncTicker.C:
+			j.jlock.Lock()
+			if err := j.journal.Sync(); err != nil {
+				log.Error().Err(err).Msg("journal sync failed")
+			}
+			j.jlock.Unlock()
+		case <-checkpointTicker.C:
+			if err := j.Checkpoint(); err != nil {
+				log.Error().Err(err).Msg("checkpoint failed")
+			}
+		}
+	}
+}
+
+// Checkpoint saves the whole store and empties the journal.  Writes block while this happens so
+// nothing can slip in between the checkpoint and the journal being reset.  Journaling starts again
+// if it had stopped.
+func (j *journaledStore) Checkpoint() error {
+	j.jlock.Lock()
+	defer j.jlock.Unlock()
+
+	if err := j.dataModelImpl.Save(filepath.Join(j.dir, checkpointFileName), withJournalSequence(j.seq)); err != nil {
+		return err
+	}
+	if err := j.journal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := j.journal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if j.failed != nil {
+		log.Info().Msg("journaling resumed after a checkpoint")
+		j.failed = nil
+	}
+	return nil
+}
+
+// append writes an entry to the journal.  A failed write stops journaling until the next checkpoint,
+// a torn entry would hide every entry after it when the journal is replayed anyway.
+func (j *journaledStore) append(entry journalEntry) {
+	if j.failed != nil {
+		return
+	}
+	j.seq++
+	entry.Seq = j.seq
+
+	body, err := misc.EncodeToBytes(entry)
+	if err != nil {
+		panic(err)
+	}
+
+	record := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(body))
+	record = append(record, body...)
+
+	if _, err := j.journal.Write(record); err != nil {
+		j.failed = err
+		metrics.JournalErrors.Inc()
+		log.Error().Err(err).Msg("journal write failed, changes will not be journaled until the next checkpoint")
+	}
+}
+
+func (j *journaledStore) AddResource(resource resources.Resource) {
+	j.jlock.Lock()
+	defer j.jlock.Unlock()
+
+	j.append(journalEntry{Op: journalAdd, Resource: resource})
+	j.dataModelImpl.AddResource(resource)
+}
+
+func (j *journaledStore) UpdateResource(resource resources.Resource) {
+	j.jlock.Lock()
+	defer j.jlock.Unlock()
+
+	j.append(journalEntry{Op: journalUpdate, Resource: resource})
+	j.dataModelImpl.UpdateResource(resource)
+}
+
+func (j *journaledStore) DeleteResource(resource resources.Resource) {
+	j.jlock.Lock()
+	defer j.jlock.Unlock()
+
+	j.append(journalEntry{Op: journalDelete, Resource: resource})
+	j.dataModelImpl.DeleteResource(resource)
+}
+
+func (j *journaledStore) SetLabel(t time.Time, label string) {
+	j.jlock.Lock()
+	defer j.jlock.Unlock()
+
+	j.append(journalEntry{Op: journalLabel, Time: t, Label: label})
+	j.dataModelImpl.SetLabel(t, label)
+}
+
+// Compact checkpoints right away when anything changed so the journal doesn't replay history that
+// retention removed
+func (j *journaledStore) Compact(policy temporal.RetentionPolicy, now time.Time) {
+	if !j.dataModelImpl.compact(policy, now) {
+		return
+	}
+	if err := j.Checkpoint(); err != nil {
+		log.Error().Err(err).Msg("checkpoint after compaction failed")
+	}
+}
+
+// Merge checkpoints right away since merged history never goes through the journal
+func (j *journaledStore) Merge(other KhronoStore) ([]Conflict, error) {
+	conflicts, err := j.dataModelImpl.Merge(other)
+	if err != nil {
+		return nil, err
+	}
+	return conflicts, j.Checkpoint()
+}
+
+// Close writes a final checkpoint and closes the journal, closing it again returns the first error
+func (j *journaledStore) Close() error {
+	j.closeOnce.Do(func() {
+		close(j.done)
+		j.wg.Wait()
+
+		err := j.Checkpoint()
+		j.closeErr = errors.Join(err, j.journal.Close(), j.dataModelImpl.Close())
+	})
+	return j.closeErr
+}
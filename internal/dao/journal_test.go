@@ -0,0 +1,147 @@
+package dao_test
+
+import (
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hoyle1974/khronoscope/internal/dao"
+	"github.com/hoyle1974/khronoscope/internal/resources"
+)
+
+func addJournalResources(store dao.KhronoStore, r *rand.Rand, start time.Time, count int) []resources.Resource {
+	data := []resources.Resource{}
+	for i := 0; i < count; i++ {
+		resource := randomResource(r)
+		resource.Uid = newUuid(r)
+		resource.Timestamp.Time = start.Add(time.Duration(i) * time.Second)
+		store.AddResource(resource)
+		data = append(data, resource)
+	}
+	return data
+}
+
+func checkJournalResources(t *testing.T, store dao.KhronoStore, data []resources.Resource) {
+	for _, resource := range data {
+		got, err := store.GetResourceAt(resource.GetTimestamp(), resource.Uid)
+		if err != nil || got.Name != resource.Name {
+			t.Fatalf("Expected %s to be recovered: %v", resource.Uid, err)
+		}
+	}
+}
+
+func TestJournalRecovery(t *testing.T) {
+	dir := t.TempDir()
+	r := rand.New(rand.NewPCG(0, 3))
+	start := time.Now()
+
+	store, err := dao.OpenJournal(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := addJournalResources(store, r, start, 20)
+	store.SetLabel(start.Add(5*time.Second), "crash")
+	store.DeleteResource(data[0])
+
+	// Simulate a crash, nothing is closed or checkpointed.  Chop the last entry in half too.
+	journal := filepath.Join(dir, "journal.log")
+	fi, err := os.Stat(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extra := randomResource(r)
+	extra.Timestamp.Time = start.Add(time.Minute)
+	store.AddResource(extra)
+	if err := os.Truncate(journal, fi.Size()+10); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered, err := dao.OpenJournal(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkJournalResources(t, recovered, data[1:])
+	if recovered.GetLabel(start.Add(6*time.Second)) != "crash" {
+		t.Fatalf("Expected label to be recovered")
+	}
+	if _, err := recovered.GetResourceAt(start.Add(30*time.Second), data[0].Uid); err == nil {
+		t.Fatalf("Expected deleted resource to stay deleted")
+	}
+	if _, err := recovered.GetResourceAt(extra.GetTimestamp(), extra.Uid); err == nil {
+		t.Fatalf("Expected the partial entry to be dropped")
+	}
+
+	// Keep recording on top of the recovered data, then shut down cleanly
+	more := addJournalResources(recovered, r, start.Add(2*time.Minute), 5)
+	if err := recovered.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := recovered.Close(); err != nil {
+		t.Fatalf("Expected closing again to be safe: %v", err)
+	}
+	if fi, err := os.Stat(journal); err != nil || fi.Size() != 0 {
+		t.Fatalf("Expected the journal to be empty after a clean shutdown")
+	}
+
+	reopened, err := dao.OpenJournal(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := reopened.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	checkJournalResources(t, reopened, append(data[1:], more...))
+}
+
+func TestJournalCheckpointCrash(t *testing.T) {
+	dir := t.TempDir()
+	r := rand.New(rand.NewPCG(0, 4))
+	start := time.Now()
+
+	store, err := dao.OpenJournal(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := addJournalResources(store, r, start, 10)
+
+	// Crash after the checkpoint is saved but before the journal is emptied
+	journal := filepath.Join(dir, "journal.log")
+	entries, err := os.ReadFile(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.(interface{ Checkpoint() error }).Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(journal, entries, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered, err := dao.OpenJournal(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, resource := range data {
+		history, err := recovered.GetHistory(resource.Uid, start, start.Add(time.Minute))
+		if err != nil || len(history) != 1 {
+			t.Fatalf("Expected %s to be recorded once, got %d revisions (%v)", resource.Uid, len(history), err)
+		}
+	}
+
+	// Entries written after recovering are numbered after the checkpoint, so they are replayed
+	more := addJournalResources(recovered, r, start.Add(time.Minute), 3)
+	reopened, err := dao.OpenJournal(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := reopened.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	checkJournalResources(t, reopened, append(data, more...))
+}
@@ -1,93 +1,149 @@
 package dao
 
 import (
-	"bufio"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"iter"
+	"maps"
 	"os"
+	"path/filepath"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/rs/zerolog/log"
 
+	"github.com/hoyle1974/khronoscope/internal/metrics"
 	"github.com/hoyle1974/khronoscope/internal/misc"
 	"github.com/hoyle1974/khronoscope/internal/resources"
 	"github.com/hoyle1974/khronoscope/internal/temporal"
 )
 
-type KhronoStore interface {
+// Recording is what playing a recording back needs.  It's all a recording held somewhere else, like
+// on a khronoscope server, can offer.
+type Recording interface {
 	GetResourcesAt(timestamp time.Time, kind string, namespace string) []resources.Resource
 	GetResourceAt(timestamp time.Time, uid string) (resources.Resource, error)
+	GetResourceByName(timestamp time.Time, kind, namespace, name string) (resources.Resource, error)
 	GetTimeRange() (time.Time, time.Time)
+	GetLabel(time time.Time) string
+	GetNextLabelTime(time.Time) time.Time
+	GetPrevLabelTime(time.Time) time.Time
+	GetLabels(from, to time.Time) []Label
+	GetHistory(uid string, from, to time.Time) ([]Revision, error)
+	GetMetadata() Metadata
+	Close() error
+	Events(from, to time.Time) iter.Seq2[Event, error]
+}
+
+// KhronoStore is a Recording held by this process, which can be recorded to, labelled, saved,
+// compacted and merged
+type KhronoStore interface {
+	Recording
 	AddResource(resource resources.Resource)
 	UpdateResource(resource resources.Resource)
 	DeleteResource(resource resources.Resource)
 	SetLabel(time.Time, string)
-	GetLabel(time time.Time) string
-	GetNextLabelTime(time.Time) time.Time
-	GetPrevLabelTime(time.Time) time.Time
-	Save(string)
+	SetMetadata(Metadata)
+	Save(filename string, opts ...FileOption) error
+	Write(w io.Writer, codec Codec, opts ...FileOption) error
+	Slice(opts SliceOptions) (KhronoStore, error)
+	Export(w io.Writer, opts ExportOptions) error
 	Size() int
+	StoredBytes() int64
+	Compact(policy temporal.RetentionPolicy, now time.Time)
+	Merge(other KhronoStore) ([]Conflict, error)
 }
 
 type dataModelImpl struct {
 	lock      sync.Mutex
 	meta      temporal.Map
 	resources temporal.Map
+	metadata  Metadata
+	kinds     map[string]bool
+	index     *resourceIndex
+	snapshot  *snapshot
+
+	journalSeq uint64 // The last journal entry held by the checkpoint this was loaded from
 }
 
-func New() KhronoStore {
-	return &dataModelImpl{
-		meta:      temporal.New(),
-		resources: temporal.New(),
+// Option customizes a KhronoStore created with New
+type Option func(*dataModelImpl)
+
+// WithResourceMap selects the temporal.Map used to hold resources, for example a disk backed
+// map created with temporal.NewSegmentMap for long recordings.
+func WithResourceMap(m temporal.Map) Option {
+	return func(d *dataModelImpl) {
+		d.resources = m
 	}
 }
 
-func NewFromFile(filename string) KhronoStore {
-	d := New().(*dataModelImpl)
+// WithMetaMap selects the temporal.Map used to hold labels, so a disk backed recording keeps them too
+func WithMetaMap(m temporal.Map) Option {
+	return func(d *dataModelImpl) {
+		d.meta = m
+	}
+}
 
-	fi, err := os.Open(filename)
+func New(opts ...Option) KhronoStore {
+	d := &dataModelImpl{
+		meta:      temporal.New(),
+		resources: temporal.New(resourceMapOptions()...),
+		kinds:     map[string]bool{},
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	// A disk backed map may already hold a recording
+	d.index = buildIndex(d.resources)
+	for kind := range d.index.byKind {
+		d.kinds[kind] = true
+	}
+	return d
+}
+
+// OpenDir opens a recording kept in segment files in dir, creating it if it doesn't exist.  The
+// resources are stored with DefaultDiffer and KeyframePolicies like an in memory recording, the
+// labels are kept in the meta subdirectory.
+func OpenDir(dir string) (KhronoStore, error) {
+	resourceMap, err := temporal.NewSegmentMap(dir, temporal.SegmentOptions{Differ: DefaultDiffer, KeyframePolicy: keyframePolicy, OnError: logStorageError(dir)})
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	// close on exit and check for its returned error
-	defer func() {
-		if err := fi.Close(); err != nil {
-			panic(err)
+	metaMap, err := temporal.NewSegmentMap(filepath.Join(dir, "meta"), temporal.SegmentOptions{OnError: logStorageError(dir)})
+	if err != nil {
+		if c, ok := resourceMap.(io.Closer); ok {
+			_ = c.Close()
 		}
-	}()
-
-	reader := bufio.NewReader(fi)
-
-	// Read the length of the first byte array
-	var data1Len uint32
-	if err := binary.Read(reader, binary.BigEndian, &data1Len); err != nil {
-		panic(fmt.Errorf("failed to read data1 length: %w", err))
+		return nil, err
 	}
+	return New(WithResourceMap(resourceMap), WithMetaMap(metaMap)), nil
+}
 
-	// Read the first byte array
-	data1 := make([]byte, data1Len)
-	if _, err := io.ReadFull(reader, data1); err != nil {
-		panic(fmt.Errorf("failed to read data1: %w", err))
+// logStorageError logs the failures of the segment maps in dir.  Once a write fails the recording
+// stops growing, Close returns the error.
+func logStorageError(dir string) func(error) {
+	return func(err error) {
+		log.Error().Err(err).Str("Dir", dir).Msg("recording storage failed")
 	}
+}
 
-	// Read the length of the second byte array
-	var data2Len uint32
-	if err := binary.Read(reader, binary.BigEndian, &data2Len); err != nil {
-		panic(fmt.Errorf("failed to read data2 length: %w", err))
+// NewFromFile loads a recording previously written with Save, encrypted recordings need WithPassphrase
+func NewFromFile(filename string, opts ...FileOption) (KhronoStore, error) {
+	fi, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s: %w", filename, err)
 	}
+	defer func() {
+		_ = fi.Close()
+	}()
 
-	// Read the second byte array
-	data2 := make([]byte, data2Len)
-	if _, err := io.ReadFull(reader, data2); err != nil {
-		panic(fmt.Errorf("failed to read data2: %w", err))
+	d, err := Read(fi, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load %s: %w", filename, err)
 	}
-
-	d.resources = temporal.FromBytes(data1)
-	d.meta = temporal.FromBytes(data2)
-
-	return d
+	return d, nil
 }
 
 func (d *dataModelImpl) Size() int {
@@ -100,51 +156,106 @@ func (d *dataModelImpl) Size() int {
 	return len(resourceMap) + len(metaMap)
 }
 
-func (d *dataModelImpl) Save(filename string) {
-	d.lock.Lock()
-	defer d.lock.Unlock()
+// StoredBytes is how many bytes of history the store holds.  Unlike Size nothing is serialized to
+// find out, so it is cheap enough to measure often.
+func (d *dataModelImpl) StoredBytes() int64 {
+	return d.resources.StoredBytes() + d.meta.StoredBytes()
+}
 
-	// open output file
-	fo, err := os.Create(filename)
+// Save writes the recording to filename.  The data is written to a temporary file first and then
+// renamed so a failed save never clobbers an existing recording.  The file is compressed with the
+// codec its extension selects, or DefaultCodec, and encrypted if WithPassphrase is given.
+func (d *dataModelImpl) Save(filename string, opts ...FileOption) error {
+	tmp := filename + ".tmp"
+	fo, err := os.Create(tmp)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("unable to create %s: %w", tmp, err)
 	}
 
-	// close on exit and check for its returned error
-	defer func() {
-		if err := fo.Close(); err != nil {
-			panic(err)
-		}
-	}()
+	if err := d.Write(fo, codecForFile(filename), opts...); err != nil {
+		_ = fo.Close()
+		_ = os.Remove(tmp)
+		return fmt.Errorf("unable to save %s: %w", filename, err)
+	}
+	if err := fo.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("unable to save %s: %w", filename, err)
+	}
 
-	resourceMap := d.resources.ToBytes()
-	metaMap := d.meta.ToBytes()
+	return os.Rename(tmp, filename)
+}
+
+// SetMetadata records information about where the recording came from
+func (d *dataModelImpl) SetMetadata(metadata Metadata) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
 
-	writer := bufio.NewWriter(fo)
+	d.metadata = metadata
+}
 
-	// Write the length of the first byte array
-	if err := binary.Write(writer, binary.BigEndian, uint32(len(resourceMap))); err != nil {
-		panic(fmt.Errorf("failed to write data1 length: %w", err))
-	}
+// GetMetadata describes the recording, the time range and kinds are always current
+func (d *dataModelImpl) GetMetadata() Metadata {
+	d.lock.Lock()
+	defer d.lock.Unlock()
 
-	// Write the first byte array
-	if _, err := writer.Write(resourceMap); err != nil {
-		panic(fmt.Errorf("failed to write data1: %w", err))
+	return d.metadataLocked()
+}
+
+func (d *dataModelImpl) metadataLocked() Metadata {
+	meta := d.metadata
+	meta.StartTime, meta.EndTime = d.resources.GetTimeRange()
+	meta.Kinds = slices.Sorted(maps.Keys(d.kinds))
+	if meta.ToolVersion == "" {
+		meta.ToolVersion = ToolVersion()
 	}
+	return meta
+}
+
+// Close releases any resources held by the underlying maps, like open segment files
+func (d *dataModelImpl) Close() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
 
-	// Write the length of the second byte array
-	if err := binary.Write(writer, binary.BigEndian, uint32(len(metaMap))); err != nil {
-		panic(fmt.Errorf("failed to write data2 length: %w", err))
+	var errs []error
+	for _, m := range []temporal.Map{d.resources, d.meta} {
+		if c, ok := m.(io.Closer); ok {
+			errs = append(errs, c.Close())
+		}
 	}
+	return errors.Join(errs...)
+}
 
-	// Write the second byte array
-	if _, err := writer.Write(metaMap); err != nil {
-		panic(fmt.Errorf("failed to write data2: %w", err))
+// Compact drops or downsamples old history, labels are never downsampled but do age out with MaxAge
+func (d *dataModelImpl) Compact(policy temporal.RetentionPolicy, now time.Time) {
+	d.compact(policy, now)
+}
+
+// compact is Compact returning whether anything changed.  Retention never drops the first or last
+// value of a key it keeps, so the index only has to forget the keys that went entirely.
+func (d *dataModelImpl) compact(policy temporal.RetentionPolicy, now time.Time) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	changed := d.resources.Compact(policy, now)
+	if d.meta.Compact(temporal.RetentionPolicy{MaxAge: policy.MaxAge}, now) {
+		changed = true
+	}
+	if !changed {
+		return false
 	}
 
-	if err := writer.Flush(); err != nil {
-		panic(fmt.Errorf("failed to flush writer: %w", err))
+	touched := now.Add(-policy.FullFidelity)
+	if cutoff := now.Add(-policy.MaxAge); policy.MaxAge > 0 {
+		d.index.trim(cutoff)
+		if cutoff.After(touched) {
+			touched = cutoff
+		}
+	}
+	// Only a snapshot taken where values went can be out of date
+	if d.snapshot != nil && d.snapshot.at.Before(touched) {
+		d.snapshot = nil
 	}
+	return true
 }
 
 const META_LABEL_KEY = "Meta.Label"
@@ -183,6 +294,7 @@ func (d *dataModelImpl) GetTimeRange() (time.Time, time.Time) {
 
 func (d *dataModelImpl) AddResource(resource resources.Resource) {
 	log.Debug().Str("Resource", resource.Name).Str("Uid", resource.Uid).Msg("Add")
+	metrics.EventsIngested.Inc(resource.Kind, "add")
 
 	d.lock.Lock()
 	defer d.lock.Unlock()
@@ -192,11 +304,15 @@ func (d *dataModelImpl) AddResource(resource resources.Resource) {
 		panic(err)
 	}
 
+	d.kinds[resource.Kind] = true
+	d.index.write(resource.Key(), resource)
 	d.resources.Add(resource.Timestamp.Time, resource.Key(), data)
+	d.written(resource.Timestamp.Time, resource.Key())
 }
 
 func (d *dataModelImpl) UpdateResource(resource resources.Resource) {
 	log.Debug().Str("Resource", resource.Name).Str("Uid", resource.Uid).Msg("Update")
+	metrics.EventsIngested.Inc(resource.Kind, "update")
 
 	d.lock.Lock()
 	defer d.lock.Unlock()
@@ -206,19 +322,25 @@ func (d *dataModelImpl) UpdateResource(resource resources.Resource) {
 		panic(err)
 	}
 
+	d.kinds[resource.Kind] = true
+	d.index.write(resource.Key(), resource)
 	d.resources.Update(resource.Timestamp.Time, resource.Key(), data)
-
+	d.written(resource.Timestamp.Time, resource.Key())
 }
 
 func (d *dataModelImpl) DeleteResource(resource resources.Resource) {
 	log.Debug().Str("Resource", resource.Name).Str("Uid", resource.Uid).Msg("Delete")
+	metrics.EventsIngested.Inc(resource.Kind, "delete")
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
+	d.index.remove(resource.Key(), resource.Timestamp.Time)
 	d.resources.Remove(resource.Timestamp.Time, resource.Key())
+	d.written(resource.Timestamp.Time, resource.Key())
 }
 
 func (d *dataModelImpl) GetResourceAt(timestamp time.Time, uid string) (resources.Resource, error) {
+	defer observeQuery("resource_at", time.Now())
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
@@ -233,14 +355,32 @@ func (d *dataModelImpl) GetResourceAt(timestamp time.Time, uid string) (resource
 	return r, nil
 }
 
+// GetResourcesAt returns the resources of kind in namespace that exist at timestamp, an empty kind or
+// namespace matches anything.  Asking for everything is answered from a cached snapshot that follows
+// the timestamp around, otherwise only resources the index can't rule out are decoded.
 func (d *dataModelImpl) GetResourcesAt(timestamp time.Time, kind string, namespace string) []resources.Resource {
+	defer observeQuery("resources_at", time.Now())
 	d.lock.Lock()
 	defer d.lock.Unlock()
-	m := d.resources.GetStateAtTime(timestamp)
 
-	// Create a slice of keys
-	values := make([]resources.Resource, 0, len(m))
-	for _, v := range m {
+	if (kind == "" && namespace == "") || (d.snapshot != nil && d.snapshot.at.Equal(timestamp)) {
+		s := d.snapshotAt(timestamp)
+		values := make([]resources.Resource, 0, len(s.resources))
+		for _, r := range s.resources {
+			if (kind == "" || kind == r.Kind) && (namespace == "" || namespace == r.Namespace) {
+				values = append(values, r)
+			}
+		}
+		return values
+	}
+
+	keys := d.index.candidates(timestamp, kind, namespace)
+	values := make([]resources.Resource, 0, len(keys))
+	for _, key := range keys {
+		v := d.resources.GetItem(timestamp, key)
+		if len(v) == 0 {
+			continue
+		}
 		var r resources.Resource
 		err := misc.DecodeFromBytes(v, &r)
 		if err != nil {
@@ -257,3 +397,25 @@ func (d *dataModelImpl) GetResourcesAt(timestamp time.Time, kind string, namespa
 
 	return values
 }
+
+// GetResourceByName returns the resource that had this name at timestamp.  Names are reused, a
+// resource that is deleted and recreated has a new uid, so the uid can change over time.
+func (d *dataModelImpl) GetResourceByName(timestamp time.Time, kind, namespace, name string) (resources.Resource, error) {
+	defer observeQuery("resource_by_name", time.Now())
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for _, key := range d.index.named(timestamp, kind, namespace, name) {
+		v := d.resources.GetItem(timestamp, key)
+		if len(v) == 0 {
+			continue
+		}
+		var r resources.Resource
+		if err := misc.DecodeFromBytes(v, &r); err != nil {
+			return r, err
+		}
+		return r, nil
+	}
+
+	return resources.Resource{}, fmt.Errorf("no %s %s/%s at %v", kind, namespace, name, timestamp)
+}
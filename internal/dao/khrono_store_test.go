@@ -4,6 +4,7 @@ import (
 	"encoding/gob"
 	"fmt"
 	"math/rand/v2"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -13,6 +14,7 @@ import (
 	"github.com/hoyle1974/khronoscope/internal/dao"
 	"github.com/hoyle1974/khronoscope/internal/resources"
 	"github.com/hoyle1974/khronoscope/internal/serializable"
+	"github.com/hoyle1974/khronoscope/internal/temporal"
 )
 
 func randomStrings(r *rand.Rand) []string {
@@ -115,6 +117,75 @@ func Test_Store(t *testing.T) {
 		}
 	}
 
-	store.Save("test.dat")
+	if err := store.Save(filepath.Join(t.TempDir(), "test.dat")); err != nil {
+		t.Fatal(err)
+	}
+
+}
 
+func Test_SegmentStore(t *testing.T) {
+	gob.Register(resources.Resource{})
+	gob.Register(resources.PodExtra{})
+
+	m, err := temporal.NewSegmentMap(t.TempDir(), temporal.SegmentOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := dao.New(dao.WithResourceMap(m))
+	defer func() {
+		if err := store.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	r := rand.New(rand.NewPCG(0, 1))
+	resource := randomResource(r)
+	store.AddResource(resource)
+
+	got, err := store.GetResourceAt(resource.GetTimestamp(), resource.Uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := []cmp.Option{cmpopts.EquateEmpty(), cmpopts.IgnoreFields(serializable.Time{}, "Location")}
+	if !cmp.Equal(resource, got, opts...) {
+		t.Fatalf("Mismatch: %s", cmp.Diff(resource, got, opts...))
+	}
+}
+
+func TestOpenDir(t *testing.T) {
+	gob.Register(resources.Resource{})
+	gob.Register(resources.PodExtra{})
+
+	dir := t.TempDir()
+	store, err := dao.OpenDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rand.New(rand.NewPCG(0, 1))
+	resource := randomResource(r)
+	store.AddResource(resource)
+	store.SetLabel(resource.GetTimestamp(), "deploy")
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Labels and kinds survive a restart along with the resources
+	store, err = dao.OpenDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := store.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	if got, err := store.GetResourceAt(resource.GetTimestamp(), resource.Uid); err != nil || got.Uid != resource.Uid {
+		t.Errorf("Expected %s to be reopened, got %+v %v", resource.Uid, got, err)
+	}
+	if label := store.GetLabel(resource.GetTimestamp()); label != "deploy" {
+		t.Errorf("Expected the label to be reopened, got %q", label)
+	}
+	if kinds := store.GetMetadata().Kinds; len(kinds) != 1 || kinds[0] != resource.Kind {
+		t.Errorf("Expected the kinds to be reopened, got %v", kinds)
+	}
 }
@@ -0,0 +1,160 @@
+package dao
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/hoyle1974/khronoscope/internal/misc"
+	"github.com/hoyle1974/khronoscope/internal/redact"
+	"github.com/hoyle1974/khronoscope/internal/resources"
+	"github.com/hoyle1974/khronoscope/internal/temporal"
+)
+
+// Conflict is a resource, or label, that two recordings disagree about at the same instant.  The
+// recording being merged into wins.
+type Conflict struct {
+	Timestamp time.Time
+	Key       string // The resource uid, or META_LABEL_KEY for a label
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+func (c Conflict) String() string {
+	if c.Key == META_LABEL_KEY {
+		return fmt.Sprintf("%s label %q", c.Timestamp.Format(time.RFC3339Nano), c.Name)
+	}
+	return fmt.Sprintf("%s %s %s/%s (%s)", c.Timestamp.Format(time.RFC3339Nano), c.Kind, c.Namespace, c.Name, c.Key)
+}
+
+// localStore is implemented by the stores whose history can be read directly
+type localStore interface {
+	local() *dataModelImpl
+}
+
+func (d *dataModelImpl) local() *dataModelImpl {
+	return d
+}
+
+// Merge interleaves the history of other into this store.  Resources are matched by uid and labels
+// by time, a value other recorded at the same instant as this store is skipped, and reported as a
+// conflict if the two differ.  Resources from other are scrubbed with this store's redaction rules
+// when they were recorded with different ones, so the rules still hold for everything in the store.
+func (d *dataModelImpl) Merge(other KhronoStore) ([]Conflict, error) {
+	source, ok := other.(localStore)
+	if !ok {
+		return nil, fmt.Errorf("unable to merge a %T", other)
+	}
+	o := source.local()
+	if o == d {
+		return nil, errors.New("unable to merge a recording into itself")
+	}
+
+	o.lock.Lock()
+	theirs := o.metadata
+	o.lock.Unlock()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	// Nothing is known about what was scrubbed when this store doesn't know, otherwise the rules
+	// other was recorded with may have left behind something ours wouldn't have
+	var rescrub *redact.Rules
+	if ours := d.metadata.Redaction; ours != nil && (theirs.Redaction == nil || !reflect.DeepEqual(*ours, *theirs.Redaction)) {
+		rescrub = ours
+	}
+
+	conflicts := []Conflict{}
+
+	from, to := o.resources.GetTimeRange()
+	for change := range o.resources.Changes(from, to) {
+		if rescrub != nil && change.Value != nil {
+			change.Value = redactValue(*rescrub, change.Value)
+		}
+		if ours, ok := valueAt(d.resources, change.Key, change.Timestamp); ok {
+			if !sameResource(ours, change.Value) {
+				conflicts = append(conflicts, resourceConflict(change, ours))
+			}
+			continue
+		}
+		d.applyLocked(change)
+	}
+
+	from, to = o.meta.GetTimeRange()
+	for change := range o.meta.Changes(from, to) {
+		if change.Key != META_LABEL_KEY {
+			continue
+		}
+		if ours, ok := valueAt(d.meta, change.Key, change.Timestamp); ok {
+			if !bytes.Equal(ours, change.Value) {
+				conflicts = append(conflicts, Conflict{Timestamp: change.Timestamp, Key: META_LABEL_KEY, Name: string(ours)})
+			}
+			continue
+		}
+		d.meta.Add(change.Timestamp, change.Key, change.Value)
+	}
+
+	if d.metadata.ClusterContext == "" {
+		d.metadata.ClusterContext = theirs.ClusterContext
+	}
+	if d.metadata.ServerVersion == "" {
+		d.metadata.ServerVersion = theirs.ServerVersion
+	}
+
+	return conflicts, nil
+}
+
+// applyLocked writes a change read from another store's resources, the caller must hold the lock
+func (d *dataModelImpl) applyLocked(change temporal.Change) {
+	if change.Value == nil {
+		d.resources.Remove(change.Timestamp, change.Key)
+	} else {
+		d.resources.Update(change.Timestamp, change.Key, change.Value)
+	}
+	d.index.apply(change)
+	if info, ok := d.index.keys[change.Key]; ok {
+		d.kinds[info.kind] = true
+	}
+	d.written(change.Timestamp, change.Key)
+}
+
+// valueAt returns the value m recorded for key at exactly timestamp, if there is one
+func valueAt(m temporal.Map, key string, timestamp time.Time) ([]byte, bool) {
+	var value []byte
+	found := false
+	for _, v := range m.History(key, timestamp, timestamp) {
+		value, found = v, true
+	}
+	return value, found
+}
+
+// sameResource compares two encoded resources, gob doesn't encode maps in a stable order so equal
+// resources can have different bytes
+func sameResource(a, b []byte) bool {
+	if bytes.Equal(a, b) {
+		return true
+	}
+	if len(a) == 0 || len(b) == 0 {
+		return false
+	}
+	var ra, rb resources.Resource
+	if misc.DecodeFromBytes(a, &ra) != nil || misc.DecodeFromBytes(b, &rb) != nil {
+		return false
+	}
+	return reflect.DeepEqual(ra, rb)
+}
+
+func resourceConflict(change temporal.Change, ours []byte) Conflict {
+	c := Conflict{Timestamp: change.Timestamp, Key: change.Key}
+	for _, value := range [][]byte{ours, change.Value} {
+		var r resources.Resource
+		if len(value) > 0 && misc.DecodeFromBytes(value, &r) == nil {
+			c.Kind, c.Namespace, c.Name = r.Kind, r.Namespace, r.Name
+			break
+		}
+	}
+	return c
+}
@@ -0,0 +1,150 @@
+package dao_test
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hoyle1974/khronoscope/internal/dao"
+	"github.com/hoyle1974/khronoscope/internal/redact"
+	"github.com/hoyle1974/khronoscope/internal/resources"
+)
+
+func TestMerge(t *testing.T) {
+	start := time.Now()
+	at := func(seconds int) time.Time {
+		return start.Add(time.Duration(seconds) * time.Second)
+	}
+	pod := func(seconds int, phase string) resources.Resource {
+		r := resources.NewResource("uid-pod", at(seconds), "Pod", "default", "web")
+		r.RawJSON = `{"phase":"` + phase + `"}`
+		return r
+	}
+
+	a := dao.New()
+	a.SetMetadata(dao.Metadata{ClusterContext: "alice"})
+	a.AddResource(pod(0, "Pending"))
+	a.UpdateResource(pod(20, "Running"))
+	a.UpdateResource(pod(40, "Succeeded"))
+	a.SetLabel(at(5), "deploy")
+	a.SetLabel(at(30), "ours")
+
+	b := dao.New()
+	b.SetMetadata(dao.Metadata{ClusterContext: "bob", ServerVersion: "v1.31"})
+	b.AddResource(pod(0, "Pending"))    // Same as a, not a conflict
+	b.UpdateResource(pod(10, "Init"))   // Interleaved
+	b.UpdateResource(pod(40, "Failed")) // Disagrees with a
+	b.AddResource(resources.NewResource("uid-svc", at(15), "Service", "default", "web"))
+	b.DeleteResource(resources.NewResource("uid-svc", at(50), "Service", "default", "web"))
+	b.SetLabel(at(25), "theirs")
+	b.SetLabel(at(30), "different")
+
+	conflicts, err := a.Merge(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 2 {
+		t.Fatalf("Expected 2 conflicts, got %v", conflicts)
+	}
+	if c := conflicts[0]; c.Key != "uid-pod" || !c.Timestamp.Equal(at(40)) || c.Kind != "Pod" || c.Name != "web" {
+		t.Fatalf("Unexpected resource conflict %v", c)
+	}
+	if c := conflicts[1]; c.Key != dao.META_LABEL_KEY || !c.Timestamp.Equal(at(30)) || c.Name != "ours" {
+		t.Fatalf("Unexpected label conflict %v", c)
+	}
+
+	check := func(store dao.KhronoStore) {
+		t.Helper()
+		for _, tt := range []struct {
+			seconds int
+			phase   string
+		}{{1, "Pending"}, {11, "Init"}, {21, "Running"}, {41, "Succeeded"}} {
+			r, err := store.GetResourceAt(at(tt.seconds), "uid-pod")
+			if err != nil || r.RawJSON != `{"phase":"`+tt.phase+`"}` {
+				t.Fatalf("At %d expected %s, got %s (%v)", tt.seconds, tt.phase, r.RawJSON, err)
+			}
+		}
+		if len(store.GetResourcesAt(at(16), "Service", "")) != 1 || len(store.GetResourcesAt(at(51), "Service", "")) != 0 {
+			t.Fatalf("Expected the service from the other recording")
+		}
+		for _, tt := range []struct {
+			seconds int
+			label   string
+		}{{6, "deploy"}, {26, "theirs"}, {31, "ours"}} {
+			if label := store.GetLabel(at(tt.seconds)); label != tt.label {
+				t.Fatalf("At %d expected label %s, got %s", tt.seconds, tt.label, label)
+			}
+		}
+		meta := store.GetMetadata()
+		if meta.ClusterContext != "alice" || meta.ServerVersion != "v1.31" || len(meta.Kinds) != 2 {
+			t.Fatalf("Unexpected metadata %+v", meta)
+		}
+		if from, to := store.GetTimeRange(); !from.Equal(at(0)) || !to.Equal(at(50)) {
+			t.Fatalf("Unexpected time range %v to %v", from, to)
+		}
+	}
+	check(a)
+
+	filename := filepath.Join(t.TempDir(), "merged.khron")
+	if err := a.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := dao.NewFromFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(loaded)
+
+	// Merging again changes nothing
+	conflicts, err = a.Merge(b)
+	if err != nil || len(conflicts) != 2 {
+		t.Fatalf("Expected the same 2 conflicts, got %v (%v)", conflicts, err)
+	}
+	check(a)
+
+	if _, err := a.Merge(a); err == nil {
+		t.Fatalf("Expected an error merging a recording into itself")
+	}
+}
+
+func TestMergeRedaction(t *testing.T) {
+	start := time.Now()
+	secret := func(password string) resources.Resource {
+		r := resources.NewResource("uid-secret", start, "Secret", "default", "db")
+		r.RawJSON = `{"kind":"Secret","data":{"password":"` + password + `"}}`
+		return r
+	}
+	rules := &redact.Rules{SecretData: true}
+
+	tests := []struct {
+		ours, theirs *redact.Rules
+		scrubbed     bool
+	}{
+		{rules, nil, true},                          // Nobody knows what they scrubbed
+		{rules, &redact.Rules{HashEnv: true}, true}, // They scrubbed something else
+		{rules, rules, false},                       // The same rules, theirs are kept as they are
+		{nil, nil, false},                           // Nothing to hold the merge to
+	}
+	for _, test := range tests {
+		a := dao.New()
+		a.SetMetadata(dao.Metadata{Redaction: test.ours})
+		b := dao.New()
+		b.SetMetadata(dao.Metadata{Redaction: test.theirs})
+		b.AddResource(secret("hunter2"))
+
+		if _, err := a.Merge(b); err != nil {
+			t.Fatal(err)
+		}
+		r, err := a.GetResourceAt(start, "uid-secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if scrubbed := !strings.Contains(r.RawJSON, "hunter2"); scrubbed != test.scrubbed {
+			t.Errorf("%v into %v: expected scrubbed to be %v, got %s", test.theirs, test.ours, test.scrubbed, r.RawJSON)
+		}
+		if got := a.GetMetadata().Redaction; got != test.ours {
+			t.Errorf("%v into %v: expected the redaction to stay %v, got %v", test.theirs, test.ours, test.ours, got)
+		}
+	}
+}
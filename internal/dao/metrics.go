@@ -0,0 +1,31 @@
+package dao
+
+import (
+	"context"
+	"time"
+
+	"github.com/hoyle1974/khronoscope/internal/metrics"
+)
+
+// DefaultMetricsInterval is how often RunMetrics measures the store
+const DefaultMetricsInterval = time.Minute
+
+// observeQuery records how long a query that started at start took
+func observeQuery(query string, start time.Time) {
+	metrics.QueryDuration.Observe(time.Since(start).Seconds(), query)
+}
+
+// RunMetrics periodically updates the metrics that describe the whole store until ctx is done
+func RunMetrics(ctx context.Context, store KhronoStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		metrics.StoreBytes.Set(float64(store.StoredBytes()))
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
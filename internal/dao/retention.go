@@ -0,0 +1,50 @@
+package dao
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/hoyle1974/khronoscope/internal/config"
+	"github.com/hoyle1974/khronoscope/internal/temporal"
+)
+
+// RetentionPolicy converts the retention config into a temporal.RetentionPolicy, filling in defaults
+func RetentionPolicy(cfg config.Retention) temporal.RetentionPolicy {
+	policy := temporal.RetentionPolicy{
+		FullFidelity: cfg.FullFidelity,
+		Resolution:   cfg.Resolution,
+		MaxAge:       cfg.MaxAge,
+	}
+	if policy.FullFidelity <= 0 {
+		policy.FullFidelity = 6 * time.Hour
+	}
+	if policy.Resolution <= 0 {
+		policy.Resolution = time.Minute
+	}
+	return policy
+}
+
+// RunRetention periodically applies the configured retention policy to the store until ctx is done
+func RunRetention(ctx context.Context, store KhronoStore, cfg config.Retention) {
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	policy := RetentionPolicy(cfg)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			start := time.Now()
+			store.Compact(policy, now)
+			log.Debug().Any("Duration", time.Since(start)).Msg("Applied retention")
+		}
+	}
+}
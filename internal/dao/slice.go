@@ -0,0 +1,110 @@
+package dao
+
+import (
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/hoyle1974/khronoscope/internal/misc"
+	"github.com/hoyle1974/khronoscope/internal/redact"
+	"github.com/hoyle1974/khronoscope/internal/resources"
+	"github.com/hoyle1974/khronoscope/internal/temporal"
+)
+
+// SliceOptions selects part of a recording, empty fields select everything
+type SliceOptions struct {
+	From       time.Time
+	To         time.Time
+	Kinds      []string
+	Namespaces []string      // Cluster scoped resources have the namespace ""
+	Redact     *redact.Rules // Scrub the resources on the way out, on top of whatever was scrubbed when recording
+}
+
+// Slice copies the resources and labels selected by opts into a new store.  Whatever state a
+// resource or label was in at From is written at From, so the slice replays from its first moment.
+func (d *dataModelImpl) Slice(opts SliceOptions) (KhronoStore, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	from, to := d.resources.GetTimeRange()
+	if !opts.From.IsZero() {
+		from = opts.From
+	}
+	if !opts.To.IsZero() {
+		to = opts.To
+	}
+	if to.Before(from) {
+		return nil, errors.New("slice ends before it starts")
+	}
+
+	slice := New().(*dataModelImpl)
+	slice.metadata = d.metadata
+	if opts.Redact != nil {
+		rules := *opts.Redact
+		if d.metadata.Redaction != nil {
+			rules = d.metadata.Redaction.Union(rules)
+		}
+		slice.metadata.Redaction = &rules
+	}
+	write := func(timestamp time.Time, key string, value []byte) {
+		if opts.Redact != nil && value != nil {
+			value = redactValue(*opts.Redact, value)
+		}
+		slice.applyLocked(temporal.Change{Timestamp: timestamp, Key: key, Value: value})
+	}
+
+	for key, info := range d.index.keys {
+		if len(opts.Kinds) > 0 && !slices.Contains(opts.Kinds, info.kind) {
+			continue
+		}
+		if len(opts.Namespaces) > 0 && !slices.Contains(opts.Namespaces, info.namespace) {
+			continue
+		}
+		if info.first.After(to) {
+			continue
+		}
+
+		value := d.resources.GetItem(from, key)
+		live := len(value) > 0
+		if live {
+			write(from, key, value)
+		}
+		for timestamp, value := range d.resources.History(key, from, to) {
+			// Removing something the slice never had would leave an empty history behind
+			if !timestamp.After(from) || (value == nil && !live) {
+				continue
+			}
+			live = value != nil
+			write(timestamp, key, value)
+		}
+	}
+
+	if label := d.meta.GetItem(from, META_LABEL_KEY); len(label) > 0 {
+		slice.meta.Add(from, META_LABEL_KEY, label)
+	}
+	for timestamp, label := range d.meta.History(META_LABEL_KEY, from, to) {
+		if timestamp.After(from) {
+			slice.meta.Add(timestamp, META_LABEL_KEY, label)
+		}
+	}
+
+	return slice, nil
+}
+
+// redactValue scrubs an encoded resource
+func redactValue(rules redact.Rules, value []byte) []byte {
+	var r resources.Resource
+	if err := misc.DecodeFromBytes(value, &r); err != nil {
+		return value
+	}
+	redacted := rules.JSON(r.RawJSON)
+	if redacted == r.RawJSON {
+		return value
+	}
+	r.RawJSON = redacted
+	b, err := misc.EncodeToBytes(r)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
@@ -0,0 +1,129 @@
+package dao_test
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hoyle1974/khronoscope/internal/dao"
+	"github.com/hoyle1974/khronoscope/internal/redact"
+	"github.com/hoyle1974/khronoscope/internal/resources"
+)
+
+func TestSlice(t *testing.T) {
+	start := time.Now()
+	events := indexHistory(start)
+
+	store := dao.New()
+	for _, e := range events {
+		if e.deleted {
+			store.DeleteResource(e.resource)
+		} else {
+			store.AddResource(e.resource)
+		}
+	}
+	store.SetLabel(start.Add(100*time.Second), "before")
+	store.SetLabel(start.Add(300*time.Second), "during")
+	store.SetLabel(start.Add(500*time.Second), "after")
+
+	from, to := start.Add(200*time.Second+time.Millisecond), start.Add(400*time.Second)
+	slice, err := store.Slice(dao.SliceOptions{From: from, To: to, Kinds: []string{"Pod", "Service"}, Namespaces: []string{"default", ""}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(slice dao.KhronoStore) {
+		t.Helper()
+
+		if first, last := slice.GetTimeRange(); !first.Equal(from) || last.After(to) {
+			t.Fatalf("Unexpected time range %v to %v", first.Sub(start), last.Sub(start))
+		}
+		for _, offset := range []time.Duration{200 * time.Second, 201 * time.Second, 300 * time.Second, 399 * time.Second} {
+			ts := start.Add(offset + time.Millisecond)
+			expected := []string{}
+			for uid, r := range expectedAt(events, ts) {
+				if (r.Kind == "Pod" || r.Kind == "Service") && (r.Namespace == "default" || r.Namespace == "") {
+					expected = append(expected, uid+r.RawJSON)
+				}
+			}
+			got := []string{}
+			for _, r := range slice.GetResourcesAt(ts, "", "") {
+				got = append(got, r.Uid+r.RawJSON)
+			}
+			slices.Sort(expected)
+			slices.Sort(got)
+			if !slices.Equal(expected, got) {
+				t.Fatalf("At %v expected %v, got %v", offset, expected, got)
+			}
+		}
+		if len(slice.GetResourcesAt(from.Add(-time.Millisecond), "", "")) != 0 {
+			t.Fatalf("Expected nothing before the slice")
+		}
+
+		for offset, label := range map[time.Duration]string{200 * time.Second: "before", 350 * time.Second: "during"} {
+			if got := slice.GetLabel(start.Add(offset + time.Millisecond)); got != label {
+				t.Fatalf("At %v expected label %q, got %q", offset, label, got)
+			}
+		}
+		if slice.GetNextLabelTime(start.Add(301 * time.Second)).After(to) {
+			t.Fatalf("Expected no labels after the slice")
+		}
+		if kinds := slice.GetMetadata().Kinds; !slices.Equal(kinds, []string{"Pod", "Service"}) {
+			t.Fatalf("Unexpected kinds %v", kinds)
+		}
+	}
+	check(slice)
+
+	filename := filepath.Join(t.TempDir(), "slice.khron")
+	if err := slice.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := dao.NewFromFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(loaded)
+
+	if _, err := store.Slice(dao.SliceOptions{From: to, To: from}); err == nil {
+		t.Fatalf("Expected an error for a slice that ends before it starts")
+	}
+}
+
+func TestSliceRedact(t *testing.T) {
+	start := time.Now()
+	store := dao.New()
+	store.SetMetadata(dao.Metadata{Redaction: &redact.Rules{HashEnv: true}})
+	for i, password := range []string{"aHVudGVyMg==", "c3dvcmRmaXNo"} {
+		r := resources.NewResource("uid-secret", start.Add(time.Duration(i)*time.Second), "Secret", "default", "db")
+		r.RawJSON = `{"kind":"Secret","data":{"password":"` + password + `"}}`
+		store.AddResource(r)
+	}
+
+	slice, err := store.Slice(dao.SliceOptions{Redact: &redact.Rules{SecretData: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "redacted.khron")
+	if err := slice.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := dao.NewFromFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 2 {
+		r, err := loaded.GetResourceAt(start.Add(time.Duration(i)*time.Second), "uid-secret")
+		if err != nil || strings.Contains(r.RawJSON, "aHVudGVyMg") || strings.Contains(r.RawJSON, "c3dvcmRmaXNo") || !strings.Contains(r.RawJSON, redact.Mask) {
+			t.Fatalf("Expected the secret to be redacted, got %s (%v)", r.RawJSON, err)
+		}
+	}
+
+	// The rules the recording was made with are kept along with the new ones
+	rules := loaded.GetMetadata().Redaction
+	if rules == nil || !rules.SecretData || !rules.HashEnv {
+		t.Fatalf("Expected the redaction to be recorded, got %+v", rules)
+	}
+}
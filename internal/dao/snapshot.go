@@ -0,0 +1,101 @@
+package dao
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hoyle1974/khronoscope/internal/misc"
+	"github.com/hoyle1974/khronoscope/internal/resources"
+)
+
+// snapshot is every resource decoded at a point in time.  The UI asks for the whole state on every
+// render and mostly steps the time a little at a time, so rather than decoding everything again the
+// snapshot is rolled forward or back by the handful of resources that changed in between.
+type snapshot struct {
+	at        time.Time
+	resources map[string]resources.Resource
+}
+
+// snapshotAt returns the state at timestamp, reusing and moving the cached snapshot when that's
+// cheaper than starting over.  The caller must hold the lock.
+func (d *dataModelImpl) snapshotAt(timestamp time.Time) *snapshot {
+	if d.snapshot == nil || !d.rollSnapshot(timestamp) {
+		d.snapshot = d.newSnapshot(timestamp)
+	}
+	return d.snapshot
+}
+
+func (d *dataModelImpl) newSnapshot(timestamp time.Time) *snapshot {
+	s := &snapshot{at: timestamp, resources: map[string]resources.Resource{}}
+	for _, key := range d.index.candidates(timestamp, "", "") {
+		s.set(key, d.resources.GetItem(timestamp, key))
+	}
+	return s
+}
+
+// rollSnapshot moves the cached snapshot to timestamp, it gives up and returns false once more
+// resources have changed than the snapshot holds since decoding those would cost as much as a
+// fresh snapshot.
+func (d *dataModelImpl) rollSnapshot(timestamp time.Time) bool {
+	s := d.snapshot
+	if timestamp.Equal(s.at) {
+		return true
+	}
+	limit := max(len(s.resources), 64)
+
+	if timestamp.After(s.at) {
+		// Only the newest value of each key in (at, timestamp] matters
+		latest := map[string][]byte{}
+		for change := range d.resources.Changes(s.at, timestamp) {
+			if !change.Timestamp.After(s.at) {
+				continue
+			}
+			latest[change.Key] = change.Value
+			if len(latest) > limit {
+				return false
+			}
+		}
+		for key, value := range latest {
+			s.set(key, value)
+		}
+	} else {
+		// Anything that changed in (timestamp, at] goes back to the value it had at timestamp
+		changed := map[string]bool{}
+		for change := range d.resources.Changes(timestamp, s.at) {
+			if !change.Timestamp.After(timestamp) {
+				continue
+			}
+			changed[change.Key] = true
+			if len(changed) > limit {
+				return false
+			}
+		}
+		for key := range changed {
+			s.set(key, d.resources.GetItem(timestamp, key))
+		}
+	}
+
+	s.at = timestamp
+	return true
+}
+
+// written keeps the cached snapshot in step with a write, only writes at or before the snapshot's
+// time can change it.  The caller must hold the lock.
+func (d *dataModelImpl) written(timestamp time.Time, key string) {
+	if d.snapshot == nil || timestamp.After(d.snapshot.at) {
+		return
+	}
+	d.snapshot.set(key, d.resources.GetItem(d.snapshot.at, key))
+}
+
+func (s *snapshot) set(key string, value []byte) {
+	if len(value) == 0 {
+		delete(s.resources, key)
+		return
+	}
+	var r resources.Resource
+	if err := misc.DecodeFromBytes(value, &r); err != nil {
+		panic(fmt.Sprintf("Tried to decode %d bytes but got an error: %v", len(value), err))
+	}
+	s.resources[key] = r
+}
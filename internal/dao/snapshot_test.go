@@ -0,0 +1,125 @@
+package dao_test
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/hoyle1974/khronoscope/internal/dao"
+	"github.com/hoyle1974/khronoscope/internal/resources"
+)
+
+func checkResourcesAt(t *testing.T, store dao.KhronoStore, events []indexEvent, ts time.Time) {
+	t.Helper()
+
+	live := expectedAt(events, ts)
+	got := store.GetResourcesAt(ts, "", "")
+	if len(got) != len(live) {
+		t.Fatalf("At %v expected %d resources, got %d", ts, len(live), len(got))
+	}
+	for _, r := range got {
+		expected, ok := live[r.Uid]
+		if !ok || expected.RawJSON != r.RawJSON {
+			t.Fatalf("At %v got unexpected %s %q", ts, r.Uid, r.RawJSON)
+		}
+	}
+}
+
+func TestSnapshotPlayback(t *testing.T) {
+	start := time.Now()
+	events := indexHistory(start)
+
+	store := dao.New()
+	for _, e := range events {
+		if e.deleted {
+			store.DeleteResource(e.resource)
+		} else {
+			store.AddResource(e.resource)
+		}
+	}
+
+	// Small steps in both directions roll the snapshot, big jumps replace it
+	r := rand.New(rand.NewPCG(1, 1))
+	offset := 300 * time.Second
+	for i := 0; i < 500; i++ {
+		switch r.IntN(10) {
+		case 0:
+			offset = time.Duration(r.IntN(600)) * time.Second
+		default:
+			offset += time.Duration(r.IntN(5000)-2500) * time.Millisecond
+		}
+		ts := start.Add(offset)
+		checkResourcesAt(t, store, events, ts)
+
+		// A filtered query at the snapshot's time must agree with the index
+		pods := store.GetResourcesAt(ts, "Pod", "default")
+		for _, p := range pods {
+			if p.Kind != "Pod" || p.Namespace != "default" {
+				t.Fatalf("Unexpected %s %s/%s", p.Uid, p.Kind, p.Namespace)
+			}
+		}
+	}
+}
+
+func TestSnapshotWrites(t *testing.T) {
+	start := time.Now()
+	store := dao.New()
+	events := []indexEvent{}
+	write := func(e indexEvent) {
+		events = append(events, e)
+		slices.SortStableFunc(events, func(a, b indexEvent) int {
+			return a.resource.Timestamp.Time.Compare(b.resource.Timestamp.Time)
+		})
+		if e.deleted {
+			store.DeleteResource(e.resource)
+		} else {
+			store.AddResource(e.resource)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		write(indexEvent{resource: resources.NewResource(fmt.Sprintf("uid-%d", i), start.Add(time.Duration(i)*time.Second), "Pod", "default", fmt.Sprintf("pod-%d", i))})
+	}
+	now := start.Add(time.Minute)
+	checkResourcesAt(t, store, events, now)
+
+	// A write before the snapshot's time changes it
+	late := resources.NewResource("uid-late", start.Add(30*time.Second), "Pod", "default", "late")
+	write(indexEvent{resource: late})
+	checkResourcesAt(t, store, events, now)
+
+	removed := resources.NewResource("uid-3", start.Add(45*time.Second), "Pod", "default", "pod-3")
+	write(indexEvent{resource: removed, deleted: true})
+	checkResourcesAt(t, store, events, now)
+
+	// A write after it doesn't, until the time moves past it
+	future := resources.NewResource("uid-future", start.Add(2*time.Minute), "Pod", "default", "future")
+	write(indexEvent{resource: future})
+	checkResourcesAt(t, store, events, now)
+	checkResourcesAt(t, store, events, start.Add(3*time.Minute))
+	checkResourcesAt(t, store, events, start.Add(5*time.Second))
+}
+
+// BenchmarkPlayback steps through a large recording a second at a time like the VCR does
+func BenchmarkPlayback(b *testing.B) {
+	start := time.Now()
+	store := dao.New()
+	for i := 0; i < 2000; i++ {
+		store.AddResource(resources.NewResource(fmt.Sprintf("uid-%d", i), start, "ConfigMap", "default", fmt.Sprintf("name-%d", i)))
+	}
+	for i := 0; i < 3600; i++ {
+		r := resources.NewResource(fmt.Sprintf("uid-%d", i%2000), start.Add(time.Duration(i)*time.Second), "ConfigMap", "default", fmt.Sprintf("name-%d", i%2000))
+		r.RawJSON = fmt.Sprintf(`{"generation":%d}`, i)
+		store.UpdateResource(r)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ts := start.Add(time.Duration(i%3600) * time.Second)
+		if len(store.GetResourcesAt(ts, "", "")) != 2000 {
+			b.Fatalf("Expected 2000 resources")
+		}
+	}
+}
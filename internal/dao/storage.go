@@ -0,0 +1,50 @@
+package dao
+
+import (
+	"github.com/hoyle1974/khronoscope/internal/config"
+	"github.com/hoyle1974/khronoscope/internal/misc"
+	"github.com/hoyle1974/khronoscope/internal/resources"
+	"github.com/hoyle1974/khronoscope/internal/temporal"
+)
+
+// DefaultDiffer is the temporal.Differ new resource maps are stored with.  It is bsdiff unless the
+// config opts in to temporal.ResourceDiffer.
+var DefaultDiffer = temporal.BsDiffer
+
+// KeyframePolicies picks how often each kind of resource is stored whole rather than as a diff.
+// DefaultKind applies to any kind that isn't listed.  Every kind gets a keyframe every
+// temporal.KEYFRAME_RATE values unless the config opts in to a MaxDiffRatio, which sizes chains
+// like temporal.AdaptiveKeyframePolicy.
+var KeyframePolicies = map[string]temporal.KeyframePolicy{
+	DefaultKind: temporal.FixedKeyframePolicy,
+}
+
+const DefaultKind = "default"
+
+// ApplyConfig sets how resource history is stored from the config file
+func ApplyConfig(cfg config.Config) error {
+	if len(cfg.Differ) > 0 {
+		if _, err := temporal.GetDiffer(cfg.Differ); err != nil {
+			return err
+		}
+		DefaultDiffer = cfg.Differ
+	}
+	for kind, k := range cfg.Keyframes {
+		KeyframePolicies[kind] = temporal.KeyframePolicy{MaxDiffs: k.MaxDiffs, MaxDiffRatio: k.MaxDiffRatio}
+	}
+	return nil
+}
+
+func resourceMapOptions() []temporal.Option {
+	return []temporal.Option{temporal.WithDiffer(DefaultDiffer), temporal.WithKeyframePolicy(keyframePolicy)}
+}
+
+func keyframePolicy(key string, value []byte) temporal.KeyframePolicy {
+	var r resources.Resource
+	if err := misc.DecodeFromBytes(value, &r); err == nil {
+		if policy, ok := KeyframePolicies[r.Kind]; ok {
+			return policy
+		}
+	}
+	return KeyframePolicies[DefaultKind]
+}
@@ -0,0 +1,247 @@
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/hoyle1974/khronoscope/internal/jsonpatch"
+	"github.com/hoyle1974/khronoscope/internal/redact"
+)
+
+// Audit imports API server audit logs (audit.k8s.io/v1 events, one JSON object per line).  Only
+// events in the ResponseComplete stage that changed something are used, dry runs are not, and the objects come from
+// the response so the audit policy needs the RequestResponse level for the resources of interest.
+// Events logged at a lower level still show up, as partial objects built from what the request had
+// or, failing that, just the name.
+//
+// API servers write their logs independently and rotated logs may be read in any order, so every
+// event is read first and replayed in time order.
+type Audit struct {
+	rules  redact.Rules
+	events []auditEvent
+	seen   map[string]bool
+	stats  Stats
+}
+
+type auditEvent struct {
+	AuditID        string          `json:"auditID"`
+	Stage          string          `json:"stage"`
+	Verb           string          `json:"verb"`
+	RequestURI     string          `json:"requestURI"`
+	ObjectRef      *auditObjectRef `json:"objectRef"`
+	ResponseStatus *struct {
+		Code int `json:"code"`
+	} `json:"responseStatus"`
+	RequestObject  json.RawMessage `json:"requestObject"`
+	ResponseObject json.RawMessage `json:"responseObject"`
+	StageTimestamp time.Time       `json:"stageTimestamp"`
+}
+
+type auditObjectRef struct {
+	Resource    string `json:"resource"`
+	Namespace   string `json:"namespace"`
+	Name        string `json:"name"`
+	UID         string `json:"uid"`
+	APIGroup    string `json:"apiGroup"`
+	APIVersion  string `json:"apiVersion"`
+	Subresource string `json:"subresource"`
+}
+
+// NewAudit returns an importer that scrubs what it imports with rules
+func NewAudit(rules redact.Rules) *Audit {
+	return &Audit{rules: rules, seen: map[string]bool{}}
+}
+
+// Read adds the events in an audit log, events already read from another log are ignored.  Lines
+// that aren't events, like a line cut short by a crash, are skipped.
+func (a *Audit) Read(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		a.stats.Read++
+
+		var e auditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil || e.StageTimestamp.IsZero() {
+			a.stats.Skipped++
+			continue
+		}
+		if e.Stage != "ResponseComplete" || e.ObjectRef == nil || !e.succeeded() || e.dryRun() || a.seen[e.AuditID] {
+			a.stats.Skipped++
+			continue
+		}
+		if e.AuditID != "" {
+			a.seen[e.AuditID] = true
+		}
+		a.events = append(a.events, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("unable to read audit log: %w", err)
+	}
+	return nil
+}
+
+// Import replays every event read so far into store in time order
+func (a *Audit) Import(store Store) Stats {
+	slices.SortStableFunc(a.events, func(x, y auditEvent) int {
+		return x.StageTimestamp.Compare(y.StageTimestamp)
+	})
+
+	t := newTracker(store, a.rules)
+	t.stats = a.stats
+	learned := map[string]string{}
+	for _, e := range a.events {
+		if !e.apply(t, learned) {
+			t.stats.Skipped++
+		}
+	}
+	a.events = nil
+	return t.stats
+}
+
+func (e *auditEvent) succeeded() bool {
+	return e.ResponseStatus == nil || (e.ResponseStatus.Code >= 200 && e.ResponseStatus.Code < 300)
+}
+
+// dryRun is whether the request only said what it would have changed
+func (e *auditEvent) dryRun() bool {
+	u, err := url.Parse(e.RequestURI)
+	return err == nil && u.Query().Get("dryRun") != ""
+}
+
+// name identifies a resource by its name, the name is only unique within a resource type
+func (ref *auditObjectRef) name(namespace, name string) string {
+	return ref.APIGroup + "/" + ref.Resource + "/" + namespace + "/" + name
+}
+
+// apply replays an event, returning false if it didn't change anything
+func (e *auditEvent) apply(t *tracker, learned map[string]string) bool {
+	ref := e.ObjectRef
+	if ref.Subresource != "" && ref.Subresource != "status" {
+		return false
+	}
+
+	switch e.Verb {
+	case "create", "update", "patch":
+		return e.write(t, learned)
+	case "delete":
+		_, meta := decodeObject(e.ResponseObject)
+		uid := ref.UID
+		if meta.Kind != "Status" && meta.Metadata.UID != "" {
+			uid = meta.Metadata.UID
+		}
+		return t.remove(t.key(uid, ref.name(ref.Namespace, ref.Name), e.StageTimestamp), e.StageTimestamp)
+	case "deletecollection":
+		var list struct {
+			Items []json.RawMessage `json:"items"`
+		}
+		if json.Unmarshal(e.ResponseObject, &list) != nil {
+			return false
+		}
+		removed := false
+		for _, item := range list.Items {
+			var meta object
+			if json.Unmarshal(item, &meta) != nil {
+				continue
+			}
+			name := ref.name(meta.Metadata.Namespace, meta.Metadata.Name)
+			removed = t.remove(t.key(meta.Metadata.UID, name, e.StageTimestamp), e.StageTimestamp) || removed
+		}
+		return removed
+	}
+	return false
+}
+
+func (e *auditEvent) write(t *tracker, learned map[string]string) bool {
+	ref := e.ObjectRef
+	partial := false
+
+	obj, meta := decodeObject(e.ResponseObject)
+	if obj == nil && e.Verb != "patch" {
+		// What the client sent, without anything the server fills in
+		obj, meta = decodeObject(e.RequestObject)
+		partial = true
+	}
+	if obj != nil {
+		learned[ref.Resource] = meta.Kind
+	}
+
+	namespace, name := ref.Namespace, ref.Name
+	if meta.Metadata.Name != "" {
+		namespace, name = meta.Metadata.Namespace, meta.Metadata.Name
+	}
+	if name == "" {
+		return false
+	}
+	uid := meta.Metadata.UID
+	if uid == "" {
+		uid = ref.UID
+	}
+	key := t.key(uid, ref.name(namespace, name), e.StageTimestamp)
+	prev, existed := t.live[key]
+
+	if obj == nil {
+		partial = true
+		known := prev.RawJSON
+		if !existed {
+			// All that is known is the name
+			metadata := map[string]any{"name": name}
+			if namespace != "" {
+				metadata["namespace"] = namespace
+			}
+			if uid != "" {
+				metadata["uid"] = uid
+			}
+			stub, _ := json.Marshal(map[string]any{
+				"apiVersion": ref.apiVersion(),
+				"kind":       kindFor(learned, ref.Resource),
+				"metadata":   metadata,
+			})
+			known = string(stub)
+		} else if e.Verb != "patch" || !mergeable(e.RequestObject) {
+			// Something changed but there is no way to tell what
+			return false
+		}
+		if e.Verb == "patch" && mergeable(e.RequestObject) {
+			// Merge and strategic merge patches are close enough to apply a patch to what we know
+			if merged, err := jsonpatch.MergePatch([]byte(known), e.RequestObject); err == nil {
+				known = string(merged)
+			}
+		}
+		if json.Unmarshal([]byte(known), &obj) != nil {
+			return false
+		}
+	}
+
+	kind, _ := obj["kind"].(string)
+	if kind == "" {
+		kind = kindFor(learned, ref.Resource)
+	}
+	if partial {
+		t.stats.Partial++
+	}
+	t.write(newResource(t.rules, key, e.StageTimestamp, kind, obj), ref.name(namespace, name))
+	return true
+}
+
+func (ref *auditObjectRef) apiVersion() string {
+	if ref.APIGroup == "" {
+		return ref.APIVersion
+	}
+	return ref.APIGroup + "/" + ref.APIVersion
+}
+
+// mergeable is true for patches that are objects, JSON patches are lists of operations on paths
+// that might not exist in what is known
+func mergeable(patch json.RawMessage) bool {
+	trimmed := bytes.TrimSpace(patch)
+	return len(trimmed) > 0 && trimmed[0] == '{'
+}
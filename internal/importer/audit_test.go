@@ -0,0 +1,117 @@
+package importer
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hoyle1974/khronoscope/internal/dao"
+	"github.com/hoyle1974/khronoscope/internal/redact"
+)
+
+func TestAudit(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	at := func(seconds float64) time.Time {
+		return start.Add(time.Duration(seconds * float64(time.Second)))
+	}
+	event := func(id string, seconds float64, verb, resource, name, uid, request, response string) string {
+		line := fmt.Sprintf(`{"kind":"Event","apiVersion":"audit.k8s.io/v1","auditID":%q,"stage":"ResponseComplete","verb":%q,`+
+			`"objectRef":{"resource":%q,"namespace":"default","name":%q,"uid":%q,"apiVersion":"v1"},"responseStatus":{"code":200},`+
+			`"stageTimestamp":%q`, id, verb, resource, name, uid, at(seconds).Format(time.RFC3339Nano))
+		if request != "" {
+			line += `,"requestObject":` + request
+		}
+		if response != "" {
+			line += `,"responseObject":` + response
+		}
+		return line + "}"
+	}
+	pod := func(phase string) string {
+		return `{"kind":"Pod","apiVersion":"v1","metadata":{"name":"web","namespace":"default","uid":"uid-pod"},"status":{"phase":"` + phase + `"}}`
+	}
+
+	// Out of order, as if the logs of two API servers were read one after the other
+	lines := []string{
+		event("a", 3, "update", "pods", "web", "uid-pod", "", pod("Running")),
+		event("b", 1, "create", "pods", "web", "", "", pod("Pending")),
+		event("c", 2, "patch", "configmaps", "cfg", "", `{"data":{"a":"1"}}`, ""),
+		event("d", 4, "patch", "configmaps", "cfg", "", "",
+			`{"kind":"ConfigMap","apiVersion":"v1","metadata":{"name":"cfg","namespace":"default","uid":"uid-cfg"},"data":{"a":"2"}}`),
+		event("e", 5, "patch", "pods", "web", "", `{"metadata":{"labels":{"app":"web"}}}`, ""),
+		event("f", 6, "delete", "pods", "web", "", "", `{"kind":"Status","status":"Success"}`),
+		event("a", 3, "update", "pods", "web", "uid-pod", "", pod("Running")),
+		event("g", 3, "get", "pods", "web", "", "", pod("Running")),
+		strings.Replace(event("h", 3, "update", "pods", "web", "", "", pod("Failed")), "ResponseComplete", "RequestReceived", 1),
+		strings.Replace(event("i", 3, "update", "pods", "web", "", "", pod("Failed")), `"code":200`, `"code":409`, 1),
+		`{"kind":"Event","auditID":"j","stage":"ResponseCompl`,
+		strings.Replace(event("k", 5.2, "delete", "pods", "web", "", "", `{"kind":"Status","status":"Success"}`),
+			`"verb"`, `"requestURI":"/api/v1/namespaces/default/pods/web?dryRun=All","verb"`, 1),
+	}
+
+	audit := NewAudit(redact.Rules{})
+	if err := audit.Read(strings.NewReader(strings.Join(lines[:6], "\n") + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := audit.Read(strings.NewReader(strings.Join(lines[6:], "\n"))); err != nil {
+		t.Fatal(err)
+	}
+	store := dao.New()
+	stats := audit.Import(store)
+
+	expectedStats := Stats{Read: 12, Imported: 7, Partial: 2, Skipped: 6}
+	if stats != expectedStats {
+		t.Errorf("Expected %+v, got %+v", expectedStats, stats)
+	}
+
+	expected := []struct {
+		seconds  float64
+		contents map[string]string // Key to something in the json
+	}{
+		{0.5, map[string]string{}},
+		{1.5, map[string]string{"uid-pod": `"Pending"`}},
+		{2.5, map[string]string{"uid-pod": `"Pending"`, "import:/configmaps/default/cfg": `"data":{"a":"1"}`}},
+		{4.5, map[string]string{"uid-pod": `"Running"`, "uid-cfg": `"a":"2"`}},
+		{5.5, map[string]string{"uid-pod": `"labels":{"app":"web"}`, "uid-cfg": `"a":"2"`}},
+		{6.5, map[string]string{"uid-cfg": `"a":"2"`}},
+	}
+	for _, e := range expected {
+		found := store.GetResourcesAt(at(e.seconds), "", "")
+		if len(found) != len(e.contents) {
+			t.Errorf("At %v expected %d resources, got %v", e.seconds, len(e.contents), found)
+			continue
+		}
+		for _, r := range found {
+			contains, ok := e.contents[r.Uid]
+			if !ok {
+				t.Errorf("At %v didn't expect %s", e.seconds, r.Uid)
+			} else if !strings.Contains(r.RawJSON, contains) {
+				t.Errorf("At %v expected %s to contain %s, got %s", e.seconds, r.Uid, contains, r.RawJSON)
+			}
+		}
+	}
+
+	// The patched pod kept what it had before the patch, and is still a pod
+	for _, r := range store.GetResourcesAt(at(5.5), "Pod", "default") {
+		if !strings.Contains(r.RawJSON, `"Running"`) || r.Extra == nil {
+			t.Errorf("Expected the patch to apply to the running pod, got %s", r.RawJSON)
+		}
+	}
+}
+
+func TestAuditRedact(t *testing.T) {
+	line := `{"auditID":"a","stage":"ResponseComplete","verb":"create","objectRef":{"resource":"secrets","namespace":"default","name":"token"},` +
+		`"stageTimestamp":"2024-05-01T12:00:00Z","responseObject":{"kind":"Secret","metadata":{"name":"token","namespace":"default","uid":"uid-secret"},"data":{"token":"c2VjcmV0"}}}`
+
+	audit := NewAudit(redact.Rules{SecretData: true})
+	if err := audit.Read(strings.NewReader(line)); err != nil {
+		t.Fatal(err)
+	}
+	store := dao.New()
+	audit.Import(store)
+
+	found := store.GetResourcesAt(time.Date(2024, 5, 1, 12, 0, 1, 0, time.UTC), "Secret", "default")
+	if len(found) != 1 || strings.Contains(found[0].RawJSON, "c2VjcmV0") {
+		t.Errorf("Expected the secret to be redacted, got %v", found)
+	}
+}
@@ -0,0 +1,187 @@
+// Package importer builds recordings from sources other than a live watch, like API server audit
+// logs, so incidents that happened before anyone was recording can still be replayed.
+package importer
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/hoyle1974/khronoscope/internal/redact"
+	"github.com/hoyle1974/khronoscope/internal/resources"
+	"github.com/hoyle1974/khronoscope/internal/serializable"
+)
+
+// Store is where imported resources are written, a dao.KhronoStore
+type Store interface {
+	AddResource(resources.Resource)
+	UpdateResource(resources.Resource)
+	DeleteResource(resources.Resource)
+}
+
+// Stats counts what an import did
+type Stats struct {
+	Read     int // Entries read from the source
+	Imported int // Changes written to the store
+	Partial  int // Changes written from an incomplete object
+	Skipped  int // Entries that didn't describe a change
+}
+
+// commonKinds maps the plural resource names used in URLs to kinds, for when the kind can't be
+// learned from an object
+var commonKinds = map[string]string{
+	"configmaps":               "ConfigMap",
+	"cronjobs":                 "CronJob",
+	"daemonsets":               "DaemonSet",
+	"deployments":              "Deployment",
+	"endpoints":                "Endpoints",
+	"endpointslices":           "EndpointSlice",
+	"events":                   "Event",
+	"horizontalpodautoscalers": "HorizontalPodAutoscaler",
+	"ingresses":                "Ingress",
+	"jobs":                     "Job",
+	"leases":                   "Lease",
+	"namespaces":               "Namespace",
+	"networkpolicies":          "NetworkPolicy",
+	"nodes":                    "Node",
+	"persistentvolumeclaims":   "PersistentVolumeClaim",
+	"persistentvolumes":        "PersistentVolume",
+	"pods":                     "Pod",
+	"replicasets":              "ReplicaSet",
+	"roles":                    "Role",
+	"rolebindings":             "RoleBinding",
+	"secrets":                  "Secret",
+	"serviceaccounts":          "ServiceAccount",
+	"services":                 "Service",
+	"statefulsets":             "StatefulSet",
+}
+
+// kindFor guesses the kind of a plural resource name, preferring what has been learned from objects
+func kindFor(learned map[string]string, resource string) string {
+	if kind, ok := learned[resource]; ok {
+		return kind
+	}
+	if kind, ok := commonKinds[resource]; ok {
+		return kind
+	}
+	singular := strings.TrimSuffix(resource, "s")
+	if singular == "" {
+		return resource
+	}
+	return strings.ToUpper(singular[:1]) + singular[1:]
+}
+
+// object is the parts of a kubernetes object the importers need
+type object struct {
+	Kind     string `json:"kind"`
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+		UID       string `json:"uid"`
+	} `json:"metadata"`
+}
+
+// decodeObject returns raw as a generic object, nil unless it is a whole object with a kind and name
+func decodeObject(raw json.RawMessage) (map[string]any, object) {
+	var meta object
+	if len(raw) == 0 || json.Unmarshal(raw, &meta) != nil || meta.Kind == "" || meta.Metadata.Name == "" {
+		return nil, meta
+	}
+	var obj map[string]any
+	if json.Unmarshal(raw, &obj) != nil {
+		return nil, meta
+	}
+	return obj, meta
+}
+
+// newResource converts an object to a resource, scrubbing it on the way
+func newResource(rules redact.Rules, key string, timestamp time.Time, kind string, obj map[string]any) resources.Resource {
+	rules.Object(obj)
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		raw = []byte("{}")
+	}
+	metadata, _ := obj["metadata"].(map[string]any)
+	name, _ := metadata["name"].(string)
+	namespace, _ := metadata["namespace"].(string)
+
+	return resources.WithExtra(resources.Resource{
+		Uid:       key,
+		Timestamp: serializable.Time{Time: timestamp},
+		Kind:      kind,
+		Namespace: namespace,
+		Name:      name,
+		RawJSON:   string(raw),
+	})
+}
+
+// syntheticPrefix marks keys made up for resources whose uid was never seen
+const syntheticPrefix = "import:"
+
+// tracker turns a sequence of observed objects into adds, updates and deletes
+type tracker struct {
+	store Store
+	rules redact.Rules
+	stats Stats
+	live  map[string]resources.Resource // What each resource that currently exists last looked like
+	names map[string]string             // The key of the resource that currently has a name
+	named map[string]string             // The name each key currently has
+}
+
+func newTracker(store Store, rules redact.Rules) *tracker {
+	return &tracker{
+		store: store,
+		rules: rules,
+		live:  map[string]resources.Resource{},
+		names: map[string]string{},
+		named: map[string]string{},
+	}
+}
+
+// key returns the key for a resource, the uid if known, otherwise whatever currently has the name
+// or a key made up from the name.  Two resources can't have the same name at once, so one that
+// has a name someone else holds must have replaced it without the delete being seen.
+func (t *tracker) key(uid, name string, timestamp time.Time) string {
+	existing, ok := t.names[name]
+	if uid == "" {
+		if ok {
+			return existing
+		}
+		return syntheticPrefix + name
+	}
+	if ok && existing != uid {
+		t.remove(existing, timestamp)
+	}
+	return uid
+}
+
+// write adds or updates a resource
+func (t *tracker) write(r resources.Resource, name string) {
+	if _, ok := t.live[r.Uid]; ok {
+		t.store.UpdateResource(r)
+	} else {
+		t.store.AddResource(r)
+	}
+	t.live[r.Uid] = r
+	if old, ok := t.named[r.Uid]; ok && old != name {
+		delete(t.names, old)
+	}
+	t.names[name] = r.Uid
+	t.named[r.Uid] = name
+	t.stats.Imported++
+}
+
+// remove deletes a resource, resources that were never seen are ignored
+func (t *tracker) remove(key string, timestamp time.Time) bool {
+	r, ok := t.live[key]
+	if !ok {
+		return false
+	}
+	r.Timestamp = serializable.Time{Time: timestamp}
+	t.store.DeleteResource(r)
+	delete(t.live, key)
+	delete(t.names, t.named[key])
+	delete(t.named, key)
+	t.stats.Imported++
+	return true
+}
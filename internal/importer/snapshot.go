@@ -0,0 +1,255 @@
+package importer
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"k8s.io/apimachinery/pkg/util/yaml"
+
+	"github.com/hoyle1974/khronoscope/internal/redact"
+)
+
+// Snapshots imports periodic dumps of a cluster, like the output of kubectl get -A -o yaml saved
+// every few minutes or a series of must-gather directories.  Consecutive snapshots are diffed so a
+// resource shows up when it first appears, changes when it does and is deleted when it's missing.
+// Anything that happened between snapshots is lost.
+//
+// Each file or directory in a snapshot directory is one snapshot, unless it is a must-gather
+// directory itself.  A snapshot is timed by a timestamp in
+// its name, by the timestamp file must-gather writes or failing that by when it was modified.
+type Snapshots struct {
+	rules     redact.Rules
+	snapshots []snapshotSource
+}
+
+type snapshotSource struct {
+	fsys fs.FS
+	path string
+	at   time.Time
+}
+
+// NewSnapshots returns an importer that scrubs what it imports with rules
+func NewSnapshots(rules redact.Rules) *Snapshots {
+	return &Snapshots{rules: rules}
+}
+
+// timestampPattern finds timestamps like 2024-05-01T12:00:00Z, 20240501-120000 or 2024-05-01_12-00-00
+var timestampPattern = regexp.MustCompile(`(\d{4})-?(\d{2})-?(\d{2})[T_ -]?(\d{2})[:-]?(\d{2})[:-]?(\d{2})`)
+
+// nameTime finds the time in a snapshot's name, names without a zone are UTC
+func nameTime(name string) (time.Time, bool) {
+	name = strings.TrimSuffix(name, path.Ext(name))
+	if len(name) == 10 {
+		if seconds, err := strconv.ParseInt(name, 10, 64); err == nil {
+			return time.Unix(seconds, 0), true
+		}
+	}
+	if match := timestampPattern.FindStringSubmatch(name); match != nil {
+		if t, err := time.Parse("20060102150405", strings.Join(match[1:], "")); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// mustGatherTime reads the first line of a must-gather timestamp file, when it started
+func mustGatherTime(fsys fs.FS, name string) (time.Time, bool) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return time.Time{}, false
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return time.Time{}, false
+	}
+	line, _, _ := strings.Cut(scanner.Text(), " m=") // Drop the monotonic clock
+	t, err := time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", strings.TrimSpace(line))
+	return t, err == nil
+}
+
+// isManifest is true for files that might hold kubernetes objects
+func isManifest(name string) bool {
+	switch path.Ext(name) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
+
+// ReadDir finds the snapshots in the root of fsys, they aren't read until they're imported
+func (s *Snapshots) ReadDir(fsys fs.FS) error {
+	if at, ok := mustGatherTime(fsys, "timestamp"); ok {
+		// A single must-gather
+		s.snapshots = append(s.snapshots, snapshotSource{fsys: fsys, path: ".", at: at})
+		return nil
+	}
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && !isManifest(entry.Name()) {
+			continue
+		}
+		at, found := nameTime(entry.Name())
+		if entry.IsDir() {
+			err = fs.WalkDir(fsys, entry.Name(), func(name string, d fs.DirEntry, err error) error {
+				if err != nil || d.IsDir() {
+					return err
+				}
+				if !found && d.Name() == "timestamp" {
+					at, found = mustGatherTime(fsys, name)
+				}
+				if info, err := d.Info(); err == nil && !found && info.ModTime().After(at) {
+					at = info.ModTime()
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		} else if !found {
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			at = info.ModTime()
+		}
+		s.snapshots = append(s.snapshots, snapshotSource{fsys: fsys, path: entry.Name(), at: at})
+	}
+	return nil
+}
+
+// Import diffs every snapshot found so far, in time order, into store
+func (s *Snapshots) Import(store Store) (Stats, error) {
+	slices.SortStableFunc(s.snapshots, func(x, y snapshotSource) int {
+		return x.at.Compare(y.at)
+	})
+
+	t := newTracker(store, s.rules)
+	for _, snapshot := range s.snapshots {
+		if err := s.importSnapshot(t, snapshot); err != nil {
+			return t.stats, err
+		}
+	}
+	s.snapshots = nil
+	return t.stats, nil
+}
+
+func (s *Snapshots) importSnapshot(t *tracker, snapshot snapshotSource) error {
+	seen := map[string]bool{}
+	complete := true
+	err := fs.WalkDir(snapshot.fsys, snapshot.path, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !isManifest(name) {
+			return err
+		}
+		f, err := snapshot.fsys.Open(name)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+
+		decoder := yaml.NewYAMLOrJSONDecoder(f, 4096)
+		for {
+			var obj map[string]any
+			if err := decoder.Decode(&obj); errors.Is(err, io.EOF) {
+				return nil
+			} else if err != nil {
+				// Support bundles have all sorts in them, the rest of the snapshot is still useful
+				log.Warn().Err(err).Str("file", name).Msg("unable to read manifest")
+				t.stats.Skipped++
+				complete = false
+				return nil
+			} else if obj == nil {
+				continue // An empty document
+			}
+			for _, item := range listItems(obj) {
+				s.observe(t, snapshot.at, item, seen)
+			}
+		}
+	})
+	if err != nil || !complete {
+		return err
+	}
+
+	// Whatever wasn't in this snapshot has been deleted, unless it could have been in a file that
+	// couldn't be read
+	missing := []string{}
+	for key := range t.live {
+		if !seen[key] {
+			missing = append(missing, key)
+		}
+	}
+	slices.Sort(missing)
+	for _, key := range missing {
+		t.remove(key, snapshot.at)
+	}
+	return nil
+}
+
+// listItems returns the objects in a list, kubectl fills in each item's kind but the API doesn't
+func listItems(obj map[string]any) []map[string]any {
+	kind, _ := obj["kind"].(string)
+	items, ok := obj["items"].([]any)
+	if !ok || !strings.HasSuffix(kind, "List") {
+		return []map[string]any{obj}
+	}
+	list := make([]map[string]any, 0, len(items))
+	for _, item := range items {
+		if item, ok := item.(map[string]any); ok {
+			if _, ok := item["kind"]; !ok && kind != "List" {
+				item["kind"] = strings.TrimSuffix(kind, "List")
+				item["apiVersion"] = obj["apiVersion"]
+			}
+			list = append(list, listItems(item)...)
+		}
+	}
+	return list
+}
+
+// observe records an object as it was in a snapshot, writing it if it's new or changed
+func (s *Snapshots) observe(t *tracker, at time.Time, obj map[string]any, seen map[string]bool) {
+	t.stats.Read++
+	kind, _ := obj["kind"].(string)
+	metadata, _ := obj["metadata"].(map[string]any)
+	name, _ := metadata["name"].(string)
+	if kind == "" || name == "" {
+		t.stats.Skipped++
+		return
+	}
+	namespace, _ := metadata["namespace"].(string)
+	uid, _ := metadata["uid"].(string)
+	apiVersion, _ := obj["apiVersion"].(string)
+	group, _, _ := strings.Cut(apiVersion, "/")
+	if !strings.Contains(apiVersion, "/") {
+		group = ""
+	}
+	named := group + "/" + kind + "/" + namespace + "/" + name
+
+	key := t.key(uid, named, at)
+	if seen[key] {
+		// The same object in more than one file
+		return
+	}
+	seen[key] = true
+
+	r := newResource(t.rules, key, at, kind, obj)
+	if prev, ok := t.live[key]; ok && prev.RawJSON == r.RawJSON {
+		return
+	}
+	t.write(r, named)
+}
@@ -0,0 +1,130 @@
+package importer
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/hoyle1974/khronoscope/internal/dao"
+	"github.com/hoyle1974/khronoscope/internal/redact"
+)
+
+func TestSnapshots(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	at := func(minutes float64) time.Time {
+		return start.Add(time.Duration(minutes * float64(time.Minute)))
+	}
+	pod := func(uid, phase string) string {
+		return `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+  namespace: default
+  uid: ` + uid + `
+  resourceVersion: "1"
+status:
+  phase: ` + phase + `
+`
+	}
+	cfg := `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: cfg
+  namespace: default
+data:
+  a: "1"
+`
+
+	fsys := fstest.MapFS{
+		// Out of order by name, and one of them is a must-gather
+		"cluster-20240501-120500.yaml": {Data: []byte(pod("uid-1", "Running") + "---\n" + cfg)},
+		"cluster-20240501-120000.yaml": {Data: []byte(pod("uid-1", "Pending") + "---\n" + cfg + "---\n" + `
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Service
+  metadata:
+    name: web
+    namespace: default
+    uid: uid-svc
+`)},
+		"must-gather/timestamp": {Data: []byte("2024-05-01 12:10:00.5 +0000 UTC m=+0.043817006\n2024-05-01 12:11:00 +0000 UTC m=+60.0\n")},
+		"must-gather/namespaces/default/core/pods.yaml": {Data: []byte(`
+apiVersion: v1
+kind: PodList
+items:
+- metadata:
+    name: web
+    namespace: default
+    uid: uid-2
+  status:
+    phase: Running
+`)},
+		"must-gather/namespaces/default/pods/web/web.log": {Data: []byte("not a manifest")},
+		"notes.txt":   {Data: []byte("not a snapshot")},
+		"broken.yaml": {Data: []byte("kind: [Pod"), ModTime: at(20)},
+	}
+
+	snapshots := NewSnapshots(redact.Rules{})
+	if err := snapshots.ReadDir(fsys); err != nil {
+		t.Fatal(err)
+	}
+	store := dao.New()
+	stats, err := snapshots.Import(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pending pod, config map and service added, pod updated, pod replaced and the rest deleted,
+	// the broken snapshot doesn't delete anything
+	expectedStats := Stats{Read: 6, Imported: 8, Skipped: 1}
+	if stats != expectedStats {
+		t.Errorf("Expected %+v, got %+v", expectedStats, stats)
+	}
+
+	expected := []struct {
+		minutes  float64
+		contents map[string]string // Key to something in the json
+	}{
+		{-1, map[string]string{}},
+		{1, map[string]string{"uid-1": `"Pending"`, "uid-svc": `"Service"`, "import:/ConfigMap/default/cfg": `"a":"1"`}},
+		{6, map[string]string{"uid-1": `"Running"`, "import:/ConfigMap/default/cfg": `"a":"1"`}},
+		{11, map[string]string{"uid-2": `"kind":"Pod"`}},
+		{21, map[string]string{"uid-2": `"kind":"Pod"`}},
+	}
+	for _, e := range expected {
+		found := store.GetResourcesAt(at(e.minutes), "", "")
+		if len(found) != len(e.contents) {
+			t.Errorf("At %v expected %d resources, got %v", e.minutes, len(e.contents), found)
+			continue
+		}
+		for _, r := range found {
+			contains, ok := e.contents[r.Uid]
+			if !ok {
+				t.Errorf("At %v didn't expect %s", e.minutes, r.Uid)
+			} else if !strings.Contains(r.RawJSON, contains) {
+				t.Errorf("At %v expected %s to contain %s, got %s", e.minutes, r.Uid, contains, r.RawJSON)
+			}
+		}
+	}
+}
+
+func TestSnapshotTimes(t *testing.T) {
+	expected := map[string]time.Time{
+		"2024-05-01T12:30:15Z.yaml":   time.Date(2024, 5, 1, 12, 30, 15, 0, time.UTC),
+		"dump-20240501-123015.yaml":   time.Date(2024, 5, 1, 12, 30, 15, 0, time.UTC),
+		"2024-05-01_12-30-15":         time.Date(2024, 5, 1, 12, 30, 15, 0, time.UTC),
+		"1714566615.json":             time.Unix(1714566615, 0),
+		"must-gather.local.123456789": {},
+	}
+	for name, expect := range expected {
+		at, ok := nameTime(name)
+		if ok != !expect.IsZero() || !at.Equal(expect) {
+			t.Errorf("%s: expected %v, got %v %v", name, expect, at, ok)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Package jsonpatch implements JSON merge patches (RFC 7386).  A merge patch is a JSON document that
+// looks like the changed parts of the target, with null marking a removed member, which makes it
+// easy to read when inspecting how a resource changed over time.
+package jsonpatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+)
+
+// ErrUnrepresentable is returned when the change needs a member to be set to null, merge patches use
+// null to remove members so there is no way to express it
+var ErrUnrepresentable = errors.New("change can not be expressed as a merge patch")
+
+// CreateMergePatch returns a merge patch that turns original into modified.  Both must be JSON
+// documents.  Arrays are always replaced as a whole.
+func CreateMergePatch(original, modified []byte) ([]byte, error) {
+	a, err := decode(original)
+	if err != nil {
+		return nil, err
+	}
+	b, err := decode(modified)
+	if err != nil {
+		return nil, err
+	}
+
+	patch, err := createPatch(a, b)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(patch)
+}
+
+// MergePatch applies a merge patch to doc
+func MergePatch(doc, patch []byte) ([]byte, error) {
+	target, err := decode(doc)
+	if err != nil {
+		return nil, err
+	}
+	p, err := decode(patch)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(applyPatch(target, p))
+}
+
+// decode keeps numbers as written so applying a patch never changes how a number is formatted
+func decode(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func createPatch(a, b any) (any, error) {
+	ao, aok := a.(map[string]any)
+	bo, bok := b.(map[string]any)
+	if !aok || !bok {
+		// Patching anything into an object merges it, so an object replacing a non object can't hold nulls
+		if containsNull(b) {
+			return nil, ErrUnrepresentable
+		}
+		return b, nil
+	}
+
+	patch := map[string]any{}
+	for k := range ao {
+		if _, ok := bo[k]; !ok {
+			patch[k] = nil
+		}
+	}
+	for k, bv := range bo {
+		av, ok := ao[k]
+		if ok && reflect.DeepEqual(av, bv) {
+			continue
+		}
+		if bv == nil {
+			return nil, ErrUnrepresentable
+		}
+		pv, err := createPatch(av, bv)
+		if err != nil {
+			return nil, err
+		}
+		patch[k] = pv
+	}
+	return patch, nil
+}
+
+// containsNull reports whether an object has a null member anywhere inside it, which a merge patch
+// would treat as a removal.  Arrays are copied verbatim so their contents don't matter.
+func containsNull(v any) bool {
+	o, ok := v.(map[string]any)
+	if !ok {
+		return false
+	}
+	for _, member := range o {
+		if member == nil || containsNull(member) {
+			return true
+		}
+	}
+	return false
+}
+
+func applyPatch(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = map[string]any{}
+	}
+
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = applyPatch(t[k], v)
+		}
+	}
+	return t
+}
@@ -0,0 +1,62 @@
+package jsonpatch
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		original string
+		modified string
+		patch    string
+	}{
+		{"Unchanged", `{"a":1}`, `{"a":1}`, `{}`},
+		{"Changed", `{"a":1,"b":"x"}`, `{"a":2,"b":"x"}`, `{"a":2}`},
+		{"Added", `{"a":1}`, `{"a":1,"b":{"c":true}}`, `{"b":{"c":true}}`},
+		{"Removed", `{"a":1,"b":2}`, `{"a":1}`, `{"b":null}`},
+		{"Nested", `{"meta":{"labels":{"app":"x"},"name":"n"}}`, `{"meta":{"labels":{"app":"y"},"name":"n"}}`, `{"meta":{"labels":{"app":"y"}}}`},
+		{"Array", `{"a":[1,2,3]}`, `{"a":[1,2]}`, `{"a":[1,2]}`},
+		{"UnchangedNull", `{"a":null,"b":1}`, `{"a":null,"b":2}`, `{"b":2}`},
+		{"BigNumber", `{"a":1}`, `{"a":12345678901234567890}`, `{"a":12345678901234567890}`},
+		{"NotAnObject", `[1]`, `{"a":1}`, `{"a":1}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patch, err := CreateMergePatch([]byte(tt.original), []byte(tt.modified))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(patch) != tt.patch {
+				t.Fatalf("Expected patch %s, got %s", tt.patch, patch)
+			}
+
+			result, err := MergePatch([]byte(tt.original), patch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(result) != tt.modified {
+				t.Fatalf("Expected %s, got %s", tt.modified, result)
+			}
+		})
+	}
+}
+
+func TestMergePatchUnrepresentable(t *testing.T) {
+	for _, modified := range []string{`{"a":null}`, `{"a":1,"b":{"c":null}}`} {
+		if _, err := CreateMergePatch([]byte(`{"a":1}`), []byte(modified)); !errors.Is(err, ErrUnrepresentable) {
+			t.Fatalf("Expected %s to be unrepresentable, got %v", modified, err)
+		}
+	}
+}
+
+func TestMergePatchInvalid(t *testing.T) {
+	if _, err := CreateMergePatch([]byte(`{`), []byte(`{}`)); err == nil {
+		t.Fatalf("Expected an error for invalid JSON")
+	}
+	if _, err := MergePatch([]byte(`{}`), []byte(`nope`)); err == nil {
+		t.Fatalf("Expected an error for an invalid patch")
+	}
+}
@@ -0,0 +1,150 @@
+// Package manifest writes recorded resources back out as manifests kubectl can apply, so the
+// state of a cluster at a moment in a recording can be restored.
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+
+	"github.com/hoyle1974/khronoscope/internal/redact"
+	"github.com/hoyle1974/khronoscope/internal/resources"
+)
+
+// ClusterDir holds cluster scoped resources, it sorts before namespace names so kubectl apply -R
+// creates namespaces before what goes in them
+const ClusterDir = "_cluster"
+
+// Options controls what Write includes
+type Options struct {
+	IncludeOwned bool // Also write resources a controller manages, like the pods of a replica set
+}
+
+// Stats counts what Write did
+type Stats struct {
+	Written  int      // Manifests written
+	Skipped  int      // Resources that can't or shouldn't be applied
+	Scrubbed []string // Manifests holding redacted values that need filling in before being applied
+}
+
+// serverFields are set by the API server and are rejected or meaningless when applied
+var serverFields = []string{
+	"uid", "resourceVersion", "managedFields", "creationTimestamp", "generation", "selfLink",
+	"deletionTimestamp", "deletionGracePeriodSeconds",
+}
+
+// serverAnnotations are added by kubectl and controllers
+var serverAnnotations = []string{
+	"kubectl.kubernetes.io/last-applied-configuration",
+	"deployment.kubernetes.io/revision",
+}
+
+// unappliable kinds only make sense as records of what happened
+var unappliable = map[string]bool{
+	"Event": true,
+}
+
+// Write writes each resource to dir/namespace/kind/name.yaml, cluster scoped resources go under
+// ClusterDir
+func Write(dir string, rs []resources.Resource, opts Options) (Stats, error) {
+	stats := Stats{}
+	for _, r := range rs {
+		obj, ok := Clean(r, opts)
+		if !ok {
+			stats.Skipped++
+			continue
+		}
+		if r.Kind == "Secret" && redact.Scrubbed(obj["data"]) {
+			// Applying this would replace the real secret with the mask
+			stats.Skipped++
+			continue
+		}
+
+		namespace := r.Namespace
+		if namespace == "" {
+			namespace = ClusterDir
+		}
+		filename := filepath.Join(dir, namespace, strings.ToLower(r.Kind), r.Name+".yaml")
+		if err := writeManifest(filename, obj); err != nil {
+			return stats, err
+		}
+		stats.Written++
+		if redact.Scrubbed(obj) {
+			stats.Scrubbed = append(stats.Scrubbed, filename)
+		}
+	}
+	return stats, nil
+}
+
+func writeManifest(filename string, obj map[string]any) error {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	if b, err = yaml.JSONToYAML(b); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filename, b, 0o644); err != nil {
+		return fmt.Errorf("unable to write manifest: %w", err)
+	}
+	return nil
+}
+
+// Clean returns a resource as an object that can be applied, without the status and the fields
+// the API server fills in.  It returns false for resources that shouldn't be applied.
+func Clean(r resources.Resource, opts Options) (map[string]any, bool) {
+	var obj map[string]any
+	if unappliable[r.Kind] || json.Unmarshal([]byte(r.RawJSON), &obj) != nil || obj == nil {
+		return nil, false
+	}
+	if _, ok := obj["apiVersion"].(string); !ok {
+		return nil, false
+	}
+	if _, ok := obj["kind"].(string); !ok {
+		obj["kind"] = r.Kind
+	}
+	metadata, ok := obj["metadata"].(map[string]any)
+	if !ok {
+		return nil, false
+	}
+
+	if owners, ok := metadata["ownerReferences"].([]any); ok {
+		for _, owner := range owners {
+			if owner, ok := owner.(map[string]any); ok && owner["controller"] == true && !opts.IncludeOwned {
+				// The controller recreates it from its owner
+				return nil, false
+			}
+		}
+		// Owners are referred to by uid, which won't match once they've been recreated
+		delete(metadata, "ownerReferences")
+	}
+
+	delete(obj, "status")
+	for _, field := range serverFields {
+		delete(metadata, field)
+	}
+	if annotations, ok := metadata["annotations"].(map[string]any); ok {
+		for _, annotation := range serverAnnotations {
+			delete(annotations, annotation)
+		}
+		if len(annotations) == 0 {
+			delete(metadata, "annotations")
+		}
+	}
+
+	if r.Kind == "Service" {
+		// Addresses are allocated, applying an old one conflicts if it has been reused
+		if spec, ok := obj["spec"].(map[string]any); ok {
+			delete(spec, "clusterIP")
+			delete(spec, "clusterIPs")
+		}
+	}
+	return obj, true
+}
@@ -0,0 +1,86 @@
+package manifest
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hoyle1974/khronoscope/internal/redact"
+	"github.com/hoyle1974/khronoscope/internal/resources"
+)
+
+func resource(kind, namespace, name, raw string) resources.Resource {
+	r := resources.NewResource("uid-"+name, time.Now(), kind, namespace, name)
+	r.RawJSON = raw
+	return r
+}
+
+func TestWrite(t *testing.T) {
+	rs := []resources.Resource{
+		resource("Deployment", "default", "web", `{"apiVersion":"apps/v1","kind":"Deployment",
+			"metadata":{"name":"web","namespace":"default","uid":"uid-web","resourceVersion":"42","generation":3,
+				"creationTimestamp":"2024-05-01T12:00:00Z","managedFields":[{"manager":"kubectl"}],
+				"annotations":{"deployment.kubernetes.io/revision":"3"},"labels":{"app":"web"}},
+			"spec":{"replicas":1000000,"template":{"spec":{"containers":[{"name":"web","env":[{"name":"A","value":"`+redact.Hash("x")+`"}]}]}}},
+			"status":{"readyReplicas":1}}`),
+		resource("ReplicaSet", "default", "web-1", `{"apiVersion":"apps/v1","kind":"ReplicaSet",
+			"metadata":{"name":"web-1","namespace":"default","ownerReferences":[{"kind":"Deployment","name":"web","uid":"uid-web","controller":true}]}}`),
+		resource("Service", "default", "web", `{"apiVersion":"v1","kind":"Service",
+			"metadata":{"name":"web","namespace":"default","ownerReferences":[{"kind":"Thing","name":"x","uid":"uid-x"}]},
+			"spec":{"clusterIP":"10.0.0.1","clusterIPs":["10.0.0.1"],"ports":[{"port":80}]}}`),
+		resource("Namespace", "", "default", `{"apiVersion":"v1","kind":"Namespace","metadata":{"name":"default"}}`),
+		resource("Secret", "default", "db", `{"apiVersion":"v1","kind":"Secret","metadata":{"name":"db","namespace":"default"},"data":{"password":"`+redact.Mask+`"}}`),
+		resource("Event", "default", "web.1", `{"apiVersion":"v1","kind":"Event","metadata":{"name":"web.1","namespace":"default"}}`),
+		resource("Pod", "default", "legacy", ``),
+	}
+
+	dir := t.TempDir()
+	stats, err := Write(dir, rs, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Written != 3 || stats.Skipped != 4 || len(stats.Scrubbed) != 1 {
+		t.Errorf("Expected 3 written, 4 skipped and 1 scrubbed, got %+v", stats)
+	}
+
+	expected := map[string]struct{ contains, missing []string }{
+		"default/deployment/web.yaml": {
+			contains: []string{"name: web", "app: web", "replicas: 1000000"},
+			missing:  []string{"uid", "resourceVersion", "generation", "creationTimestamp", "managedFields", "annotations", "status"},
+		},
+		"default/service/web.yaml": {
+			contains: []string{"port: 80"},
+			missing:  []string{"clusterIP", "ownerReferences"},
+		},
+		ClusterDir + "/namespace/default.yaml": {
+			contains: []string{"kind: Namespace"},
+		},
+	}
+	for filename, e := range expected {
+		b, err := os.ReadFile(filepath.Join(dir, filename))
+		if err != nil {
+			t.Errorf("Expected %s: %v", filename, err)
+			continue
+		}
+		for _, s := range e.contains {
+			if !strings.Contains(string(b), s) {
+				t.Errorf("Expected %s to contain %q, got\n%s", filename, s, b)
+			}
+		}
+		for _, s := range e.missing {
+			if strings.Contains(string(b), s) {
+				t.Errorf("Didn't expect %s to contain %q, got\n%s", filename, s, b)
+			}
+		}
+	}
+
+	stats, err = Write(t.TempDir(), rs, Options{IncludeOwned: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Written != 4 {
+		t.Errorf("Expected the replica set to be written too, got %+v", stats)
+	}
+}
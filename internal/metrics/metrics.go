@@ -1,37 +1,370 @@
+// Package metrics keeps counters, gauges and histograms about the recorder and exposes them in the
+// Prometheus text format.  Metrics are registered once as package variables and are safe to
+// update from any goroutine.
 package metrics
 
 import (
 	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/rs/zerolog/log"
 )
 
-var lock = sync.Mutex{}
-var counter = map[string]int{}
+// The metrics the recorder keeps
+var (
+	EventsIngested  = NewCounter("khronoscope_events_ingested_total", "Resource changes written to the store", "kind", "type")
+	Keyframes       = NewCounter("khronoscope_keyframes_total", "Values stored whole rather than as a diff")
+	KeyframeSplits  = NewCounter("khronoscope_keyframe_splits_total", "Keyframes split to insert a value that arrived late")
+	DiffBytes       = NewHistogram("khronoscope_diff_bytes", "Size of the diffs stored between keyframes", ExponentialBuckets(64, 4, 8))
+	DiffReplays     = NewCounter("khronoscope_diff_replays_total", "Values rebuilt by replaying diffs, rather than from a cached value")
+	QueryDuration   = NewHistogram("khronoscope_query_duration_seconds", "How long queries against the store take", ExponentialBuckets(0.0001, 4, 8), "query")
+	StoreBytes      = NewGauge("khronoscope_store_bytes", "Bytes of history held by the recording")
+	JournalErrors   = NewCounter("khronoscope_journal_errors_total", "Journal writes that failed, changes go unjournaled until the next checkpoint")
+	WatchReconnects = NewCounter("khronoscope_watch_reconnects_total", "Watches restarted after the API server closed them", "kind")
+)
 
-func Print() {
-	lock.Lock()
-	defer lock.Unlock()
-	fmt.Println("Metrics:")
-	for k, v := range counter {
-		fmt.Printf("	%s: %d\n", k, v)
+type metric interface {
+	name() string
+	write(w io.Writer) error
+}
+
+var registry = struct {
+	lock    sync.Mutex
+	metrics map[string]metric
+}{metrics: map[string]metric{}}
+
+func register(m metric) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	if _, ok := registry.metrics[m.name()]; ok {
+		panic("metric " + m.name() + " registered twice")
 	}
+	registry.metrics[m.name()] = m
 }
 
-func Log() {
-	lock.Lock()
-	defer lock.Unlock()
-	l := log.Info()
-	for k, v := range counter {
-		l.Any(k, v)
+// desc describes a metric and the labels its values are split by
+type desc struct {
+	metricName string
+	help       string
+	labels     []string
+}
+
+func (d desc) name() string { return d.metricName }
+
+func (d desc) header(w io.Writer, kind string) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.metricName, escapeHelp(d.help), d.metricName, kind)
+	return err
+}
+
+// key joins label values into a map key, values that don't match the labels are a bug
+func (d desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s has labels %v, got %d values", d.metricName, d.labels, len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelString formats the labels for key plus any extra label, like a histogram's le
+func (d desc) labelString(key string, extra ...string) string {
+	pairs := []string{}
+	if len(d.labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, d.labels[i]+`="`+escapeLabel(value)+`"`)
+		}
 	}
-	l.Msg("Metrics)")
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Counter counts something that only goes up, like events seen
+type Counter struct {
+	desc
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+// NewCounter registers a counter whose values are split by labels
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{desc: desc{name, help, labels}, values: map[string]float64{}}
+	register(c)
+	return c
 }
 
-func Count(key string, value int) {
+// Inc adds one to the value for the label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds delta, which mustn't be negative, to the value for the label values
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	key := c.key(labelValues)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values[key] += delta
+}
+
+// Value returns the value for the label values
+func (c *Counter) Value(labelValues ...string) float64 {
+	key := c.key(labelValues)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.values[key]
+}
+
+func (c *Counter) write(w io.Writer) error {
+	return writeValues(w, c.desc, "counter", &c.lock, c.values)
+}
+
+// Gauge is a value that goes up and down, like the size of something
+type Gauge struct {
+	desc
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+// NewGauge registers a gauge whose values are split by labels
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{desc: desc{name, help, labels}, values: map[string]float64{}}
+	register(g)
+	return g
+}
+
+// Set sets the value for the label values
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	key := g.key(labelValues)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.values[key] = value
+}
+
+// Add adds delta to the value for the label values
+func (g *Gauge) Add(delta float64, labelValues ...string) {
+	key := g.key(labelValues)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.values[key] += delta
+}
+
+// Value returns the value for the label values
+func (g *Gauge) Value(labelValues ...string) float64 {
+	key := g.key(labelValues)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.values[key]
+}
+
+func (g *Gauge) write(w io.Writer) error {
+	return writeValues(w, g.desc, "gauge", &g.lock, g.values)
+}
+
+func writeValues(w io.Writer, d desc, kind string, lock *sync.Mutex, values map[string]float64) error {
 	lock.Lock()
 	defer lock.Unlock()
 
-	counter[key] += value
+	if err := d.header(w, kind); err != nil {
+		return err
+	}
+	if len(d.labels) == 0 && len(values) == 0 {
+		_, err := fmt.Fprintf(w, "%s 0\n", d.metricName)
+		return err
+	}
+	for _, key := range sortedKeys(values) {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", d.metricName, d.labelString(key), formatFloat(values[key])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Histogram counts observations, like durations, in buckets
+type Histogram struct {
+	desc
+	buckets []float64 // Upper bounds, +Inf is implied
+	lock    sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	counts []uint64 // Per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram registers a histogram with buckets, whose values are split by labels
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		desc:    desc{name, help, labels},
+		buckets: slices.Sorted(slices.Values(buckets)),
+		values:  map[string]*histogramValue{},
+	}
+	register(h)
+	return h
+}
+
+// ExponentialBuckets returns count buckets, the first ending at start and each factor times the last
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+// Observe records value for the label values
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = v
+	}
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		v.counts[i]++
+	}
+	v.count++
+	v.sum += value
+}
+
+// Count returns how many values have been observed for the label values
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	key := h.key(labelValues)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if v, ok := h.values[key]; ok {
+		return v.count
+	}
+	return 0
+}
+
+func (h *Histogram) write(w io.Writer) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if err := h.header(w, "histogram"); err != nil {
+		return err
+	}
+	values := h.values
+	if len(h.labels) == 0 && len(values) == 0 {
+		values = map[string]*histogramValue{"": {counts: make([]uint64, len(h.buckets))}}
+	}
+	for _, key := range sortedKeys(values) {
+		v := values[key]
+		cumulative := uint64(0)
+		for i, bound := range h.buckets {
+			cumulative += v.counts[i]
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, h.labelString(key, "le", formatFloat(bound)), cumulative); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+			h.metricName, h.labelString(key, "le", "+Inf"), v.count,
+			h.metricName, h.labelString(key), formatFloat(v.sum),
+			h.metricName, h.labelString(key), v.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+
+// WriteText writes every metric in the Prometheus text format
+func WriteText(w io.Writer) error {
+	registry.lock.Lock()
+	metrics := make([]metric, 0, len(registry.metrics))
+	for _, name := range sortedKeys(registry.metrics) {
+		metrics = append(metrics, registry.metrics[name])
+	}
+	registry.lock.Unlock()
+
+	for _, m := range metrics {
+		if err := m.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler serves the metrics for Prometheus to scrape
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := WriteText(w); err != nil {
+			log.Warn().Err(err).Msg("unable to write metrics")
+		}
+	})
+}
+
+// Print writes the metrics to stdout
+func Print() {
+	fmt.Println("Metrics:")
+	if err := WriteText(indenter{}); err != nil {
+		log.Warn().Err(err).Msg("unable to print metrics")
+	}
+}
+
+type indenter struct{}
+
+func (indenter) Write(b []byte) (int, error) {
+	for _, line := range strings.SplitAfter(string(b), "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") {
+			fmt.Print("\t" + line)
+		}
+	}
+	return len(b), nil
+}
+
+// Log logs the metrics
+func Log() {
+	var b strings.Builder
+	if err := WriteText(&b); err != nil {
+		log.Warn().Err(err).Msg("unable to log metrics")
+		return
+	}
+	l := log.Info()
+	for _, line := range strings.Split(b.String(), "\n") {
+		if name, value, ok := strings.Cut(line, " "); ok && !strings.HasPrefix(line, "#") {
+			l.Str(name, value)
+		}
+	}
+	l.Msg("Metrics")
 }
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	counter := NewCounter("test_events_total", "Events\nseen", "kind")
+	counter.Inc("Pod")
+	counter.Add(2, "Pod")
+	counter.Inc(`Odd"Kind`)
+	gauge := NewGauge("test_bytes", "Bytes")
+	gauge.Set(10)
+	gauge.Add(-4)
+	histogram := NewHistogram("test_seconds", "Durations", []float64{1, 0.1}, "query")
+	histogram.Observe(0.05, "a")
+	histogram.Observe(0.5, "a")
+	histogram.Observe(5, "a")
+
+	if counter.Value("Pod") != 3 || gauge.Value() != 6 || histogram.Count("a") != 3 {
+		t.Errorf("Unexpected values %v %v %v", counter.Value("Pod"), gauge.Value(), histogram.Count("a"))
+	}
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type %q", rec.Header().Get("Content-Type"))
+	}
+	text := rec.Body.String()
+	for _, expected := range []string{
+		"# HELP test_events_total Events\\nseen\n# TYPE test_events_total counter\n",
+		`test_events_total{kind="Odd\"Kind"} 1` + "\n",
+		`test_events_total{kind="Pod"} 3` + "\n",
+		"# TYPE test_bytes gauge\ntest_bytes 6\n",
+		`test_seconds_bucket{query="a",le="0.1"} 1` + "\n",
+		`test_seconds_bucket{query="a",le="1"} 2` + "\n",
+		`test_seconds_bucket{query="a",le="+Inf"} 3` + "\n",
+		`test_seconds_sum{query="a"} 5.55` + "\n",
+		`test_seconds_count{query="a"} 3` + "\n",
+		// Registered but never used
+		"khronoscope_keyframe_splits_total 0\n",
+	} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("Expected %q in\n%s", expected, text)
+		}
+	}
+}
+
+func TestLabelMismatch(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected a panic for missing label values")
+		}
+	}()
+	EventsIngested.Inc("Pod")
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math"
 	"reflect"
+	"slices"
 	"strings"
 	"time"
 
@@ -20,6 +21,7 @@ import (
 	"github.com/hoyle1974/khronoscope/internal/config"
 	"github.com/hoyle1974/khronoscope/internal/conn"
 	"github.com/hoyle1974/khronoscope/internal/dao"
+	"github.com/hoyle1974/khronoscope/internal/manifest"
 	"github.com/hoyle1974/khronoscope/internal/misc"
 	"github.com/hoyle1974/khronoscope/internal/resources"
 	"github.com/hoyle1974/khronoscope/internal/types"
@@ -28,7 +30,7 @@ import (
 )
 
 type KhronoscopeTeaProgram struct {
-	data              dao.KhronoStore
+	data              dao.Recording
 	watcher           *resources.K8sWatcher
 	ready             bool
 	viewMode          int
@@ -54,7 +56,46 @@ type KhronoscopeTeaProgram struct {
 }
 
 func (m *KhronoscopeTeaProgram) SetLabel(label string) {
-	m.data.SetLabel(m.VCR.GetTimeToUse(), label)
+	if store, ok := m.data.(dao.KhronoStore); ok {
+		store.SetLabel(m.VCR.GetTimeToUse(), label)
+	}
+}
+
+// downloader is a recording held somewhere else that can be copied here
+type downloader interface {
+	Download() (dao.KhronoStore, error)
+}
+
+// save saves the recording to filename, a recording on a server is downloaded first which can take
+// a while so it is done in the background
+func (m *KhronoscopeTeaProgram) save(filename, passphrase string) {
+	if store, ok := m.data.(dao.KhronoStore); ok {
+		if err := store.Save(filename, dao.WithPassphrase(passphrase)); err != nil {
+			log.Error().Err(err).Str("Filename", filename).Msg("save failed")
+		}
+		return
+	}
+	remote, ok := m.data.(downloader)
+	if !ok {
+		log.Error().Str("Filename", filename).Msg("this recording can't be saved")
+		return
+	}
+	log.Info().Str("Filename", filename).Msg("downloading the recording from the server to save it")
+	go func() {
+		local, err := remote.Download()
+		if err != nil {
+			log.Error().Err(err).Str("Filename", filename).Msg("save failed")
+			return
+		}
+		defer func() {
+			_ = local.Close()
+		}()
+		if err := local.Save(filename, dao.WithPassphrase(passphrase)); err != nil {
+			log.Error().Err(err).Str("Filename", filename).Msg("save failed")
+			return
+		}
+		log.Info().Str("Filename", filename).Msg("saved the recording from the server")
+	}()
 }
 
 func calculatePercentageOfTime(min, max, value time.Time) float64 {
@@ -148,7 +189,7 @@ func (m *KhronoscopeTeaProgram) footerView() string {
 	return lipgloss.JoinHorizontal(lipgloss.Center, line, info)
 }
 
-func NewProgram(watcher *resources.K8sWatcher, d dao.KhronoStore, l *resources.LogCollector, client conn.KhronosConn, ringBuffer *misc.RingBuffer) *KhronoscopeTeaProgram {
+func NewProgram(watcher *resources.K8sWatcher, d dao.Recording, l *resources.LogCollector, client conn.KhronosConn, ringBuffer *misc.RingBuffer) *KhronoscopeTeaProgram {
 	am := &KhronoscopeTeaProgram{
 		watcher:      watcher,
 		data:         d,
@@ -460,10 +501,29 @@ func (m *KhronoscopeTeaProgram) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			m.search = true
 			return m, nil
 		case m.cfg.KeyBindings.Save: // "s":
-			m.SetPopup(popup.NewSavePopup(func(filename string) {
+			m.SetPopup(popup.NewSavePopup(func(filename, passphrase string) {
 				if len(filename) > 0 {
-					m.data.Save(filename)
+					m.save(filename, passphrase)
+				}
+			}))
+			return m, nil
+		case m.cfg.KeyBindings.Manifests:
+			timestamp := m.VCR.GetTimeToUse()
+			filter := m.searchFilter
+			m.SetPopup(popup.NewManifestsPopup("manifests-"+timestamp.Format("20060102-150405"), func(dir string) {
+				if len(dir) == 0 {
+					return
 				}
+				rs := m.data.GetResourcesAt(timestamp, "", "")
+				if filter != nil {
+					rs = slices.DeleteFunc(rs, func(r resources.Resource) bool { return !filter.Matches(r) })
+				}
+				stats, err := manifest.Write(dir, rs, manifest.Options{})
+				if err != nil {
+					log.Error().Err(err).Str("Directory", dir).Msg("writing manifests failed")
+					return
+				}
+				log.Info().Int("Written", stats.Written).Int("Skipped", stats.Skipped).Strs("Scrubbed", stats.Scrubbed).Str("Directory", dir).Msg("wrote manifests")
 			}))
 			return m, nil
 		case m.cfg.KeyBindings.Debug:
@@ -485,6 +545,10 @@ func (m *KhronoscopeTeaProgram) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			}
 			return m, nil
 		case m.cfg.KeyBindings.NewLabel: //"m":
+			if _, ok := m.data.(dao.KhronoStore); !ok {
+				log.Warn().Msg("labels can't be added to a recording on a server")
+				return m, nil
+			}
 			m.VCR.Pause()
 			m.SetPopup(popup.NewLabelPopup(m))
 			return m, nil
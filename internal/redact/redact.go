@@ -0,0 +1,185 @@
+// Package redact scrubs sensitive data out of kubernetes objects before they are recorded or
+// shared.  Rules work on the decoded JSON of an object so they apply to anything the watcher sees.
+package redact
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/hoyle1974/khronoscope/internal/config"
+)
+
+// Mask replaces values that are removed outright
+const Mask = "REDACTED"
+
+// lastApplied holds the whole object as kubectl last applied it, including a Secret's data
+const lastApplied = "kubectl.kubernetes.io/last-applied-configuration"
+
+// Rules describe what is scrubbed from an object
+type Rules struct {
+	SecretData  bool     `json:"secretData,omitempty"`  // Drop data and stringData from Secrets
+	HashEnv     bool     `json:"hashEnv,omitempty"`     // Replace env var values with a hash so changes are still visible
+	Annotations []string `json:"annotations,omitempty"` // Mask annotations whose key matches one of these path.Match patterns
+}
+
+// FromConfig converts the redaction config into Rules
+func FromConfig(cfg config.Redaction) Rules {
+	return Rules{
+		SecretData:  cfg.SecretData,
+		HashEnv:     cfg.HashEnv,
+		Annotations: slices.Clone(cfg.Annotations),
+	}
+}
+
+// Enabled is true if the rules scrub anything
+func (r Rules) Enabled() bool {
+	return r.SecretData || r.HashEnv || len(r.Annotations) > 0
+}
+
+// Union returns rules that scrub everything either r or other does
+func (r Rules) Union(other Rules) Rules {
+	union := Rules{
+		SecretData:  r.SecretData || other.SecretData,
+		HashEnv:     r.HashEnv || other.HashEnv,
+		Annotations: slices.Clone(r.Annotations),
+	}
+	for _, pattern := range other.Annotations {
+		if !slices.Contains(union.Annotations, pattern) {
+			union.Annotations = append(union.Annotations, pattern)
+		}
+	}
+	return union
+}
+
+// Object scrubs obj in place and reports if anything changed
+func (r Rules) Object(obj map[string]any) bool {
+	changed := false
+
+	if r.SecretData && obj["kind"] == "Secret" {
+		for _, field := range []string{"data", "stringData"} {
+			if values, ok := obj[field].(map[string]any); ok {
+				for key := range values {
+					values[key] = Mask
+				}
+				changed = changed || len(values) > 0
+			}
+		}
+		changed = maskAnnotations(obj, func(key string) bool { return key == lastApplied }) || changed
+	}
+
+	if len(r.Annotations) > 0 {
+		changed = maskAnnotations(obj, func(key string) bool {
+			return slices.ContainsFunc(r.Annotations, func(pattern string) bool {
+				matched, _ := path.Match(pattern, key)
+				return matched
+			})
+		}) || changed
+	}
+
+	if r.HashEnv {
+		changed = hashEnv(obj) || changed
+	}
+
+	return changed
+}
+
+// JSON scrubs an object encoded as JSON, it is returned unchanged if it isn't a JSON object or
+// there was nothing to scrub
+func (r Rules) JSON(raw string) string {
+	if !r.Enabled() {
+		return raw
+	}
+	var obj map[string]any
+	if err := json.Unmarshal([]byte(raw), &obj); err != nil || obj == nil {
+		return raw
+	}
+	if !r.Object(obj) {
+		return raw
+	}
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return raw
+	}
+	return string(b)
+}
+
+// Scrubbed is true if value holds anything the rules have masked or hashed, such a value can't be
+// used to recreate the original
+func Scrubbed(value any) bool {
+	switch v := value.(type) {
+	case map[string]any:
+		for _, child := range v {
+			if Scrubbed(child) {
+				return true
+			}
+		}
+	case []any:
+		for _, child := range v {
+			if Scrubbed(child) {
+				return true
+			}
+		}
+	case string:
+		return v == Mask || isHash(v)
+	}
+	return false
+}
+
+func maskAnnotations(obj map[string]any, match func(key string) bool) bool {
+	metadata, _ := obj["metadata"].(map[string]any)
+	annotations, _ := metadata["annotations"].(map[string]any)
+	changed := false
+	for key, value := range annotations {
+		if value != Mask && match(key) {
+			annotations[key] = Mask
+			changed = true
+		}
+	}
+	return changed
+}
+
+// hashEnv finds every env list in the object, which covers pods as well as the pod templates of
+// deployments, jobs and so on, and hashes the values
+func hashEnv(value any) bool {
+	changed := false
+	switch v := value.(type) {
+	case map[string]any:
+		for key, child := range v {
+			if vars, ok := child.([]any); ok && key == "env" {
+				for _, item := range vars {
+					if envVar, ok := item.(map[string]any); ok {
+						if s, ok := envVar["value"].(string); ok && !isHash(s) {
+							envVar["value"] = Hash(s)
+							changed = true
+						}
+					}
+				}
+				continue
+			}
+			changed = hashEnv(child) || changed
+		}
+	case []any:
+		for _, child := range v {
+			changed = hashEnv(child) || changed
+		}
+	}
+	return changed
+}
+
+const hashPrefix = "sha256:"
+
+// Hash returns a short fingerprint of a value.  It isn't salted so short or guessable values can
+// still be recovered by brute force, it only keeps them from being read at a glance.
+func Hash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hashPrefix + hex.EncodeToString(sum[:6])
+}
+
+// isHash keeps values that were already hashed, by an earlier redaction, from being hashed again
+func isHash(value string) bool {
+	return strings.HasPrefix(value, hashPrefix) && len(value) == len(hashPrefix)+12
+}
@@ -0,0 +1,123 @@
+package redact
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const secret = `{
+	"apiVersion": "v1",
+	"kind": "Secret",
+	"metadata": {
+		"name": "db",
+		"annotations": {
+			"kubectl.kubernetes.io/last-applied-configuration": "{\"data\":{\"password\":\"aHVudGVyMg==\"}}",
+			"owner": "team-a"
+		}
+	},
+	"data": {"password": "aHVudGVyMg=="},
+	"stringData": {"user": "admin"}
+}`
+
+const deployment = `{
+	"apiVersion": "apps/v1",
+	"kind": "Deployment",
+	"metadata": {
+		"name": "web",
+		"annotations": {"vault.hashicorp.com/agent-inject-secret": "db/creds", "owner": "team-a"}
+	},
+	"spec": {"template": {"spec": {
+		"containers": [{"name": "web", "env": [
+			{"name": "PASSWORD", "value": "hunter2"},
+			{"name": "FROM_SECRET", "valueFrom": {"secretKeyRef": {"name": "db", "key": "password"}}}
+		]}],
+		"initContainers": [{"name": "init", "env": [{"name": "TOKEN", "value": "abc"}]}]
+	}}}
+}`
+
+func decode(t *testing.T, raw string) map[string]any {
+	t.Helper()
+	var obj map[string]any
+	if err := json.Unmarshal([]byte(raw), &obj); err != nil {
+		t.Fatal(err)
+	}
+	return obj
+}
+
+func TestSecretData(t *testing.T) {
+	redacted := (Rules{SecretData: true}).JSON(secret)
+	if strings.Contains(redacted, "aHVudGVyMg") || strings.Contains(redacted, "admin") {
+		t.Fatalf("Secret data leaked: %s", redacted)
+	}
+
+	obj := decode(t, redacted)
+	if obj["data"].(map[string]any)["password"] != Mask || obj["stringData"].(map[string]any)["user"] != Mask {
+		t.Fatalf("Expected the keys to be kept and the values masked: %s", redacted)
+	}
+	if obj["metadata"].(map[string]any)["annotations"].(map[string]any)["owner"] != "team-a" {
+		t.Fatalf("Expected other annotations to be kept: %s", redacted)
+	}
+
+	// Other kinds aren't touched
+	if (Rules{SecretData: true}).JSON(deployment) != deployment {
+		t.Fatalf("Expected the deployment to be unchanged")
+	}
+}
+
+func TestHashEnv(t *testing.T) {
+	redacted := Rules{HashEnv: true}.JSON(deployment)
+	if strings.Contains(redacted, "hunter2") || strings.Contains(redacted, `"abc"`) {
+		t.Fatalf("Env var leaked: %s", redacted)
+	}
+	if !strings.Contains(redacted, Hash("hunter2")) || !strings.Contains(redacted, Hash("abc")) {
+		t.Fatalf("Expected hashed values: %s", redacted)
+	}
+	if !strings.Contains(redacted, "secretKeyRef") {
+		t.Fatalf("Expected valueFrom to be kept: %s", redacted)
+	}
+
+	// Redacting twice changes nothing
+	if again := (Rules{HashEnv: true}).JSON(redacted); again != redacted {
+		t.Fatalf("Expected redaction to be idempotent:\n%s\n%s", redacted, again)
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	redacted := Rules{Annotations: []string{"vault.hashicorp.com/*"}}.JSON(deployment)
+	annotations := decode(t, redacted)["metadata"].(map[string]any)["annotations"].(map[string]any)
+	if annotations["vault.hashicorp.com/agent-inject-secret"] != Mask || annotations["owner"] != "team-a" {
+		t.Fatalf("Unexpected annotations %v", annotations)
+	}
+}
+
+func TestPassThrough(t *testing.T) {
+	for _, raw := range []string{"", "not json", "[1,2]", "null"} {
+		if got := (Rules{SecretData: true, HashEnv: true}).JSON(raw); got != raw {
+			t.Fatalf("Expected %q unchanged, got %q", raw, got)
+		}
+	}
+	if (Rules{}).JSON(secret) != secret {
+		t.Fatalf("Expected no rules to change nothing")
+	}
+}
+
+func TestUnion(t *testing.T) {
+	union := Rules{SecretData: true, Annotations: []string{"a/*"}}.Union(Rules{HashEnv: true, Annotations: []string{"a/*", "b/*"}})
+	if !union.SecretData || !union.HashEnv || strings.Join(union.Annotations, ",") != "a/*,b/*" {
+		t.Fatalf("Unexpected union %+v", union)
+	}
+}
+
+func TestScrubbed(t *testing.T) {
+	for _, raw := range []string{secret, deployment} {
+		obj := decode(t, raw)
+		if Scrubbed(obj) {
+			t.Fatalf("Didn't expect %s to be scrubbed", raw)
+		}
+		(Rules{SecretData: true, HashEnv: true}).Object(obj)
+		if !Scrubbed(obj) {
+			t.Fatalf("Expected %v to be scrubbed", obj)
+		}
+	}
+}
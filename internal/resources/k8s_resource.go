@@ -7,13 +7,19 @@ import (
 	"strings"
 	"time"
 
+	"github.com/rs/zerolog/log"
+
 	"github.com/hoyle1974/khronoscope/internal/conn"
+	"github.com/hoyle1974/khronoscope/internal/metrics"
 	"github.com/hoyle1974/khronoscope/internal/misc"
+	"github.com/hoyle1974/khronoscope/internal/redact"
 	"github.com/hoyle1974/khronoscope/internal/serializable"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
 )
 
 type watcher struct {
@@ -21,6 +27,7 @@ type watcher struct {
 	resource schema.GroupVersionResource
 	renderer ResourceRenderer
 	ticker   func()
+	redact   redact.Rules
 }
 
 func (g watcher) Tick() {
@@ -37,6 +44,7 @@ func (g watcher) ToResource(obj runtime.Object) Resource {
 		return Resource{}
 	}
 
+	g.redact.Object(unstructuredObj.Object)
 	rawBytes, err := json.Marshal(unstructuredObj.Object)
 	if err != nil {
 		rawBytes = []byte("{}")
@@ -63,12 +71,78 @@ func (r defaultRenderer) Render(resource Resource, details bool) []string {
 	return []string{resource.Name}
 }
 
+// reconnectBackoff is how long to wait before retrying a watch that couldn't be reconnected, it
+// doubles on every failure up to maxReconnectBackoff
+var (
+	reconnectBackoff    = time.Second
+	maxReconnectBackoff = 30 * time.Second
+)
+
 func watchForResource(ctx context.Context, watcher *K8sWatcher, k conn.KhronosConn, g watcher) error {
 	watchChan, err := k.DynamicClient.Resource(g.resource).Watch(ctx, v1.ListOptions{})
 	if err != nil {
 		return fmt.Errorf("failed to watch resource %s: %w", g.kind, err)
 	}
 
-	go watcher.registerEventWatcher(watchChan.ResultChan(), g)
+	go func() {
+		resourceVersion := ""
+		for {
+			resourceVersion = watcher.registerEventWatcher(watchChan.ResultChan(), g, resourceVersion)
+			if watcher == nil || ctx.Err() != nil {
+				return
+			}
+
+			// The API server ends watches every so often, pick up where this one left off
+			metrics.WatchReconnects.Inc(g.kind)
+			log.Info().Str("Kind", g.kind).Str("ResourceVersion", resourceVersion).Msg("reconnecting watch")
+			if watchChan, resourceVersion = reconnect(ctx, watcher, k, g, resourceVersion); watchChan == nil {
+				return
+			}
+		}
+	}()
 	return nil
 }
+
+// reconnect watches g again from resourceVersion, relisting first if it's empty, and keeps retrying
+// until it works.  It returns the watch and the resource version it started from, or a nil watch
+// once ctx is done.
+func reconnect(ctx context.Context, watcher *K8sWatcher, k conn.KhronosConn, g watcher, resourceVersion string) (watch.Interface, string) {
+	for backoff := reconnectBackoff; ; backoff = min(backoff*2, maxReconnectBackoff) {
+		var err error
+		if resourceVersion == "" {
+			// Too much time has passed to resume, catch up on what was missed from a list
+			resourceVersion, err = relist(ctx, watcher, k, g)
+		}
+		if err == nil {
+			var watchChan watch.Interface
+			watchChan, err = k.DynamicClient.Resource(g.resource).Watch(ctx, v1.ListOptions{ResourceVersion: resourceVersion})
+			if err == nil {
+				return watchChan, resourceVersion
+			}
+			if apierrors.IsResourceExpired(err) || apierrors.IsGone(err) {
+				resourceVersion = ""
+			}
+		}
+		log.Warn().Err(err).Str("Kind", g.kind).Msg("unable to reconnect watch")
+		select {
+		case <-ctx.Done():
+			return nil, ""
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// relist records the changes to g's resources that a watch missed by listing them, and returns the
+// resource version of the list to watch from
+func relist(ctx context.Context, watcher *K8sWatcher, k conn.KhronosConn, g watcher) (string, error) {
+	list, err := k.DynamicClient.Resource(g.resource).List(ctx, v1.ListOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to list resource %s: %w", g.kind, err)
+	}
+	objects := make([]runtime.Object, 0, len(list.Items))
+	for idx := range list.Items {
+		objects = append(objects, &list.Items[idx])
+	}
+	watcher.resync(g, objects)
+	return list.GetResourceVersion(), nil
+}
@@ -0,0 +1,114 @@
+package resources
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/hoyle1974/khronoscope/internal/conn"
+)
+
+type recordingDAO struct {
+	lock  sync.Mutex
+	added []string
+}
+
+func (d *recordingDAO) AddResource(r Resource) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.added = append(d.added, r.Name)
+}
+func (d *recordingDAO) UpdateResource(Resource) {}
+func (d *recordingDAO) DeleteResource(Resource) {}
+func (d *recordingDAO) GetResourcesAt(time.Time, string, string) []Resource {
+	return nil
+}
+func (d *recordingDAO) GetResourceAt(time.Time, string) (Resource, error) {
+	return Resource{}, errors.New("not found")
+}
+
+func (d *recordingDAO) has(name string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, n := range d.added {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func configMap(name, resourceVersion string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("ConfigMap")
+	obj.SetNamespace("default")
+	obj.SetName(name)
+	obj.SetUID(types.UID("uid-" + name))
+	obj.SetResourceVersion(resourceVersion)
+	return obj
+}
+
+func TestWatchReconnectAfterError(t *testing.T) {
+	defer func(backoff time.Duration) { reconnectBackoff = backoff }(reconnectBackoff)
+	reconnectBackoff = 10 * time.Millisecond
+
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{gvr: "ConfigMapList"})
+
+	first := watch.NewFakeWithChanSize(1, false)
+	second := watch.NewFakeWithChanSize(1, false)
+	var lock sync.Mutex
+	calls := 0
+	versions := []string{}
+	client.PrependWatchReactor("configmaps", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		calls++
+		versions = append(versions, action.(k8stesting.WatchActionImpl).GetWatchRestrictions().ResourceVersion)
+		switch calls {
+		case 1:
+			return true, first, nil
+		case 2:
+			return true, nil, errors.New("connection refused")
+		}
+		return true, second, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	data := &recordingDAO{}
+	w := &K8sWatcher{data: data}
+	if err := watchForResource(ctx, w, conn.KhronosConn{DynamicClient: client}, watcher{kind: "ConfigMap", resource: gvr, renderer: defaultRenderer{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The watch ends after an event, the first attempt to resume fails and the next one works
+	first.Add(configMap("before", "5"))
+	first.Stop()
+	second.Add(configMap("after", "6"))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !data.has("after") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the watch to be resumed after a failed attempt, got %v", data.added)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(versions) != 3 || versions[1] != "5" || versions[2] != "5" {
+		t.Fatalf("Expected both attempts to resume from version 5, got %q", versions)
+	}
+}
@@ -1,6 +1,7 @@
 package resources
 
 import (
+	"encoding/gob"
 	"strings"
 	"sync"
 	"time"
@@ -11,6 +12,14 @@ import (
 
 // A Resource represents a k8s resource like a Pod, ReplicaSet, or Node.
 
+// Resources are gob encoded in recordings and journals, which may need to be decoded before any
+// watcher has started so register the concrete types up front.
+func init() {
+	gob.Register(Resource{})
+	gob.Register(NodeExtra{})
+	gob.Register(PodExtra{})
+}
+
 type ResourceRenderer interface {
 	Render(resource Resource, detailed bool) []string
 }
@@ -67,6 +76,16 @@ func NewK8sResource(kind string, obj K8sResource, extra Copyable) Resource {
 	return r
 }
 
+// WithExtra fills in Extra from RawJSON for resources that didn't come from a watcher, like ones
+// imported from elsewhere, pods need it to be rendered
+func WithExtra(r Resource) Resource {
+	if r.Kind == "Pod" {
+		r.Extra = nil
+		r.Extra = getPodExtra(r)
+	}
+	return r
+}
+
 // Render the details of the Resource
 func (r Resource) GetDetails() []string {
 	rr := GetRenderer(r.Kind)
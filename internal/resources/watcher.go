@@ -2,7 +2,6 @@ package resources
 
 import (
 	"context"
-	"encoding/gob"
 	"reflect"
 	"sync"
 	"time"
@@ -11,6 +10,10 @@ import (
 
 	"github.com/hoyle1974/khronoscope/internal/config"
 	"github.com/hoyle1974/khronoscope/internal/conn"
+	"github.com/hoyle1974/khronoscope/internal/redact"
+	"github.com/hoyle1974/khronoscope/internal/serializable"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/watch"
@@ -39,14 +42,19 @@ type K8sWatcher struct {
 	lastChange time.Time
 	data       DAO
 	onChange   func()
+
+	lock           sync.Mutex
+	subscribers    map[int]func(Change)
+	nextSubscriber int
 }
 
-func (w *K8sWatcher) StartWatching(ctx context.Context, client conn.KhronosConn, dao DAO, lc *LogCollector, ns string) error {
-	// TODO find a new place for this
-	gob.Register(Resource{})
-	gob.Register(NodeExtra{})
-	gob.Register(PodExtra{})
+// Change is a change the watcher recorded
+type Change struct {
+	Type     watch.EventType // watch.Added, watch.Modified or watch.Deleted
+	Resource Resource
+}
 
+func (w *K8sWatcher) StartWatching(ctx context.Context, client conn.KhronosConn, dao DAO, lc *LogCollector, ns string) error {
 	// Get API group resources
 	apiGroupResources, err := client.DiscoveryClient.ServerPreferredResources()
 	if err != nil {
@@ -54,6 +62,7 @@ func (w *K8sWatcher) StartWatching(ctx context.Context, client conn.KhronosConn,
 	}
 
 	filter := config.Get().Filter
+	rules := redact.FromConfig(config.Get().Redaction)
 
 	// Extract GroupVersionResource information
 	for _, list := range apiGroupResources {
@@ -101,7 +110,7 @@ func (w *K8sWatcher) StartWatching(ctx context.Context, client conn.KhronosConn,
 				renderer = defaultRenderer{}
 			}
 
-			if err := watchForResource(ctx, w, client, watcher{kind: resource.Kind, resource: gvr, renderer: renderer, ticker: ticker}); err != nil {
+			if err := watchForResource(ctx, w, client, watcher{kind: resource.Kind, resource: gvr, renderer: renderer, ticker: ticker, redact: rules}); err != nil {
 				log.Error().Err(err).Msg("error watching for resource")
 			}
 		}
@@ -134,43 +143,101 @@ func (w *K8sWatcher) OnChange(onChange func()) {
 	w.onChange = onChange
 }
 
+// Subscribe calls fn with every change recorded from now on, until the returned function is
+// called.  fn is called from the goroutines doing the watching so it mustn't block.
+func (w *K8sWatcher) Subscribe(fn func(Change)) func() {
+	if w == nil {
+		return func() {}
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.subscribers == nil {
+		w.subscribers = map[int]func(Change){}
+	}
+	id := w.nextSubscriber
+	w.nextSubscriber++
+	w.subscribers[id] = fn
+
+	return func() {
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		delete(w.subscribers, id)
+	}
+}
+
 // See if anything we watch has changed since a certain time
 func (w *K8sWatcher) ChangedSince(t time.Time) bool {
 	return w.lastChange.After(t)
 }
 
 // Used internally to denote when the internal struct has been modified and notify anyone listening about that change
-func (w *K8sWatcher) dirty() {
+func (w *K8sWatcher) dirty(change Change) {
 	w.lastChange = time.Now()
 	if w.onChange != nil {
 		w.onChange()
 	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for _, fn := range w.subscribers {
+		fn(change)
+	}
 }
 
 // Add a resource to the temporal map
 func (w *K8sWatcher) Add(r Resource) {
 	w.data.AddResource(r)
-	w.dirty()
+	w.dirty(Change{watch.Added, r})
 }
 
 // Update a resource in the temporal map
 func (w *K8sWatcher) Update(r Resource) {
 	w.data.UpdateResource(r)
-	w.dirty()
+	w.dirty(Change{watch.Modified, r})
 }
 
 // Delete a resource in the temporal map
 func (w *K8sWatcher) Delete(r Resource) {
 	w.data.DeleteResource(r)
-	w.dirty()
+	w.dirty(Change{watch.Deleted, r})
+}
+
+// resync records the difference between what the store holds for a kind now and every object of
+// that kind the cluster has, for when events were missed
+func (w *K8sWatcher) resync(resourceEventWatcher ResourceEventWatcher, objects []runtime.Object) {
+	recorded := map[string]Resource{}
+	for _, r := range w.data.GetResourcesAt(time.Now(), resourceEventWatcher.Kind(), "") {
+		recorded[r.Uid] = r
+	}
+
+	for _, obj := range objects {
+		r := resourceEventWatcher.ToResource(obj)
+		prev, ok := recorded[r.Uid]
+		delete(recorded, r.Uid)
+		switch {
+		case !ok:
+			w.Add(r)
+		case prev.RawJSON != r.RawJSON:
+			w.Update(r)
+		}
+	}
+
+	// Whatever is left was deleted while nobody was watching
+	for _, r := range recorded {
+		r.Timestamp = serializable.Time{Time: time.Now()}
+		w.Delete(r)
+	}
 }
 
-func (w *K8sWatcher) registerEventWatcher(watcher <-chan watch.Event, resourceEventWatcher ResourceEventWatcher) {
+// registerEventWatcher records events until the watch ends, returning the resource version to
+// resume from, empty if the watch has to start over
+func (w *K8sWatcher) registerEventWatcher(watcher <-chan watch.Event, resourceEventWatcher ResourceEventWatcher, resourceVersion string) string {
 	log.Info().Any("Watcher", reflect.TypeOf(resourceEventWatcher)).Msg("registerEventWatcher")
 
 	RegisterResourceRenderer(resourceEventWatcher.Kind(), resourceEventWatcher.Renderer())
 	if w == nil {
-		return
+		return resourceVersion
 	}
 
 	ticker := time.NewTicker(WATCHER_STEP)
@@ -181,7 +248,10 @@ func (w *K8sWatcher) registerEventWatcher(watcher <-chan watch.Event, resourceEv
 		case event, ok := <-watcher:
 			if !ok {
 				// fmt.Println("Channel closed")
-				return
+				return resourceVersion
+			}
+			if obj, err := meta.Accessor(event.Object); err == nil && event.Type != watch.Error {
+				resourceVersion = obj.GetResourceVersion()
 			}
 
 			switch event.Type {
@@ -193,6 +263,10 @@ func (w *K8sWatcher) registerEventWatcher(watcher <-chan watch.Event, resourceEv
 				w.Delete(resourceEventWatcher.ToResource(event.Object))
 			case watch.Error:
 				// fmt.Printf("Unknown error watching: %v\n", event.Object)
+				if err := apierrors.FromObject(event.Object); apierrors.IsResourceExpired(err) || apierrors.IsGone(err) {
+					// Too old to resume from, the events in between are gone
+					resourceVersion = ""
+				}
 			}
 		case <-ticker.C:
 			resourceEventWatcher.Tick()
@@ -69,6 +69,16 @@ func (st *Time) GobDecode(data []byte) error {
 		return err
 	}
 
+	restored, err := NewTimeIn(t, locationName)
+	if err != nil {
+		return err
+	}
+	*st = restored
+	return nil
+}
+
+// NewTimeIn returns t in the named location, resolving the location the same way decoding does
+func NewTimeIn(t time.Time, locationName string) (Time, error) {
 	// Resolve the location
 	normalizedLocation := locationName
 	if mappedLocation, ok := timeZoneMapping[locationName]; ok {
@@ -78,10 +88,8 @@ func (st *Time) GobDecode(data []byte) error {
 	// Set the location
 	loc, err := time.LoadLocation(normalizedLocation)
 	if err != nil {
-		return err
+		return Time{}, err
 	}
 
-	st.Time = t.In(loc)
-	st.Location = locationName
-	return nil
+	return Time{Time: t.In(loc), Location: locationName}, nil
 }
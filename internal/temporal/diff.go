@@ -1,12 +1,70 @@
 package temporal
 
 import (
+	"fmt"
+	"sync"
+
 	"github.com/gabstv/go-bsdiff/pkg/bsdiff"
 	"github.com/gabstv/go-bsdiff/pkg/bspatch"
 )
 
 type Diff []byte
 
+// A Differ computes the diffs stored between keyframes.  A TimeValueStore records the name of the
+// differ that built it, so a differ must keep applying the diffs it has produced for as long as old
+// recordings need to load.
+type Differ interface {
+	Diff(a, b []byte) (Diff, error)
+	Apply(a []byte, diff Diff) ([]byte, error)
+}
+
+const (
+	BsDiffer       = "bsdiff"   // Binary diffs of the raw values, works for anything
+	ResourceDiffer = "resource" // JSON merge patches of gob encoded resources.Resource values
+)
+
+var differLock sync.RWMutex
+var differs = map[string]Differ{
+	BsDiffer:       bsDiffer{},
+	ResourceDiffer: resourceDiffer{},
+}
+
+// RegisterDiffer makes a differ available by name
+func RegisterDiffer(name string, d Differ) {
+	differLock.Lock()
+	defer differLock.Unlock()
+	differs[name] = d
+}
+
+// GetDiffer looks up a differ, an empty name is bsdiff which is what every store used before
+// differs were pluggable
+func GetDiffer(name string) (Differ, error) {
+	if name == "" {
+		name = BsDiffer
+	}
+
+	differLock.RLock()
+	defer differLock.RUnlock()
+	if d, ok := differs[name]; ok {
+		return d, nil
+	}
+	return nil, fmt.Errorf("unknown differ %q", name)
+}
+
+func mustGetDiffer(name string) Differ {
+	d, err := GetDiffer(name)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+type bsDiffer struct{}
+
+func (bsDiffer) Diff(a, b []byte) (Diff, error) { return generateDiff(a, b) }
+
+func (bsDiffer) Apply(a []byte, diff Diff) ([]byte, error) { return applyDiff(a, diff) }
+
 func generateDiff(a, b []byte) (Diff, error) {
 	patch, err := bsdiff.Bytes(a, b)
 	if err != nil {
@@ -0,0 +1,250 @@
+package temporal
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hoyle1974/khronoscope/internal/misc"
+	"github.com/hoyle1974/khronoscope/internal/resources"
+	"github.com/hoyle1974/khronoscope/internal/serializable"
+)
+
+// podHistory returns a pod changing the way pods usually do, mostly status and metrics
+func podHistory(count int) [][]byte {
+	start := time.Now()
+	values := [][]byte{}
+	for i := 0; i < count; i++ {
+		obj := map[string]any{
+			"apiVersion": "v1",
+			"kind":       "Pod",
+			"metadata": map[string]any{
+				"name":              "web-0",
+				"namespace":         "default",
+				"resourceVersion":   fmt.Sprint(1000 + i),
+				"creationTimestamp": nil,
+				"labels":            map[string]any{"app": "web"},
+			},
+			"spec": map[string]any{
+				"containers": []any{map[string]any{"name": "web", "image": "nginx:1.27"}},
+				"nodeName":   "node-1",
+			},
+			"status": map[string]any{
+				"phase":        []string{"Pending", "Running"}[min(i, 1)],
+				"restartCount": i / 5,
+			},
+		}
+		raw, err := json.Marshal(obj)
+		if err != nil {
+			panic(err)
+		}
+
+		r := resources.Resource{
+			Uid:       "uid-web-0",
+			Timestamp: serializable.Time{Time: start.Add(time.Duration(i) * time.Second)},
+			Kind:      "Pod",
+			Namespace: "default",
+			Name:      "web-0",
+			RawJSON:   string(raw),
+			Extra: resources.PodExtra{
+				Phase:    "Running",
+				NodeName: "node-1",
+				Metrics:  map[string]resources.PodMetric{"web": {CPUPercentage: float64(i), MemoryPercentage: float64(i) / 2}},
+				Uptime:   time.Duration(i) * time.Second,
+				Logs:     []string{strings.Repeat("log line ", i%3)},
+			},
+		}
+		b, err := misc.EncodeToBytes(r)
+		if err != nil {
+			panic(err)
+		}
+		values = append(values, b)
+	}
+	return values
+}
+
+func decodeTestResource(t *testing.T, b []byte) resources.Resource {
+	r, err := decodeResource(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestResourceDiffer(t *testing.T) {
+	values := podHistory(40)
+	differ := resourceDiffer{}
+
+	for i := 1; i < len(values); i++ {
+		diff, err := differ.Diff(values[i-1], values[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff[0] != '{' {
+			t.Fatalf("Expected a JSON patch, got %q", diff)
+		}
+		var patch resourcePatch
+		if err := json.Unmarshal(diff, &patch); err != nil {
+			t.Fatal(err)
+		}
+		if patch.FullJSON != nil || len(patch.FullExtra) > 0 {
+			t.Fatalf("Expected patches, got a full value: %s", diff)
+		}
+
+		rebuilt, err := differ.Apply(values[i-1], diff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameResource(decodeTestResource(t, rebuilt), decodeTestResource(t, values[i])) {
+			t.Fatalf("Value %d did not round trip through %s", i, diff)
+		}
+	}
+}
+
+func TestResourceDifferFallback(t *testing.T) {
+	values := podHistory(2)
+	differ := resourceDiffer{}
+
+	// A member set to null can't be expressed by a merge patch
+	r := decodeTestResource(t, values[1])
+	r.RawJSON = `{"kind":"Pod","metadata":null}`
+	r.Extra = nil
+	nulled, err := misc.EncodeToBytes(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		a, b []byte
+	}{
+		{"Unpatchable", values[0], nulled},
+		{"Removed", values[0], nil},
+		{"Readded", nil, values[1]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diff, err := differ.Diff(tt.a, tt.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rebuilt, err := differ.Apply(tt.a, diff)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tt.b) == 0 {
+				if len(rebuilt) != 0 {
+					t.Fatalf("Expected an empty value")
+				}
+				return
+			}
+			if !sameResource(decodeTestResource(t, rebuilt), decodeTestResource(t, tt.b)) {
+				t.Fatalf("Value did not round trip through %s", diff)
+			}
+		})
+	}
+}
+
+func TestResourceDifferStore(t *testing.T) {
+	values := podHistory(50)
+	start := decodeTestResource(t, values[0]).Timestamp.Time
+
+	m := New(WithDiffer(ResourceDiffer))
+	for i, v := range values {
+		m.Add(start.Add(time.Duration(i)*time.Second), "pod", v)
+	}
+	m.Remove(start.Add(time.Minute), "pod")
+
+	check := func(m Map) {
+		for i, v := range values {
+			got := m.GetItem(start.Add(time.Duration(i)*time.Second), "pod")
+			if !sameResource(decodeTestResource(t, got), decodeTestResource(t, v)) {
+				t.Fatalf("Value %d does not match", i)
+			}
+		}
+		if len(m.GetItem(start.Add(time.Minute), "pod")) != 0 {
+			t.Fatalf("Expected the pod to be removed")
+		}
+	}
+	check(m)
+	// The differ is saved with the map
+	check(FromBytes(m.ToBytes()))
+}
+
+func TestResourceDifferSegmentMap(t *testing.T) {
+	values := podHistory(50)
+	start := decodeTestResource(t, values[0]).Timestamp.Time
+	dir := t.TempDir()
+
+	long := func(key string, value []byte) KeyframePolicy { return KeyframePolicy{MaxDiffs: 40} }
+	m, err := NewSegmentMap(dir, SegmentOptions{Differ: ResourceDiffer, KeyframePolicy: long})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range values {
+		m.Add(start.Add(time.Duration(i)*time.Second), "pod", v)
+	}
+	m.Remove(start.Add(time.Minute), "pod")
+
+	entries := m.(*segmentMapImpl).index["pod"]
+	depth := 0
+	for _, entry := range entries {
+		depth = max(depth, entry.Depth)
+	}
+	if depth != 40 {
+		t.Errorf("Expected the policy to chain 40 diffs, got %d", depth)
+	}
+	record, err := m.(*segmentMapImpl).readAt(entries[1].Location)
+	if err != nil || record.Kind != recordDiff || record.Differ != ResourceDiffer {
+		t.Errorf("Expected a resource diff, got kind %d by %q %v", record.Kind, record.Differ, err)
+	}
+
+	check := func(m Map) {
+		for i, v := range values {
+			got := m.GetItem(start.Add(time.Duration(i)*time.Second), "pod")
+			if !sameResource(decodeTestResource(t, got), decodeTestResource(t, v)) {
+				t.Fatalf("Value %d does not match", i)
+			}
+		}
+		if len(m.GetItem(start.Add(time.Minute), "pod")) != 0 {
+			t.Fatalf("Expected the pod to be removed")
+		}
+	}
+	check(m)
+	closeMap(t, m)
+
+	// The diffs are applied with the differ that built them whatever the map is opened with
+	reopened, err := NewSegmentMap(dir, SegmentOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeMap(t, reopened)
+	check(reopened)
+}
+
+func benchmarkDiffer(b *testing.B, name string) {
+	values := podHistory(KEYFRAME_RATE + 1)
+	start := time.Now()
+
+	size := 0
+	for i := 0; i < b.N; i++ {
+		store := NewTimeValueStore()
+		store.Differ = name
+		for idx, v := range values {
+			store.AddValue(start.Add(time.Duration(idx)*time.Second), v)
+		}
+		store.QueryValue(start.Add(time.Hour))
+
+		size = 0
+		for _, df := range store.Keyframes[0].DiffFrames {
+			size += len(df.Diff)
+		}
+	}
+	b.ReportMetric(float64(size)/float64(KEYFRAME_RATE), "bytes/diff")
+}
+
+func BenchmarkBsDiffer(b *testing.B) { benchmarkDiffer(b, BsDiffer) }
+
+func BenchmarkResourceDiffer(b *testing.B) { benchmarkDiffer(b, ResourceDiffer) }
@@ -0,0 +1,296 @@
+package temporal
+
+import (
+	"container/heap"
+	"fmt"
+	"iter"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Change is a value written to a Map
+type Change struct {
+	Timestamp time.Time
+	Key       string
+	Value     []byte // nil when the key was removed
+}
+
+// History and Changes walk every value written between from and to, both inclusive, in time order.
+// Each value is decoded once from the one before it rather than being looked up from scratch.
+// Neither holds the map's lock while yielding so the loop body is free to use the map, values
+// written while iterating may or may not be seen.
+
+// cursor steps through the changes to a single key in time order
+type cursor interface {
+	next() (Change, bool)
+}
+
+func historyOf(c cursor) iter.Seq2[time.Time, []byte] {
+	return func(yield func(time.Time, []byte) bool) {
+		if c == nil {
+			return
+		}
+		for {
+			change, ok := c.next()
+			if !ok || !yield(change.Timestamp, change.Value) {
+				return
+			}
+		}
+	}
+}
+
+// mergeChanges yields the changes from every cursor in time order, ties are broken by key
+func mergeChanges(cursors []cursor, yield func(Change) bool) {
+	h := &changeHeap{}
+	for _, c := range cursors {
+		if change, ok := c.next(); ok {
+			h.items = append(h.items, changeItem{change: change, cursor: c})
+		}
+	}
+	heap.Init(h)
+
+	for h.Len() > 0 {
+		item := &h.items[0]
+		if !yield(item.change) {
+			return
+		}
+		if change, ok := item.cursor.next(); ok {
+			item.change = change
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+}
+
+type changeItem struct {
+	change Change
+	cursor cursor
+}
+
+type changeHeap struct {
+	items []changeItem
+}
+
+func (h *changeHeap) Len() int { return len(h.items) }
+func (h *changeHeap) Less(i, j int) bool {
+	a, b := h.items[i].change, h.items[j].change
+	if a.Timestamp.Equal(b.Timestamp) {
+		return a.Key < b.Key
+	}
+	return a.Timestamp.Before(b.Timestamp)
+}
+func (h *changeHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *changeHeap) Push(x any)    { h.items = append(h.items, x.(changeItem)) }
+func (h *changeHeap) Pop() any {
+	item := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return item
+}
+
+// storeCursor walks a copy of the keyframes of a TimeValueStore.  Values and diffs are never changed
+// once written, inserts only ever replace slices, so the copy stays valid without any locking.
+type storeCursor struct {
+	key      string
+	differ   Differ
+	frames   []keyFrame
+	from, to time.Time
+
+	frame int
+	diff  int    // -1 is the keyframe's own value
+	at    int    // The diff of the current frame cur holds
+	cur   []byte // Only brought up to date when a value is yielded
+}
+
+// cursor returns a cursor over the values between from and to
+func (store *TimeValueStore) cursor(key string, from, to time.Time) *storeCursor {
+	// Start at the keyframe holding the value valid at from
+	lo := max(sort.Search(len(store.Keyframes), func(j int) bool {
+		return store.Keyframes[j].Timestamp.Time.After(from)
+	})-1, 0)
+	hi := sort.Search(len(store.Keyframes), func(j int) bool {
+		return store.Keyframes[j].Timestamp.Time.After(to)
+	})
+	if lo >= hi {
+		return &storeCursor{}
+	}
+
+	return &storeCursor{
+		key:    key,
+		differ: store.differ(),
+		frames: slices.Clone(store.Keyframes[lo:hi]),
+		from:   from,
+		to:     to,
+		diff:   -1,
+	}
+}
+
+func (c *storeCursor) next() (Change, bool) {
+	for c.frame < len(c.frames) {
+		k := &c.frames[c.frame]
+		var timestamp time.Time
+		switch {
+		case c.diff < 0:
+			timestamp = k.Timestamp.Time
+			c.cur, c.at = k.Value, -1
+		case c.diff < len(k.DiffFrames):
+			timestamp = k.DiffFrames[c.diff].Timestamp.Time
+		default:
+			c.frame++
+			c.diff = -1
+			continue
+		}
+		c.diff++
+
+		if timestamp.After(c.to) {
+			c.frame = len(c.frames)
+			break
+		}
+		if timestamp.Before(c.from) {
+			continue
+		}
+
+		c.catchUp(k, c.diff-1)
+		change := Change{Timestamp: timestamp, Key: c.key}
+		if len(c.cur) > 0 {
+			change.Value = c.cur
+		}
+		return change, true
+	}
+	return Change{}, false
+}
+
+// catchUp applies the diffs of k up to and including diff, values skipped before from are only
+// decoded once something in range needs them
+func (c *storeCursor) catchUp(k *keyFrame, diff int) {
+	if diff < 0 {
+		return
+	}
+	if ptr := k.DiffFrames[diff].original.Value(); ptr != nil {
+		c.cur, c.at = *ptr, diff
+		return
+	}
+	for c.at < diff {
+		c.at++
+		if ptr := k.DiffFrames[c.at].original.Value(); ptr != nil {
+			c.cur = *ptr
+			continue
+		}
+		value, err := c.differ.Apply(c.cur, k.DiffFrames[c.at].Diff)
+		if err != nil {
+			panic(err)
+		}
+		c.cur = value
+	}
+}
+
+func (tm *mapImpl) History(key string, from, to time.Time) iter.Seq2[time.Time, []byte] {
+	return func(yield func(time.Time, []byte) bool) {
+		tm.lock.RLock()
+		store, ok := tm.Items[key]
+		var c cursor
+		if ok {
+			c = store.cursor(key, from, to)
+		}
+		tm.lock.RUnlock()
+
+		historyOf(c)(yield)
+	}
+}
+
+func (tm *mapImpl) Changes(from, to time.Time) iter.Seq[Change] {
+	return func(yield func(Change) bool) {
+		tm.lock.RLock()
+		cursors := make([]cursor, 0, len(tm.Items))
+		for key, store := range tm.Items {
+			cursors = append(cursors, store.cursor(key, from, to))
+		}
+		tm.lock.RUnlock()
+
+		mergeChanges(cursors, yield)
+	}
+}
+
+// segmentCursor walks a copy of the index entries of a key, reading each value as it goes
+type segmentCursor struct {
+	tm         *segmentMapImpl
+	key        string
+	entries    []segmentEntry
+	generation int
+}
+
+// cursorLocked returns a cursor over the values of key between from and to
+func (tm *segmentMapImpl) cursorLocked(key string, from, to time.Time) *segmentCursor {
+	entries := tm.index[key]
+	lo := sort.Search(len(entries), func(j int) bool {
+		return !entries[j].Timestamp.Before(from)
+	})
+	hi := sort.Search(len(entries), func(j int) bool {
+		return entries[j].Timestamp.After(to)
+	})
+	c := &segmentCursor{tm: tm, key: key, generation: tm.generation}
+	if lo < hi {
+		c.entries = slices.Clone(entries[lo:hi])
+	}
+	return c
+}
+
+func (c *segmentCursor) next() (Change, bool) {
+	if len(c.entries) == 0 {
+		return Change{}, false
+	}
+	e := c.entries[0]
+	c.entries = c.entries[1:]
+
+	c.tm.lock.Lock()
+	defer c.tm.lock.Unlock()
+
+	// Compaction rewrote every record, the rest of the entries no longer point at anything
+	if c.tm.generation != c.generation {
+		c.entries = nil
+		return Change{}, false
+	}
+
+	// A value that can't be read ends the walk, the failure is kept as the map's error
+	if err := c.tm.writer.Flush(); err != nil {
+		c.tm.fail(fmt.Errorf("segment map flush failed: %w", err))
+		c.entries = nil
+		return Change{}, false
+	}
+	value, err := c.tm.materialize(e.Location)
+	if err != nil {
+		c.tm.fail(fmt.Errorf("segment map read failed: %w", err))
+		c.entries = nil
+		return Change{}, false
+	}
+
+	change := Change{Timestamp: e.Timestamp, Key: c.key}
+	if len(value) > 0 {
+		change.Value = value
+	}
+	return change, true
+}
+
+func (tm *segmentMapImpl) History(key string, from, to time.Time) iter.Seq2[time.Time, []byte] {
+	return func(yield func(time.Time, []byte) bool) {
+		tm.lock.RLock()
+		c := tm.cursorLocked(key, from, to)
+		tm.lock.RUnlock()
+
+		historyOf(c)(yield)
+	}
+}
+
+func (tm *segmentMapImpl) Changes(from, to time.Time) iter.Seq[Change] {
+	return func(yield func(Change) bool) {
+		tm.lock.RLock()
+		cursors := make([]cursor, 0, len(tm.index))
+		for key := range tm.index {
+			cursors = append(cursors, tm.cursorLocked(key, from, to))
+		}
+		tm.lock.RUnlock()
+
+		mergeChanges(cursors, yield)
+	}
+}
@@ -0,0 +1,107 @@
+package temporal
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fillForIteration writes two interleaved keys, key2 is removed half way through
+func fillForIteration(m Map, start time.Time) []Change {
+	changes := []Change{}
+	for i := 0; i < 100; i++ {
+		ts := start.Add(time.Duration(i) * time.Second)
+		key := fmt.Sprintf("key%d", i%2+1)
+		value := []byte(fmt.Sprintf("%s:%d", key, i))
+		if key == "key2" && i == 51 {
+			m.Remove(ts, key)
+			value = nil
+		} else {
+			m.Add(ts, key, value)
+		}
+		changes = append(changes, Change{Timestamp: ts, Key: key, Value: value})
+	}
+	return changes
+}
+
+func validateIteration(t *testing.T, m Map, start time.Time, expected []Change) {
+	at := func(i int) time.Time { return start.Add(time.Duration(i) * time.Second) }
+	same := func(a, b Change) bool {
+		return a.Timestamp.Equal(b.Timestamp) && a.Key == b.Key && string(a.Value) == string(b.Value) && (a.Value == nil) == (b.Value == nil)
+	}
+
+	// Everything, twice to make sure the iterator can be reused
+	all := m.Changes(at(0), at(99))
+	for range 2 {
+		got := slices.Collect(all)
+		if len(got) != len(expected) {
+			t.Fatalf("Expected %d changes, got %d", len(expected), len(got))
+		}
+		for i := range got {
+			if !same(got[i], expected[i]) {
+				t.Fatalf("Change %d: expected %v, got %v", i, expected[i], got[i])
+			}
+		}
+	}
+
+	// A window in the middle, both ends inclusive
+	got := slices.Collect(m.Changes(at(40), at(59)))
+	if len(got) != 20 || !same(got[0], expected[40]) || !same(got[19], expected[59]) {
+		t.Fatalf("Unexpected window: %v", got)
+	}
+
+	// History of a single key, including the removal
+	count := 0
+	for ts, value := range m.History("key2", at(45), at(55)) {
+		i := int(ts.Sub(start) / time.Second)
+		if i%2 != 1 || !same(Change{Timestamp: ts, Key: "key2", Value: value}, expected[i]) {
+			t.Fatalf("Unexpected history at %d: %q", i, value)
+		}
+		count++
+	}
+	if count != 6 {
+		t.Fatalf("Expected 6 values of key2, got %d", count)
+	}
+
+	// Stopping early, and using the map from inside the loop
+	count = 0
+	for change := range m.Changes(at(0), at(99)) {
+		if string(m.GetItem(change.Timestamp, change.Key)) != string(change.Value) {
+			t.Fatalf("GetItem disagrees with Changes at %v", change.Timestamp)
+		}
+		count++
+		if count == 10 {
+			break
+		}
+	}
+	if count != 10 {
+		t.Fatalf("Expected to stop after 10 changes")
+	}
+
+	if len(slices.Collect(m.Changes(at(200), at(300)))) != 0 {
+		t.Fatalf("Expected nothing after the end of the map")
+	}
+	for range m.History("missing", at(0), at(99)) {
+		t.Fatalf("Expected no history for a missing key")
+	}
+}
+
+func TestIterationMap(t *testing.T) {
+	start := time.Now()
+	m := New()
+	expected := fillForIteration(m, start)
+	validateIteration(t, m, start, expected)
+}
+
+func TestIterationSegmentMap(t *testing.T) {
+	start := time.Now()
+	m, err := NewSegmentMap(t.TempDir(), SegmentOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeMap(t, m)
+
+	expected := fillForIteration(m, start)
+	validateIteration(t, m, start, expected)
+}
@@ -0,0 +1,60 @@
+package temporal
+
+// KeyframePolicy decides when a TimeValueStore starts a new keyframe instead of adding another diff.
+// Querying a value means applying every diff between it and its keyframe, so long chains are cheap
+// to store but expensive to read, and a chain of diffs that together outweigh the value they started
+// from costs more than just storing the value again.
+//
+// With MaxDiffRatio set a keyframe is started once the diffs chained after it add up to more than
+// MaxDiffRatio times the size of the keyframe, or when a single diff is no smaller than the value it
+// encodes.  That keeps the work to read any value within a constant factor of reading a keyframe,
+// so values that change a little often get long chains and values that change a lot get short ones.
+type KeyframePolicy struct {
+	MaxDiffs     int     // Most diffs chained after a keyframe, 0 means KEYFRAME_RATE
+	MaxDiffRatio float64 // Start a keyframe once the chained diffs add up to this multiple of its size, 0 disables
+}
+
+var (
+	// FixedKeyframePolicy is how every store behaved before policies existed, a keyframe every KEYFRAME_RATE values
+	FixedKeyframePolicy = KeyframePolicy{MaxDiffs: KEYFRAME_RATE}
+	// AdaptiveKeyframePolicy sizes each chain by how big its diffs are
+	AdaptiveKeyframePolicy = KeyframePolicy{MaxDiffs: 4 * KEYFRAME_RATE, MaxDiffRatio: 1}
+)
+
+// KeyframePolicyFunc picks the policy for a key when the key is first written
+type KeyframePolicyFunc func(key string, value []byte) KeyframePolicy
+
+// WithKeyframePolicy selects the keyframe policy of each new key
+func WithKeyframePolicy(policy KeyframePolicyFunc) Option {
+	return func(tm *mapImpl) {
+		tm.keyframePolicy = policy
+	}
+}
+
+func (p KeyframePolicy) maxDiffs() int {
+	if p.MaxDiffs <= 0 {
+		return KEYFRAME_RATE
+	}
+	return p.MaxDiffs
+}
+
+// full reports whether frame should stop growing rather than take diff for value
+func (p KeyframePolicy) full(frame *keyFrame, diff Diff, value []byte) bool {
+	chained := 0
+	for _, df := range frame.DiffFrames {
+		chained += len(df.Diff)
+	}
+	return p.chainFull(len(frame.Value), chained, diff, value)
+}
+
+// chainFull reports whether a chain of diffs adding up to chained bytes after a keyframe of size
+// bytes should stop growing rather than take diff for value
+func (p KeyframePolicy) chainFull(size, chained int, diff Diff, value []byte) bool {
+	if p.MaxDiffRatio <= 0 {
+		return false
+	}
+	if len(diff) >= len(value) {
+		return true
+	}
+	return float64(chained+len(diff)) > p.MaxDiffRatio*float64(size)
+}
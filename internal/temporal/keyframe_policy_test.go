@@ -0,0 +1,205 @@
+package temporal
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"runtime"
+	"testing"
+	"time"
+	"weak"
+)
+
+// randomHistory returns values that share nothing with each other, so every diff is at least as big
+// as the value it encodes
+func randomHistory(count, size int) [][]byte {
+	r := rand.New(rand.NewPCG(1, 2))
+	values := [][]byte{}
+	for i := 0; i < count; i++ {
+		v := make([]byte, size)
+		for j := range v {
+			v[j] = byte(r.IntN(256))
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+// counterHistory returns a large value where only a counter changes
+func counterHistory(count int) [][]byte {
+	values := [][]byte{}
+	for i := 0; i < count; i++ {
+		values = append(values, []byte(fmt.Sprintf("%s counter:%08d", bytes.Repeat([]byte("x"), 4096), i)))
+	}
+	return values
+}
+
+func fillStore(differ string, policy KeyframePolicy, values [][]byte, start time.Time) *TimeValueStore {
+	store := NewTimeValueStore()
+	store.Differ = differ
+	store.Policy = policy
+	for i, v := range values {
+		store.AddValue(start.Add(time.Duration(i)*time.Second), v)
+	}
+	return store
+}
+
+// storeBytes is roughly how much memory a store holds onto
+func storeBytes(store *TimeValueStore) int {
+	size := 0
+	for _, k := range store.Keyframes {
+		size += len(k.Value)
+		if len(k.DiffFrames) > 0 {
+			size += len(k.Last) // Otherwise it is the same slice as Value
+		}
+		for _, df := range k.DiffFrames {
+			size += len(df.Diff)
+		}
+	}
+	return size
+}
+
+func checkStore(t *testing.T, store *TimeValueStore, values [][]byte, start time.Time) {
+	for i, v := range values {
+		if got := store.QueryValue(start.Add(time.Duration(i) * time.Second)); !bytes.Equal(got, v) {
+			t.Fatalf("Value %d does not match", i)
+		}
+	}
+}
+
+func TestKeyframePolicy(t *testing.T) {
+	start := time.Now()
+
+	tests := []struct {
+		name      string
+		policy    KeyframePolicy
+		values    [][]byte
+		keyframes int
+	}{
+		{"ZeroIsFixed", KeyframePolicy{}, counterHistory(100), 6},
+		{"Fixed", FixedKeyframePolicy, counterHistory(100), 6},
+		{"MaxDiffs", KeyframePolicy{MaxDiffs: 4}, counterHistory(100), 20},
+		{"AdaptiveSmallDiffs", AdaptiveKeyframePolicy, counterHistory(100), 4},
+		{"AdaptiveRatio", KeyframePolicy{MaxDiffs: 1000, MaxDiffRatio: 4}, counterHistory(100), 1},
+		{"AdaptiveBigDiffs", AdaptiveKeyframePolicy, randomHistory(20, 256), 20},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := fillStore(BsDiffer, tt.policy, tt.values, start)
+			if len(store.Keyframes) != tt.keyframes {
+				t.Fatalf("Expected %d keyframes, got %d", tt.keyframes, len(store.Keyframes))
+			}
+			checkStore(t, store, tt.values, start)
+		})
+	}
+}
+
+func TestKeyframeLateValue(t *testing.T) {
+	start := time.Now()
+	values := counterHistory(100)
+	store := fillStore(BsDiffer, AdaptiveKeyframePolicy, values, start)
+	if store.Keyframes[0].Last != nil {
+		t.Fatalf("Expected older keyframes to drop their last value")
+	}
+
+	// A late value that lands after the end of the first keyframe's chain
+	_, last := store.Keyframes[0].MinMax()
+	late := []byte("late")
+	store.AddValue(last.Add(time.Millisecond), late)
+
+	if got := store.QueryValue(last.Add(2 * time.Millisecond)); !bytes.Equal(got, late) {
+		t.Fatalf("Expected the late value, got %q", got)
+	}
+	checkStore(t, store, values, start)
+}
+
+func TestKeyframePolicyPerKey(t *testing.T) {
+	m := New(WithKeyframePolicy(func(key string, value []byte) KeyframePolicy {
+		if key == "often" {
+			return KeyframePolicy{MaxDiffs: 2}
+		}
+		return FixedKeyframePolicy
+	}))
+
+	start := time.Now()
+	for i, v := range counterHistory(30) {
+		m.Add(start.Add(time.Duration(i)*time.Second), "often", v)
+		m.Add(start.Add(time.Duration(i)*time.Second), "rarely", v)
+	}
+
+	items := m.(*mapImpl).Items
+	if len(items["often"].Keyframes) != 10 || len(items["rarely"].Keyframes) != 2 {
+		t.Fatalf("Expected per key policies, got %d and %d keyframes", len(items["often"].Keyframes), len(items["rarely"].Keyframes))
+	}
+
+	// The policy is saved with each key
+	loaded := FromBytes(m.ToBytes()).(*mapImpl)
+	if loaded.Items["often"].Policy.MaxDiffs != 2 {
+		t.Fatalf("Expected the policy to be saved")
+	}
+}
+
+type keyframeWorkload struct {
+	name   string
+	differ string
+	values [][]byte
+}
+
+func keyframeWorkloads() []keyframeWorkload {
+	return []keyframeWorkload{
+		{"PodMetrics", ResourceDiffer, podHistory(200)},
+		{"SmallChanges", BsDiffer, counterHistory(200)},
+		{"Rewrites", BsDiffer, randomHistory(200, 1024)},
+	}
+}
+
+var keyframePolicies = []struct {
+	name   string
+	policy KeyframePolicy
+}{
+	{"Fixed", FixedKeyframePolicy},
+	{"Adaptive", AdaptiveKeyframePolicy},
+}
+
+// BenchmarkKeyframeMemory reports how many bytes each policy holds per value
+func BenchmarkKeyframeMemory(b *testing.B) {
+	start := time.Now()
+	for _, w := range keyframeWorkloads() {
+		for _, p := range keyframePolicies {
+			b.Run(w.name+"/"+p.name, func(b *testing.B) {
+				var store *TimeValueStore
+				for i := 0; i < b.N; i++ {
+					store = fillStore(w.differ, p.policy, w.values, start)
+				}
+				b.ReportMetric(float64(storeBytes(store))/float64(len(w.values)), "bytes/value")
+				b.ReportMetric(float64(len(store.Keyframes)), "keyframes")
+			})
+		}
+	}
+}
+
+// BenchmarkKeyframeQuery measures queryValue with the cached originals dropped, so every query
+// replays diffs from its keyframe
+func BenchmarkKeyframeQuery(b *testing.B) {
+	start := time.Now()
+	for _, w := range keyframeWorkloads() {
+		for _, p := range keyframePolicies {
+			b.Run(w.name+"/"+p.name, func(b *testing.B) {
+				store := fillStore(w.differ, p.policy, w.values, start)
+				for k := range store.Keyframes {
+					for d := range store.Keyframes[k].DiffFrames {
+						store.Keyframes[k].DiffFrames[d].original = weak.Pointer[[]byte]{}
+					}
+				}
+				r := rand.New(rand.NewPCG(3, 4))
+
+				runtime.GC()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					store.QueryValue(start.Add(time.Duration(r.IntN(len(w.values))) * time.Second))
+				}
+			})
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/gob"
 	"errors"
+	"io"
+	"iter"
 	"sync"
 	"time"
 
@@ -19,9 +21,9 @@ import (
 // TemporalMap is threadsafe.
 //
 
-
 type Map interface {
 	ToBytes() []byte
+	Encode(w io.Writer) error
 	GetTimeRange() (time.Time, time.Time)
 	Add(timestamp time.Time, key string, value []byte)
 	GetItem(timestamp time.Time, key string) []byte
@@ -29,6 +31,10 @@ type Map interface {
 	Remove(timestamp time.Time, key string)
 	GetStateAtTime(timestamp time.Time) map[string][]byte
 	FindNextTimeKey(timestamp time.Time, dir int, key string) (time.Time, error)
+	Compact(policy RetentionPolicy, now time.Time) bool
+	History(key string, from, to time.Time) iter.Seq2[time.Time, []byte]
+	Changes(from, to time.Time) iter.Seq[Change]
+	StoredBytes() int64
 }
 
 // Map represents a map-like data structure with time-ordered items.
@@ -37,20 +43,45 @@ type mapImpl struct {
 	Items   map[string]*TimeValueStore
 	MinTime serializable.Time
 	MaxTime serializable.Time
+	Differ  string // The Differ new keys are stored with
+
+	keyframePolicy KeyframePolicyFunc
+	size           int64     // Bytes of values and diffs held by every key
+	watermark      watermark // How far Compact has downsampled
+}
+
+// Option configures a Map created with New
+type Option func(*mapImpl)
+
+// WithDiffer stores new keys using the named Differ, keys that already exist keep their own
+func WithDiffer(name string) Option {
+	return func(tm *mapImpl) {
+		tm.Differ = name
+	}
 }
 
 // New creates a new empty TimedMap.
-func New() Map {
-	return &mapImpl{
+func New(opts ...Option) Map {
+	tm := &mapImpl{
 		Items: map[string]*TimeValueStore{},
 	}
+	for _, opt := range opts {
+		opt(tm)
+	}
+	return tm
 }
 
-func FromBytes(b []byte) Map {
-	dec := gob.NewDecoder(bytes.NewReader(b))
+func (tm *mapImpl) newStore(key string, value []byte) *TimeValueStore {
+	store := NewTimeValueStore()
+	store.Differ = tm.Differ
+	if tm.keyframePolicy != nil {
+		store.Policy = tm.keyframePolicy(key, value)
+	}
+	return store
+}
 
-	tm := New().(*mapImpl)
-	err := dec.Decode(&tm)
+func FromBytes(b []byte) Map {
+	tm, err := Decode(b)
 	if err != nil {
 		panic(err)
 	}
@@ -58,6 +89,40 @@ func FromBytes(b []byte) Map {
 	return tm
 }
 
+// Decode is like FromBytes but returns an error instead of panicing on bad data.  Options apply
+// to keys added after loading and override anything that was saved with the map.
+func Decode(b []byte, opts ...Option) (Map, error) {
+	dec := gob.NewDecoder(bytes.NewReader(b))
+
+	tm := New().(*mapImpl)
+	if err := dec.Decode(&tm); err != nil {
+		return nil, err
+	}
+	for _, opt := range opts {
+		opt(tm)
+	}
+	tm.measure()
+
+	return tm, nil
+}
+
+// measure works out how many bytes the map holds, after it has been loaded
+func (tm *mapImpl) measure() {
+	tm.size = 0
+	for _, item := range tm.Items {
+		tm.size += item.storedBytes()
+	}
+}
+
+// StoredBytes is how many bytes of values and diffs the map holds, it is kept up to date as values
+// are written so it is cheap to ask for
+func (tm *mapImpl) StoredBytes() int64 {
+	tm.lock.RLock()
+	defer tm.lock.RUnlock()
+
+	return tm.size
+}
+
 func (tm *mapImpl) ToBytes() []byte {
 	tm.lock.Lock()
 	defer tm.lock.Unlock()
@@ -92,12 +157,13 @@ func (tm *mapImpl) Add(timestamp time.Time, key string, value []byte) {
 	defer tm.lock.Unlock()
 
 	tm.updateTimeRange(timestamp)
+	tm.watermark.written(timestamp)
 
 	v, ok := tm.Items[key]
 	if !ok {
-		v = NewTimeValueStore()
+		v = tm.newStore(key, value)
 	}
-	v.AddValue(timestamp, value)
+	tm.size += v.addValue(timestamp, value)
 	tm.Items[key] = v
 }
 
@@ -118,13 +184,14 @@ func (tm *mapImpl) Update(timestamp time.Time, key string, value []byte) {
 	defer tm.lock.Unlock()
 
 	tm.updateTimeRange(timestamp)
+	tm.watermark.written(timestamp)
 
 	v, ok := tm.Items[key]
 	if !ok {
-		v = NewTimeValueStore()
+		v = tm.newStore(key, value)
 	}
 	//if v.QueryValue(timestamp) != nil {
-	v.AddValue(timestamp, value)
+	tm.size += v.addValue(timestamp, value)
 	tm.Items[key] = v
 	//}
 }
@@ -135,12 +202,13 @@ func (tm *mapImpl) Remove(timestamp time.Time, key string) {
 	defer tm.lock.Unlock()
 
 	tm.updateTimeRange(timestamp)
+	tm.watermark.written(timestamp)
 
 	v, ok := tm.Items[key]
 	if !ok {
-		v = NewTimeValueStore()
+		v = tm.newStore(key, nil)
 	}
-	v.AddValue(timestamp, nil)
+	tm.size += v.addValue(timestamp, nil)
 	tm.Items[key] = v
 }
 
@@ -169,3 +237,49 @@ func (tm *mapImpl) FindNextTimeKey(timestamp time.Time, dir int, key string) (ti
 
 	return timestamp, errors.New("no key found")
 }
+
+// Compact applies a retention policy, rebuilding only the keyframes holding values that go.  Keys
+// that start after the MaxAge cutoff and have nothing between the watermark and now-FullFidelity are
+// skipped without decoding anything.  It returns whether anything changed.
+func (tm *mapImpl) Compact(policy RetentionPolicy, now time.Time) bool {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	since := tm.watermark.since(policy)
+	changed := false
+	for key, item := range tm.Items {
+		itemChanged, grown := item.compact(policy, since, now)
+		if !itemChanged {
+			continue
+		}
+		changed = true
+		tm.size += grown
+		if len(item.Keyframes) == 0 {
+			delete(tm.Items, key)
+		}
+	}
+	tm.watermark.compacted(policy, now)
+
+	if changed {
+		tm.recalculateTimeRange()
+	}
+	return changed
+}
+
+func (tm *mapImpl) recalculateTimeRange() {
+	first := true
+	for _, item := range tm.Items {
+		if len(item.Keyframes) == 0 {
+			continue
+		}
+		min := item.Keyframes[0].Timestamp.Time
+		_, max := item.Keyframes[len(item.Keyframes)-1].MinMax()
+		if first || min.Before(tm.MinTime.Time) {
+			tm.MinTime = serializable.Time{Time: min}
+		}
+		if first || max.After(tm.MaxTime.Time) {
+			tm.MaxTime = serializable.Time{Time: max}
+		}
+		first = false
+	}
+}
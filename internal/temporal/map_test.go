@@ -2,6 +2,7 @@ package temporal
 
 import (
 	"bytes"
+	"fmt"
 	"testing"
 	"time"
 )
@@ -71,7 +72,46 @@ func TestBasicSerialization(t *testing.T) {
 
 }
 
+func TestStreamSerialization(t *testing.T) {
+	start, end, t1, t2, t3, m := createTestMap()
+
+	var buf bytes.Buffer
+	if err := m.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	m2, err := DecodeStream(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	validateMap(t, start, end, t1, t2, t3, m2)
+}
+
 func TestBasicMap(t *testing.T) {
 	start, end, t1, t2, t3, m := createTestMap()
 	validateMap(t, start, end, t1, t2, t3, m)
 }
+
+func TestStoredBytes(t *testing.T) {
+	now := time.Now()
+	m := New()
+	// Out of order values split keyframes
+	for _, i := range []int{0, 5, 3, 9, 1, 7, 2, 8, 4, 6} {
+		m.Add(now.Add(time.Duration(i)*time.Second), "key1", []byte(fmt.Sprintf("value:%d", i)))
+	}
+	m.Remove(now.Add(10*time.Second), "key1")
+	m.Add(now, "key2", []byte("key2value1"))
+
+	measured := func(m Map) int64 {
+		loaded := FromBytes(m.ToBytes())
+		return loaded.StoredBytes()
+	}
+	if got, expected := m.StoredBytes(), measured(m); got != expected || got == 0 {
+		t.Fatalf("Expected %d stored bytes, got %d", expected, got)
+	}
+
+	m.Compact(RetentionPolicy{MaxAge: 5 * time.Second}, now.Add(10*time.Second))
+	if got, expected := m.StoredBytes(), measured(m); got != expected {
+		t.Fatalf("Expected %d stored bytes after compaction, got %d", expected, got)
+	}
+}
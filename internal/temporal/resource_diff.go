@@ -0,0 +1,213 @@
+package temporal
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"time"
+
+	"github.com/hoyle1974/khronoscope/internal/jsonpatch"
+	"github.com/hoyle1974/khronoscope/internal/misc"
+	"github.com/hoyle1974/khronoscope/internal/resources"
+	"github.com/hoyle1974/khronoscope/internal/serializable"
+)
+
+// resourceDiffer diffs gob encoded resources.Resource values structurally.  The diff is a JSON
+// document holding the fields that changed, a merge patch of RawJSON and a merge patch of Extra, so
+// it can be read to see what changed without replaying it.  Anything a patch can't reproduce exactly
+// is stored whole instead.
+//
+// Values that aren't resources, like the nil written when a key is removed, are diffed with bsdiff.
+// The two are told apart by the first byte of the diff since a resource patch is always an object.
+type resourceDiffer struct{}
+
+type resourcePatch struct {
+	Uid       *string         `json:"uid,omitempty"`
+	Kind      *string         `json:"kind,omitempty"`
+	Namespace *string         `json:"namespace,omitempty"`
+	Name      *string         `json:"name,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+	Location  string          `json:"location"`
+	RawJSON   json.RawMessage `json:"rawJSON,omitempty"`   // Merge patch against the previous RawJSON
+	FullJSON  *string         `json:"fullJSON,omitempty"`  // The whole RawJSON when it can't be patched
+	Extra     json.RawMessage `json:"extra,omitempty"`     // Merge patch against the previous Extra
+	FullExtra []byte          `json:"fullExtra,omitempty"` // The gob encoded Extra when it can't be patched
+}
+
+// extraHolder lets an Extra, which is an interface, be gob encoded on its own
+type extraHolder struct {
+	Extra resources.Copyable
+}
+
+func decodeResource(b []byte) (resources.Resource, error) {
+	var r resources.Resource
+	if len(b) == 0 {
+		return r, errors.New("not a resource")
+	}
+	err := misc.DecodeFromBytes(b, &r)
+	return r, err
+}
+
+func (d resourceDiffer) Diff(a, b []byte) (Diff, error) {
+	ra, errA := decodeResource(a)
+	rb, errB := decodeResource(b)
+	if errA != nil || errB != nil {
+		return generateDiff(a, b)
+	}
+
+	changed := func(from, to string) *string {
+		if from == to {
+			return nil
+		}
+		return &to
+	}
+
+	patch := resourcePatch{
+		Uid:       changed(ra.Uid, rb.Uid),
+		Kind:      changed(ra.Kind, rb.Kind),
+		Namespace: changed(ra.Namespace, rb.Namespace),
+		Name:      changed(ra.Name, rb.Name),
+		Timestamp: rb.Timestamp.Time,
+		Location:  rb.Timestamp.Time.Location().String(),
+	}
+
+	if ra.RawJSON != rb.RawJSON {
+		if p, err := jsonpatch.CreateMergePatch([]byte(ra.RawJSON), []byte(rb.RawJSON)); err == nil {
+			patch.RawJSON = p
+		} else {
+			patch.FullJSON = &rb.RawJSON
+		}
+	}
+
+	if !reflect.DeepEqual(ra.Extra, rb.Extra) {
+		if p, err := extraPatch(ra.Extra, rb.Extra); err == nil {
+			patch.Extra = p
+		} else if patch.FullExtra, err = misc.EncodeToBytes(extraHolder{Extra: rb.Extra}); err != nil {
+			return nil, err
+		}
+	}
+
+	// Make sure the patch rebuilds b, anything that doesn't survive the trip through JSON is stored whole
+	if rebuilt, err := patch.apply(ra); err != nil || !sameResource(rebuilt, rb) {
+		patch.RawJSON = nil
+		patch.FullJSON = &rb.RawJSON
+		patch.Extra = nil
+		if patch.FullExtra, err = misc.EncodeToBytes(extraHolder{Extra: rb.Extra}); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(patch)
+}
+
+func (d resourceDiffer) Apply(a []byte, diff Diff) ([]byte, error) {
+	if len(diff) == 0 || diff[0] != '{' {
+		return applyDiff(a, diff)
+	}
+
+	ra, err := decodeResource(a)
+	if err != nil {
+		return nil, err
+	}
+	var patch resourcePatch
+	if err := json.Unmarshal(diff, &patch); err != nil {
+		return nil, err
+	}
+
+	rebuilt, err := patch.apply(ra)
+	if err != nil {
+		return nil, err
+	}
+	return misc.EncodeToBytes(rebuilt)
+}
+
+// extraPatch diffs two Extras of the same type as JSON
+func extraPatch(a, b resources.Copyable) (json.RawMessage, error) {
+	if a == nil || b == nil || reflect.TypeOf(a) != reflect.TypeOf(b) {
+		return nil, errors.New("extra can not be patched")
+	}
+	ja, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	jb, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	return jsonpatch.CreateMergePatch(ja, jb)
+}
+
+func (p resourcePatch) apply(r resources.Resource) (resources.Resource, error) {
+	for _, field := range []struct {
+		value *string
+		dest  *string
+	}{{p.Uid, &r.Uid}, {p.Kind, &r.Kind}, {p.Namespace, &r.Namespace}, {p.Name, &r.Name}} {
+		if field.value != nil {
+			*field.dest = *field.value
+		}
+	}
+
+	timestamp, err := serializable.NewTimeIn(p.Timestamp, p.Location)
+	if err != nil {
+		return r, err
+	}
+	r.Timestamp = timestamp
+
+	if p.FullJSON != nil {
+		r.RawJSON = *p.FullJSON
+	} else if len(p.RawJSON) > 0 {
+		raw, err := jsonpatch.MergePatch([]byte(r.RawJSON), p.RawJSON)
+		if err != nil {
+			return r, err
+		}
+		r.RawJSON = string(raw)
+	}
+
+	if len(p.FullExtra) > 0 {
+		var holder extraHolder
+		if err := misc.DecodeFromBytes(p.FullExtra, &holder); err != nil {
+			return r, err
+		}
+		r.Extra = holder.Extra
+	} else if len(p.Extra) > 0 {
+		if r.Extra == nil {
+			return r, errors.New("extra patch without a previous extra")
+		}
+		prev, err := json.Marshal(r.Extra)
+		if err != nil {
+			return r, err
+		}
+		patched, err := jsonpatch.MergePatch(prev, p.Extra)
+		if err != nil {
+			return r, err
+		}
+		extra := reflect.New(reflect.TypeOf(r.Extra))
+		if err := json.Unmarshal(patched, extra.Interface()); err != nil {
+			return r, err
+		}
+		copyable, ok := extra.Elem().Interface().(resources.Copyable)
+		if !ok {
+			return r, errors.New("patched extra is not copyable")
+		}
+		r.Extra = copyable
+	}
+
+	return r, nil
+}
+
+// sameResource compares resources the way they will be used, Extras are compared as JSON since
+// time zones don't survive a trip through JSON exactly
+func sameResource(a, b resources.Resource) bool {
+	if a.Uid != b.Uid || a.Kind != b.Kind || a.Namespace != b.Namespace || a.Name != b.Name || a.RawJSON != b.RawJSON {
+		return false
+	}
+	if !a.Timestamp.Time.Equal(b.Timestamp.Time) || a.Timestamp.Time.Location().String() != b.Timestamp.Time.Location().String() {
+		return false
+	}
+	if reflect.TypeOf(a.Extra) != reflect.TypeOf(b.Extra) {
+		return false
+	}
+	ja, errA := json.Marshal(a.Extra)
+	jb, errB := json.Marshal(b.Extra)
+	return errA == nil && errB == nil && string(ja) == string(jb)
+}
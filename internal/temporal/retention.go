@@ -0,0 +1,109 @@
+package temporal
+
+import (
+	"time"
+)
+
+// RetentionPolicy describes how much history a Map keeps.  Values newer than FullFidelity are
+// never touched, values between FullFidelity and MaxAge are downsampled to the last value per key
+// per Resolution, and values older than MaxAge are dropped.  The value that was valid at the MaxAge
+// cutoff is kept as the first value of the key so the state at the new start of the map is unchanged.
+//
+// Which values go is decided from their timestamps alone, so only the values around the ones that
+// go are decoded.  Maps keep a watermark of how far they have been downsampled so each compaction
+// only looks at the values that aged past FullFidelity since the one before.
+type RetentionPolicy struct {
+	FullFidelity time.Duration // Keep everything newer than this at full fidelity
+	Resolution   time.Duration // Keep one value per key per Resolution beyond FullFidelity, 0 disables downsampling
+	MaxAge       time.Duration // Drop everything older than this, 0 keeps everything
+}
+
+type timeValue struct {
+	Timestamp time.Time
+	Value     []byte
+}
+
+// cutoff is when values stop being dropped, and whether any are
+func (p RetentionPolicy) cutoff(now time.Time) (time.Time, bool) {
+	return now.Add(-p.MaxAge), p.MaxAge > 0
+}
+
+// trim drops the values before cutoff.  The value that was valid at the cutoff is kept at the cutoff
+// so the state there is unchanged, unless there is already a value at the cutoff.  next is the time
+// of the first value after values, if there is one.
+func trim(values []timeValue, cutoff time.Time, next time.Time) []timeValue {
+	start := 0
+	for start < len(values) && values[start].Timestamp.Before(cutoff) {
+		start++
+	}
+
+	kept := make([]timeValue, 0, len(values)-start+1)
+	if start > 0 {
+		atCutoff := next.Equal(cutoff)
+		if start < len(values) {
+			atCutoff = values[start].Timestamp.Equal(cutoff)
+		}
+		// Materialize the value that was valid at the cutoff so the state there is preserved
+		if floor := values[start-1]; len(floor.Value) > 0 && !atCutoff {
+			kept = append(kept, timeValue{Timestamp: cutoff, Value: floor.Value})
+		}
+	}
+	return append(kept, values[start:]...)
+}
+
+// downsample returns the indexes of the times whose values downsampling drops, only the last value
+// in each Resolution bucket older than FullFidelity survives.  Pairs of values where the later one
+// is before since were downsampled already and aren't looked at again.  first is whether times
+// starts with the first value of its key, which is always kept so the key's history doesn't start
+// any later than it did.
+func (p RetentionPolicy) downsample(times []time.Time, first bool, since, now time.Time) []int {
+	if p.Resolution <= 0 {
+		return nil
+	}
+	coarsenBefore := now.Add(-p.FullFidelity)
+
+	var drop []int
+	for idx := 0; idx+1 < len(times); idx++ {
+		if idx == 0 && first {
+			continue
+		}
+		next := times[idx+1]
+		if next.Before(since) {
+			continue
+		}
+		if !next.Before(coarsenBefore) {
+			break
+		}
+		if next.Truncate(p.Resolution).Equal(times[idx].Truncate(p.Resolution)) {
+			drop = append(drop, idx)
+		}
+	}
+	return drop
+}
+
+// watermark remembers how far a map has been downsampled
+type watermark struct {
+	policy RetentionPolicy
+	at     time.Time // Values before this have been downsampled with policy, zero if none have
+}
+
+// since is where downsampling with policy has to start looking
+func (w *watermark) since(policy RetentionPolicy) time.Time {
+	if w.policy != policy {
+		return time.Time{}
+	}
+	return w.at
+}
+
+// compacted moves the watermark to what compacting with policy at now downsampled
+func (w *watermark) compacted(policy RetentionPolicy, now time.Time) {
+	w.policy = policy
+	w.at = now.Add(-policy.FullFidelity)
+}
+
+// written moves the watermark back to a value written before it, so downsampling looks at it
+func (w *watermark) written(timestamp time.Time) {
+	if timestamp.Before(w.at) {
+		w.at = timestamp
+	}
+}
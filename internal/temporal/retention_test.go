@@ -0,0 +1,127 @@
+package temporal
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func fillForRetention(m Map, now time.Time) {
+	// A value every 10 seconds for the last 3 hours
+	for i := 3 * 360; i >= 0; i-- {
+		ts := now.Add(-time.Duration(i) * 10 * time.Second)
+		m.Add(ts, "key1", []byte(fmt.Sprintf("value:%d", i)))
+	}
+	// A key that was deleted a long time ago
+	m.Add(now.Add(-170*time.Minute), "key2", []byte("gone"))
+	m.Remove(now.Add(-160*time.Minute), "key2")
+}
+
+func validateRetention(t *testing.T, m Map, now time.Time) {
+	policy := RetentionPolicy{FullFidelity: time.Hour, Resolution: time.Minute, MaxAge: 2 * time.Hour}
+
+	before := m.GetStateAtTime(now.Add(-2 * time.Hour))
+	recent := m.GetItem(now.Add(-30*time.Minute), "key1")
+
+	m.Compact(policy, now)
+
+	min, max := m.GetTimeRange()
+	if !min.Equal(now.Add(-2 * time.Hour)) {
+		t.Fatalf("Expected min time to move to the cutoff, got %v", now.Sub(min))
+	}
+	if !max.Equal(now) {
+		t.Fatalf("Expected max time to be unchanged, got %v", now.Sub(max))
+	}
+
+	// The state at the cutoff must be preserved
+	after := m.GetStateAtTime(now.Add(-2 * time.Hour))
+	if len(after) != len(before) || string(after["key1"]) != string(before["key1"]) {
+		t.Fatalf("State at the cutoff changed: %v -> %v", before, after)
+	}
+	if _, ok := after["key2"]; ok {
+		t.Fatalf("Expected key2 to be gone")
+	}
+
+	// Recent values are untouched
+	if string(m.GetItem(now.Add(-30*time.Minute), "key1")) != string(recent) {
+		t.Fatalf("Recent values should be kept at full fidelity")
+	}
+	count := 0
+	ts := now.Add(-2 * time.Hour)
+	for {
+		next, err := m.FindNextTimeKey(ts, 1, "key1")
+		if err != nil {
+			break
+		}
+		if next.Before(now.Add(-time.Hour)) {
+			count++
+		}
+		ts = next
+	}
+	// One value per minute between 2h and 1h
+	if count != 60 {
+		t.Fatalf("Expected 60 downsampled values, got %d", count)
+	}
+
+	// Compacting again with the same time is a no-op
+	if m.Compact(policy, now) {
+		t.Fatalf("Compaction should be idempotent")
+	}
+	if min2, _ := m.GetTimeRange(); !min2.Equal(min) {
+		t.Fatalf("Compaction should be idempotent")
+	}
+
+	// A minute later only the values that aged past FullFidelity in that minute are looked at
+	later := now.Add(time.Minute)
+	m.Add(later, "key1", []byte("later"))
+	if !m.Compact(policy, later) {
+		t.Fatalf("Expected the values that aged past FullFidelity to be downsampled")
+	}
+	// The value kept at the cutoff and one per minute after it
+	if count := countValues(m, "key1", later.Add(-2*time.Hour), later.Add(-time.Hour)); count != 61 {
+		t.Fatalf("Expected 61 values a minute later, got %d", count)
+	}
+	if m.Compact(policy, later) {
+		t.Fatalf("Compaction should be idempotent")
+	}
+}
+
+// countValues counts the values of key in [from, to)
+func countValues(m Map, key string, from, to time.Time) int {
+	count := 0
+	for ts := range m.History(key, from, to) {
+		if ts.Before(to) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestRetentionMap(t *testing.T) {
+	now := time.Now().Truncate(time.Minute)
+	m := New()
+	fillForRetention(m, now)
+	validateRetention(t, m, now)
+}
+
+func TestRetentionSegmentMap(t *testing.T) {
+	now := time.Now().Truncate(time.Minute)
+	dir := t.TempDir()
+	m, err := NewSegmentMap(dir, SegmentOptions{MaxSegmentBytes: 16 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillForRetention(m, now)
+	validateRetention(t, m, now)
+	closeMap(t, m)
+
+	m2, err := NewSegmentMap(dir, SegmentOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeMap(t, m2)
+	// validateRetention compacts a second time a minute later
+	if min, _ := m2.GetTimeRange(); !min.Equal(now.Add(time.Minute - 2*time.Hour)) {
+		t.Fatalf("Compacted segments were not persisted")
+	}
+}
@@ -0,0 +1,1205 @@
+package temporal
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hoyle1974/khronoscope/internal/serializable"
+)
+
+// The segment map is a disk backed implementation of Map.  Every value written to it is appended
+// to a segment file as either a full keyframe or as a diff against the value before it.  Only an
+// index of where each record lives is kept in memory along with a bounded LRU cache of recently
+// materialized values, so long recordings no longer need to fit in RAM.
+//
+// Diff records store the location of the record they were diffed against, so a value can always be
+// rebuilt by following that chain back to a keyframe no matter what order the records were written in.
+// Out of order writes are simply written as new keyframes.  Diffs built by a Differ other than
+// bsdiff are written as named diff records so they are applied with the same Differ when read back,
+// whatever the map is opened with later.
+//
+// Retention drops values by appending a drop record naming the record that went, the record itself
+// stays where it is since later diffs may be based on it.  Once dropped records make up half of the
+// files the surviving values are rewritten to fresh segments.
+
+const (
+	segmentFilePrefix = "segment-"
+	segmentFileSuffix = ".seg"
+	segmentMagic      = "KSEG0001"
+	compactDir        = "compact.tmp"    // Where a rewrite builds the new segments
+	compactMarker     = "compact.commit" // Written once they're complete, holds the last old segment id
+
+	defaultMaxSegmentBytes = 64 * 1024 * 1024
+	defaultCacheBytes      = 32 * 1024 * 1024
+
+	recordKeyframe  byte = 0
+	recordDiff      byte = 1
+	recordTombstone byte = 2
+	recordDrop      byte = 3 // Base is the record that was dropped
+	recordNamedDiff byte = 4 // A diff with the name of the Differ that built it, read back as a recordDiff
+
+	// length + crc
+	recordHeaderSize = 8
+)
+
+// SegmentOptions controls how a segment map lays out its files and how much it caches.
+// Zero values select sensible defaults.
+type SegmentOptions struct {
+	MaxSegmentBytes int64 // Roll over to a new segment file once the active one grows past this size
+	CacheBytes      int   // Upper bound on the bytes held by the materialized value cache
+
+	Differ         string             // The Differ new diffs are built with, empty for bsdiff
+	KeyframePolicy KeyframePolicyFunc // Picks when each key starts a new keyframe, nil is FixedKeyframePolicy
+	OnError        func(error)        // Told about each write, read or compaction that fails
+}
+
+// recordLocation identifies a record within the segment files
+type recordLocation struct {
+	Segment int
+	Offset  int64
+}
+
+// segmentEntry is the in memory index for a single record
+type segmentEntry struct {
+	Timestamp time.Time
+	Kind      byte
+	Depth     int // How many diffs must be applied to get from a keyframe to this value
+	Location  recordLocation
+	Size      int64 // Bytes the record occupies on disk
+	Keyframe  int   // Size of the keyframe the chain starts from
+	Chained   int   // Size of the diffs chained after the keyframe up to this value
+}
+
+type segmentRecord struct {
+	Kind      byte
+	Timestamp time.Time
+	Key       string
+	Base      recordLocation
+	Differ    string // The Differ a diff was built with, empty for bsdiff
+	Payload   []byte
+}
+
+type segmentMapImpl struct {
+	lock    sync.RWMutex
+	dir     string
+	opts    SegmentOptions
+	index   map[string][]segmentEntry
+	minTime time.Time
+	maxTime time.Time
+
+	segments   map[int]*os.File // Read handles for every segment
+	active     *os.File
+	activeID   int
+	activeSize int64
+	closedSize int64 // Bytes in every segment but the active one
+	deadSize   int64 // Bytes of dropped records and the drop records themselves
+	writer     *bufio.Writer
+
+	cache    *valueCache
+	policies map[string]KeyframePolicy // The keyframe policy of each key written since the map was opened
+
+	generation int       // Bumped when compaction moves every record, so iterators know their locations are stale
+	watermark  watermark // How far Compact has downsampled
+
+	err    error // The first write, read or compaction that failed, returned by Sync, Close and Encode
+	broken bool  // A write failed, the active segment may end in part of a record so nothing more is written
+}
+
+// NewSegmentMap opens (or creates) a disk backed Map in dir.  Any existing segments are scanned to
+// rebuild the index, and a partially written record at the end of the last segment is truncated away.
+func NewSegmentMap(dir string, opts SegmentOptions) (Map, error) {
+	if opts.MaxSegmentBytes <= 0 {
+		opts.MaxSegmentBytes = defaultMaxSegmentBytes
+	}
+	if opts.CacheBytes <= 0 {
+		opts.CacheBytes = defaultCacheBytes
+	}
+	if _, err := GetDiffer(opts.Differ); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("unable to create segment directory %s: %w", dir, err)
+	}
+	if err := recoverCompaction(dir); err != nil {
+		return nil, fmt.Errorf("unable to recover compaction in %s: %w", dir, err)
+	}
+
+	tm := &segmentMapImpl{
+		dir:      dir,
+		opts:     opts,
+		index:    map[string][]segmentEntry{},
+		segments: map[int]*os.File{},
+		cache:    newValueCache(opts.CacheBytes),
+		policies: map[string]KeyframePolicy{},
+	}
+
+	ids, err := tm.listSegments()
+	if err != nil {
+		return nil, err
+	}
+
+	for idx, id := range ids {
+		if err := tm.loadSegment(id, idx == len(ids)-1); err != nil {
+			_ = tm.Close()
+			return nil, err
+		}
+		if idx < len(ids)-1 {
+			fi, err := tm.segments[id].Stat()
+			if err != nil {
+				_ = tm.Close()
+				return nil, fmt.Errorf("unable to stat segment %d: %w", id, err)
+			}
+			tm.closedSize += fi.Size()
+		}
+	}
+
+	if tm.deadSize > 0 {
+		tm.recalculateTimeRangeLocked()
+	}
+
+	if len(ids) == 0 {
+		if err := tm.openActive(1); err != nil {
+			return nil, err
+		}
+	} else if err := tm.openActive(ids[len(ids)-1]); err != nil {
+		_ = tm.Close()
+		return nil, err
+	}
+
+	return tm, nil
+}
+
+func segmentFileName(id int) string {
+	return fmt.Sprintf("%s%06d%s", segmentFilePrefix, id, segmentFileSuffix)
+}
+
+func (tm *segmentMapImpl) listSegments() ([]int, error) {
+	files, err := os.ReadDir(tm.dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list segments in %s: %w", tm.dir, err)
+	}
+
+	ids := []int{}
+	for _, f := range files {
+		if id, ok := segmentID(f); ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	return ids, nil
+}
+
+// segmentID returns the id of a segment file
+func segmentID(f os.DirEntry) (int, bool) {
+	name := f.Name()
+	if f.IsDir() || !strings.HasPrefix(name, segmentFilePrefix) || !strings.HasSuffix(name, segmentFileSuffix) {
+		return 0, false
+	}
+	var id int
+	if _, err := fmt.Sscanf(strings.TrimSuffix(strings.TrimPrefix(name, segmentFilePrefix), segmentFileSuffix), "%d", &id); err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+// loadSegment reads every record in a segment and adds it to the index
+func (tm *segmentMapImpl) loadSegment(id int, last bool) error {
+	filename := filepath.Join(tm.dir, segmentFileName(id))
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("unable to open segment %s: %w", filename, err)
+	}
+	tm.segments[id] = f
+
+	reader := bufio.NewReader(f)
+	magic := make([]byte, len(segmentMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != segmentMagic {
+		if last && (errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)) {
+			// The segment was created but the header never made it to disk
+			return os.Truncate(filename, 0)
+		}
+		return fmt.Errorf("segment %s has an invalid header", filename)
+	}
+
+	offset := int64(len(segmentMagic))
+	for {
+		record, size, err := readRecord(reader)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			if last {
+				// A crash while appending leaves a partial record, drop it
+				return os.Truncate(filename, offset)
+			}
+			return fmt.Errorf("segment %s is corrupt at offset %d: %w", filename, offset, err)
+		}
+
+		tm.indexRecord(record, recordLocation{Segment: id, Offset: offset}, size)
+		offset += size
+	}
+}
+
+func (tm *segmentMapImpl) indexRecord(record segmentRecord, loc recordLocation, size int64) {
+	entries := tm.index[record.Key]
+	if record.Kind == recordDrop {
+		tm.deadSize += size
+		if idx := slices.IndexFunc(entries, func(e segmentEntry) bool { return e.Location == record.Base }); idx >= 0 {
+			tm.deadSize += entries[idx].Size
+			tm.setEntries(record.Key, slices.Delete(entries, idx, idx+1))
+		}
+		return
+	}
+
+	entry := segmentEntry{
+		Timestamp: record.Timestamp,
+		Kind:      record.Kind,
+		Location:  loc,
+		Size:      size,
+	}
+	switch record.Kind {
+	case recordKeyframe:
+		entry.Keyframe = len(record.Payload)
+	case recordDiff:
+		// Find the base record to figure out how long the chain is, it's almost always the latest entry
+		for idx := len(entries) - 1; idx >= 0; idx-- {
+			if entries[idx].Location == record.Base {
+				entry.Depth = entries[idx].Depth + 1
+				entry.Keyframe = entries[idx].Keyframe
+				entry.Chained = entries[idx].Chained + len(record.Payload)
+				break
+			}
+		}
+	}
+
+	tm.insertEntry(record.Key, entries, entry)
+}
+
+func (tm *segmentMapImpl) insertEntry(key string, entries []segmentEntry, entry segmentEntry) {
+	if len(tm.index) == 0 || entry.Timestamp.Before(tm.minTime) {
+		tm.minTime = entry.Timestamp
+	}
+	if len(tm.index) == 0 || entry.Timestamp.After(tm.maxTime) {
+		tm.maxTime = entry.Timestamp
+	}
+
+	index := sort.Search(len(entries), func(j int) bool {
+		return entries[j].Timestamp.After(entry.Timestamp)
+	})
+	entries = append(entries, segmentEntry{})
+	copy(entries[index+1:], entries[index:])
+	entries[index] = entry
+
+	tm.index[key] = entries
+}
+
+func (tm *segmentMapImpl) openActive(id int) error {
+	filename := filepath.Join(tm.dir, segmentFileName(id))
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("unable to open segment %s for writing: %w", filename, err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("unable to stat segment %s: %w", filename, err)
+	}
+
+	tm.active = f
+	tm.activeID = id
+	tm.activeSize = fi.Size()
+	tm.writer = bufio.NewWriter(f)
+
+	if tm.activeSize == 0 {
+		if _, err := tm.writer.WriteString(segmentMagic); err != nil {
+			return err
+		}
+		tm.activeSize = int64(len(segmentMagic))
+	}
+
+	if _, ok := tm.segments[id]; !ok {
+		rf, err := os.Open(filename)
+		if err != nil {
+			return fmt.Errorf("unable to open segment %s: %w", filename, err)
+		}
+		tm.segments[id] = rf
+	}
+
+	return nil
+}
+
+func (tm *segmentMapImpl) rollover() error {
+	if err := tm.writer.Flush(); err != nil {
+		return err
+	}
+	if err := tm.active.Close(); err != nil {
+		return err
+	}
+	tm.closedSize += tm.activeSize
+	return tm.openActive(tm.activeID + 1)
+}
+
+func encodeRecord(record segmentRecord) []byte {
+	kind := record.Kind
+	if kind == recordDiff && record.Differ != "" {
+		kind = recordNamedDiff
+	}
+
+	var body bytes.Buffer
+	body.WriteByte(kind)
+	_ = binary.Write(&body, binary.BigEndian, record.Timestamp.UnixNano())
+	_ = binary.Write(&body, binary.BigEndian, uint32(len(record.Key)))
+	body.WriteString(record.Key)
+	if record.Kind == recordDiff || record.Kind == recordDrop {
+		_ = binary.Write(&body, binary.BigEndian, uint32(record.Base.Segment))
+		_ = binary.Write(&body, binary.BigEndian, record.Base.Offset)
+	}
+	if kind == recordNamedDiff {
+		_ = binary.Write(&body, binary.BigEndian, uint32(len(record.Differ)))
+		body.WriteString(record.Differ)
+	}
+	body.Write(record.Payload)
+
+	out := make([]byte, recordHeaderSize, recordHeaderSize+body.Len())
+	binary.BigEndian.PutUint32(out[0:4], uint32(body.Len()))
+	binary.BigEndian.PutUint32(out[4:8], crc32.ChecksumIEEE(body.Bytes()))
+	return append(out, body.Bytes()...)
+}
+
+// readRecord reads a single record, returning it and the number of bytes it occupied on disk
+func readRecord(r io.Reader) (segmentRecord, int64, error) {
+	var header [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return segmentRecord{}, 0, fmt.Errorf("truncated record header: %w", err)
+		}
+		return segmentRecord{}, 0, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return segmentRecord{}, 0, fmt.Errorf("truncated record body: %w", err)
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:8]) {
+		return segmentRecord{}, 0, errors.New("record checksum mismatch")
+	}
+
+	record, err := decodeRecordBody(body)
+	return record, int64(recordHeaderSize + len(body)), err
+}
+
+func decodeRecordBody(body []byte) (segmentRecord, error) {
+	var record segmentRecord
+	if len(body) < 13 {
+		return record, errors.New("record too short")
+	}
+
+	record.Kind = body[0]
+	record.Timestamp = time.Unix(0, int64(binary.BigEndian.Uint64(body[1:9])))
+	keyLen := int(binary.BigEndian.Uint32(body[9:13]))
+	pos := 13
+	if len(body) < pos+keyLen {
+		return record, errors.New("record key truncated")
+	}
+	record.Key = string(body[pos : pos+keyLen])
+	pos += keyLen
+
+	if record.Kind == recordDiff || record.Kind == recordDrop || record.Kind == recordNamedDiff {
+		if len(body) < pos+12 {
+			return record, errors.New("record base truncated")
+		}
+		record.Base.Segment = int(binary.BigEndian.Uint32(body[pos : pos+4]))
+		record.Base.Offset = int64(binary.BigEndian.Uint64(body[pos+4 : pos+12]))
+		pos += 12
+	}
+	if record.Kind == recordNamedDiff {
+		if len(body) < pos+4 {
+			return record, errors.New("record differ truncated")
+		}
+		differLen := int(binary.BigEndian.Uint32(body[pos : pos+4]))
+		pos += 4
+		if len(body) < pos+differLen {
+			return record, errors.New("record differ truncated")
+		}
+		record.Kind = recordDiff
+		record.Differ = string(body[pos : pos+differLen])
+		pos += differLen
+	}
+	record.Payload = body[pos:]
+
+	return record, nil
+}
+
+// append writes a record to the active segment and returns where it was written and its size
+func (tm *segmentMapImpl) append(record segmentRecord) (recordLocation, int64, error) {
+	if tm.activeSize >= tm.opts.MaxSegmentBytes {
+		if err := tm.rollover(); err != nil {
+			return recordLocation{}, 0, err
+		}
+	}
+
+	data := encodeRecord(record)
+	loc := recordLocation{Segment: tm.activeID, Offset: tm.activeSize}
+	if _, err := tm.writer.Write(data); err != nil {
+		return loc, 0, err
+	}
+	tm.activeSize += int64(len(data))
+
+	return loc, int64(len(data)), nil
+}
+
+// readAt reads the record at a location, flushing pending writes first if needed
+func (tm *segmentMapImpl) readAt(loc recordLocation) (segmentRecord, error) {
+	f, ok := tm.segments[loc.Segment]
+	if !ok {
+		return segmentRecord{}, fmt.Errorf("unknown segment %d", loc.Segment)
+	}
+
+	var header [recordHeaderSize]byte
+	if _, err := f.ReadAt(header[:], loc.Offset); err != nil {
+		return segmentRecord{}, err
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+	if _, err := f.ReadAt(body, loc.Offset+recordHeaderSize); err != nil {
+		return segmentRecord{}, err
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:8]) {
+		return segmentRecord{}, fmt.Errorf("record checksum mismatch in segment %d at %d", loc.Segment, loc.Offset)
+	}
+
+	return decodeRecordBody(body)
+}
+
+// materialize returns the full value stored at a location, walking the diff chain if needed
+func (tm *segmentMapImpl) materialize(loc recordLocation) ([]byte, error) {
+	if value, ok := tm.cache.get(loc); ok {
+		return value, nil
+	}
+
+	record, err := tm.readAt(loc)
+	if err != nil {
+		return nil, err
+	}
+
+	var value []byte
+	switch record.Kind {
+	case recordKeyframe:
+		value = record.Payload
+	case recordTombstone:
+		return nil, nil
+	case recordDiff:
+		base, err := tm.materialize(record.Base)
+		if err != nil {
+			return nil, err
+		}
+		differ, err := GetDiffer(record.Differ)
+		if err != nil {
+			return nil, err
+		}
+		if value, err = differ.Apply(base, record.Payload); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown record kind %d", record.Kind)
+	}
+
+	tm.cache.put(loc, value)
+	return value, nil
+}
+
+func (tm *segmentMapImpl) write(timestamp time.Time, key string, value []byte) {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	if tm.broken {
+		return
+	}
+	if err := tm.writeLocked(timestamp, key, value); err != nil {
+		tm.broken = true
+		tm.fail(fmt.Errorf("segment map write failed: %w", err))
+		return
+	}
+	tm.watermark.written(timestamp)
+}
+
+// fail records err, keeping the first as the map's error, and passes it to OnError
+func (tm *segmentMapImpl) fail(err error) {
+	if tm.err == nil {
+		tm.err = err
+	}
+	if tm.opts.OnError != nil {
+		tm.opts.OnError(err)
+	}
+}
+
+// Err returns the first write, read or compaction that failed, if any
+func (tm *segmentMapImpl) Err() error {
+	tm.lock.RLock()
+	defer tm.lock.RUnlock()
+
+	return tm.err
+}
+
+func (tm *segmentMapImpl) writeLocked(timestamp time.Time, key string, value []byte) error {
+	entries := tm.index[key]
+	record := segmentRecord{Kind: recordKeyframe, Timestamp: timestamp, Key: key, Payload: value}
+	entry := segmentEntry{Timestamp: timestamp, Keyframe: len(value)}
+
+	policy := tm.policy(key, value)
+	if value == nil {
+		record.Kind = recordTombstone
+	} else if n := len(entries); n > 0 && entries[n-1].Timestamp.Before(timestamp) &&
+		entries[n-1].Kind != recordTombstone && entries[n-1].Depth < policy.maxDiffs() {
+		// Appending in order, store a diff against the previous value unless the policy wants a keyframe
+		prevEntry := entries[n-1]
+		if err := tm.writer.Flush(); err != nil {
+			return err
+		}
+		prev, err := tm.materialize(prevEntry.Location)
+		if err != nil {
+			return err
+		}
+		differ, err := GetDiffer(tm.opts.Differ)
+		if err != nil {
+			return err
+		}
+		diff, err := differ.Diff(prev, value)
+		if err != nil {
+			return err
+		}
+		if !policy.chainFull(prevEntry.Keyframe, prevEntry.Chained, diff, value) {
+			record.Kind = recordDiff
+			record.Base = prevEntry.Location
+			if tm.opts.Differ != BsDiffer {
+				record.Differ = tm.opts.Differ
+			}
+			record.Payload = diff
+			entry.Depth = prevEntry.Depth + 1
+			entry.Keyframe = prevEntry.Keyframe
+			entry.Chained = prevEntry.Chained + len(diff)
+		}
+	}
+
+	loc, size, err := tm.append(record)
+	if err != nil {
+		return err
+	}
+	if value != nil {
+		tm.cache.put(loc, value)
+	}
+
+	entry.Kind = record.Kind
+	entry.Location = loc
+	entry.Size = size
+	tm.insertEntry(key, entries, entry)
+
+	return nil
+}
+
+// policy is the keyframe policy of a key, picked when the key is first written after the map is opened
+func (tm *segmentMapImpl) policy(key string, value []byte) KeyframePolicy {
+	if policy, ok := tm.policies[key]; ok {
+		return policy
+	}
+	if tm.opts.KeyframePolicy == nil || value == nil {
+		return FixedKeyframePolicy
+	}
+	policy := tm.opts.KeyframePolicy(key, value)
+	tm.policies[key] = policy
+	return policy
+}
+
+// entryAt returns the index of the entry valid at timestamp, or -1
+func entryAt(entries []segmentEntry, timestamp time.Time) int {
+	return sort.Search(len(entries), func(j int) bool {
+		return entries[j].Timestamp.After(timestamp)
+	}) - 1
+}
+
+func (tm *segmentMapImpl) queryLocked(timestamp time.Time, key string) []byte {
+	entries := tm.index[key]
+	idx := entryAt(entries, timestamp)
+	if idx < 0 || entries[idx].Kind == recordTombstone {
+		return nil
+	}
+
+	if err := tm.writer.Flush(); err != nil {
+		tm.fail(fmt.Errorf("segment map flush failed: %w", err))
+		return nil
+	}
+	value, err := tm.materialize(entries[idx].Location)
+	if err != nil {
+		tm.fail(fmt.Errorf("segment map read failed: %w", err))
+		return nil
+	}
+	return value
+}
+
+// ToBytes materializes the whole map into the in memory format so it can be saved like any other
+// Map.  Values that can't be read are left out and the failure is kept for Err, Encode reports it.
+func (tm *segmentMapImpl) ToBytes() []byte {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	if err := tm.writer.Flush(); err != nil {
+		tm.fail(fmt.Errorf("segment map flush failed: %w", err))
+	}
+
+	mem := New().(*mapImpl)
+	mem.MinTime = serializable.Time{Time: tm.minTime}
+	mem.MaxTime = serializable.Time{Time: tm.maxTime}
+	for key := range tm.index {
+		store, err := tm.storeLocked(key)
+		if err != nil {
+			tm.fail(fmt.Errorf("segment map read failed: %w", err))
+			continue
+		}
+		mem.Items[key] = store
+	}
+
+	return mem.ToBytes()
+}
+
+// storeLocked materializes every value of key into a TimeValueStore, the writer must be flushed
+func (tm *segmentMapImpl) storeLocked(key string) (*TimeValueStore, error) {
+	store := NewTimeValueStore()
+	for _, e := range tm.index[key] {
+		value, err := tm.materialize(e.Location)
+		if err != nil {
+			return nil, err
+		}
+		store.AddValue(e.Timestamp, value)
+	}
+	return store, nil
+}
+
+// StoredBytes is the size of the segment files
+func (tm *segmentMapImpl) StoredBytes() int64 {
+	tm.lock.RLock()
+	defer tm.lock.RUnlock()
+
+	return tm.closedSize + tm.activeSize
+}
+
+func (tm *segmentMapImpl) GetTimeRange() (time.Time, time.Time) {
+	tm.lock.RLock()
+	defer tm.lock.RUnlock()
+
+	return tm.minTime, tm.maxTime
+}
+
+func (tm *segmentMapImpl) Add(timestamp time.Time, key string, value []byte) {
+	tm.write(timestamp, key, value)
+}
+
+func (tm *segmentMapImpl) Update(timestamp time.Time, key string, value []byte) {
+	tm.write(timestamp, key, value)
+}
+
+func (tm *segmentMapImpl) Remove(timestamp time.Time, key string) {
+	tm.write(timestamp, key, nil)
+}
+
+func (tm *segmentMapImpl) GetItem(timestamp time.Time, key string) []byte {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	return tm.queryLocked(timestamp, key)
+}
+
+func (tm *segmentMapImpl) GetStateAtTime(timestamp time.Time) map[string][]byte {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	state := make(map[string][]byte)
+	for key := range tm.index {
+		value := tm.queryLocked(timestamp, key)
+		if len(value) > 0 {
+			state[key] = value
+		}
+	}
+	return state
+}
+
+func (tm *segmentMapImpl) FindNextTimeKey(timestamp time.Time, dir int, key string) (time.Time, error) {
+	tm.lock.RLock()
+	defer tm.lock.RUnlock()
+
+	entries, ok := tm.index[key]
+	if !ok {
+		return timestamp, errors.New("no key found")
+	}
+	if dir == 0 {
+		return timestamp, fmt.Errorf("invalid direction: %d", dir)
+	}
+
+	if dir > 0 {
+		idx := entryAt(entries, timestamp) + 1
+		if idx < len(entries) {
+			return entries[idx].Timestamp, nil
+		}
+		return timestamp, errors.New("no next")
+	}
+
+	idx := sort.Search(len(entries), func(j int) bool {
+		return !entries[j].Timestamp.Before(timestamp)
+	}) - 1
+	if idx >= 0 {
+		return entries[idx].Timestamp, nil
+	}
+	return timestamp, errors.New("no next")
+}
+
+// Compact applies a retention policy.  Which values go is worked out from the index alone, only the
+// value valid at the MaxAge cutoff is read.  Segments are append only so dropped values are recorded
+// with drop records, and the surviving values are rewritten to fresh segments once dropped records
+// make up half of the files.  It returns whether anything changed.
+func (tm *segmentMapImpl) Compact(policy RetentionPolicy, now time.Time) bool {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	if tm.broken {
+		return false
+	}
+	changed, err := tm.compactLocked(policy, now)
+	if err != nil {
+		tm.fail(fmt.Errorf("segment map compaction failed: %w", err))
+	}
+	return changed
+}
+
+func (tm *segmentMapImpl) entryValues(entries []segmentEntry) ([]timeValue, error) {
+	values := make([]timeValue, 0, len(entries))
+	for _, e := range entries {
+		value, err := tm.materialize(e.Location)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, timeValue{Timestamp: e.Timestamp, Value: value})
+	}
+	return values, nil
+}
+
+func (tm *segmentMapImpl) compactLocked(policy RetentionPolicy, now time.Time) (bool, error) {
+	if err := tm.writer.Flush(); err != nil {
+		return false, err
+	}
+
+	since := tm.watermark.since(policy)
+	changed := false
+	for key := range tm.index {
+		trimmed, err := tm.trimLocked(key, policy, now)
+		if err != nil {
+			return changed, err
+		}
+		downsampled, err := tm.downsampleLocked(key, policy, since, now)
+		if err != nil {
+			return changed, err
+		}
+		changed = changed || trimmed || downsampled
+	}
+	tm.watermark.compacted(policy, now)
+	if !changed {
+		return false, nil
+	}
+	tm.recalculateTimeRangeLocked()
+
+	if tm.deadSize*2 > tm.closedSize+tm.activeSize {
+		return true, tm.rewriteLocked()
+	}
+	return true, nil
+}
+
+// trimLocked drops the values of key before the MaxAge cutoff, the value valid at the cutoff is
+// written at the cutoff so the state there is unchanged
+func (tm *segmentMapImpl) trimLocked(key string, policy RetentionPolicy, now time.Time) (bool, error) {
+	cutoff, ok := policy.cutoff(now)
+	entries := tm.index[key]
+	if !ok || len(entries) == 0 || !entries[0].Timestamp.Before(cutoff) {
+		return false, nil
+	}
+
+	floor := sort.Search(len(entries), func(j int) bool {
+		return !entries[j].Timestamp.Before(cutoff)
+	}) - 1
+	atCutoff := floor+1 < len(entries) && entries[floor+1].Timestamp.Equal(cutoff)
+	if entries[floor].Kind != recordTombstone && !atCutoff {
+		value, err := tm.materialize(entries[floor].Location)
+		if err != nil {
+			return false, err
+		}
+		if err := tm.writeLocked(cutoff, key, value); err != nil {
+			return false, err
+		}
+	}
+
+	return true, tm.dropLocked(key, func(e segmentEntry) bool {
+		return e.Timestamp.Before(cutoff)
+	})
+}
+
+// downsampleLocked drops the values of key that downsampling doesn't keep, only their timestamps are
+// looked at
+func (tm *segmentMapImpl) downsampleLocked(key string, policy RetentionPolicy, since, now time.Time) (bool, error) {
+	entries := tm.index[key]
+	lo := max(sort.Search(len(entries), func(j int) bool {
+		return !entries[j].Timestamp.Before(since)
+	})-1, 0)
+	hi := sort.Search(len(entries), func(j int) bool {
+		return !entries[j].Timestamp.Before(now.Add(-policy.FullFidelity))
+	})
+	if lo >= hi {
+		return false, nil
+	}
+
+	// The first value at or after now-FullFidelity decides whether the last one before it goes
+	window := entries[lo:min(hi+1, len(entries))]
+	times := make([]time.Time, len(window))
+	for idx, e := range window {
+		times[idx] = e.Timestamp
+	}
+	drop := policy.downsample(times, lo == 0, since, now)
+	if len(drop) == 0 {
+		return false, nil
+	}
+
+	dropped := map[recordLocation]bool{}
+	for _, idx := range drop {
+		dropped[window[idx].Location] = true
+	}
+	return true, tm.dropLocked(key, func(e segmentEntry) bool {
+		return dropped[e.Location]
+	})
+}
+
+// dropLocked appends a drop record for every entry of key that matches and removes them from the index
+func (tm *segmentMapImpl) dropLocked(key string, match func(segmentEntry) bool) error {
+	entries := tm.index[key]
+	kept := make([]segmentEntry, 0, len(entries))
+	for _, e := range entries {
+		if !match(e) {
+			kept = append(kept, e)
+			continue
+		}
+		_, size, err := tm.append(segmentRecord{Kind: recordDrop, Timestamp: e.Timestamp, Key: key, Base: e.Location})
+		if err != nil {
+			return err
+		}
+		tm.deadSize += size + e.Size
+	}
+	tm.setEntries(key, kept)
+	return nil
+}
+
+// setEntries replaces the entries of key, forgetting the key once it has none
+func (tm *segmentMapImpl) setEntries(key string, entries []segmentEntry) {
+	if len(entries) == 0 {
+		delete(tm.index, key)
+		return
+	}
+	tm.index[key] = entries
+}
+
+func (tm *segmentMapImpl) recalculateTimeRangeLocked() {
+	first := true
+	for _, entries := range tm.index {
+		if first || entries[0].Timestamp.Before(tm.minTime) {
+			tm.minTime = entries[0].Timestamp
+		}
+		if first || entries[len(entries)-1].Timestamp.After(tm.maxTime) {
+			tm.maxTime = entries[len(entries)-1].Timestamp
+		}
+		first = false
+	}
+}
+
+// rewriteLocked writes the values still in the index to a fresh set of segments which then replace
+// the old ones, leaving the dropped records behind.  The new segments are built in compactDir and
+// numbered after the old ones.  Once they are on disk a marker naming the last old segment commits
+// the rewrite, and recoverCompaction finishes the swap, again on the next open if it's interrupted.
+// Until the marker is written the old segments are untouched and the map carries on with them.
+func (tm *segmentMapImpl) rewriteLocked() error {
+	if err := tm.writer.Flush(); err != nil {
+		return err
+	}
+
+	tmpDir := filepath.Join(tm.dir, compactDir)
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmpDir, 0o755); err != nil {
+		return err
+	}
+	// An empty segment is picked up as the active one, so the new segments start after the old
+	last := tm.activeID
+	if err := os.WriteFile(filepath.Join(tmpDir, segmentFileName(last+1)), nil, 0o644); err != nil {
+		return err
+	}
+	m, err := NewSegmentMap(tmpDir, tm.opts)
+	if err != nil {
+		_ = os.RemoveAll(tmpDir)
+		return err
+	}
+	compacted := m.(*segmentMapImpl)
+	abort := func(err error) error {
+		_ = compacted.Close()
+		_ = os.RemoveAll(tmpDir)
+		return err
+	}
+
+	for key, entries := range tm.index {
+		values, err := tm.entryValues(entries)
+		if err != nil {
+			return abort(err)
+		}
+		for _, v := range values {
+			var value []byte
+			if len(v.Value) > 0 {
+				value = v.Value
+			}
+			if err := compacted.writeLocked(v.Timestamp, key, value); err != nil {
+				return abort(err)
+			}
+		}
+	}
+	if err := compacted.Sync(); err != nil {
+		return abort(err)
+	}
+	if err := compacted.Close(); err != nil {
+		return abort(err)
+	}
+	if err := syncDir(tmpDir); err != nil {
+		return abort(err)
+	}
+	if err := rewriteFault("commit"); err != nil {
+		return abort(err)
+	}
+	if err := writeCompactMarker(tm.dir, last); err != nil {
+		return abort(err)
+	}
+
+	// The old handles stay open until the new segments are, so if the swap fails the map can still
+	// be read and the next open finishes it
+	if err := recoverCompaction(tm.dir); err != nil {
+		return err
+	}
+	reopened, err := NewSegmentMap(tm.dir, tm.opts)
+	if err != nil {
+		return err
+	}
+	_ = tm.closeFiles()
+
+	r := reopened.(*segmentMapImpl)
+	tm.index = r.index
+	tm.minTime = r.minTime
+	tm.maxTime = r.maxTime
+	tm.segments = r.segments
+	tm.active = r.active
+	tm.activeID = r.activeID
+	tm.activeSize = r.activeSize
+	tm.closedSize = r.closedSize
+	tm.deadSize = r.deadSize
+	tm.writer = r.writer
+	tm.cache = r.cache
+	tm.generation++
+
+	return nil
+}
+
+// rewriteFault lets tests fail a rewrite at the named stage
+var rewriteFault = func(stage string) error { return nil }
+
+// writeCompactMarker atomically records that the segments in compactDir replace every segment up to last
+func writeCompactMarker(dir string, last int) error {
+	tmp := filepath.Join(dir, compactMarker+".tmp")
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d\n", last)), 0o644); err != nil {
+		return err
+	}
+	f, err := os.Open(tmp)
+	if err != nil {
+		return err
+	}
+	if err := errors.Join(f.Sync(), f.Close()); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, compactMarker)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// recoverCompaction finishes a committed rewrite by removing the old segments and moving the new
+// ones in, or throws away the new segments of a rewrite that never committed.  It is safe to run
+// again after it's interrupted.
+func recoverCompaction(dir string) error {
+	tmpDir := filepath.Join(dir, compactDir)
+	data, err := os.ReadFile(filepath.Join(dir, compactMarker))
+	if errors.Is(err, os.ErrNotExist) {
+		return os.RemoveAll(tmpDir)
+	}
+	if err != nil {
+		return err
+	}
+	var last int
+	if _, err := fmt.Sscanf(string(data), "%d", &last); err != nil {
+		return fmt.Errorf("compaction marker is corrupt: %w", err)
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if id, ok := segmentID(f); ok && id <= last {
+			if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	if err := rewriteFault("swap"); err != nil {
+		return err
+	}
+	files, err = os.ReadDir(tmpDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	for _, f := range files {
+		if _, ok := segmentID(f); ok {
+			if err := os.Rename(filepath.Join(tmpDir, f.Name()), filepath.Join(dir, f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(dir, compactMarker)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	return errors.Join(d.Sync(), d.Close())
+}
+
+// Sync flushes buffered records and fsyncs the active segment, or returns the map's error
+func (tm *segmentMapImpl) Sync() error {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	if tm.err != nil {
+		return tm.err
+	}
+	if err := tm.writer.Flush(); err != nil {
+		return err
+	}
+	return tm.active.Sync()
+}
+
+// Close flushes pending writes and releases all file handles, returning the map's error too
+func (tm *segmentMapImpl) Close() error {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	return errors.Join(tm.err, tm.closeFiles())
+}
+
+func (tm *segmentMapImpl) closeFiles() error {
+	var errs []error
+	if tm.writer != nil {
+		errs = append(errs, tm.writer.Flush())
+	}
+	if tm.active != nil {
+		errs = append(errs, tm.active.Close())
+	}
+	for _, f := range tm.segments {
+		errs = append(errs, f.Close())
+	}
+	tm.writer = nil
+	tm.active = nil
+	tm.segments = map[int]*os.File{}
+
+	return errors.Join(errs...)
+}
+
+// valueCache is a size bounded LRU of materialized values keyed by record location
+type valueCache struct {
+	lock     sync.Mutex
+	maxBytes int
+	size     int
+	items    map[recordLocation]*list.Element
+	order    *list.List
+}
+
+type valueCacheItem struct {
+	loc   recordLocation
+	value []byte
+}
+
+func newValueCache(maxBytes int) *valueCache {
+	return &valueCache{
+		maxBytes: maxBytes,
+		items:    map[recordLocation]*list.Element{},
+		order:    list.New(),
+	}
+}
+
+func (c *valueCache) get(loc recordLocation) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if e, ok := c.items[loc]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*valueCacheItem).value, true
+	}
+	return nil, false
+}
+
+func (c *valueCache) put(loc recordLocation, value []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(value) > c.maxBytes {
+		return
+	}
+	if e, ok := c.items[loc]; ok {
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.items[loc] = c.order.PushFront(&valueCacheItem{loc: loc, value: value})
+	c.size += len(value)
+
+	for c.size > c.maxBytes {
+		e := c.order.Back()
+		item := e.Value.(*valueCacheItem)
+		c.order.Remove(e)
+		delete(c.items, item.loc)
+		c.size -= len(item.value)
+	}
+}
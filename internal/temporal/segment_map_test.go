@@ -0,0 +1,365 @@
+package temporal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func createTestSegmentMap(t *testing.T, dir string) (start, end, t1, t2, t3 time.Time, m Map) {
+	m, err := NewSegmentMap(dir, SegmentOptions{})
+	if err != nil {
+		t.Fatalf("NewSegmentMap failed: %v", err)
+	}
+
+	start = time.Now().Add(-time.Second)
+	t1 = time.Now()
+	m.Add(t1, "key1", []byte("key1value1"))
+
+	t2 = time.Now()
+	m.Add(t2, "key1", []byte("key1value2"))
+	m.Add(t2, "key2", []byte("key2value1"))
+
+	t3 = time.Now()
+	m.Add(t3, "key1", []byte("key1value3"))
+
+	end = time.Now().Add(time.Second)
+
+	return start, end, t1, t2, t3, m
+}
+
+func closeMap(t *testing.T, m Map) {
+	if c, ok := m.(interface{ Close() error }); ok {
+		if err := c.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+	}
+}
+
+func TestSegmentMap(t *testing.T) {
+	start, end, t1, t2, t3, m := createTestSegmentMap(t, t.TempDir())
+	defer closeMap(t, m)
+
+	validateMap(t, start, end, t1, t2, t3, m)
+}
+
+func TestSegmentMapReopen(t *testing.T) {
+	dir := t.TempDir()
+	start, end, t1, t2, t3, m := createTestSegmentMap(t, dir)
+	closeMap(t, m)
+
+	m2, err := NewSegmentMap(dir, SegmentOptions{})
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer closeMap(t, m2)
+
+	validateMap(t, start, end, t1, t2, t3, m2)
+}
+
+func TestSegmentMapSerialization(t *testing.T) {
+	start, end, t1, t2, t3, m := createTestSegmentMap(t, t.TempDir())
+	defer closeMap(t, m)
+
+	validateMap(t, start, end, t1, t2, t3, FromBytes(m.ToBytes()))
+}
+
+func TestSegmentMapStream(t *testing.T) {
+	start, end, t1, t2, t3, m := createTestSegmentMap(t, t.TempDir())
+	defer closeMap(t, m)
+
+	var buf bytes.Buffer
+	if err := m.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	m2, err := DecodeStream(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validateMap(t, start, end, t1, t2, t3, m2)
+}
+
+func TestSegmentMapTruncatedTail(t *testing.T) {
+	dir := t.TempDir()
+	start, end, t1, t2, t3, m := createTestSegmentMap(t, dir)
+	m.Add(t3.Add(time.Millisecond), "key3", []byte("this record will be damaged"))
+	closeMap(t, m)
+
+	// Chop a few bytes off the last record to simulate a crash mid write
+	filename := filepath.Join(dir, segmentFileName(1))
+	fi, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(filename, fi.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	m2, err := NewSegmentMap(dir, SegmentOptions{})
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer closeMap(t, m2)
+
+	validateMap(t, start, end, t1, t2, t3, m2)
+
+	// The map must still be writable after recovery
+	m2.Add(end, "key3", []byte("key3value1"))
+	if !bytes.Equal(m2.GetItem(end, "key3"), []byte("key3value1")) {
+		t.Fatalf("Expected a value for key3 after recovery")
+	}
+}
+
+func TestSegmentMapManyValues(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewSegmentMap(dir, SegmentOptions{MaxSegmentBytes: 4096, CacheBytes: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Now()
+	for i := 0; i < 500; i++ {
+		m.Add(base.Add(time.Duration(i)*time.Second), "key", []byte(fmt.Sprintf("value:%d", i)))
+	}
+	// Insert a few values out of order
+	for i := 0; i < 500; i += 50 {
+		m.Add(base.Add(time.Duration(i)*time.Second+time.Millisecond), "key", []byte(fmt.Sprintf("late:%d", i)))
+	}
+	m.Remove(base.Add(600*time.Second), "key")
+
+	check := func(m Map) {
+		for i := 0; i < 500; i++ {
+			expected := fmt.Sprintf("value:%d", i)
+			if i%50 == 0 {
+				expected = fmt.Sprintf("late:%d", i)
+			}
+			if v := m.GetItem(base.Add(time.Duration(i)*time.Second+2*time.Millisecond), "key"); string(v) != expected {
+				t.Fatalf("Expected %s, got %s", expected, v)
+			}
+		}
+		if v := m.GetItem(base.Add(601*time.Second), "key"); v != nil {
+			t.Fatalf("Expected key to be removed")
+		}
+	}
+
+	check(m)
+	closeMap(t, m)
+
+	ids, err := (&segmentMapImpl{dir: dir}).listSegments()
+	if err != nil || len(ids) < 2 {
+		t.Fatalf("Expected multiple segments, got %v (%v)", ids, err)
+	}
+
+	m2, err := NewSegmentMap(dir, SegmentOptions{CacheBytes: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeMap(t, m2)
+	check(m2)
+
+	var size int64
+	for _, id := range ids {
+		fi, err := os.Stat(filepath.Join(dir, segmentFileName(id)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		size += fi.Size()
+	}
+	if got := m2.StoredBytes(); got != size {
+		t.Fatalf("Expected the size of the segments, %d, got %d", size, got)
+	}
+}
+
+func TestSegmentMapDropRecords(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewSegmentMap(dir, SegmentOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A value every 10 seconds for an hour, only the first few minutes are old enough to downsample
+	now := time.Now().Truncate(time.Minute)
+	for i := 360; i >= 0; i-- {
+		m.Add(now.Add(-time.Duration(i)*10*time.Second), "key", []byte(fmt.Sprintf("value:%d", i)))
+	}
+	if !m.Compact(RetentionPolicy{FullFidelity: 55 * time.Minute, Resolution: time.Minute}, now) {
+		t.Fatalf("Expected values to be downsampled")
+	}
+	if generation := m.(*segmentMapImpl).generation; generation != 0 {
+		t.Fatalf("Dropping a few values should not rewrite the segments")
+	}
+
+	history := func(m Map) []string {
+		values := []string{}
+		for ts, value := range m.History("key", now.Add(-time.Hour), now) {
+			values = append(values, fmt.Sprintf("%v=%s", now.Sub(ts), value))
+		}
+		return values
+	}
+	before := history(m)
+	closeMap(t, m)
+
+	m2, err := NewSegmentMap(dir, SegmentOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeMap(t, m2)
+	if after := history(m2); fmt.Sprint(after) != fmt.Sprint(before) {
+		t.Fatalf("Dropped values came back after reopening:\n%v\n%v", before, after)
+	}
+	if len(before) >= 361 {
+		t.Fatalf("Expected fewer than 361 values, got %d", len(before))
+	}
+}
+
+func TestSegmentMapRewriteFailure(t *testing.T) {
+	now := time.Now().Truncate(time.Minute)
+	policy := RetentionPolicy{MaxAge: 10 * time.Minute}
+	fill := func(t *testing.T, dir string) *segmentMapImpl {
+		m, err := NewSegmentMap(dir, SegmentOptions{MaxSegmentBytes: 4096})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 360; i >= 0; i-- {
+			m.Add(now.Add(-time.Duration(i)*10*time.Second), "key", []byte(fmt.Sprintf("value:%d", i)))
+		}
+		return m.(*segmentMapImpl)
+	}
+	history := func(m Map) string {
+		values := []string{}
+		for ts, value := range m.History("key", now.Add(-time.Hour), now) {
+			values = append(values, fmt.Sprintf("%v=%s", now.Sub(ts), value))
+		}
+		return fmt.Sprint(values)
+	}
+	expected := func(t *testing.T) string {
+		m := fill(t, t.TempDir())
+		defer closeMap(t, m)
+		if !m.Compact(policy, now) || m.generation != 1 {
+			t.Fatalf("Expected the segments to be rewritten")
+		}
+		if _, err := os.Stat(filepath.Join(m.dir, compactDir)); !os.IsNotExist(err) {
+			t.Fatalf("Expected %s to be cleaned up", compactDir)
+		}
+		return history(m)
+	}(t)
+
+	fail := func(t *testing.T, stage string) {
+		rewriteFault = func(s string) error {
+			if s == stage {
+				return fmt.Errorf("injected failure at %s", s)
+			}
+			return nil
+		}
+		t.Cleanup(func() { rewriteFault = func(string) error { return nil } })
+	}
+
+	t.Run("BeforeCommit", func(t *testing.T) {
+		dir := t.TempDir()
+		m := fill(t, dir)
+		before := history(m)
+		fail(t, "commit")
+		m.lock.Lock()
+		_, err := m.compactLocked(policy, now)
+		m.lock.Unlock()
+		if err == nil {
+			t.Fatalf("Expected the injected failure")
+		}
+
+		// The old segments carry on being used, with the values dropped so far
+		if got := history(m); got != expected {
+			t.Fatalf("Expected the compacted values from the old segments:\n%v\n%v", expected, got)
+		}
+		m.Add(now.Add(time.Second), "key", []byte("after"))
+		closeMap(t, m)
+
+		m2, err := NewSegmentMap(dir, SegmentOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closeMap(t, m2)
+		if value := m2.GetItem(now.Add(time.Second), "key"); string(value) != "after" {
+			t.Fatalf("Expected writes after the failure to be kept, got %q", value)
+		}
+		if got := history(m2); got == before {
+			t.Fatalf("Expected the drop records to survive")
+		}
+		if _, err := os.Stat(filepath.Join(dir, compactDir)); !os.IsNotExist(err) {
+			t.Fatalf("Expected %s to be cleaned up", compactDir)
+		}
+	})
+
+	t.Run("MidSwap", func(t *testing.T) {
+		dir := t.TempDir()
+		m := fill(t, dir)
+		fail(t, "swap")
+		m.lock.Lock()
+		_, err := m.compactLocked(policy, now)
+		m.lock.Unlock()
+		if err == nil {
+			t.Fatalf("Expected the injected failure")
+		}
+		// The old segments are gone from the directory but still open
+		if got := history(m); got != expected {
+			t.Fatalf("Expected the map to still be readable:\n%v\n%v", expected, got)
+		}
+		closeMap(t, m)
+
+		// Opening again finishes the swap
+		rewriteFault = func(string) error { return nil }
+		m2, err := NewSegmentMap(dir, SegmentOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closeMap(t, m2)
+		if got := history(m2); got != expected {
+			t.Fatalf("Expected the rewritten segments after recovery:\n%v\n%v", expected, got)
+		}
+		for _, name := range []string{compactDir, compactMarker} {
+			if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+				t.Fatalf("Expected %s to be cleaned up", name)
+			}
+		}
+	})
+}
+
+func TestSegmentMapWriteFailure(t *testing.T) {
+	var reported []error
+	m, err := NewSegmentMap(t.TempDir(), SegmentOptions{OnError: func(err error) { reported = append(reported, err) }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm := m.(*segmentMapImpl)
+	now := time.Now()
+	m.Add(now, "key", []byte("before"))
+
+	// Pull the segment out from under the map, the next write can't be flushed
+	if err := tm.active.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m.Add(now.Add(time.Second), "key", []byte("after"))
+	m.Add(now.Add(2*time.Second), "other", []byte("ignored"))
+
+	if len(reported) != 1 {
+		t.Fatalf("Expected the failed write to be reported once, got %v", reported)
+	}
+	if tm.Err() == nil {
+		t.Fatalf("Expected the map to keep the error")
+	}
+	if _, ok := tm.index["other"]; ok {
+		t.Fatalf("Expected no writes after the failure")
+	}
+	if err := m.Encode(io.Discard); err == nil {
+		t.Fatalf("Expected Encode to return the error")
+	}
+	if err := tm.Sync(); err == nil {
+		t.Fatalf("Expected Sync to return the error")
+	}
+	if err := tm.Close(); err == nil {
+		t.Fatalf("Expected Close to return the error")
+	}
+}
@@ -0,0 +1,145 @@
+package temporal
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+
+	"github.com/hoyle1974/khronoscope/internal/serializable"
+)
+
+// The stream format encodes a Map as a sequence of gob messages instead of one big value so the
+// map can be written to and read from a file one key at a time.  Gob buffers each message in full
+// before writing it, so encoding the whole map as one value needs a second copy of it in memory.
+//
+//	streamHeader
+//	streamEntry * Count
+
+type streamHeader struct {
+	MinTime serializable.Time
+	MaxTime serializable.Time
+	Count   int
+	Differ  string
+}
+
+type streamEntry struct {
+	Key   string
+	Store *TimeValueStore
+}
+
+// DecodeStream reads a Map written by Encode, options are applied like they are by Decode
+func DecodeStream(r io.Reader, opts ...Option) (Map, error) {
+	dec := gob.NewDecoder(r)
+
+	var header streamHeader
+	if err := dec.Decode(&header); err != nil {
+		return nil, fmt.Errorf("failed to read map header: %w", err)
+	}
+
+	tm := New().(*mapImpl)
+	tm.MinTime = header.MinTime
+	tm.MaxTime = header.MaxTime
+	tm.Differ = header.Differ
+	for i := 0; i < header.Count; i++ {
+		var entry streamEntry
+		if err := dec.Decode(&entry); err != nil {
+			return nil, fmt.Errorf("failed to read map entry %d of %d: %w", i, header.Count, err)
+		}
+		tm.Items[entry.Key] = entry.Store
+	}
+	for _, opt := range opts {
+		opt(tm)
+	}
+	tm.measure()
+
+	return tm, nil
+}
+
+// DecodeStreamInto reads a Map written by Encode into m one key at a time, so a map that isn't held
+// in memory, like a segment map, can be loaded without ever holding all of it
+func DecodeStreamInto(r io.Reader, m Map) error {
+	dec := gob.NewDecoder(r)
+
+	var header streamHeader
+	if err := dec.Decode(&header); err != nil {
+		return fmt.Errorf("failed to read map header: %w", err)
+	}
+	for i := 0; i < header.Count; i++ {
+		var entry streamEntry
+		if err := dec.Decode(&entry); err != nil {
+			return fmt.Errorf("failed to read map entry %d of %d: %w", i, header.Count, err)
+		}
+		if entry.Store == nil {
+			return fmt.Errorf("map entry %d of %d has no values", i, header.Count)
+		}
+		if _, err := GetDiffer(entry.Store.Differ); err != nil {
+			return fmt.Errorf("failed to read map entry %d of %d: %w", i, header.Count, err)
+		}
+		for _, v := range entry.Store.values() {
+			if len(v.Value) == 0 {
+				m.Remove(v.Timestamp, entry.Key)
+			} else {
+				m.Add(v.Timestamp, entry.Key, v.Value)
+			}
+		}
+		// A disk backed map keeps a failed write as its error rather than returning it
+		if f, ok := m.(interface{ Err() error }); ok {
+			if err := f.Err(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Encode writes the map to w in the stream format
+func (tm *mapImpl) Encode(w io.Writer) error {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(streamHeader{MinTime: tm.MinTime, MaxTime: tm.MaxTime, Count: len(tm.Items), Differ: tm.Differ}); err != nil {
+		return err
+	}
+	for key, store := range tm.Items {
+		if err := enc.Encode(streamEntry{Key: key, Store: store}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Encode writes the map to w in the stream format, only one key is materialized at a time
+func (tm *segmentMapImpl) Encode(w io.Writer) error {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	if tm.err != nil {
+		return tm.err
+	}
+	if err := tm.writer.Flush(); err != nil {
+		return fmt.Errorf("segment map flush failed: %w", err)
+	}
+
+	enc := gob.NewEncoder(w)
+	header := streamHeader{
+		MinTime: serializable.Time{Time: tm.minTime},
+		MaxTime: serializable.Time{Time: tm.maxTime},
+		Count:   len(tm.index),
+	}
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+	for key := range tm.index {
+		store, err := tm.storeLocked(key)
+		if err != nil {
+			err = fmt.Errorf("segment map read failed: %w", err)
+			tm.fail(err)
+			return err
+		}
+		if err := enc.Encode(streamEntry{Key: key, Store: store}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -26,6 +26,12 @@ func NewTimeValueStore() *TimeValueStore {
 // TimeValueStore holds the values and diffs with associated timestamps
 type TimeValueStore struct {
 	Keyframes []keyFrame
+	Differ    string         // The name of the Differ that built the diffs, empty for bsdiff
+	Policy    KeyframePolicy // When to start a new keyframe, the zero value is FixedKeyframePolicy
+}
+
+func (store *TimeValueStore) differ() Differ {
+	return mustGetDiffer(store.Differ)
 }
 
 // keyFrame represents a snapshot of a value at a specific timestamp
@@ -80,16 +86,16 @@ func (frame *keyFrame) MinMax() (time.Time, time.Time) {
 	return frame.Timestamp.Time, frame.DiffFrames[len(frame.DiffFrames)-1].Timestamp.Time
 }
 
-func (frame *keyFrame) CheckForErrors() error {
+func (frame *keyFrame) CheckForErrors(differ Differ) error {
 	var r resources.Resource
-	orig := frame.queryValue(frame.Timestamp.Time)
+	orig := frame.queryValue(differ, frame.Timestamp.Time)
 	err := misc.DecodeFromBytes(orig, &r)
 	if err != nil {
 		return err
 	}
 
 	for _, d := range frame.DiffFrames {
-		b := frame.queryValue(d.Timestamp.Time)
+		b := frame.queryValue(differ, d.Timestamp.Time)
 
 		err := misc.DecodeFromBytes(b, &r)
 		if err != nil {
@@ -101,7 +107,7 @@ func (frame *keyFrame) CheckForErrors() error {
 
 // This keyFrame is expected to hold this value.  Query it and it's diffs to find the
 // one that was valid for when this timestamp is
-func (frame *keyFrame) queryValue(timestamp time.Time) []byte {
+func (frame *keyFrame) queryValue(differ Differ, timestamp time.Time) []byte {
 	index := sort.Search(len(frame.DiffFrames), func(j int) bool {
 		return frame.DiffFrames[j].Timestamp.Time.After(timestamp)
 	})
@@ -113,17 +119,14 @@ func (frame *keyFrame) queryValue(timestamp time.Time) []byte {
 
 	if index > 0 {
 		if ptr := frame.DiffFrames[index-1].original.Value(); ptr != nil {
-			metrics.Count("DiffFrame.Original", 1)
 			return *ptr
-		} else {
-			metrics.Count("DiffFrame.Original.Nil", 1)
 		}
+		metrics.DiffReplays.Inc()
 	}
-	metrics.Count("DiffFrame.Diff", 1)
 
 	cur := frame.Value
 	for i := 0; i < index; i++ {
-		cur, _ = applyDiff(cur, frame.DiffFrames[i].Diff)
+		cur, _ = differ.Apply(cur, frame.DiffFrames[i].Diff)
 		/*
 			if bytes.Compare(cur, frame.DiffFrames[i].Original) != 0 {
 				var r1, r2 resources.Resource
@@ -142,77 +145,68 @@ func (frame *keyFrame) queryValue(timestamp time.Time) []byte {
 	return cur
 }
 
-func (frame *keyFrame) addDiffFrame(timestamp time.Time, value []byte) bool {
-	if len(frame.DiffFrames) == KEYFRAME_RATE {
-		if len(frame.DiffFrames) > 0 && frame.DiffFrames[len(frame.DiffFrames)-1].Timestamp.Time.Before(timestamp) {
-			return false // We have enough frames, and adding at the end
-		}
+// addDiffFrame tries to add value to this keyframe.  A value after the last diff is appended if the
+// policy allows it.  A value that lands in the middle of the chain splits the keyframe instead: the
+// diffs after the insertion point move to a new keyframe, returned as tail, which starts with the
+// next value in full, and the value is appended to what is left.  The diffs in the tail stay valid
+// since each diff only depends on the value before it, so a late value costs a replay of at most one
+// chain rather than regenerating every diff in it.
+func (frame *keyFrame) addDiffFrame(differ Differ, policy KeyframePolicy, timestamp time.Time, value []byte) (bool, *keyFrame) {
+	index := sort.Search(len(frame.DiffFrames), func(j int) bool {
+		return frame.DiffFrames[j].Timestamp.Time.After(timestamp)
+	})
+	if index == len(frame.DiffFrames) {
+		return frame.appendDiffFrame(differ, policy, timestamp, value), nil
 	}
 
-	if len(frame.DiffFrames) == 0 || (len(frame.DiffFrames) > 0 && frame.DiffFrames[len(frame.DiffFrames)-1].Timestamp.Time.Before(timestamp)) {
-		metrics.Count("addDiffFrame.Append", 1)
-		diff, err := generateDiff(frame.Last, value) // Diff against full last value
-		if err != nil {
-			return false
-		}
-
-		frame.DiffFrames = append(frame.DiffFrames, diffFrame{
-			Timestamp: serializable.Time{Time: timestamp},
-			Diff:      diff,
-			original:  weak.Make(&value),
-		})
+	metrics.KeyframeSplits.Inc()
 
-		frame.Last = value // Update stored full value for next append
-		return true
+	prev := frame.queryValue(differ, timestamp)
+	next, err := differ.Apply(prev, frame.DiffFrames[index].Diff)
+	if err != nil {
+		panic(err)
 	}
 
-	metrics.Count("addDiffFrame.Insert", 1)
-
-	// Decompress all frames
-	curr := frame.Value
-	times := make([]serializable.Time, len(frame.DiffFrames))
-	original := make([][]byte, len(frame.DiffFrames))
-	for idx, diffFrame := range frame.DiffFrames {
-		actual, err := applyDiff(curr, diffFrame.Diff)
-		if err != nil {
-			return false // Stop if any diff application fails
-		}
-		original[idx] = actual
-		times[idx] = diffFrame.Timestamp
-		curr = actual
+	tail := &keyFrame{
+		Timestamp:  frame.DiffFrames[index].Timestamp,
+		Value:      next,
+		DiffFrames: slices.Clone(frame.DiffFrames[index+1:]),
+		Last:       frame.Last,
 	}
+	if tail.Last == nil && len(tail.DiffFrames) == 0 {
+		tail.Last = next
+	}
+	frame.DiffFrames = slices.Clip(frame.DiffFrames[:index])
+	frame.Last = prev
 
-	index := sort.Search(len(times), func(j int) bool {
-		return times[j].Time.After(timestamp)
-	})
-
-	original = append(original, nil)           // Extend the slice by one
-	times = append(times, serializable.Time{}) // Extend the slice by one
-
-	copy(original[index+1:], original[index:]) // Shift elements to the right
-	copy(times[index+1:], times[index:])       // Shift elements to the right
-
-	original[index] = value
-	times[index] = serializable.Time{Time: timestamp}
-
-	frame.DiffFrames = []diffFrame{}
+	return frame.appendDiffFrame(differ, policy, timestamp, value), tail
+}
 
-	last := frame.Value
-	for idx := 0; idx < len(original); idx++ {
-		diff, err := generateDiff(last, original[idx])
-		if err != nil {
-			panic(err)
-		}
+// appendDiffFrame adds value after the last diff, unless the policy says it's time for a new keyframe
+func (frame *keyFrame) appendDiffFrame(differ Differ, policy KeyframePolicy, timestamp time.Time, value []byte) bool {
+	if len(frame.DiffFrames) >= policy.maxDiffs() {
+		return false // We have enough frames
+	}
 
-		frame.DiffFrames = append(frame.DiffFrames, diffFrame{
-			Timestamp: times[idx],
-			Diff:      diff,
-			original:  weak.Make(&original[idx]),
-		})
+	if frame.Last == nil {
+		// Keyframes that are no longer the newest drop Last, rebuild it for the rare late value
+		_, last := frame.MinMax()
+		frame.Last = frame.queryValue(differ, last)
+	}
 
-		last = original[idx]
+	diff, err := differ.Diff(frame.Last, value) // Diff against full last value
+	if err != nil || policy.full(frame, diff, value) {
+		return false
 	}
 
+	frame.DiffFrames = append(frame.DiffFrames, diffFrame{
+		Timestamp: serializable.Time{Time: timestamp},
+		Diff:      diff,
+		original:  weak.Make(&value),
+	})
+	metrics.DiffBytes.Observe(float64(len(diff)))
+
+	frame.Last = value // Update stored full value for next append
 	return true
 }
 
@@ -222,36 +216,190 @@ type diffFrame struct {
 	original  weak.Pointer[[]byte]
 }
 
+// storedBytes is how many bytes of values and diffs the keyframe holds
+func (frame *keyFrame) storedBytes() int64 {
+	size := int64(len(frame.Value))
+	for _, df := range frame.DiffFrames {
+		size += int64(len(df.Diff))
+	}
+	return size
+}
+
 // Add a value that is valid @timestamp and after
 func (store *TimeValueStore) AddValue(timestamp time.Time, value []byte) {
+	store.addValue(timestamp, value)
+}
+
+// addValue adds a value and returns how many more bytes the store holds because of it
+func (store *TimeValueStore) addValue(timestamp time.Time, value []byte) int64 {
 	// Find the insertion point to maintain chronological order.
 	index := sort.Search(len(store.Keyframes), func(j int) bool {
 		return store.Keyframes[j].Timestamp.Time.After(timestamp)
 	})
 
 	if len(store.Keyframes) == 0 {
+		metrics.Keyframes.Inc()
 		store.Keyframes = append(store.Keyframes, keyFrame{
 			Timestamp:  serializable.Time{Time: timestamp},
 			Value:      value,
-			DiffFrames: make([]diffFrame, 0, KEYFRAME_RATE),
+			DiffFrames: []diffFrame{},
 			Last:       value,
 		})
-		return
+		return int64(len(value))
 	}
 
 	// index is where we would put this keyframe.  Backup one keyframe and see if we just want to append diff
-	if index > 0 && store.Keyframes[index-1].addDiffFrame(timestamp, value) { // Corrected: Check index > 0
-		return
+	var grown int64
+	if index > 0 {
+		frame := &store.Keyframes[index-1]
+		before := frame.storedBytes()
+		added, tail := frame.addDiffFrame(store.differ(), store.Policy, timestamp, value)
+		grown = frame.storedBytes() - before
+		if tail != nil {
+			grown += tail.storedBytes()
+			store.Keyframes = slices.Insert(store.Keyframes, index, *tail)
+		}
+		if added {
+			return grown
+		}
 	}
 
 	// Insert the new value at the correct position.
-	store.Keyframes = append(store.Keyframes[:index], append([]keyFrame{{
+	metrics.Keyframes.Inc()
+	store.Keyframes = slices.Insert(store.Keyframes, index, keyFrame{
 		Timestamp:  serializable.Time{Time: timestamp},
 		Value:      value,
-		DiffFrames: make([]diffFrame, 0, KEYFRAME_RATE),
+		DiffFrames: []diffFrame{},
 		Last:       value,
-	}}, store.Keyframes[index:]...)...)
+	})
+
+	// Only the newest keyframe is normally appended to, so the one before doesn't need its last value
+	if index > 0 && index == len(store.Keyframes)-1 {
+		store.Keyframes[index-1].Last = nil
+	}
+	return grown + int64(len(value))
+}
+
+// storedBytes is how many bytes of values and diffs the store holds
+func (store *TimeValueStore) storedBytes() int64 {
+	var size int64
+	for idx := range store.Keyframes {
+		size += store.Keyframes[idx].storedBytes()
+	}
+	return size
+}
+
+// values decodes every value held by the store in chronological order
+func (store *TimeValueStore) values() []timeValue {
+	return store.frameValues(0, len(store.Keyframes))
+}
+
+// frameValues decodes the values held by keyframes [a, b) in chronological order
+func (store *TimeValueStore) frameValues(a, b int) []timeValue {
+	differ := store.differ()
+	values := []timeValue{}
+	for _, k := range store.Keyframes[a:b] {
+		cur := k.Value
+		values = append(values, timeValue{Timestamp: k.Timestamp.Time, Value: cur})
+		for _, d := range k.DiffFrames {
+			cur, _ = differ.Apply(cur, d.Diff)
+			values = append(values, timeValue{Timestamp: d.Timestamp.Time, Value: cur})
+		}
+	}
+	return values
+}
 
+// replaceFrames replaces keyframes [a, b) with keyframes holding values and returns how many more
+// bytes the store holds.  The keyframes slice is replaced rather than changed in place so cursors
+// walking a copy of it are unaffected.
+func (store *TimeValueStore) replaceFrames(a, b int, values []timeValue) int64 {
+	rebuilt := &TimeValueStore{Keyframes: []keyFrame{}, Differ: store.Differ, Policy: store.Policy}
+	var grown int64
+	for _, v := range values {
+		grown += rebuilt.addValue(v.Timestamp, v.Value)
+	}
+	for idx := a; idx < b; idx++ {
+		grown -= store.Keyframes[idx].storedBytes()
+	}
+	// Only the newest keyframe needs its last value
+	if n := len(rebuilt.Keyframes); n > 0 && b < len(store.Keyframes) {
+		rebuilt.Keyframes[n-1].Last = nil
+	}
+
+	store.Keyframes = slices.Concat(store.Keyframes[:a], rebuilt.Keyframes, store.Keyframes[b:])
+	return grown
+}
+
+// compact applies a retention policy to the store.  Which values go is worked out from the
+// timestamps, only the keyframes holding them are decoded and rebuilt.  Values whose successor is
+// before since were downsampled already.  It returns whether anything went and how many more bytes
+// the store holds.
+func (store *TimeValueStore) compact(policy RetentionPolicy, since, now time.Time) (bool, int64) {
+	changed := false
+	var grown int64
+
+	if cutoff, ok := policy.cutoff(now); ok && len(store.Keyframes) > 0 && store.Keyframes[0].Timestamp.Time.Before(cutoff) {
+		// Everything before the keyframe holding the value valid at the cutoff goes
+		k := sort.Search(len(store.Keyframes), func(j int) bool {
+			return !store.Keyframes[j].Timestamp.Time.Before(cutoff)
+		}) - 1
+		var next time.Time
+		if k+1 < len(store.Keyframes) {
+			next = store.Keyframes[k+1].Timestamp.Time
+		}
+		grown += store.replaceFrames(0, k+1, trim(store.frameValues(k, k+1), cutoff, next))
+		changed = true
+	}
+
+	if policy.Resolution <= 0 || len(store.Keyframes) == 0 {
+		return changed, grown
+	}
+
+	// Only the keyframes holding values between since and now-FullFidelity are looked at, along
+	// with the first value after them
+	lo := max(sort.Search(len(store.Keyframes), func(j int) bool {
+		return !store.Keyframes[j].Timestamp.Time.Before(since)
+	})-1, 0)
+	hi := sort.Search(len(store.Keyframes), func(j int) bool {
+		return !store.Keyframes[j].Timestamp.Time.Before(now.Add(-policy.FullFidelity))
+	})
+	if lo >= hi {
+		return changed, grown
+	}
+
+	var times []time.Time
+	frameOf := []int{}
+	for idx := lo; idx < hi; idx++ {
+		k := &store.Keyframes[idx]
+		times = append(times, k.Timestamp.Time)
+		frameOf = append(frameOf, idx)
+		for _, df := range k.DiffFrames {
+			times = append(times, df.Timestamp.Time)
+			frameOf = append(frameOf, idx)
+		}
+	}
+	if hi < len(store.Keyframes) {
+		times = append(times, store.Keyframes[hi].Timestamp.Time)
+	}
+
+	drop := policy.downsample(times, lo == 0, since, now)
+	if len(drop) == 0 {
+		return changed, grown
+	}
+
+	// Rebuild the keyframes holding the dropped values without them
+	a, b := frameOf[drop[0]], frameOf[drop[len(drop)-1]]+1
+	start := slices.Index(frameOf, a)
+	values := store.frameValues(a, b)
+	kept := make([]timeValue, 0, len(values)-len(drop))
+	for idx, v := range values {
+		if _, dropped := slices.BinarySearch(drop, start+idx); !dropped {
+			kept = append(kept, v)
+		}
+	}
+	grown += store.replaceFrames(a, b, kept)
+
+	return true, grown
 }
 
 func (store *TimeValueStore) QueryValue(timestamp time.Time) []byte {
@@ -276,9 +424,9 @@ func (store *TimeValueStore) queryValue(timestamp time.Time) []byte {
 	if index == 0 { // Timestamp is before the first keyframe
 		return nil
 	} else if index == len(store.Keyframes) { // Timestamp is after the last keyframe
-		return store.Keyframes[index-1].queryValue(timestamp) // Use the *last* keyframe
+		return store.Keyframes[index-1].queryValue(store.differ(), timestamp) // Use the *last* keyframe
 	} else { // Timestamp is within the keyframes
-		return store.Keyframes[index-1].queryValue(timestamp) // Use the keyframe *before*
+		return store.Keyframes[index-1].queryValue(store.differ(), timestamp) // Use the keyframe *before*
 	}
 }
 
@@ -287,30 +435,27 @@ func (store *TimeValueStore) FindNextTimeKey(timestamp time.Time, dir int) (time
 		return timestamp, fmt.Errorf("invalid direction: %d", dir)
 	}
 
-	// We are just going to brute force it
-	times := []time.Time{}
-
-	for _, k := range store.Keyframes {
-		times = append(times, k.Timestamp.Time)
-		for _, d := range k.DiffFrames {
-			times = append(times, d.Timestamp.Time)
-		}
-	}
-
+	// Every diff of a keyframe is before the next keyframe, so only one keyframe has to be searched
 	if dir > 0 {
-		for _, t := range times {
-			if t.After(timestamp) {
+		index := sort.Search(len(store.Keyframes), func(j int) bool {
+			return store.Keyframes[j].Timestamp.Time.After(timestamp)
+		})
+		if index > 0 {
+			if t, err := store.Keyframes[index-1].FindNextTime(timestamp, 1); err == nil {
 				return t, nil
 			}
 		}
+		if index < len(store.Keyframes) {
+			return store.Keyframes[index].Timestamp.Time, nil
+		}
 		return timestamp, errors.New("no next")
 	}
 
-	slices.Reverse(times)
-	for _, t := range times {
-		if t.Before(timestamp) {
-			return t, nil
-		}
+	index := sort.Search(len(store.Keyframes), func(j int) bool {
+		return !store.Keyframes[j].Timestamp.Time.Before(timestamp)
+	})
+	if index > 0 {
+		return store.Keyframes[index-1].FindNextTime(timestamp, -1)
 	}
 	return timestamp, errors.New("no next")
 }
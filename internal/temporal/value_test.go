@@ -3,6 +3,7 @@ package temporal
 import (
 	"bytes"
 	"fmt"
+	"math/rand/v2"
 	"testing"
 	"time"
 )
@@ -133,6 +134,84 @@ func Test_Next(t *testing.T) {
 
 }
 
+func Test_RandomOrder(t *testing.T) {
+	start := time.Now()
+	count := 2000
+
+	tests := []struct {
+		name   string
+		differ string
+		policy KeyframePolicy
+		values [][]byte
+	}{
+		{"Fixed", BsDiffer, FixedKeyframePolicy, nil},
+		{"Adaptive", BsDiffer, AdaptiveKeyframePolicy, nil},
+		{"Resources", ResourceDiffer, AdaptiveKeyframePolicy, podHistory(500)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := tt.values
+			if values == nil {
+				for i := 0; i < count; i++ {
+					values = append(values, []byte(fmt.Sprintf("value:%d", i)))
+				}
+			}
+
+			store := NewTimeValueStore()
+			store.Differ = tt.differ
+			store.Policy = tt.policy
+			r := rand.New(rand.NewPCG(5, 6))
+			for _, i := range r.Perm(len(values)) {
+				store.AddValue(start.Add(time.Duration(i)*time.Second), values[i])
+			}
+
+			for i, v := range values {
+				if got := store.QueryValue(start.Add(time.Duration(i)*time.Second + time.Millisecond)); !bytes.Equal(got, v) {
+					t.Fatalf("Value %d does not match", i)
+				}
+			}
+			all := store.values()
+			if len(all) != len(values) {
+				t.Fatalf("Expected %d values, got %d", len(values), len(all))
+			}
+			for i, v := range all {
+				if !v.Timestamp.Equal(start.Add(time.Duration(i)*time.Second)) || !bytes.Equal(v.Value, values[i]) {
+					t.Fatalf("Value %d is out of order", i)
+				}
+			}
+		})
+	}
+}
+
+func benchmarkAddValue(b *testing.B, order func(n int) []int) {
+	start := time.Now()
+	values := counterHistory(1000)
+	indexes := order(len(values))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store := NewTimeValueStore()
+		for _, idx := range indexes {
+			store.AddValue(start.Add(time.Duration(idx)*time.Second), values[idx])
+		}
+	}
+}
+
+func BenchmarkAddValueInOrder(b *testing.B) {
+	benchmarkAddValue(b, func(n int) []int {
+		indexes := make([]int, n)
+		for i := range indexes {
+			indexes[i] = i
+		}
+		return indexes
+	})
+}
+
+func BenchmarkAddValueRandomOrder(b *testing.B) {
+	benchmarkAddValue(b, rand.New(rand.NewPCG(7, 8)).Perm)
+}
+
 // func Test_Crash(t *testing.T) {
 // 	gob.Register(resources.PodExtra{})
 // 	resources.RegisterResourceRenderer("Pod", resources.PodRenderer{})
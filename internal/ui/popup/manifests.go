@@ -0,0 +1,67 @@
+package popup
+
+import (
+	"fmt"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+type manifestsPopupModel struct {
+	textInput     textinput.Model
+	onDone        func(dir string)
+	width, height int
+}
+
+func (model *manifestsPopupModel) Init() tea.Cmd { return nil }
+
+func (model *manifestsPopupModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		switch msg.Type {
+		case tea.KeyCtrlC, tea.KeyEsc:
+			return model, Close
+		case tea.KeyEnter:
+			model.onDone(model.textInput.Value())
+			return model, Close
+		}
+	}
+
+	model.textInput, _ = model.textInput.Update(msg)
+
+	return model, nil
+}
+
+func (model *manifestsPopupModel) View() string {
+	b := lipgloss.RoundedBorder()
+	style := lipgloss.NewStyle().
+		BorderStyle(b).
+		Padding(1).
+		Width(model.width - 2).
+		Height(5).
+		AlignHorizontal(lipgloss.Center).
+		AlignVertical(lipgloss.Center)
+
+	return style.Render(fmt.Sprintf(
+		"Write manifests of the resources shown to a directory\n\n%s\n\n%s",
+		model.textInput.View(),
+		"(esc to quit)",
+	))
+}
+
+func (model *manifestsPopupModel) OnResize(width, height int) {
+	model.width = width
+	model.height = height
+}
+
+// NewManifestsPopup asks for the directory to write manifests to, starting with dir
+func NewManifestsPopup(dir string, onDone func(dir string)) Popup {
+	ti := textinput.New()
+	ti.Focus()
+	ti.CharLimit = 156
+	ti.Width = 40
+	ti.SetValue(dir)
+
+	return &manifestsPopupModel{textInput: ti, onDone: onDone}
+}
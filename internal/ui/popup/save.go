@@ -13,9 +13,10 @@ import (
 // }
 
 type savePopupModel struct {
-	textInput     textinput.Model
-	onDone        func(string)
-	width, height int
+	textInput       textinput.Model
+	passphraseInput textinput.Model
+	onDone          func(filename, passphrase string)
+	width, height   int
 }
 
 func (model *savePopupModel) Init() tea.Cmd { return nil }
@@ -25,16 +26,26 @@ func (model *savePopupModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case tea.KeyMsg:
 		switch msg.Type {
 		case tea.KeyCtrlC, tea.KeyEsc:
-			model.onDone("")
+			model.onDone("", "")
 			return model, Close
 		case tea.KeyEnter:
 			// Save the label
-			model.onDone(model.textInput.Value())
+			model.onDone(model.textInput.Value(), model.passphraseInput.Value())
 			return model, Close
+		case tea.KeyTab, tea.KeyShiftTab, tea.KeyUp, tea.KeyDown:
+			if model.textInput.Focused() {
+				model.textInput.Blur()
+				model.passphraseInput.Focus()
+			} else {
+				model.passphraseInput.Blur()
+				model.textInput.Focus()
+			}
+			return model, nil
 		}
 	}
 
 	model.textInput, _ = model.textInput.Update(msg)
+	model.passphraseInput, _ = model.passphraseInput.Update(msg)
 
 	return model, nil
 }
@@ -45,14 +56,15 @@ func (model *savePopupModel) View() string {
 		BorderStyle(b).
 		Padding(1).
 		Width(model.width - 2).
-		Height(5).
+		Height(7).
 		AlignHorizontal(lipgloss.Center).
 		AlignVertical(lipgloss.Center)
 
 	return style.Render(fmt.Sprintf(
-		"Save data:\n\n%s\n\n%s",
+		"Save data:\n\n%s\n%s\n\n%s",
 		model.textInput.View(),
-		"(esc to quit)",
+		model.passphraseInput.View(),
+		"(tab to enter a passphrase to encrypt with, esc to quit)",
 	))
 }
 
@@ -61,12 +73,18 @@ func (model *savePopupModel) OnResize(width, height int) {
 	model.height = height
 }
 
-func NewSavePopup(onDone func(string)) Popup {
+func NewSavePopup(onDone func(filename, passphrase string)) Popup {
 	ti := textinput.New()
 	ti.Focus()
 	ti.CharLimit = 156
 	ti.Width = 20
 	ti.SetValue("session.khron")
 
-	return &savePopupModel{textInput: ti, onDone: onDone}
+	pi := textinput.New()
+	pi.Placeholder = "no passphrase"
+	pi.EchoMode = textinput.EchoPassword
+	pi.CharLimit = 156
+	pi.Width = 20
+
+	return &savePopupModel{textInput: ti, passphraseInput: pi, onDone: onDone}
 }